@@ -10,17 +10,30 @@ CREATE TABLE IF NOT EXISTS Users (
     email VARCHAR(255) UNIQUE NOT NULL,
     phone_number VARCHAR(50),
     password TEXT NOT NULL,
+    email_verified BOOLEAN DEFAULT FALSE,
     created_at TIMESTAMPTZ DEFAULT NOW()
 );
 
+-- Accounts registered before email verification count as verified
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN DEFAULT TRUE;
+ALTER TABLE Users ALTER COLUMN email_verified SET DEFAULT FALSE;
+
 -- Create Organizations Table
 CREATE TABLE IF NOT EXISTS Organizations (
     organization_id UUID PRIMARY KEY,
     name VARCHAR(255) NOT NULL,
-    created_at TIMESTAMPTZ DEFAULT NOW()
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    deleted_at TIMESTAMPTZ,
+    purge_at TIMESTAMPTZ
 );
 
-CREATE TYPE role_enum AS ENUM ('creator', 'admin', 'member');
+ALTER TABLE Organizations ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE Organizations ADD COLUMN IF NOT EXISTS purge_at TIMESTAMPTZ;
+
+DO $$ BEGIN
+    CREATE TYPE role_enum AS ENUM ('creator', 'admin', 'member');
+EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
 
 -- Create UserOrganizations Table
 CREATE TABLE IF NOT EXISTS UserOrganizations (
@@ -31,6 +44,73 @@ CREATE TABLE IF NOT EXISTS UserOrganizations (
     created_at TIMESTAMPTZ DEFAULT NOW()
 );
 
+-- Create EncryptionKeys Table
+-- Data keys of an organization, stored wrapped by the master key master_key_id identifies. The active key
+-- encrypts new content, older keys are kept to decrypt the content encrypted with them. rewrap_error is why
+-- the key last failed to be wrapped with the current master key, it is tried again after a while
+CREATE TABLE IF NOT EXISTS EncryptionKeys (
+    id UUID PRIMARY KEY,
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    version INT NOT NULL,
+    wrapped_key BYTEA NOT NULL,
+    master_key_id VARCHAR(255) NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    wrapped_at TIMESTAMPTZ DEFAULT NOW(),
+    rewrap_error TEXT,
+    rewrap_attempted_at TIMESTAMPTZ,
+    UNIQUE (organization_id, version)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS encryption_keys_active_idx ON EncryptionKeys (organization_id) WHERE active;
+CREATE INDEX IF NOT EXISTS encryption_keys_master_key_idx ON EncryptionKeys (master_key_id);
+
+-- Create Blobs Table
+-- Stored content of an organization addressed by its SHA-256, files and versions with the same content share
+-- one blob. ref_count counts the files and versions referencing it, released_at is when it last dropped to zero.
+-- encryption_key_id is the data key the object is encrypted with, NULL for objects stored unencrypted
+CREATE TABLE IF NOT EXISTS Blobs (
+    id UUID PRIMARY KEY,
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    hash CHAR(64) NOT NULL,
+    file_path TEXT NOT NULL,
+    file_size BIGINT NOT NULL,
+    ref_count INT NOT NULL DEFAULT 0,
+    released_at TIMESTAMPTZ,
+    encryption_key_id UUID REFERENCES EncryptionKeys(id),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (organization_id, hash)
+);
+
+CREATE INDEX IF NOT EXISTS blobs_released_idx ON Blobs (released_at) WHERE ref_count = 0;
+CREATE INDEX IF NOT EXISTS blobs_file_path_idx ON Blobs (file_path);
+
+-- Create PendingEncryptions Table
+-- Blobs stored unencrypted before encryption was configured, waiting to be encrypted with the key of their
+-- organization. Failed attempts are retried later and later
+CREATE TABLE IF NOT EXISTS PendingEncryptions (
+    blob_id UUID PRIMARY KEY REFERENCES Blobs(id) ON DELETE CASCADE,
+    attempts INT NOT NULL DEFAULT 0,
+    error TEXT,
+    queued_at TIMESTAMPTZ DEFAULT NOW(),
+    next_attempt_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS pendingencryptions_next_idx ON PendingEncryptions (next_attempt_at);
+
+-- Create PendingObjectDeletions Table
+-- Objects of blobs and thumbnails that were deleted, waiting to be deleted from Spaces. Blob and thumbnail keys
+-- are never reused so a queued object can't hold content stored since. Failed attempts are retried later and later
+CREATE TABLE IF NOT EXISTS PendingObjectDeletions (
+    file_path TEXT PRIMARY KEY,
+    attempts INT NOT NULL DEFAULT 0,
+    error TEXT,
+    queued_at TIMESTAMPTZ DEFAULT NOW(),
+    next_attempt_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS pendingobjectdeletions_next_idx ON PendingObjectDeletions (next_attempt_at);
+
 -- Create Folders Table
 CREATE TABLE IF NOT EXISTS Folders (
     id UUID PRIMARY KEY,
@@ -40,7 +120,11 @@ CREATE TABLE IF NOT EXISTS Folders (
     created_at TIMESTAMPTZ DEFAULT NOW(),
     updated_at TIMESTAMPTZ DEFAULT NOW(),
     deleted BOOLEAN DEFAULT FALSE,
-    deleted_at TIMESTAMPTZ
+    deleted_at TIMESTAMPTZ,
+    inherit_permissions BOOLEAN NOT NULL DEFAULT TRUE,
+    ancestor_ids UUID[] NOT NULL DEFAULT '{}',
+    created_by UUID REFERENCES Users(user_id) ON DELETE SET NULL,
+    metadata JSONB NOT NULL DEFAULT '{}'
 );
 
 -- Create Files Table
@@ -54,5 +138,822 @@ CREATE TABLE IF NOT EXISTS Files (
     updated_at TIMESTAMPTZ DEFAULT NOW(),
     organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
     deleted BOOLEAN DEFAULT FALSE,
-    deleted_at TIMESTAMPTZ
+    deleted_at TIMESTAMPTZ,
+    created_by UUID REFERENCES Users(user_id) ON DELETE SET NULL,
+    metadata JSONB NOT NULL DEFAULT '{}',
+    blob_id UUID REFERENCES Blobs(id)
+);
+
+ALTER TABLE Folders ADD COLUMN IF NOT EXISTS inherit_permissions BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE Folders ADD COLUMN IF NOT EXISTS ancestor_ids UUID[] NOT NULL DEFAULT '{}';
+ALTER TABLE Folders ADD COLUMN IF NOT EXISTS created_by UUID REFERENCES Users(user_id) ON DELETE SET NULL;
+ALTER TABLE Folders ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE Files ADD COLUMN IF NOT EXISTS created_by UUID REFERENCES Users(user_id) ON DELETE SET NULL;
+ALTER TABLE Files ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE Files ADD COLUMN IF NOT EXISTS blob_id UUID REFERENCES Blobs(id);
+
+-- Names an item gets after a conflict, like "report (2).pdf". Extensions stay at the end when keep_extension is set,
+-- the name is cut to fit the 255 characters of the name columns
+CREATE OR REPLACE FUNCTION numbered_name(p_name TEXT, p_number INTEGER, p_keep_extension BOOLEAN) RETURNS TEXT AS $$
+    SELECT left(base, 255 - length(suffix) - length(extension)) || suffix || extension
+    FROM (
+        SELECT
+            left(p_name, length(p_name) - length(extension)) AS base,
+            ' (' || p_number || ')' AS suffix,
+            extension
+        FROM (
+            SELECT CASE WHEN p_keep_extension AND p_name ~ '.\.[^.]+$' THEN substring(p_name FROM '\.[^.]+$') ELSE '' END AS extension
+        ) e
+    ) parts;
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- Numbers items named alike in one folder, from before names were unique, so the unique name indexes can be
+-- created. The oldest item keeps its name. Numbered names can be taken as well, so this runs until no
+-- duplicates are left
+CREATE OR REPLACE FUNCTION number_duplicate_names() RETURNS VOID AS $$
+BEGIN
+    LOOP
+        WITH duplicates AS (
+            SELECT id, ROW_NUMBER() OVER (PARTITION BY COALESCE(parent_folder_id, organization_id), LOWER(name) ORDER BY created_at, id) AS number
+            FROM folders WHERE deleted = false
+        )
+        UPDATE folders SET name = numbered_name(folders.name, duplicates.number::INTEGER, false)
+        FROM duplicates WHERE duplicates.id = folders.id AND duplicates.number > 1;
+        EXIT WHEN NOT FOUND;
+    END LOOP;
+
+    LOOP
+        WITH duplicates AS (
+            SELECT id, ROW_NUMBER() OVER (PARTITION BY COALESCE(folder_id, organization_id), LOWER(name) ORDER BY created_at, id) AS number
+            FROM files WHERE deleted = false
+        )
+        UPDATE files SET name = numbered_name(files.name, duplicates.number::INTEGER, true)
+        FROM duplicates WHERE duplicates.id = files.id AND duplicates.number > 1;
+        EXIT WHEN NOT FOUND;
+    END LOOP;
+END;
+$$ LANGUAGE plpgsql;
+
+SELECT number_duplicate_names();
+
+-- Names are unique per parent folder, or per organization at the root, ignoring case. Items in the recycle bin don't count
+CREATE UNIQUE INDEX IF NOT EXISTS folders_name_idx ON Folders (COALESCE(parent_folder_id, organization_id), LOWER(name)) WHERE deleted = false;
+CREATE UNIQUE INDEX IF NOT EXISTS files_name_idx ON Files (COALESCE(folder_id, organization_id), LOWER(name)) WHERE deleted = false;
+
+-- Folders keep the ids of their ancestors, root first, so paths are read without walking the tree
+CREATE INDEX IF NOT EXISTS folders_ancestors_idx ON Folders USING GIN (ancestor_ids);
+
+-- Fills in the ancestors of folders created before ancestors were kept, walking down from the root folders
+CREATE OR REPLACE FUNCTION fill_folder_ancestors() RETURNS VOID AS $$
+    WITH RECURSIVE tree AS (
+        SELECT id, ARRAY[]::UUID[] AS ancestor_ids FROM folders WHERE parent_folder_id IS NULL
+        UNION ALL
+        SELECT f.id, tree.ancestor_ids || tree.id FROM folders f JOIN tree ON f.parent_folder_id = tree.id
+    )
+    UPDATE folders SET ancestor_ids = tree.ancestor_ids
+    FROM tree WHERE tree.id = folders.id AND folders.ancestor_ids IS DISTINCT FROM tree.ancestor_ids;
+$$ LANGUAGE SQL;
+
+SELECT fill_folder_ancestors();
+
+CREATE OR REPLACE FUNCTION folders_set_ancestors() RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.parent_folder_id IS NULL THEN
+        NEW.ancestor_ids := '{}';
+    ELSE
+        SELECT ancestor_ids || id INTO NEW.ancestor_ids FROM folders WHERE id = NEW.parent_folder_id;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS folders_set_ancestors ON Folders;
+CREATE TRIGGER folders_set_ancestors
+BEFORE INSERT OR UPDATE OF parent_folder_id ON Folders
+FOR EACH ROW EXECUTE FUNCTION folders_set_ancestors();
+
+-- Moving a folder moves the subfolders along, their ancestors below the moved folder are kept
+CREATE OR REPLACE FUNCTION folders_move_descendants() RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE folders
+    SET ancestor_ids = NEW.ancestor_ids || ancestor_ids[array_position(ancestor_ids, NEW.id):]
+    WHERE ancestor_ids @> ARRAY[NEW.id];
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS folders_move_descendants ON Folders;
+CREATE TRIGGER folders_move_descendants
+AFTER UPDATE OF parent_folder_id ON Folders
+FOR EACH ROW WHEN (OLD.parent_folder_id IS DISTINCT FROM NEW.parent_folder_id)
+EXECUTE FUNCTION folders_move_descendants();
+
+-- Create Sessions Table
+CREATE TABLE IF NOT EXISTS Sessions (
+    id UUID PRIMARY KEY,
+    user_id UUID REFERENCES Users(user_id) ON DELETE CASCADE,
+    ip_address VARCHAR(64),
+    user_agent TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ
+);
+
+-- Create OrganizationSSO Table
+CREATE TABLE IF NOT EXISTS OrganizationSSO (
+    organization_id UUID PRIMARY KEY REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    issuer TEXT NOT NULL,
+    client_id TEXT NOT NULL,
+    client_secret TEXT,
+    email_domains TEXT[] DEFAULT '{}',
+    default_role role_enum NOT NULL DEFAULT 'member',
+    enforce_sso BOOLEAN DEFAULT FALSE,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create SSODomains Table
+-- Email domains an organization routes to its identity provider. A domain is only used once the organization
+-- proved it owns it with a DNS TXT record holding verification_token, and only one organization can verify it
+CREATE TABLE IF NOT EXISTS SSODomains (
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    domain VARCHAR(255) NOT NULL,
+    verification_token VARCHAR(64) NOT NULL,
+    verified_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (organization_id, domain)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS ssodomains_verified_idx ON SSODomains (domain) WHERE verified_at IS NOT NULL;
+
+-- Create SSOIdentities Table
+-- Identity provider accounts linked to users, an ID token signs in to the user its issuer and subject are linked to
+CREATE TABLE IF NOT EXISTS SSOIdentities (
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    user_id UUID NOT NULL REFERENCES Users(user_id) ON DELETE CASCADE,
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    last_login_at TIMESTAMPTZ,
+    PRIMARY KEY (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS ssoidentities_user_idx ON SSOIdentities (user_id);
+
+-- Create ScimTokens Table
+CREATE TABLE IF NOT EXISTS ScimTokens (
+    id UUID PRIMARY KEY,
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    name VARCHAR(255),
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    created_by UUID REFERENCES Users(user_id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+
+-- Users created by SCIM belong to the organization that provisioned them, other organizations can't link or
+-- edit them
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS scim_organization_id UUID REFERENCES Organizations(organization_id) ON DELETE SET NULL;
+
+-- Create ScimUsers Table
+CREATE TABLE IF NOT EXISTS ScimUsers (
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    user_id UUID REFERENCES Users(user_id) ON DELETE CASCADE,
+    external_id VARCHAR(255),
+    active BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (organization_id, user_id)
+);
+
+-- Create ScimGroups Table
+CREATE TABLE IF NOT EXISTS ScimGroups (
+    id UUID PRIMARY KEY,
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    external_id VARCHAR(255),
+    display_name VARCHAR(255) NOT NULL,
+    role role_enum NOT NULL DEFAULT 'member',
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Create ScimGroupMembers Table
+CREATE TABLE IF NOT EXISTS ScimGroupMembers (
+    group_id UUID REFERENCES ScimGroups(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES Users(user_id) ON DELETE CASCADE,
+    PRIMARY KEY (group_id, user_id)
+);
+
+-- Create PersonalAccessTokens Table
+CREATE TABLE IF NOT EXISTS PersonalAccessTokens (
+    id UUID PRIMARY KEY,
+    user_id UUID REFERENCES Users(user_id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+DO $$ BEGIN
+    CREATE TYPE invitation_status_enum AS ENUM ('pending', 'accepted', 'revoked', 'expired');
+EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
+
+-- Create Invitations Table
+CREATE TABLE IF NOT EXISTS Invitations (
+    id UUID PRIMARY KEY,
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    role role_enum NOT NULL DEFAULT 'member',
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    status invitation_status_enum NOT NULL DEFAULT 'pending',
+    invited_by UUID REFERENCES Users(user_id) ON DELETE SET NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    accepted_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS invitations_pending_email_idx ON Invitations (organization_id, email) WHERE status = 'pending';
+
+DO $$ BEGIN
+    CREATE TYPE transfer_status_enum AS ENUM ('pending', 'accepted', 'declined', 'cancelled');
+EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
+
+-- Create OwnershipTransfers Table
+CREATE TABLE IF NOT EXISTS OwnershipTransfers (
+    id UUID PRIMARY KEY,
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    from_user_id UUID REFERENCES Users(user_id) ON DELETE CASCADE,
+    to_user_id UUID REFERENCES Users(user_id) ON DELETE CASCADE,
+    status transfer_status_enum NOT NULL DEFAULT 'pending',
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    responded_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS ownershiptransfers_pending_idx ON OwnershipTransfers (organization_id) WHERE status = 'pending';
+
+-- Create AuditLogs Table, entries outlive the organizations and users they refer to
+CREATE TABLE IF NOT EXISTS AuditLogs (
+    id UUID PRIMARY KEY,
+    organization_id UUID,
+    actor_id UUID,
+    actor_email VARCHAR(255),
+    actor_type VARCHAR(20) NOT NULL,
+    action VARCHAR(100) NOT NULL,
+    target_type VARCHAR(50),
+    target_id VARCHAR(255),
+    ip_address VARCHAR(64),
+    user_agent TEXT,
+    before JSONB,
+    after JSONB,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS auditlogs_organization_idx ON AuditLogs (organization_id, created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS auditlogs_actor_idx ON AuditLogs (actor_id);
+
+-- Audit entries are append only, the only change allowed is removing the actor when their account is deleted
+CREATE OR REPLACE FUNCTION auditlogs_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'UPDATE'
+        AND NEW.actor_id IS NULL AND NEW.actor_email IS NULL AND NEW.ip_address IS NULL AND NEW.user_agent IS NULL
+        AND (NEW.id, NEW.organization_id, NEW.actor_type, NEW.action, NEW.target_type, NEW.target_id, NEW.before, NEW.after, NEW.created_at)
+            IS NOT DISTINCT FROM
+            (OLD.id, OLD.organization_id, OLD.actor_type, OLD.action, OLD.target_type, OLD.target_id, OLD.before, OLD.after, OLD.created_at)
+    THEN
+        RETURN NEW;
+    END IF;
+
+    RAISE EXCEPTION 'audit log entries are immutable';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS auditlogs_append_only ON AuditLogs;
+CREATE TRIGGER auditlogs_append_only
+BEFORE UPDATE OR DELETE ON AuditLogs
+FOR EACH ROW EXECUTE FUNCTION auditlogs_append_only();
+
+-- Create Groups Table
+CREATE TABLE IF NOT EXISTS Groups (
+    id UUID PRIMARY KEY,
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    description TEXT,
+    role role_enum NOT NULL DEFAULT 'member',
+    created_by UUID REFERENCES Users(user_id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (organization_id, name),
+    CHECK (role <> 'creator')
+);
+
+-- Create GroupMembers Table
+CREATE TABLE IF NOT EXISTS GroupMembers (
+    group_id UUID REFERENCES Groups(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES Users(user_id) ON DELETE CASCADE,
+    added_by UUID REFERENCES Users(user_id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS groupmembers_user_idx ON GroupMembers (user_id);
+
+-- The effective role of a member is their own role raised by the roles of their groups
+CREATE OR REPLACE FUNCTION organization_role(p_user_id UUID, p_organization_id UUID) RETURNS TEXT AS $$
+    SELECT CASE
+        WHEN uo.role = 'member' AND EXISTS (
+            SELECT 1 FROM groupmembers gm
+            JOIN groups g ON g.id = gm.group_id
+            WHERE gm.user_id = uo.user_id AND g.organization_id = uo.organization_id AND g.role = 'admin'
+        ) THEN 'admin'
+        ELSE uo.role::text
+    END
+    FROM userorganizations uo
+    JOIN organizations o ON o.organization_id = uo.organization_id
+    WHERE uo.user_id = p_user_id AND uo.organization_id = p_organization_id AND o.deleted_at IS NULL
+    LIMIT 1;
+$$ LANGUAGE SQL STABLE;
+
+DO $$ BEGIN
+    CREATE TYPE share_mode_enum AS ENUM ('view', 'download');
+EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
+
+-- Create ShareLinks Table
+-- password_failures counts wrong passwords in a row, password_locked_until is when the link accepts passwords
+-- again after too many of them
+CREATE TABLE IF NOT EXISTS ShareLinks (
+    id UUID PRIMARY KEY,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    file_id UUID REFERENCES Files(id) ON DELETE CASCADE,
+    folder_id UUID REFERENCES Folders(id) ON DELETE CASCADE,
+    group_id UUID REFERENCES Groups(id) ON DELETE CASCADE,
+    mode share_mode_enum NOT NULL DEFAULT 'view',
+    password_hash TEXT,
+    password_failures INTEGER NOT NULL DEFAULT 0,
+    password_locked_until TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ,
+    max_downloads INTEGER,
+    view_count INTEGER NOT NULL DEFAULT 0,
+    download_count INTEGER NOT NULL DEFAULT 0,
+    created_by UUID REFERENCES Users(user_id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    last_accessed_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    CHECK ((file_id IS NULL) <> (folder_id IS NULL))
+);
+
+DO $$ BEGIN
+    CREATE TYPE folder_role_enum AS ENUM ('viewer', 'editor', 'manager');
+EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
+
+-- Create FolderPermissions Table
+CREATE TABLE IF NOT EXISTS FolderPermissions (
+    id UUID PRIMARY KEY,
+    folder_id UUID REFERENCES Folders(id) ON DELETE CASCADE,
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    user_id UUID REFERENCES Users(user_id) ON DELETE CASCADE,
+    group_id UUID REFERENCES Groups(id) ON DELETE CASCADE,
+    role folder_role_enum NOT NULL,
+    granted_by UUID REFERENCES Users(user_id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (folder_id, user_id),
+    UNIQUE (folder_id, group_id),
+    CHECK ((user_id IS NULL) <> (group_id IS NULL))
+);
+
+-- Create FolderShares Table
+-- Shares only give access once their recipient accepts them, accepted_at is when they did
+CREATE TABLE IF NOT EXISTS FolderShares (
+    id UUID PRIMARY KEY,
+    folder_id UUID REFERENCES Folders(id) ON DELETE CASCADE,
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    target_organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    target_user_id UUID REFERENCES Users(user_id) ON DELETE CASCADE,
+    role folder_role_enum NOT NULL,
+    created_by UUID REFERENCES Users(user_id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    accepted_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    CHECK ((target_organization_id IS NULL) <> (target_user_id IS NULL)),
+    CHECK (role <> 'manager'),
+    CHECK (target_organization_id IS DISTINCT FROM organization_id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS foldershares_organization_idx ON FolderShares (folder_id, target_organization_id) WHERE revoked_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS foldershares_user_idx ON FolderShares (folder_id, target_user_id) WHERE revoked_at IS NULL;
+
+-- Permission ranks: 0 no access, 1 viewer, 2 editor, 3 manager
+CREATE OR REPLACE FUNCTION folder_role_rank(p_role folder_role_enum) RETURNS INTEGER AS $$
+    SELECT CASE p_role WHEN 'viewer' THEN 1 WHEN 'editor' THEN 2 WHEN 'manager' THEN 3 ELSE 0 END;
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- Creators and admins manage everything, members edit anything that inherits from the organization root
+CREATE OR REPLACE FUNCTION organization_permission_rank(p_user_id UUID, p_organization_id UUID) RETURNS INTEGER AS $$
+    SELECT CASE organization_role(p_user_id, p_organization_id) WHEN 'member' THEN 2 WHEN 'admin' THEN 3 WHEN 'creator' THEN 3 ELSE 0 END;
+$$ LANGUAGE SQL STABLE;
+
+-- The highest role given to the user or their groups on the folder itself
+CREATE OR REPLACE FUNCTION folder_grant_rank(p_user_id UUID, p_folder_id UUID) RETURNS INTEGER AS $$
+    SELECT COALESCE(MAX(folder_role_rank(fp.role)), 0)
+    FROM folderpermissions fp
+    WHERE fp.folder_id = p_folder_id
+    AND (fp.user_id = p_user_id OR fp.group_id IN (SELECT group_id FROM groupmembers WHERE user_id = p_user_id));
+$$ LANGUAGE SQL STABLE;
+
+-- The highest role of the accepted live shares of the folder itself with the user or an organization they belong to
+CREATE OR REPLACE FUNCTION folder_share_rank(p_user_id UUID, p_folder_id UUID) RETURNS INTEGER AS $$
+    SELECT COALESCE(MAX(folder_role_rank(fs.role)), 0)
+    FROM foldershares fs
+    JOIN organizations o ON o.organization_id = fs.organization_id AND o.deleted_at IS NULL
+    WHERE fs.folder_id = p_folder_id AND fs.revoked_at IS NULL AND fs.accepted_at IS NOT NULL
+    AND (fs.target_user_id = p_user_id OR organization_role(p_user_id, fs.target_organization_id) IS NOT NULL);
+$$ LANGUAGE SQL STABLE;
+
+-- Combines the organization rank of the user with the roles granted and shared on a folder and the
+-- ancestors it inherits from. Organization members only keep their default access when the folder
+-- inherits all the way up to the organization root
+CREATE OR REPLACE FUNCTION folder_access_rank(p_member INTEGER, p_granted INTEGER, p_shared INTEGER, p_inherits_root BOOLEAN) RETURNS INTEGER AS $$
+    SELECT GREATEST(
+        CASE
+            WHEN p_member IN (0, 3) THEN p_member
+            ELSE GREATEST(p_granted, CASE WHEN p_inherits_root THEN p_member ELSE 0 END)
+        END,
+        p_shared
+    );
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- A folder grants the highest role given to the user or their groups on itself and the ancestors it
+-- inherits from. A folder that breaks inheritance stops the walk up the tree, including the default
+-- access of organization members. Folders shared with another organization or an external user give
+-- the role of the share to its recipients for as long as the owning organization exists
+CREATE OR REPLACE FUNCTION folder_permission_access(p_user_id UUID, p_folder_id UUID, OUT granted INTEGER, OUT shared INTEGER, OUT inherits_root BOOLEAN) AS $$
+    WITH RECURSIVE chain AS (
+        SELECT id, parent_folder_id, inherit_permissions FROM folders WHERE id = p_folder_id
+        UNION ALL
+        SELECT parent.id, parent.parent_folder_id, parent.inherit_permissions
+        FROM folders parent
+        JOIN chain ON parent.id = chain.parent_folder_id
+        WHERE chain.inherit_permissions
+    )
+    SELECT
+        COALESCE(MAX(folder_grant_rank(p_user_id, chain.id)), 0),
+        COALESCE(MAX(folder_share_rank(p_user_id, chain.id)), 0),
+        COALESCE(BOOL_OR(chain.parent_folder_id IS NULL AND chain.inherit_permissions), FALSE)
+    FROM chain;
+$$ LANGUAGE SQL STABLE;
+
+CREATE OR REPLACE FUNCTION folder_permission_rank(p_user_id UUID, p_folder_id UUID) RETURNS INTEGER AS $$
+    SELECT COALESCE((
+        SELECT folder_access_rank(organization_permission_rank(p_user_id, f.organization_id), a.granted, a.shared, a.inherits_root)
+        FROM folders f
+        CROSS JOIN LATERAL folder_permission_access(p_user_id, f.id) a
+        WHERE f.id = p_folder_id
+    ), 0);
+$$ LANGUAGE SQL STABLE;
+
+-- Ranks a folder and its descendants, or every folder of the organization when p_folder_id is NULL, in
+-- one walk down the tree: the ancestors of the folder are only read once and every other folder only
+-- adds its own grants and shares to those of its parent. p_depth limits the walk to that many levels
+-- below the folder, where the folders at the organization root are one level below the root, NULL
+-- walks the whole subtree
+CREATE OR REPLACE FUNCTION folder_permission_ranks(p_user_id UUID, p_organization_id UUID, p_folder_id UUID, p_depth INTEGER)
+RETURNS TABLE (id UUID, rank INTEGER) AS $$
+    WITH RECURSIVE tree AS (
+        SELECT f.id, a.granted, a.shared, a.inherits_root, CASE WHEN p_folder_id IS NULL THEN 1 ELSE 0 END AS depth
+        FROM folders f
+        CROSS JOIN LATERAL folder_permission_access(p_user_id, f.id) a
+        WHERE f.organization_id = p_organization_id
+        AND (f.id = p_folder_id OR (p_folder_id IS NULL AND f.parent_folder_id IS NULL))
+        UNION ALL
+        SELECT
+            child.id,
+            GREATEST(folder_grant_rank(p_user_id, child.id), CASE WHEN child.inherit_permissions THEN tree.granted ELSE 0 END),
+            GREATEST(folder_share_rank(p_user_id, child.id), CASE WHEN child.inherit_permissions THEN tree.shared ELSE 0 END),
+            child.inherit_permissions AND tree.inherits_root,
+            tree.depth + 1
+        FROM folders child
+        JOIN tree ON child.parent_folder_id = tree.id
+        WHERE p_depth IS NULL OR tree.depth < p_depth
+    ),
+    member AS (
+        SELECT organization_permission_rank(p_user_id, p_organization_id) AS rank
+    )
+    SELECT tree.id, folder_access_rank(member.rank, tree.granted, tree.shared, tree.inherits_root)
+    FROM tree, member;
+$$ LANGUAGE SQL STABLE;
+
+-- Files take the permissions of their folder, files at the root those of the organization
+CREATE OR REPLACE FUNCTION file_permission_rank(p_user_id UUID, p_file_id UUID) RETURNS INTEGER AS $$
+    SELECT COALESCE((
+        SELECT CASE
+            WHEN folder_id IS NULL THEN organization_permission_rank(p_user_id, organization_id)
+            ELSE folder_permission_rank(p_user_id, folder_id)
+        END
+        FROM files WHERE id = p_file_id
+    ), 0);
+$$ LANGUAGE SQL STABLE;
+
+-- Create Stars Table
+CREATE TABLE IF NOT EXISTS Stars (
+    id UUID PRIMARY KEY,
+    user_id UUID REFERENCES Users(user_id) ON DELETE CASCADE,
+    file_id UUID REFERENCES Files(id) ON DELETE CASCADE,
+    folder_id UUID REFERENCES Folders(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (user_id, file_id),
+    UNIQUE (user_id, folder_id),
+    CHECK ((file_id IS NULL) <> (folder_id IS NULL))
+);
+
+-- Create RecentItems Table
+CREATE TABLE IF NOT EXISTS RecentItems (
+    id UUID PRIMARY KEY,
+    user_id UUID REFERENCES Users(user_id) ON DELETE CASCADE,
+    file_id UUID REFERENCES Files(id) ON DELETE CASCADE,
+    folder_id UUID REFERENCES Folders(id) ON DELETE CASCADE,
+    accessed_at TIMESTAMPTZ,
+    modified_at TIMESTAMPTZ,
+    UNIQUE (user_id, file_id),
+    UNIQUE (user_id, folder_id),
+    CHECK ((file_id IS NULL) <> (folder_id IS NULL))
+);
+
+CREATE INDEX IF NOT EXISTS recentitems_user_idx ON RecentItems (user_id, (GREATEST(accessed_at, modified_at)) DESC);
+
+-- Create FileVersions Table
+CREATE TABLE IF NOT EXISTS FileVersions (
+    id UUID PRIMARY KEY,
+    file_id UUID REFERENCES Files(id) ON DELETE CASCADE,
+    file_path TEXT NOT NULL,
+    file_size BIGINT,
+    created_at TIMESTAMPTZ,
+    replaced_by UUID REFERENCES Users(user_id) ON DELETE SET NULL,
+    replaced_at TIMESTAMPTZ DEFAULT NOW(),
+    blob_id UUID REFERENCES Blobs(id)
 );
+
+CREATE INDEX IF NOT EXISTS fileversions_file_idx ON FileVersions (file_id, replaced_at DESC);
+
+-- Create ImportJobs Table
+CREATE TABLE IF NOT EXISTS ImportJobs (
+    id UUID PRIMARY KEY,
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    folder_id UUID REFERENCES Folders(id) ON DELETE SET NULL,
+    user_id UUID REFERENCES Users(user_id) ON DELETE CASCADE,
+    archive_name VARCHAR(255) NOT NULL,
+    on_conflict VARCHAR(20) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    total_entries INT NOT NULL DEFAULT 0,
+    total_bytes BIGINT NOT NULL DEFAULT 0,
+    processed_entries INT NOT NULL DEFAULT 0,
+    processed_bytes BIGINT NOT NULL DEFAULT 0,
+    files_created INT NOT NULL DEFAULT 0,
+    files_replaced INT NOT NULL DEFAULT 0,
+    folders_created INT NOT NULL DEFAULT 0,
+    skipped_entries INT NOT NULL DEFAULT 0,
+    error TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    started_at TIMESTAMPTZ,
+    completed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS importjobs_user_idx ON ImportJobs (user_id, created_at DESC);
+
+-- Create FileContents Table
+-- Text extracted from files for search. Files are queued as pending whenever their content changes and the
+-- indexer moves them on to indexed, unsupported or failed
+CREATE TABLE IF NOT EXISTS FileContents (
+    file_id UUID PRIMARY KEY REFERENCES Files(id) ON DELETE CASCADE,
+    file_path TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    content TEXT,
+    content_vector TSVECTOR,
+    error TEXT,
+    queued_at TIMESTAMPTZ DEFAULT NOW(),
+    indexed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS filecontents_vector_idx ON FileContents USING GIN (content_vector);
+CREATE INDEX IF NOT EXISTS filecontents_pending_idx ON FileContents (queued_at) WHERE status = 'pending';
+
+-- Search vector of a file name, dots, dashes and underscores separate words so report_2024.pdf matches report
+CREATE OR REPLACE FUNCTION search_name_vector(p_name TEXT) RETURNS TSVECTOR AS $$
+    SELECT to_tsvector('simple', translate(p_name, '._-', '   '));
+$$ LANGUAGE SQL IMMUTABLE;
+
+CREATE INDEX IF NOT EXISTS files_name_search_idx ON Files USING GIN (search_name_vector(name));
+
+-- Files are queued for indexing when they are added or their content is replaced
+CREATE OR REPLACE FUNCTION files_queue_content() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND OLD.file_path = NEW.file_path THEN
+        RETURN NULL;
+    END IF;
+    -- Content moved to its blob is unchanged, only where it is read from changes
+    IF TG_OP = 'UPDATE' AND OLD.blob_id IS NULL AND NEW.blob_id IS NOT NULL THEN
+        UPDATE filecontents
+        SET file_path = NEW.file_path, status = CASE WHEN status = 'indexing' THEN 'pending' ELSE status END
+        WHERE file_id = NEW.id;
+        RETURN NULL;
+    END IF;
+    INSERT INTO filecontents (file_id, file_path, status, queued_at)
+    VALUES (NEW.id, NEW.file_path, 'pending', NOW())
+    ON CONFLICT (file_id) DO UPDATE
+    SET file_path = EXCLUDED.file_path, status = 'pending', content = NULL, content_vector = NULL, error = NULL,
+        queued_at = NOW(), indexed_at = NULL;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS files_queue_content ON Files;
+CREATE TRIGGER files_queue_content
+AFTER INSERT OR UPDATE OF file_path ON Files
+FOR EACH ROW EXECUTE FUNCTION files_queue_content();
+
+-- Create Tags Table
+CREATE TABLE IF NOT EXISTS Tags (
+    id UUID PRIMARY KEY,
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    color VARCHAR(7),
+    created_by UUID REFERENCES Users(user_id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS tags_name_idx ON Tags (organization_id, LOWER(name));
+
+-- Create ItemTags Table
+CREATE TABLE IF NOT EXISTS ItemTags (
+    tag_id UUID REFERENCES Tags(id) ON DELETE CASCADE,
+    file_id UUID REFERENCES Files(id) ON DELETE CASCADE,
+    folder_id UUID REFERENCES Folders(id) ON DELETE CASCADE,
+    tagged_by UUID REFERENCES Users(user_id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (tag_id, file_id),
+    UNIQUE (tag_id, folder_id),
+    CHECK ((file_id IS NULL) <> (folder_id IS NULL))
+);
+
+CREATE INDEX IF NOT EXISTS itemtags_file_idx ON ItemTags (file_id);
+CREATE INDEX IF NOT EXISTS itemtags_folder_idx ON ItemTags (folder_id);
+
+-- Names of the tags of a file or folder in alphabetical order
+CREATE OR REPLACE FUNCTION file_tag_names(p_file_id UUID) RETURNS TEXT[] AS $$
+    SELECT COALESCE(array_agg(t.name ORDER BY LOWER(t.name)), '{}')
+    FROM itemtags it JOIN tags t ON t.id = it.tag_id
+    WHERE it.file_id = p_file_id;
+$$ LANGUAGE SQL STABLE;
+
+CREATE OR REPLACE FUNCTION folder_tag_names(p_folder_id UUID) RETURNS TEXT[] AS $$
+    SELECT COALESCE(array_agg(t.name ORDER BY LOWER(t.name)), '{}')
+    FROM itemtags it JOIN tags t ON t.id = it.tag_id
+    WHERE it.folder_id = p_folder_id;
+$$ LANGUAGE SQL STABLE;
+
+-- Create MetadataFields Table
+-- The metadata fields of an organization, the metadata of files and folders holds values for these keys only
+CREATE TABLE IF NOT EXISTS MetadataFields (
+    id UUID PRIMARY KEY,
+    organization_id UUID REFERENCES Organizations(organization_id) ON DELETE CASCADE,
+    key VARCHAR(64) NOT NULL,
+    label VARCHAR(100) NOT NULL,
+    type VARCHAR(20) NOT NULL,
+    options TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (organization_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS files_metadata_idx ON Files USING GIN (metadata);
+CREATE INDEX IF NOT EXISTS folders_metadata_idx ON Folders USING GIN (metadata);
+
+-- Create PendingHashes Table
+-- Files whose content hasn't been hashed and moved to a blob yet. Failed attempts are retried later and later
+CREATE TABLE IF NOT EXISTS PendingHashes (
+    file_id UUID PRIMARY KEY REFERENCES Files(id) ON DELETE CASCADE,
+    file_path TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    error TEXT,
+    queued_at TIMESTAMPTZ DEFAULT NOW(),
+    next_attempt_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS pendinghashes_next_idx ON PendingHashes (next_attempt_at);
+
+-- A file whose path changes without a blob has new content, it no longer holds the content of its blob. Files
+-- following their blob to where it was moved keep it
+CREATE OR REPLACE FUNCTION files_reset_blob() RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.file_path IS DISTINCT FROM OLD.file_path AND NEW.blob_id IS NOT DISTINCT FROM OLD.blob_id
+        AND NOT EXISTS (SELECT 1 FROM blobs WHERE id = NEW.blob_id AND file_path = NEW.file_path) THEN
+        NEW.blob_id := NULL;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS files_reset_blob ON Files;
+CREATE TRIGGER files_reset_blob
+BEFORE UPDATE ON Files
+FOR EACH ROW EXECUTE FUNCTION files_reset_blob();
+
+-- Files are queued for hashing when they get content without a blob
+CREATE OR REPLACE FUNCTION files_queue_hash() RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.blob_id IS NOT NULL THEN
+        IF TG_OP = 'INSERT' OR OLD.blob_id IS NULL THEN
+            DELETE FROM pendinghashes WHERE file_id = NEW.id;
+        END IF;
+    ELSIF TG_OP = 'INSERT' OR OLD.file_path IS DISTINCT FROM NEW.file_path OR OLD.blob_id IS NOT NULL THEN
+        INSERT INTO pendinghashes (file_id, file_path, queued_at, next_attempt_at)
+        VALUES (NEW.id, NEW.file_path, NOW(), NOW())
+        ON CONFLICT (file_id) DO UPDATE
+        SET file_path = EXCLUDED.file_path, attempts = 0, error = NULL, queued_at = NOW(), next_attempt_at = NOW();
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS files_queue_hash ON Files;
+CREATE TRIGGER files_queue_hash
+AFTER INSERT OR UPDATE ON Files
+FOR EACH ROW EXECUTE FUNCTION files_queue_hash();
+
+-- Blobs count the files and versions referencing them
+CREATE OR REPLACE FUNCTION blobs_count_references() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND OLD.blob_id IS NOT DISTINCT FROM NEW.blob_id THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.blob_id IS NOT NULL THEN
+        UPDATE blobs
+        SET ref_count = ref_count - 1, released_at = CASE WHEN ref_count = 1 THEN NOW() ELSE released_at END
+        WHERE id = OLD.blob_id;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.blob_id IS NOT NULL THEN
+        UPDATE blobs SET ref_count = ref_count + 1, released_at = NULL WHERE id = NEW.blob_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS files_count_blob_references ON Files;
+CREATE TRIGGER files_count_blob_references
+AFTER INSERT OR UPDATE OR DELETE ON Files
+FOR EACH ROW EXECUTE FUNCTION blobs_count_references();
+
+DROP TRIGGER IF EXISTS fileversions_count_blob_references ON FileVersions;
+CREATE TRIGGER fileversions_count_blob_references
+AFTER INSERT OR UPDATE OR DELETE ON FileVersions
+FOR EACH ROW EXECUTE FUNCTION blobs_count_references();
+
+-- Create Previews Table
+-- Previews generated from the content of a blob, thumbnails for images and the first page of PDFs and a snippet
+-- for text. Blobs are queued as pending when they are stored and the generator moves them on to ready,
+-- unsupported or failed
+CREATE TABLE IF NOT EXISTS Previews (
+    blob_id UUID PRIMARY KEY REFERENCES Blobs(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    kind VARCHAR(20),
+    snippet TEXT,
+    error TEXT,
+    queued_at TIMESTAMPTZ DEFAULT NOW(),
+    generated_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS previews_pending_idx ON Previews (queued_at) WHERE status = 'pending';
+
+-- Create Thumbnails Table
+-- Thumbnail of a preview in each size, stored as a derived object encrypted like the blob it comes from
+CREATE TABLE IF NOT EXISTS Thumbnails (
+    blob_id UUID REFERENCES Previews(blob_id) ON DELETE CASCADE,
+    size VARCHAR(20) NOT NULL,
+    file_path TEXT NOT NULL,
+    file_size BIGINT NOT NULL,
+    width INT NOT NULL,
+    height INT NOT NULL,
+    PRIMARY KEY (blob_id, size)
+);
+
+-- Blobs are queued for previews when they are stored
+CREATE OR REPLACE FUNCTION blobs_queue_preview() RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO previews (blob_id, status, queued_at)
+    VALUES (NEW.id, 'pending', NOW())
+    ON CONFLICT (blob_id) DO NOTHING;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS blobs_queue_preview ON Blobs;
+CREATE TRIGGER blobs_queue_preview
+AFTER INSERT ON Blobs
+FOR EACH ROW EXECUTE FUNCTION blobs_queue_preview();
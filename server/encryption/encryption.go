@@ -0,0 +1,132 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// KeySize is the size of data keys and master keys, AES-256
+const KeySize = 32
+
+// KeyManager wraps the data keys of organizations with a master key it holds, so data keys are only stored
+// wrapped. A key management service can be used by setting Manager to an implementation calling it
+type KeyManager interface {
+	// KeyID identifies the master key new data keys are wrapped with
+	KeyID() string
+	// Wrap encrypts a data key with the master key identified by KeyID
+	Wrap(dataKey []byte) ([]byte, error)
+	// Unwrap decrypts a data key wrapped with the master key identified by keyID
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Manager wraps the data keys of organizations, nil when encryption isn't configured
+var Manager KeyManager
+
+// InitKeyManager sets Manager to the master keys in the environment variables. STORAGE_MASTER_KEYS lists the
+// keys as <id>:<base64 key> separated by commas, the first one wraps new data keys and the others are kept to
+// unwrap data keys until they are wrapped again
+func InitKeyManager() {
+	masterKeys := os.Getenv("STORAGE_MASTER_KEYS")
+	if masterKeys == "" {
+		log.Println("Missing storage master keys in environment variables, file contents won't be encrypted")
+		return
+	}
+
+	manager, err := NewConfigKeyManager(masterKeys)
+	if err != nil {
+		log.Fatal("Error loading storage master keys: ", err)
+	}
+
+	Manager = manager
+}
+
+// configKeyManager wraps data keys with AES-GCM using master keys from the configuration
+type configKeyManager struct {
+	keyID string
+	keys  map[string]cipher.AEAD
+}
+
+// NewConfigKeyManager returns a KeyManager holding master keys listed as <id>:<base64 key> separated by commas,
+// the first key wraps new data keys
+func NewConfigKeyManager(masterKeys string) (KeyManager, error) {
+	manager := &configKeyManager{keys: map[string]cipher.AEAD{}}
+	for _, entry := range strings.Split(masterKeys, ",") {
+		keyID, encoded, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found || keyID == "" {
+			return nil, errors.New("master keys must be listed as <id>:<base64 key>")
+		}
+		if _, exists := manager.keys[keyID]; exists {
+			return nil, fmt.Errorf("master key %s is listed twice", keyID)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("master key %s isn't valid base64", keyID)
+		}
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("master key %s must be %d bytes", keyID, KeySize)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		manager.keys[keyID] = aead
+		if manager.keyID == "" {
+			manager.keyID = keyID
+		}
+	}
+
+	return manager, nil
+}
+
+func (manager *configKeyManager) KeyID() string {
+	return manager.keyID
+}
+
+// Wrap seals the data key with a random nonce, which is put before it
+func (manager *configKeyManager) Wrap(dataKey []byte) ([]byte, error) {
+	aead := manager.keys[manager.keyID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(manager.keyID)), nil
+}
+
+func (manager *configKeyManager) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := manager.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %s isn't configured", keyID)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, []byte(keyID))
+}
+
+// GenerateDataKey returns a new random data key
+func GenerateDataKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
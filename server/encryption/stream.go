@@ -0,0 +1,242 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// ChunkSize is how much content is sealed at once, content is read and written a chunk at a time
+	ChunkSize = 64 << 10
+
+	// streamVersion is the first byte of encrypted content, the format it is written in
+	streamVersion = 1
+	// saltSize is how many random bytes the key of a stream is derived from along with the data key
+	saltSize = 32
+	// noncePrefixSize is how many random bytes start the nonce of every chunk, the rest is the chunk number
+	// and whether it is the last one
+	noncePrefixSize = 7
+	headerSize      = 1 + saltSize + noncePrefixSize
+)
+
+// streamKeyInfo binds the keys derived for streams to their use
+var streamKeyInfo = []byte("storify content stream")
+
+var (
+	ErrUnsupportedStream = errors.New("encrypted content has an unsupported format")
+	ErrCorruptStream     = errors.New("encrypted content is corrupt or was encrypted with another key")
+)
+
+// streamKey derives the key of a stream from a data key and the random salt of the stream
+func streamKey(key []byte, salt []byte) ([]byte, error) {
+	derived := make([]byte, len(key))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, streamKeyInfo), derived); err != nil {
+		return nil, err
+	}
+	return derived, nil
+}
+
+// chunkCipher seals and opens the chunks of a stream. Every chunk has its own nonce made of the random prefix
+// of the stream, the chunk number and a flag set on the last chunk, so chunks can't be reordered, dropped or
+// cut off the end without opening failing
+type chunkCipher struct {
+	aead   cipher.AEAD
+	nonce  []byte
+	number uint32
+}
+
+func newChunkCipher(key []byte, prefix []byte) (*chunkCipher, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, prefix)
+	return &chunkCipher{aead: aead, nonce: nonce}, nil
+}
+
+// next sets the nonce of the next chunk
+func (chunks *chunkCipher) next(last bool) error {
+	if chunks.number == ^uint32(0) {
+		return errors.New("encrypted content has too many chunks")
+	}
+
+	binary.BigEndian.PutUint32(chunks.nonce[noncePrefixSize:], chunks.number)
+	chunks.nonce[len(chunks.nonce)-1] = 0
+	if last {
+		chunks.nonce[len(chunks.nonce)-1] = 1
+	}
+	chunks.number++
+	return nil
+}
+
+// Writer encrypts content written to it a chunk at a time, Close must be called to write the last chunk
+type Writer struct {
+	dst    io.Writer
+	chunks *chunkCipher
+	buffer []byte
+	sealed []byte
+	closed bool
+}
+
+// NewWriter returns a Writer encrypting content with a data key to dst, the header is written right away. Every
+// stream is sealed with its own key derived from the data key and a random salt in the header, so the nonces
+// of chunks never repeat under one key however many streams a data key encrypts
+func NewWriter(dst io.Writer, key []byte) (*Writer, error) {
+	header := make([]byte, headerSize)
+	header[0] = streamVersion
+	if _, err := rand.Read(header[1:]); err != nil {
+		return nil, err
+	}
+
+	key, err := streamKey(key, header[1:1+saltSize])
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := newChunkCipher(key, header[1+saltSize:])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		dst:    dst,
+		chunks: chunks,
+		buffer: make([]byte, 0, ChunkSize),
+		sealed: make([]byte, 0, ChunkSize+chunks.aead.Overhead()),
+	}, nil
+}
+
+// Write buffers content and writes every full chunk once more content follows it, so the last chunk is only
+// sealed on Close
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed encryption writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if len(w.buffer) == ChunkSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.buffer[len(w.buffer):ChunkSize], p)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals and writes the last chunk, it doesn't close the destination
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+func (w *Writer) flush(last bool) error {
+	if err := w.chunks.next(last); err != nil {
+		return err
+	}
+
+	w.sealed = w.chunks.aead.Seal(w.sealed[:0], w.chunks.nonce, w.buffer, nil)
+	w.buffer = w.buffer[:0]
+	_, err := w.dst.Write(w.sealed)
+	return err
+}
+
+// Reader decrypts content written by a Writer a chunk at a time. Reading fails with ErrCorruptStream when a
+// chunk was changed or the content was cut short
+type Reader struct {
+	src    *bufio.Reader
+	chunks *chunkCipher
+	sealed []byte
+	opened []byte
+	offset int
+	done   bool
+}
+
+// NewReader returns a Reader decrypting content from src with a data key, the header is read right away
+func NewReader(src io.Reader, key []byte) (*Reader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrCorruptStream
+		}
+		return nil, err
+	}
+	if header[0] != streamVersion {
+		return nil, ErrUnsupportedStream
+	}
+
+	key, err := streamKey(key, header[1:1+saltSize])
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := newChunkCipher(key, header[1+saltSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		src:    bufio.NewReaderSize(src, ChunkSize+chunks.aead.Overhead()+1),
+		chunks: chunks,
+		sealed: make([]byte, ChunkSize+chunks.aead.Overhead()),
+	}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for r.offset == len(r.opened) {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.opened[r.offset:])
+	r.offset += n
+	return n, nil
+}
+
+// readChunk reads and opens the next chunk, a chunk shorter than a full one or followed by nothing is the last
+func (r *Reader) readChunk() error {
+	n, err := io.ReadFull(r.src, r.sealed)
+	last := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		last = true
+	} else if err != nil {
+		return err
+	} else if _, err := r.src.Peek(1); err == io.EOF {
+		last = true
+	} else if err != nil {
+		return err
+	}
+
+	if err := r.chunks.next(last); err != nil {
+		return err
+	}
+	r.opened, err = r.chunks.aead.Open(r.opened[:0], r.chunks.nonce, r.sealed[:n], nil)
+	if err != nil {
+		return ErrCorruptStream
+	}
+	r.offset = 0
+	r.done = last
+	return nil
+}
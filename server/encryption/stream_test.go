@@ -0,0 +1,139 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+// sealedChunkSize is the size of a full chunk once sealed
+const sealedChunkSize = ChunkSize + 16
+
+// testKey returns a new data key
+func testKey(t *testing.T) []byte {
+	t.Helper()
+
+	key, err := GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// encrypt returns content encrypted with a data key, written in pieces of the given size
+func encrypt(t *testing.T, key []byte, content []byte, piece int) []byte {
+	t.Helper()
+
+	var sealed bytes.Buffer
+	writer, err := NewWriter(&sealed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(content) > 0 {
+		n := min(piece, len(content))
+		if _, err := writer.Write(content[:n]); err != nil {
+			t.Fatal(err)
+		}
+		content = content[n:]
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+// decrypt returns encrypted content decrypted with a data key
+func decrypt(key []byte, sealed []byte) ([]byte, error) {
+	reader, err := NewReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 17} {
+		content := make([]byte, size)
+		rand.Read(content)
+
+		for _, piece := range []int{1000, ChunkSize, 5 * ChunkSize} {
+			sealed := encrypt(t, key, content, piece)
+			// A stream holds at least one chunk, the last one may be full
+			if want := headerSize + size + max(1, (size+ChunkSize-1)/ChunkSize)*16; len(sealed) != want {
+				t.Errorf("%d bytes in pieces of %d: sealed to %d bytes, want %d", size, piece, len(sealed), want)
+			}
+
+			opened, err := decrypt(key, sealed)
+			if err != nil {
+				t.Errorf("%d bytes in pieces of %d: %v", size, piece, err)
+			} else if !bytes.Equal(opened, content) {
+				t.Errorf("%d bytes in pieces of %d: decrypted %d other bytes", size, piece, len(opened))
+			}
+		}
+	}
+
+	// Every stream has its own salt and so its own key
+	first, second := encrypt(t, key, []byte("same content"), 100), encrypt(t, key, []byte("same content"), 100)
+	if bytes.Equal(first[1:1+saltSize], second[1:1+saltSize]) || bytes.Equal(first[headerSize:], second[headerSize:]) {
+		t.Error("two streams of the same content were sealed alike")
+	}
+}
+
+func TestStreamRejectsChanges(t *testing.T) {
+	key := testKey(t)
+	content := make([]byte, 3*ChunkSize+100)
+	rand.Read(content)
+	sealed := encrypt(t, key, content, ChunkSize)
+
+	chunk := func(i int) []byte {
+		start := headerSize + i*sealedChunkSize
+		return sealed[start:min(start+sealedChunkSize, len(sealed))]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	flip := func(at int) []byte {
+		changed := bytes.Clone(sealed)
+		changed[at] ^= 1
+		return changed
+	}
+
+	tests := []struct {
+		name   string
+		sealed []byte
+	}{
+		{"empty", nil},
+		{"cut within the header", sealed[:headerSize-1]},
+		{"cut after the header", sealed[:headerSize]},
+		{"cut within a chunk", sealed[:headerSize+sealedChunkSize+10]},
+		{"cut after a full chunk", sealed[:headerSize+2*sealedChunkSize]},
+		{"last byte cut", sealed[:len(sealed)-1]},
+		{"chunks swapped", join(sealed[:headerSize], chunk(1), chunk(0), chunk(2), chunk(3))},
+		{"chunk dropped", join(sealed[:headerSize], chunk(0), chunk(2), chunk(3))},
+		{"chunk repeated", join(sealed[:headerSize], chunk(0), chunk(0), chunk(1), chunk(2), chunk(3))},
+		{"bytes appended", join(sealed, []byte("more"))},
+		{"salt changed", flip(1)},
+		{"nonce prefix changed", flip(1 + saltSize)},
+		{"chunk changed", flip(headerSize + 5)},
+		{"tag changed", flip(len(sealed) - 1)},
+		{"other key", nil},
+	}
+	for _, test := range tests {
+		readKey := key
+		if test.name == "other key" {
+			test.sealed, readKey = sealed, testKey(t)
+		}
+
+		opened, err := decrypt(readKey, test.sealed)
+		if !errors.Is(err, ErrCorruptStream) {
+			t.Errorf("%s: decrypted %d bytes, %v, want %v", test.name, len(opened), err, ErrCorruptStream)
+		}
+	}
+
+	if _, err := decrypt(key, join([]byte{9}, sealed[1:])); !errors.Is(err, ErrUnsupportedStream) {
+		t.Errorf("unknown version: %v, want %v", err, ErrUnsupportedStream)
+	}
+}
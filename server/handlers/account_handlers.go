@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"server/middleware"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// queryMaps runs a query and returns its rows as maps keyed by column name
+func queryMaps(db *pgxpool.Pool, query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []map[string]interface{}{}
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return nil, err
+		}
+
+		result := map[string]interface{}{}
+		for i, field := range rows.FieldDescriptions() {
+			result[string(field.Name)] = values[i]
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// ExportAccount returns a ZIP of the personal data of the logged in user
+func ExportAccount(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userID := c.Locals("user_id").(string)
+
+	queries := []struct {
+		name  string
+		query string
+	}{
+		{"profile", `
+			SELECT user_id::text, first_name, last_name, email, phone_number, email_verified, created_at
+			FROM users WHERE user_id = $1;
+		`},
+		{"memberships", `
+			SELECT o.organization_id::text, o.name, uo.role::text, uo.created_at
+			FROM userorganizations uo
+			JOIN organizations o ON o.organization_id = uo.organization_id
+			WHERE uo.user_id = $1
+			ORDER BY uo.created_at;
+		`},
+		{"groups", `
+			SELECT g.organization_id::text, g.name, g.role::text, gm.created_at
+			FROM groupmembers gm
+			JOIN groups g ON g.id = gm.group_id
+			WHERE gm.user_id = $1
+			ORDER BY gm.created_at;
+		`},
+		{"sessions", `
+			SELECT id::text, ip_address, user_agent, created_at, expires_at, revoked_at
+			FROM sessions WHERE user_id = $1
+			ORDER BY created_at;
+		`},
+		{"personal_access_tokens", `
+			SELECT id::text, name, array_to_string(scopes, ' ') AS scopes, organization_id::text, expires_at, last_used_at, revoked_at, created_at
+			FROM personalaccesstokens WHERE user_id = $1
+			ORDER BY created_at;
+		`},
+		{"invitations_sent", `
+			SELECT organization_id::text, email, role::text, status::text, created_at, accepted_at
+			FROM invitations WHERE invited_by = $1
+			ORDER BY created_at;
+		`},
+		{"invitations_received", `
+			SELECT i.organization_id::text, i.role::text, i.status::text, i.created_at, i.accepted_at
+			FROM invitations i
+			JOIN users u ON LOWER(u.email) = i.email
+			WHERE u.user_id = $1
+			ORDER BY i.created_at;
+		`},
+		{"audit_events", `
+			SELECT organization_id::text, action, target_type, target_id, ip_address, user_agent, created_at
+			FROM auditlogs WHERE actor_id = $1
+			ORDER BY created_at;
+		`},
+		{"ownership_transfers", `
+			SELECT organization_id::text, from_user_id::text, to_user_id::text, status::text, created_at, responded_at
+			FROM ownershiptransfers WHERE from_user_id = $1 OR to_user_id = $1
+			ORDER BY created_at;
+		`},
+	}
+
+	data := map[string][]map[string]interface{}{}
+	for _, q := range queries {
+		results, err := queryMaps(db, q.query, userID)
+		if err != nil {
+			log.Printf("Error exporting %s: %v", q.name, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error exporting account", "message": err.Error()})
+		}
+		data[q.name] = results
+	}
+
+	if len(data["profile"]) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	files := map[string]interface{}{
+		"profile.json":     data["profile"][0],
+		"memberships.json": fiber.Map{"organizations": data["memberships"], "groups": data["groups"]},
+		"sessions.json":    data["sessions"],
+		"activity.json": fiber.Map{
+			"personal_access_tokens": data["personal_access_tokens"],
+			"invitations_sent":       data["invitations_sent"],
+			"invitations_received":   data["invitations_received"],
+			"ownership_transfers":    data["ownership_transfers"],
+			"audit_events":           data["audit_events"],
+		},
+	}
+
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	for name, content := range files {
+		encoded, err := json.MarshalIndent(content, "", "  ")
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error exporting account", "message": err.Error()})
+		}
+
+		writer, err := archive.Create(name)
+		if err == nil {
+			_, err = writer.Write(encoded)
+		}
+		if err != nil {
+			log.Println("Error writing export archive: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error exporting account", "message": err.Error()})
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Println("Error writing export archive: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error exporting account", "message": err.Error()})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="silo-account-`+time.Now().Format("2006-01-02")+`.zip"`)
+	return c.Status(fiber.StatusOK).Send(buffer.Bytes())
+}
+
+// DeleteAccount deletes the logged in user and their personal data. Organizations the user created
+// must be transferred first unless the user is their only member, in which case they are purged
+func DeleteAccount(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userID := c.Locals("user_id").(string)
+
+	var data struct {
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&data); err != nil || data.Password == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Password is required to delete your account"})
+	}
+
+	var storedPassword string
+	err := db.QueryRow(context.Background(), "SELECT password FROM users WHERE user_id = $1", userID).Scan(&storedPassword)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching user", "details": err.Error()})
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(data.Password)); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+
+	// Organizations the user owns along with other members would be left without a creator
+	blocking, err := queryMaps(
+		db,
+		`
+			SELECT o.organization_id::text, o.name
+			FROM userorganizations uo
+			JOIN organizations o ON o.organization_id = uo.organization_id
+			WHERE uo.user_id = $1 AND uo.role = 'creator' AND o.deleted_at IS NULL
+			AND EXISTS (
+				SELECT 1 FROM userorganizations other
+				WHERE other.organization_id = uo.organization_id AND other.user_id <> uo.user_id
+			);
+		`,
+		userID,
+	)
+	if err != nil {
+		log.Println("Error checking owned organizations: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking owned organizations", "message": err.Error()})
+	}
+	if len(blocking) > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":         "Transfer ownership of these organizations before deleting your account",
+			"organizations": blocking,
+		})
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting account", "message": err.Error()})
+	}
+	defer tx.Rollback(context.Background())
+
+	// Organizations where the user is the only member are purged with the account
+	rows, err := tx.Query(
+		context.Background(),
+		`
+			UPDATE organizations SET deleted_at = COALESCE(deleted_at, NOW()), purge_at = NOW()
+			WHERE organization_id IN (
+				SELECT organization_id FROM userorganizations WHERE user_id = $1 AND role = 'creator'
+			)
+			AND NOT EXISTS (
+				SELECT 1 FROM userorganizations other
+				WHERE other.organization_id = organizations.organization_id AND other.user_id <> $1
+			)
+			RETURNING organization_id;
+		`,
+		userID,
+	)
+	if err != nil {
+		log.Println("Error scheduling organizations for purge: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting account", "message": err.Error()})
+	}
+
+	var organizationIds []string
+	for rows.Next() {
+		var organizationId string
+		if err := rows.Scan(&organizationId); err != nil {
+			rows.Close()
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		organizationIds = append(organizationIds, organizationId)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	// Invitations addressed to the user hold their email address
+	_, err = tx.Exec(
+		context.Background(),
+		"DELETE FROM invitations WHERE email = (SELECT LOWER(email) FROM users WHERE user_id = $1);",
+		userID,
+	)
+	if err != nil {
+		log.Println("Error deleting invitations: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting account", "message": err.Error()})
+	}
+
+	// Audit entries are kept for the organizations but no longer identify the user
+	_, err = tx.Exec(
+		context.Background(),
+		"UPDATE auditlogs SET actor_id = NULL, actor_email = NULL, ip_address = NULL, user_agent = NULL WHERE actor_id = $1;",
+		userID,
+	)
+	if err != nil {
+		log.Println("Error anonymizing audit log: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting account", "message": err.Error()})
+	}
+
+	// Sessions, tokens, memberships and transfers are removed by the cascade
+	_, err = tx.Exec(context.Background(), "DELETE FROM users WHERE user_id = $1;", userID)
+	if err != nil {
+		log.Println("Error deleting user: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting account", "message": err.Error()})
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting account", "message": err.Error()})
+	}
+
+	// Storage that can't be removed now is purged by the daily job
+	for _, organizationId := range organizationIds {
+		if err := purgeOrganization(db, organizationId); err != nil {
+			log.Printf("Error purging organization %s: %v", organizationId, err)
+		}
+	}
+
+	c.ClearCookie("auth_token")
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Account deleted!"})
+}
+
+func RegisterAccountRoutes(app *fiber.App, db *pgxpool.Pool) {
+	accountGroup := app.Group("/auth/account", middleware.AuthRequired(db), middleware.SessionRequired())
+
+	accountGroup.Get("/export", func(c *fiber.Ctx) error {
+		return ExportAccount(c, db)
+	})
+	accountGroup.Delete("/", func(c *fiber.Ctx) error {
+		return DeleteAccount(c, db)
+	})
+}
@@ -0,0 +1,462 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/middleware"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// auditEvent describes a change to record in the audit log. The organization is taken from the
+// before or after snapshot when it isn't set and the snapshot is a file, folder or organization
+type auditEvent struct {
+	OrganizationID string
+	ActorID        string
+	Action         string
+	TargetType     string
+	TargetID       string
+	Before         interface{}
+	After          interface{}
+}
+
+const auditLogColumns = `
+	id, organization_id, actor_id, actor_email, actor_type, action, target_type, target_id,
+	ip_address, user_agent, before::text, after::text, created_at
+`
+
+// nullableString returns nil for an empty string so it is stored as NULL
+func nullableString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// auditJSON encodes an audit snapshot, nil snapshots are stored as NULL
+func auditJSON(value interface{}) *string {
+	if value == nil {
+		return nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil || string(encoded) == "null" {
+		return nil
+	}
+	return nullableString(string(encoded))
+}
+
+// auditOrganization finds the organization a snapshot belongs to
+func auditOrganization(snapshots ...interface{}) string {
+	for _, snapshot := range snapshots {
+		switch value := snapshot.(type) {
+		case *models.File:
+			if value != nil {
+				return value.OrganizationID
+			}
+		case *models.Folder:
+			if value != nil {
+				return value.OrganizationID
+			}
+		case *models.Organization:
+			if value != nil {
+				return value.OrganizationID
+			}
+		}
+	}
+	return ""
+}
+
+// insertAuditLog appends an entry to the audit log
+func insertAuditLog(db dbConn, actorType string, ipAddress string, userAgent string, event auditEvent) error {
+	if event.OrganizationID == "" {
+		event.OrganizationID = auditOrganization(event.Before, event.After)
+	}
+
+	query := `
+		INSERT INTO auditlogs
+		(id, organization_id, actor_id, actor_email, actor_type, action, target_type, target_id, ip_address, user_agent, before, after, created_at)
+		VALUES ($1, $2, $3, (SELECT email FROM users WHERE user_id = $3), $4, $5, $6, $7, $8, $9, $10, $11, $12);
+	`
+	_, err := db.Exec(
+		context.Background(),
+		query,
+		uuid.New().String(),
+		nullableString(event.OrganizationID),
+		nullableString(event.ActorID),
+		actorType,
+		event.Action,
+		nullableString(event.TargetType),
+		nullableString(event.TargetID),
+		nullableString(ipAddress),
+		nullableString(userAgent),
+		auditJSON(event.Before),
+		auditJSON(event.After),
+		time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("error recording audit event %s: %w", event.Action, err)
+	}
+	return nil
+}
+
+// auditActor returns the actor of a request and its type
+func auditActor(c *fiber.Ctx, actorID string) (string, string) {
+	if actorID == "" {
+		actorID, _ = c.Locals("user_id").(string)
+	}
+	if _, isToken := c.Locals("token_id").(string); isToken {
+		return actorID, "token"
+	} else if _, isScim := c.Locals("organization_id").(string); isScim && actorID == "" {
+		return actorID, "scim"
+	} else if actorID == "" {
+		return actorID, "anonymous"
+	}
+	return actorID, "user"
+}
+
+// recordAudit records an event of a request that doesn't change anything, like a download, failures are
+// logged and don't fail the request. Changes are recorded with recordAuditTx
+func recordAudit(c *fiber.Ctx, db *pgxpool.Pool, event auditEvent) {
+	var actorType string
+	event.ActorID, actorType = auditActor(c, event.ActorID)
+
+	if err := insertAuditLog(db, actorType, c.IP(), c.Get(fiber.HeaderUserAgent), event); err != nil {
+		log.Println(err)
+	}
+}
+
+// recordAuditTx records a change made by the caller of a request in the transaction making it, so the change
+// isn't committed without its entry
+func recordAuditTx(c *fiber.Ctx, tx pgx.Tx, event auditEvent) error {
+	var actorType string
+	event.ActorID, actorType = auditActor(c, event.ActorID)
+
+	return insertAuditLog(tx, actorType, c.IP(), c.Get(fiber.HeaderUserAgent), event)
+}
+
+// auditedTx runs a change in a transaction and records the event it returns in the same transaction, so the
+// change and its entry are committed together. Changes returning a nil event record nothing
+func auditedTx(c *fiber.Ctx, db *pgxpool.Pool, change func(tx pgx.Tx) (*auditEvent, error)) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	event, err := change(tx)
+	if err != nil {
+		return err
+	}
+	if event != nil {
+		if err := recordAuditTx(c, tx, *event); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// recordSystemAuditTx records a change made by a scheduled job in the transaction making it
+func recordSystemAuditTx(tx pgx.Tx, event auditEvent) error {
+	return insertAuditLog(tx, "system", "", "", event)
+}
+
+// auditFile returns a snapshot of a file for the audit log, or nil if it can't be found
+func auditFile(db dbConn, fileID string) *models.File {
+	var file models.File
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT id, name, folder_id, file_path, file_size, created_at, updated_at, organization_id, deleted, deleted_at FROM files WHERE id = $1;",
+		fileID,
+	).Scan(&file.ID, &file.Name, &file.FolderID, &file.FilePath, &file.FileSize, &file.CreatedAt, &file.UpdatedAt, &file.OrganizationID, &file.Deleted, &file.DeletedAt)
+	if err != nil {
+		return nil
+	}
+	return &file
+}
+
+// auditFolder returns a snapshot of a folder for the audit log, or nil if it can't be found
+func auditFolder(db dbConn, folderID string) *models.Folder {
+	var folder models.Folder
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT id, name, organization_id, parent_folder_id, created_at, updated_at, deleted, deleted_at FROM folders WHERE id = $1;",
+		folderID,
+	).Scan(&folder.ID, &folder.Name, &folder.OrganizationID, &folder.ParentFolderID, &folder.CreatedAt, &folder.UpdatedAt, &folder.Deleted, &folder.DeletedAt)
+	if err != nil {
+		return nil
+	}
+	return &folder
+}
+
+// auditOrganizationSnapshot returns a snapshot of an organization for the audit log, or nil if it can't be found
+func auditOrganizationSnapshot(db dbConn, organizationID string) *models.Organization {
+	var organization models.Organization
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT organization_id, name, created_at, deleted_at, purge_at FROM organizations WHERE organization_id = $1;",
+		organizationID,
+	).Scan(&organization.OrganizationID, &organization.Name, &organization.CreatedAt, &organization.DeletedAt, &organization.PurgeAt)
+	if err != nil {
+		return nil
+	}
+	return &organization
+}
+
+func scanAuditLog(row pgx.Row) (models.AuditLog, error) {
+	var entry models.AuditLog
+	var before, after *string
+	err := row.Scan(
+		&entry.ID,
+		&entry.OrganizationID,
+		&entry.ActorID,
+		&entry.ActorEmail,
+		&entry.ActorType,
+		&entry.Action,
+		&entry.TargetType,
+		&entry.TargetID,
+		&entry.IPAddress,
+		&entry.UserAgent,
+		&before,
+		&after,
+		&entry.CreatedAt,
+	)
+	if before != nil {
+		entry.Before = json.RawMessage(*before)
+	}
+	if after != nil {
+		entry.After = json.RawMessage(*after)
+	}
+	return entry, err
+}
+
+// auditLogFilters builds the WHERE clause of an audit log query from the request query parameters
+func auditLogFilters(c *fiber.Ctx, organizationId string) (string, []interface{}, error) {
+	conditions := []string{"organization_id = $1"}
+	args := []interface{}{organizationId}
+
+	for _, filter := range []string{"action", "actor_id", "actor_type", "target_type", "target_id"} {
+		if value := c.Query(filter); value != "" {
+			args = append(args, value)
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", filter, len(args)))
+		}
+	}
+
+	for filter, operator := range map[string]string{"from": ">=", "to": "<"} {
+		if value := c.Query(filter); value != "" {
+			timestamp, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return "", nil, fmt.Errorf("%s must be an RFC 3339 timestamp", filter)
+			}
+			args = append(args, timestamp)
+			conditions = append(conditions, fmt.Sprintf("created_at %s $%d", operator, len(args)))
+		}
+	}
+
+	return strings.Join(conditions, " AND "), args, nil
+}
+
+// GetAuditLog returns a page of the audit log of an organization, newest first
+func GetAuditLog(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+
+	where, args, err := auditLogFilters(c, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var total int
+	err = db.QueryRow(context.Background(), "SELECT COUNT(*) FROM auditlogs WHERE "+where, args...).Scan(&total)
+	if err != nil {
+		log.Println("Error counting audit log: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching audit log", "message": err.Error()})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 500"})
+	}
+
+	// The cursor is the created_at and id of the last entry of the previous page
+	if cursor := c.Query("cursor"); cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		parts := strings.SplitN(string(decoded), ",", 2)
+		if err != nil || len(parts) != 2 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cursor"})
+		}
+		createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cursor"})
+		}
+		args = append(args, createdAt, parts[1])
+		where += fmt.Sprintf(" AND (created_at, id) < ($%d, $%d)", len(args)-1, len(args))
+	}
+
+	args = append(args, limit+1)
+	query := fmt.Sprintf(
+		"SELECT %s FROM auditlogs WHERE %s ORDER BY created_at DESC, id DESC LIMIT $%d;",
+		auditLogColumns, where, len(args),
+	)
+
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		log.Println("Error fetching audit log: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching audit log", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	entries := []models.AuditLog{}
+	for rows.Next() {
+		entry, err := scanAuditLog(rows)
+		if err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	var nextCursor *string
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[limit-1]
+		cursor := base64.RawURLEncoding.EncodeToString([]byte(last.CreatedAt.Format(time.RFC3339Nano) + "," + last.ID))
+		nextCursor = &cursor
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"items":       entries,
+		"next_cursor": nextCursor,
+		"total":       total,
+	})
+}
+
+// csvCells quotes values spreadsheets would evaluate as formulas with a leading ', user agents and names in the
+// audit log are set by whoever made the request
+func csvCells(values ...string) []string {
+	for i, value := range values {
+		if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+			values[i] = "'" + value
+		}
+	}
+	return values
+}
+
+// ExportAuditLog streams the audit log of an organization as NDJSON or CSV, oldest first
+func ExportAuditLog(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	format := c.Query("format", "ndjson")
+
+	if format != "ndjson" && format != "csv" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "format must be ndjson or csv"})
+	}
+
+	where, args, err := auditLogFilters(c, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM auditlogs WHERE %s ORDER BY created_at, id;", auditLogColumns, where)
+
+	if format == "csv" {
+		c.Set(fiber.HeaderContentType, "text/csv")
+	} else {
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	}
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="audit-`+organizationId+`.`+format+`"`)
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		rows, err := db.Query(context.Background(), query, args...)
+		if err != nil {
+			log.Println("Error exporting audit log: ", err)
+			return
+		}
+		defer rows.Close()
+
+		csvWriter := csv.NewWriter(w)
+		encoder := json.NewEncoder(w)
+		if format == "csv" {
+			csvWriter.Write([]string{
+				"id", "created_at", "actor_id", "actor_email", "actor_type", "action",
+				"target_type", "target_id", "ip_address", "user_agent", "before", "after",
+			})
+		}
+
+		value := func(s *string) string {
+			if s == nil {
+				return ""
+			}
+			return *s
+		}
+
+		for rows.Next() {
+			entry, err := scanAuditLog(rows)
+			if err != nil {
+				log.Println("Error scanning row: ", err)
+				return
+			}
+
+			if format == "csv" {
+				csvWriter.Write(csvCells(
+					entry.ID, entry.CreatedAt.Format(time.RFC3339Nano), value(entry.ActorID), value(entry.ActorEmail),
+					entry.ActorType, entry.Action, value(entry.TargetType), value(entry.TargetID),
+					value(entry.IPAddress), value(entry.UserAgent), string(entry.Before), string(entry.After),
+				))
+			} else if err := encoder.Encode(entry); err != nil {
+				log.Println("Error writing audit log export: ", err)
+				return
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			log.Println("Error iterating rows: ", err)
+		}
+		csvWriter.Flush()
+	})
+
+	return nil
+}
+
+// requireAuditAccess allows organization admins to read the audit log
+func requireAuditAccess(db *pgxpool.Pool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		isAdmin, err := isOrganizationAdmin(db, c.Locals("user_id").(string), c.Params("organization_id"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+		}
+		if !isAdmin {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can read the audit log"})
+		}
+
+		return c.Next()
+	}
+}
+
+func RegisterAuditRoutes(app *fiber.App, db *pgxpool.Pool) {
+	auditGroup := app.Group("/organization/audit", middleware.AuthRequired(db), middleware.RequireScope(db, middleware.ScopeReadAudit))
+
+	auditGroup.Get("/:organization_id", requireAuditAccess(db), func(c *fiber.Ctx) error {
+		return GetAuditLog(c, db)
+	})
+	auditGroup.Get("/:organization_id/export", requireAuditAccess(db), func(c *fiber.Ctx) error {
+		return ExportAuditLog(c, db)
+	})
+}
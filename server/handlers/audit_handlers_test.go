@@ -0,0 +1,24 @@
+package handlers
+
+import "testing"
+
+func TestCSVCells(t *testing.T) {
+	tests := []struct {
+		value string
+		cell  string
+	}{
+		{"=HYPERLINK(\"http://example.com\")", "'=HYPERLINK(\"http://example.com\")"},
+		{"+1+1", "'+1+1"},
+		{"-1+1", "'-1+1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"Mozilla/5.0", "Mozilla/5.0"},
+		{"a=1", "a=1"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if cell := csvCells(test.value)[0]; cell != test.cell {
+			t.Errorf("csvCells(%q) = %q, want %q", test.value, cell, test.cell)
+		}
+	}
+}
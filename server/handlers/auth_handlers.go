@@ -7,8 +7,10 @@ import (
 	"os"
 
 	//"os"
+	"server/middleware"
 	"server/models"
 	"server/otp"
+	"server/sessions"
 	"server/utils"
 	"time"
 
@@ -30,9 +32,9 @@ func Login(c *fiber.Ctx, db *pgxpool.Pool) error {
 	var storedUser models.User
 	err := db.QueryRow(
 		context.Background(),
-		"SELECT user_id, email, password, first_name, last_name FROM users WHERE email=$1",
+		"SELECT user_id, email, password, first_name, last_name, email_verified FROM users WHERE email=$1",
 		user.Email,
-	).Scan(&storedUser.UserID, &storedUser.Email, &storedUser.Password, &storedUser.FirstName, &storedUser.LastName)
+	).Scan(&storedUser.UserID, &storedUser.Email, &storedUser.Password, &storedUser.FirstName, &storedUser.LastName, &storedUser.EmailVerified)
 
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -49,6 +51,18 @@ func Login(c *fiber.Ctx, db *pgxpool.Pool) error {
 		})
 	}
 
+	if EmailVerificationRequired() && !storedUser.EmailVerified {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Email not verified"})
+	}
+
+	enforced, err := isSSOEnforced(db, storedUser.UserID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking SSO settings", "details": err.Error()})
+	}
+	if enforced {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Password login is disabled for your organization, sign in with SSO"})
+	}
+
 	_otp, err := otp.GenerateOTP()
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error generating OTP"})
@@ -69,6 +83,34 @@ func Login(c *fiber.Ctx, db *pgxpool.Pool) error {
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "OTP sent. Please verify."})
 }
 
+// startSession creates a session for the user and sets the auth cookie, returning the auth token
+func startSession(c *fiber.Ctx, db *pgxpool.Pool, user models.User) (string, error) {
+	sessionID, err := sessions.CreateSession(db, user.UserID, c.IP(), c.Get(fiber.HeaderUserAgent))
+	if err != nil {
+		return "", err
+	}
+
+	token, err := utils.GenerateToken(user.UserID, user.Email, user.FirstName, user.LastName, sessionID)
+	if err != nil {
+		return "", err
+	}
+
+	secureCookie := os.Getenv("SECURE_COOKIE") == "true"
+
+	c.Cookie(&fiber.Cookie{
+		Name:     "auth_token",
+		Value:    token,
+		MaxAge:		int(time.Hour.Seconds() * 24 * 3),
+		HTTPOnly: true,
+		Secure:   secureCookie,
+		SameSite: "None",
+	})
+
+	recordAudit(c, db, auditEvent{ActorID: user.UserID, Action: "auth.login", TargetType: "session", TargetID: sessionID})
+
+	return token, nil
+}
+
 func VerifyOTP(c *fiber.Ctx, db *pgxpool.Pool) error {
 	type OTPRequest struct {
 		Email string `json:"email"`
@@ -97,22 +139,11 @@ func VerifyOTP(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired OTP"})
 	}
 
-	token, err := utils.GenerateToken(storedUser.UserID, storedUser.Email, storedUser.FirstName, storedUser.LastName)
+	token, err := startSession(c, db, storedUser)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error generating token", "message": err.Error()})
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error starting session", "message": err.Error()})
 	}
 
-	secureCookie := os.Getenv("SECURE_COOKIE") == "true"
-
-	c.Cookie(&fiber.Cookie{
-		Name:     "auth_token",
-		Value:    token,
-		MaxAge:		int(time.Hour.Seconds() * 24 * 3),
-		HTTPOnly: true,
-		Secure:   secureCookie,
-		SameSite: "None",
-	})
-
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Login successful!", "token": token})
 }
 
@@ -130,6 +161,10 @@ func Register(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing required fields"})
 	}
 
+	if err := utils.ValidatePassword(user.Password); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Weak password", "message": err.Error()})
+	}
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
 		log.Println("Error hashing password: ", err)
@@ -163,6 +198,11 @@ func Register(c *fiber.Ctx, db *pgxpool.Pool) error {
 		})
 	}
 
+	if err := sendVerificationEmail(user.UserID, user.Email); err != nil {
+		// The user can ask for a new link, so registration still succeeds
+		log.Println("Error sending verification email: ", err)
+	}
+
 	// Create a new organization
 	var organization models.Organization
 	organization.OrganizationID = uuid.New().String()
@@ -209,63 +249,62 @@ func Register(c *fiber.Ctx, db *pgxpool.Pool) error {
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
-		"message":         "User registered and organization created successfully",
+		"message":         "User registered and organization created successfully, please verify your email",
 		"user_id":         user.UserID,
 		"organization_id": organization.OrganizationID,
 	})
 }
 
-// Function to delete a user, expects email in the request query
-func DeleteUser(c *fiber.Ctx, db *pgxpool.Pool) error {
-	email := c.Params("email")
-
-	if email == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Email missing"})
-	}
+// userSortColumns are the columns user listings can be sorted by
+var userSortColumns = map[string]sortColumn{
+	"name":       {Expression: "(COALESCE(u.first_name, '') || ' ' || COALESCE(u.last_name, ''))", Type: "text"},
+	"email":      {Expression: "u.email", Type: "text"},
+	"created_at": {Expression: "COALESCE(u.created_at, 'epoch')", Type: "timestamptz", Descending: true},
+}
 
-	query := "DELETE FROM users WHERE email = $1;"
+// Function to list the users sharing an organization with the logged in user, a page at a time
+func GetUsers(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userID := c.Locals("user_id").(string)
 
-	_, err := db.Exec(
-		context.Background(),
-		query,
-		email,
-	)
+	page, err := parsePageRequest(c, userSortColumns, "name")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
 
+	filters, args, err := parseFilters(c, filterColumns{CreatedAt: "u.created_at"}, []interface{}{userID})
 	if err != nil {
-		log.Println("Error deleting user")
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting user", "message": err.Error()})
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "User deleted!"})
-}
+	where := `
+		EXISTS (
+			SELECT 1 FROM userorganizations uo
+			JOIN userorganizations mine ON mine.organization_id = uo.organization_id
+			WHERE uo.user_id = u.user_id AND mine.user_id = $1
+		) AND ` + filters
 
-// Function to list all the users
-func GetUsers(c *fiber.Ctx, db *pgxpool.Pool) error {
-	query := `
-		SELECT
-		COALESCE(email, '') AS email,
-		COALESCE(first_name, '') AS first_name,
-		COALESCE(last_name, '') AS last_name 
-		FROM users;
-    `
-
-	rows, err := db.Query(
-		context.Background(),
-		query,
+	rows, total, err := queryPage(
+		db, page,
+		"u.user_id, COALESCE(u.email, ''), COALESCE(u.first_name, ''), COALESCE(u.last_name, '')",
+		"users u", where, "u.user_id", args,
 	)
-
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error listing users", "message": err.Error()})
 	}
+	defer rows.Close()
 
-	var users []models.User
+	users := []models.User{}
+	var keys []pageKey
 	for rows.Next() {
 		var user models.User
-		if err := rows.Scan(&user.Email, &user.FirstName, &user.LastName); err != nil {
+		var key pageKey
+		if err := rows.Scan(&user.UserID, &user.Email, &user.FirstName, &user.LastName, &key.Value); err != nil {
 			log.Println("Error scanning row: ", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning user data", "message": err.Error()})
 		}
+		key.ID = user.UserID
 		users = append(users, user)
+		keys = append(keys, key)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -273,7 +312,16 @@ func GetUsers(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error with user data", "message": err.Error()})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(users)
+	nextCursor := page.nextCursor(keys)
+	if len(users) > page.Limit {
+		users = users[:page.Limit]
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"items":       users,
+		"next_cursor": nextCursor,
+		"total":       total,
+	})
 }
 
 func GetOrganizationsCreatedByUser(c *fiber.Ctx, db *pgxpool.Pool) error {
@@ -282,46 +330,7 @@ func GetOrganizationsCreatedByUser(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing user_id"})
 	}
 
-	query := `
-		SELECT org.*
-		FROM organizations org
-		JOIN userorganizations uo ON org.organization_id = uo.organization_id 
-		WHERE uo.user_id = $1 AND uo.role = 'creator';
-	`
-
-	rows, err := db.Query(
-		context.Background(),
-		query,
-		userId,
-	)
-
-	if err != nil {
-		log.Println("Error fetching organizations: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching organizations", "message": err.Error()})
-	}
-	defer rows.Close()
-
-	var organizations []models.Organization
-	for rows.Next() {
-		var organization models.Organization
-		if err := rows.Scan(
-			&organization.OrganizationID,
-			&organization.Name,
-			&organization.CreatedAt,
-		); err != nil {
-			log.Println("Error scanning row: ", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
-		}
-		organizations = append(organizations, organization)
-	}
-
-	if err := rows.Err(); err != nil {
-		log.Println("Error iterating rows: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
-	}
-
-	return c.Status(fiber.StatusOK).JSON(organizations)
-
+	return listOrganizations(c, db, "uo.user_id = $1 AND uo.role = 'creator'", []interface{}{userId})
 }
 
 // Function to get a user's data, expects email in the request query
@@ -397,7 +406,22 @@ func RegisterAuthRoutes(app *fiber.App, db *pgxpool.Pool) {
 	authGroup.Post("/verify", func(c *fiber.Ctx) error {
 		return VerifyOTP(c, db)
 	})
-	authGroup.Get("/fetch/all", func(c *fiber.Ctx) error {
+	authGroup.Post("/email/verify", func(c *fiber.Ctx) error {
+		return VerifyEmail(c, db)
+	})
+	authGroup.Post("/email/resend", func(c *fiber.Ctx) error {
+		return ResendVerificationEmail(c, db)
+	})
+	authGroup.Post("/password/forgot", func(c *fiber.Ctx) error {
+		return ForgotPassword(c, db)
+	})
+	authGroup.Post("/password/reset", func(c *fiber.Ctx) error {
+		return ResetPassword(c, db)
+	})
+	authGroup.Post("/password/change", middleware.AuthRequired(db), middleware.SessionRequired(), func(c *fiber.Ctx) error {
+		return ChangePassword(c, db)
+	})
+	authGroup.Get("/fetch/all", middleware.AuthRequired(db), func(c *fiber.Ctx) error {
 		return GetUsers(c, db)
 	})
 	authGroup.Get("/fetch/specific/:user_id", func(c *fiber.Ctx) error {
@@ -409,7 +433,4 @@ func RegisterAuthRoutes(app *fiber.App, db *pgxpool.Pool) {
 	authGroup.Put("/update/:email", func(c *fiber.Ctx) error {
 		return UpdateUser(c, db)
 	})
-	authGroup.Delete("/delete/:email", func(c *fiber.Ctx) error {
-		return DeleteUser(c, db)
-	})
 }
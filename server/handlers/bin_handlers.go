@@ -4,22 +4,40 @@ import (
 	"context"
 	"log"
 
+	"server/middleware"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 func DeleteExpiredItems(c *fiber.Ctx, db *pgxpool.Pool) error {
 	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
 
 	if organizationId == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing organizationId"})
 	}
-	// Delete from folders
-	folderQuery := "DELETE FROM folders WHERE organization_id = $1 AND deleted = true;"
-	_, err := db.Exec(
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error clearing bin"})
+	}
+	defer tx.Rollback(context.Background())
+
+	// Delete from folders the user can edit down to their last subfolder
+	folderQuery := `
+		WITH restricted AS (
+			SELECT f.id, f.ancestor_ids FROM folders f
+			JOIN folder_permission_ranks($2, $1, NULL, NULL) r ON r.id = f.id
+			WHERE r.rank < 2
+		)
+		DELETE FROM folders WHERE organization_id = $1 AND deleted = true
+		AND NOT EXISTS (SELECT 1 FROM restricted WHERE restricted.id = folders.id OR folders.id = ANY(restricted.ancestor_ids));
+	`
+	folderTag, err := tx.Exec(
 		context.Background(),
 		folderQuery,
-		organizationId,
+		organizationId, userID,
 	)
 
 	if err != nil {
@@ -28,22 +46,39 @@ func DeleteExpiredItems(c *fiber.Ctx, db *pgxpool.Pool) error {
 	}
 
 	// Delete from files
-	fileQuery := "DELETE FROM files WHERE organization_id = $1 AND deleted = true;"
-	_, err = db.Exec(
+	fileQuery := "DELETE FROM files WHERE organization_id = $1 AND deleted = true AND " + fileRankCondition("folder_id", "$2", "$1", permissionEditor) + ";"
+	fileTag, err := tx.Exec(
 		context.Background(),
 		fileQuery,
-		organizationId,
+		organizationId, userID,
 	)
 
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error clearing bin"})
 	}
 
+	err = recordAuditTx(c, tx, auditEvent{
+		OrganizationID: organizationId,
+		Action:         "bin.empty",
+		TargetType:     "organization",
+		TargetID:       organizationId,
+		After:          fiber.Map{"folders_deleted": folderTag.RowsAffected(), "files_deleted": fileTag.RowsAffected()},
+	})
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error clearing bin"})
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error clearing bin"})
+	}
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Recycle bin cleared successfully!"})
 }
 
 func RegisterBinRoutes (app *fiber.App, db *pgxpool.Pool) {
-	app.Delete("/bin/empty/:organization_id", func(c *fiber.Ctx) error {
+	app.Delete("/bin/empty/:organization_id", middleware.AuthRequired(db), middleware.RequireScope(db, middleware.ScopeWriteFiles), func(c *fiber.Ctx) error {
 		return DeleteExpiredItems(c, db)
 	})
 }
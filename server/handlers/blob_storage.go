@@ -0,0 +1,466 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"server/spaces"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	// hashBatchSize is how many queued files the hasher claims at once
+	hashBatchSize = 10
+	// hashPollInterval is how long the hasher waits when no file is queued
+	hashPollInterval = 5 * time.Second
+	// blobGracePeriod is how long a blob nothing references is kept before its object is deleted, which leaves
+	// time to reference blobs just stored or found
+	blobGracePeriod = time.Hour
+	// blobSweepInterval is how often blobs nothing references are looked for
+	blobSweepInterval = 10 * time.Minute
+	// objectDeletionBatchSize is how many queued object deletions a sweep retries at once
+	objectDeletionBatchSize = 100
+)
+
+// blobKey returns the object key of the content of a blob of an organization. Keys of deleted blobs are never
+// used again so their objects can be deleted after the blob
+func blobKey(organizationID string, blobID string) string {
+	return "blobs/" + organizationID + "/" + blobID
+}
+
+// hashContent reads content to the end and returns its hex SHA-256 and size
+func hashContent(content io.Reader) (string, int64, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, content)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// storeBlob returns the id and file path of the blob of an organization holding the content with the given hash.
+// When the organization has no such blob store saves the content to the key given to it first, encrypted with
+// the data key encryptionKeyID identifies unless it is nil. The grace period of a blob nothing references starts
+// over so the caller has time to reference it
+func storeBlob(db *pgxpool.Pool, organizationID string, hash string, size int64, encryptionKeyID *string, store func(key string) error) (string, string, error) {
+	var blobID, filePath string
+	err := db.QueryRow(
+		context.Background(),
+		`
+			UPDATE blobs SET released_at = CASE WHEN ref_count = 0 THEN NOW() ELSE released_at END
+			WHERE organization_id = $1 AND hash = $2
+			RETURNING id, file_path;
+		`,
+		organizationID, hash,
+	).Scan(&blobID, &filePath)
+	if err == nil {
+		return blobID, filePath, nil
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return "", "", err
+	}
+
+	newBlobID := uuid.New().String()
+	key := blobKey(organizationID, newBlobID)
+	if err := store(key); err != nil {
+		return "", "", err
+	}
+
+	// A blob stored at the same time by another request holds the same content, the object stored here goes
+	err = db.QueryRow(
+		context.Background(),
+		`
+			INSERT INTO blobs (id, organization_id, hash, file_path, file_size, ref_count, released_at, encryption_key_id, created_at)
+			VALUES ($1, $2, $3, $4, $5, 0, NOW(), $6, NOW())
+			ON CONFLICT (organization_id, hash) DO UPDATE
+			SET released_at = CASE WHEN blobs.ref_count = 0 THEN NOW() ELSE blobs.released_at END
+			RETURNING id, file_path;
+		`,
+		newBlobID, organizationID, hash, spaces.FilePath(key), size, encryptionKeyID,
+	).Scan(&blobID, &filePath)
+	if err == nil && blobID != newBlobID {
+		if err := deleteStoredObject(spaces.FilePath(key)); err != nil {
+			log.Println("Error deleting duplicate blob from Spaces: ", err)
+		}
+	}
+	return blobID, filePath, err
+}
+
+// sharedBlob returns the blob holding the content of a file when a copy in the given organization can share it,
+// nil when the content hasn't been hashed yet or belongs to another organization
+func sharedBlob(db *pgxpool.Pool, fileID string, organizationID string) (*string, string, error) {
+	var blobID *string
+	var filePath string
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT b.id, b.file_path FROM files f JOIN blobs b ON b.id = f.blob_id WHERE f.id = $1 AND b.organization_id = $2;",
+		fileID, organizationID,
+	).Scan(&blobID, &filePath)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, "", nil
+	}
+	return blobID, filePath, err
+}
+
+// StartContentHasher hashes in the background the content of files that couldn't be hashed on ingest and moves
+// it to the blob of its hash, encrypted with the key of the organization when encryption is configured. Files
+// with content already stored share the blob and their upload is removed. Files saved before hashing existed
+// are queued first. Blobs nothing references anymore are deleted once their grace period is over
+func StartContentHasher(db *pgxpool.Pool) {
+	if spaces.S3Client == nil {
+		log.Println("Spaces is not configured, file contents won't be hashed")
+		return
+	}
+
+	_, err := db.Exec(
+		context.Background(),
+		`
+			INSERT INTO pendinghashes (file_id, file_path, queued_at, next_attempt_at)
+			SELECT id, file_path, NOW(), NOW() FROM files WHERE blob_id IS NULL
+			ON CONFLICT (file_id) DO NOTHING;
+		`,
+	)
+	if err != nil {
+		log.Println("Error queuing files for hashing: ", err)
+	}
+
+	go func() {
+		for {
+			if hashQueuedFiles(db) == 0 {
+				time.Sleep(hashPollInterval)
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			sweepReleasedBlobs(db)
+			time.Sleep(blobSweepInterval)
+		}
+	}()
+}
+
+// queuedHash is a file waiting for its content to be hashed
+type queuedHash struct {
+	FileID, FilePath, OrganizationID string
+}
+
+// hashQueuedFiles hashes a batch of queued files and returns how many it took. Claimed files are put back for
+// a while so a failing file doesn't hold up the queue, failures are retried later and later
+func hashQueuedFiles(db *pgxpool.Pool) int {
+	rows, err := db.Query(
+		context.Background(),
+		`
+			UPDATE pendinghashes ph SET attempts = ph.attempts + 1, next_attempt_at = NOW() + INTERVAL '15 minutes'
+			FROM files f
+			WHERE f.id = ph.file_id AND ph.file_id IN (
+				SELECT file_id FROM pendinghashes WHERE next_attempt_at <= NOW()
+				ORDER BY queued_at LIMIT $1 FOR UPDATE SKIP LOCKED
+			)
+			RETURNING ph.file_id, ph.file_path, f.organization_id;
+		`,
+		hashBatchSize,
+	)
+	if err != nil {
+		log.Println("Error claiming files to hash: ", err)
+		return 0
+	}
+
+	var queued []queuedHash
+	for rows.Next() {
+		var file queuedHash
+		if err := rows.Scan(&file.FileID, &file.FilePath, &file.OrganizationID); err != nil {
+			log.Println("Error scanning row: ", err)
+			break
+		}
+		queued = append(queued, file)
+	}
+	rows.Close()
+
+	for _, file := range queued {
+		if hashErr := hashQueuedFile(db, file); hashErr != nil {
+			log.Printf("Error hashing file %s: %v", file.FileID, hashErr)
+			_, err := db.Exec(
+				context.Background(),
+				`
+					UPDATE pendinghashes SET error = $1, next_attempt_at = NOW() + LEAST(attempts, 24) * INTERVAL '1 hour'
+					WHERE file_id = $2 AND file_path = $3;
+				`,
+				hashErr.Error(), file.FileID, file.FilePath,
+			)
+			if err != nil {
+				log.Printf("Error saving hashing failure of file %s: %v", file.FileID, err)
+			}
+		}
+	}
+
+	return len(queued)
+}
+
+// hashQueuedFile hashes the content of a file and points the file at the blob of its hash, then removes the
+// upload the content was read from
+func hashQueuedFile(db *pgxpool.Pool, file queuedHash) error {
+	blobID, blobPath, err := ingestUpload(db, file.OrganizationID, file.FilePath)
+	if err != nil {
+		return err
+	}
+
+	// Files whose content was replaced meanwhile are queued again with the new content
+	commandTag, err := db.Exec(
+		context.Background(),
+		"UPDATE files SET file_path = $1, blob_id = $2 WHERE id = $3 AND file_path = $4 AND blob_id IS NULL;",
+		blobPath, blobID, file.FileID, file.FilePath,
+	)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		_, err := db.Exec(context.Background(), "DELETE FROM pendinghashes WHERE file_id = $1 AND file_path = $2;", file.FileID, file.FilePath)
+		return err
+	}
+
+	removeUpload(db, file.FilePath, blobPath)
+	return nil
+}
+
+// ingestUpload hashes the content of an upload, or of a blob of another organization, and returns the id and
+// file path of the blob of its hash in the given organization. Content to encrypt is encrypted while it is
+// hashed, other content is copied within Spaces. The object read is left in place
+func ingestUpload(db *pgxpool.Pool, organizationID string, filePath string) (string, string, error) {
+	key, err := activeEncryptionKey(db, organizationID)
+	if err != nil {
+		return "", "", err
+	}
+
+	sourceKeyID, sourceSize, err := storedEncryptionKey(db, filePath)
+	if err != nil {
+		return "", "", err
+	}
+	object, err := openEncryptedObject(db, filePath, sourceKeyID, sourceSize)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Encrypted content can't be copied as it is stored, it is decrypted and stored again
+	if key == nil && sourceKeyID == nil {
+		hash, size, err := hashContent(object.Body)
+		object.Body.Close()
+		if err != nil {
+			return "", "", err
+		}
+
+		return storeBlob(db, organizationID, hash, size, nil, func(key string) error {
+			_, err := spaces.CopyObject(filePath, key)
+			return err
+		})
+	}
+
+	spool, err := spoolContent(object.Body, key)
+	object.Body.Close()
+	if err != nil {
+		return "", "", err
+	}
+	defer spool.Close()
+
+	return storeBlob(db, organizationID, spool.Hash, spool.Size, spool.KeyID, spool.store)
+}
+
+// hashOnIngest hashes a new upload of an organization so its file is saved pointing at the blob of its hash, it
+// returns the blob and the file path to save. Uploads that can't be hashed now keep their path, their file is
+// queued and the hasher tries again later
+func hashOnIngest(db *pgxpool.Pool, organizationID string, filePath string) (*string, string) {
+	if spaces.S3Client == nil || filePath == "" {
+		return nil, filePath
+	}
+
+	blobID, blobPath, err := ingestUpload(db, organizationID, filePath)
+	if err != nil {
+		log.Println("Error hashing upload, leaving it to the hasher: ", err)
+		return nil, filePath
+	}
+	return &blobID, blobPath
+}
+
+// removeUpload deletes an upload once its content is held by the blob at blobPath. Objects of blobs are never
+// removed here, they go when nothing references them anymore
+func removeUpload(db *pgxpool.Pool, filePath string, blobPath string) {
+	if filePath == blobPath {
+		return
+	}
+
+	var isBlob bool
+	if err := db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM blobs WHERE file_path = $1);", filePath).Scan(&isBlob); err != nil {
+		log.Println("Error checking hashed upload: ", err)
+		return
+	}
+	if isBlob {
+		return
+	}
+
+	if err := spaces.DeleteFile(filePath); err != nil {
+		log.Println("Error deleting hashed upload from Spaces: ", err)
+	}
+}
+
+// sweepReleasedBlobs deletes the blobs nothing has referenced for the grace period along with their objects.
+// Objects that couldn't be deleted before are tried again first
+func sweepReleasedBlobs(db *pgxpool.Pool) {
+	deleteQueuedObjects(db)
+
+	cutoff := time.Now().Add(-blobGracePeriod)
+	rows, err := db.Query(
+		context.Background(),
+		"SELECT id FROM blobs WHERE ref_count = 0 AND released_at < $1 ORDER BY released_at LIMIT 100;",
+		cutoff,
+	)
+	if err != nil {
+		log.Println("Error fetching released blobs: ", err)
+		return
+	}
+
+	var blobIDs []string
+	for rows.Next() {
+		var blobID string
+		if err := rows.Scan(&blobID); err != nil {
+			log.Println("Error scanning row: ", err)
+			break
+		}
+		blobIDs = append(blobIDs, blobID)
+	}
+	rows.Close()
+
+	for _, blobID := range blobIDs {
+		if err := deleteReleasedBlob(db, blobID, cutoff); err != nil {
+			log.Printf("Error deleting blob %s: %v", blobID, err)
+		}
+	}
+}
+
+// deleteStoredObject deletes an object from Spaces, tests replace it
+var deleteStoredObject = spaces.DeleteFile
+
+// deleteReleasedBlob deletes a blob along with its thumbnails if nothing has referenced it since before cutoff. A
+// blob stored or found again after the sweep listed it starts a new grace period and stays. Its objects are
+// queued with the deletion of the blob and deleted once it is committed, those that fail stay queued
+func deleteReleasedBlob(db *pgxpool.Pool, blobID string, cutoff time.Time) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	var filePath string
+	err = tx.QueryRow(
+		context.Background(),
+		"SELECT file_path FROM blobs WHERE id = $1 AND ref_count = 0 AND released_at < $2 FOR UPDATE;",
+		blobID, cutoff,
+	).Scan(&filePath)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(context.Background(), "SELECT file_path FROM thumbnails WHERE blob_id = $1;", blobID)
+	if err != nil {
+		return err
+	}
+	objectPaths := []string{filePath}
+	for rows.Next() {
+		var thumbnailPath string
+		if err := rows.Scan(&thumbnailPath); err != nil {
+			rows.Close()
+			return err
+		}
+		objectPaths = append(objectPaths, thumbnailPath)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(context.Background(), "DELETE FROM blobs WHERE id = $1;", blobID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		context.Background(),
+		`
+			INSERT INTO pendingobjectdeletions (file_path, queued_at, next_attempt_at)
+			SELECT UNNEST($1::TEXT[]), NOW(), NOW()
+			ON CONFLICT (file_path) DO NOTHING;
+		`,
+		objectPaths,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return err
+	}
+
+	for _, objectPath := range objectPaths {
+		deleteQueuedObject(db, objectPath)
+	}
+	return nil
+}
+
+// deleteQueuedObjects retries a batch of the queued object deletions that are due
+func deleteQueuedObjects(db *pgxpool.Pool) {
+	rows, err := db.Query(
+		context.Background(),
+		"SELECT file_path FROM pendingobjectdeletions WHERE next_attempt_at <= NOW() ORDER BY queued_at LIMIT $1;",
+		objectDeletionBatchSize,
+	)
+	if err != nil {
+		log.Println("Error fetching queued object deletions: ", err)
+		return
+	}
+
+	var objectPaths []string
+	for rows.Next() {
+		var objectPath string
+		if err := rows.Scan(&objectPath); err != nil {
+			log.Println("Error scanning row: ", err)
+			break
+		}
+		objectPaths = append(objectPaths, objectPath)
+	}
+	rows.Close()
+
+	for _, objectPath := range objectPaths {
+		deleteQueuedObject(db, objectPath)
+	}
+}
+
+// deleteQueuedObject deletes a queued object from Spaces and takes it off the queue. A failed deletion is
+// retried later and later
+func deleteQueuedObject(db *pgxpool.Pool, objectPath string) {
+	if deleteErr := deleteStoredObject(objectPath); deleteErr != nil {
+		log.Printf("Error deleting object %s from Spaces: %v", objectPath, deleteErr)
+		_, err := db.Exec(
+			context.Background(),
+			`
+				UPDATE pendingobjectdeletions
+				SET attempts = attempts + 1, error = $1, next_attempt_at = NOW() + LEAST(attempts + 1, 24) * INTERVAL '1 hour'
+				WHERE file_path = $2;
+			`,
+			deleteErr.Error(), objectPath,
+		)
+		if err != nil {
+			log.Printf("Error saving deletion failure of object %s: %v", objectPath, err)
+		}
+		return
+	}
+
+	if _, err := db.Exec(context.Background(), "DELETE FROM pendingobjectdeletions WHERE file_path = $1;", objectPath); err != nil {
+		log.Printf("Error removing deleted object %s from the queue: %v", objectPath, err)
+	}
+}
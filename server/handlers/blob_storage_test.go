@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// testBlob inserts a blob of an organization nothing references, released at the given time
+func testBlob(t *testing.T, db *pgxpool.Pool, organizationID string, releasedAt time.Time) string {
+	t.Helper()
+
+	blobID := uuid.New().String()
+	hash, _, err := hashContent(strings.NewReader(blobID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(
+		context.Background(),
+		`
+			INSERT INTO blobs (id, organization_id, hash, file_path, file_size, ref_count, released_at)
+			VALUES ($1, $2, $3, $4, 1, 0, $5);
+		`,
+		blobID, organizationID, hash, "blobs/"+blobID, releasedAt,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blobID
+}
+
+// blobReferences returns the reference count of a blob and whether it is released
+func blobReferences(t *testing.T, db *pgxpool.Pool, blobID string) (int, bool) {
+	t.Helper()
+
+	var refCount int
+	var releasedAt *time.Time
+	if err := db.QueryRow(context.Background(), "SELECT ref_count, released_at FROM blobs WHERE id = $1;", blobID).Scan(&refCount, &releasedAt); err != nil {
+		t.Fatal(err)
+	}
+	return refCount, releasedAt != nil
+}
+
+func TestBlobReferenceCounts(t *testing.T) {
+	db := testDB(t)
+
+	creatorID := testUser(t, db, "creator@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+	first := testBlob(t, db, organizationID, time.Now())
+	second := testBlob(t, db, organizationID, time.Now())
+
+	fileID := testNamedFile(t, db, organizationID, nil, "report.pdf", time.Now())
+	versionID := uuid.New().String()
+
+	steps := []struct {
+		name   string
+		query  string
+		args   []interface{}
+		counts map[string]int
+	}{
+		{"file points at a blob", "UPDATE files SET file_path = 'blobs/first', blob_id = $1 WHERE id = $2;", []interface{}{first, fileID}, map[string]int{first: 1, second: 0}},
+		{"version keeps the blob", "INSERT INTO fileversions (id, file_id, file_path, blob_id) VALUES ($1, $2, 'blobs/first', $3);", []interface{}{versionID, fileID, first}, map[string]int{first: 2, second: 0}},
+		{"file moves to another blob", "UPDATE files SET file_path = 'blobs/second', blob_id = $1 WHERE id = $2;", []interface{}{second, fileID}, map[string]int{first: 1, second: 1}},
+		{"renaming keeps the blob", "UPDATE files SET name = 'renamed.pdf' WHERE id = $1;", []interface{}{fileID}, map[string]int{first: 1, second: 1}},
+		{"new upload drops the blob", "UPDATE files SET file_path = 'uploads/new' WHERE id = $1;", []interface{}{fileID}, map[string]int{first: 1, second: 0}},
+		{"version is deleted", "DELETE FROM fileversions WHERE id = $1;", []interface{}{versionID}, map[string]int{first: 0, second: 0}},
+		{"file takes the blob again", "UPDATE files SET file_path = 'blobs/first', blob_id = $1 WHERE id = $2;", []interface{}{first, fileID}, map[string]int{first: 1, second: 0}},
+		{"file is deleted", "DELETE FROM files WHERE id = $1;", []interface{}{fileID}, map[string]int{first: 0, second: 0}},
+	}
+	for _, step := range steps {
+		if _, err := db.Exec(context.Background(), step.query, step.args...); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		for blobID, want := range step.counts {
+			refCount, released := blobReferences(t, db, blobID)
+			if refCount != want || released != (want == 0) {
+				t.Errorf("%s: blob has %d references, released %v, want %d", step.name, refCount, released, want)
+			}
+		}
+	}
+}
+
+func TestSweepReleasedBlobs(t *testing.T) {
+	db := testDB(t)
+
+	var deleted []string
+	deleteObject := deleteStoredObject
+	deleteStoredObject = func(filePath string) error {
+		deleted = append(deleted, filePath)
+		return nil
+	}
+	t.Cleanup(func() { deleteStoredObject = deleteObject })
+
+	creatorID := testUser(t, db, "creator@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+	expired := testBlob(t, db, organizationID, time.Now().Add(-2*blobGracePeriod))
+	recent := testBlob(t, db, organizationID, time.Now())
+	referenced := testBlob(t, db, organizationID, time.Now().Add(-2*blobGracePeriod))
+
+	fileID := testNamedFile(t, db, organizationID, nil, "report.pdf", time.Now())
+	if _, err := db.Exec(context.Background(), "UPDATE files SET file_path = 'blobs/referenced', blob_id = $1 WHERE id = $2;", referenced, fileID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(context.Background(), "INSERT INTO thumbnails (blob_id, size, file_path, file_size, width, height) VALUES ($1, 'small', $2, 1, 1, 1);", expired, "thumbnails/"+expired); err != nil {
+		t.Fatal(err)
+	}
+
+	sweepReleasedBlobs(db)
+
+	for blobID, want := range map[string]bool{expired: false, recent: true, referenced: true} {
+		var exists bool
+		if err := db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM blobs WHERE id = $1);", blobID).Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if exists != want {
+			t.Errorf("blob %s exists %v after the sweep, want %v", blobID, exists, want)
+		}
+	}
+	sort.Strings(deleted)
+	if len(deleted) != 2 || deleted[0] != "blobs/"+expired || deleted[1] != "thumbnails/"+expired {
+		t.Errorf("sweep deleted objects %v, want the blob and thumbnail of %s", deleted, expired)
+	}
+
+	// A blob found again after the sweep listed it starts a new grace period and stays
+	found := testBlob(t, db, organizationID, time.Now().Add(-2*blobGracePeriod))
+	cutoff := time.Now().Add(-blobGracePeriod)
+	if _, err := db.Exec(context.Background(), "UPDATE blobs SET released_at = NOW() WHERE id = $1;", found); err != nil {
+		t.Fatal(err)
+	}
+	deleted = nil
+	if err := deleteReleasedBlob(db, found, cutoff); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("blob found again had its objects %v deleted", deleted)
+	}
+
+	// A blob whose object can't be deleted goes, its object stays queued until a later sweep deletes it
+	deleteStoredObject = func(filePath string) error {
+		return errors.New("unavailable")
+	}
+	failing := testBlob(t, db, organizationID, time.Now().Add(-2*blobGracePeriod))
+	if err := deleteReleasedBlob(db, failing, cutoff); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(context.Background(), "SELECT id FROM blobs WHERE id = $1;", failing).Scan(new(string)); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("blob whose object can't be deleted wasn't deleted: %v", err)
+	}
+	var attempts int
+	if err := db.QueryRow(context.Background(), "SELECT attempts FROM pendingobjectdeletions WHERE file_path = $1;", "blobs/"+failing).Scan(&attempts); err != nil {
+		t.Fatalf("object that couldn't be deleted isn't queued: %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("queued object has %d attempts, want 1", attempts)
+	}
+
+	deleted = nil
+	deleteStoredObject = func(filePath string) error {
+		deleted = append(deleted, filePath)
+		return nil
+	}
+	if _, err := db.Exec(context.Background(), "UPDATE pendingobjectdeletions SET next_attempt_at = NOW() WHERE file_path = $1;", "blobs/"+failing); err != nil {
+		t.Fatal(err)
+	}
+	sweepReleasedBlobs(db)
+	if len(deleted) != 1 || deleted[0] != "blobs/"+failing {
+		t.Errorf("sweep deleted objects %v, want the queued object of %s", deleted, failing)
+	}
+	var queued bool
+	if err := db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM pendingobjectdeletions WHERE file_path = $1);", "blobs/"+failing).Scan(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued {
+		t.Error("deleted object is still queued")
+	}
+}
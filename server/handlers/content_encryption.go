@@ -0,0 +1,695 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"server/encryption"
+	"server/spaces"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	// keyRewrapInterval is how often data keys wrapped by a master key other than the current one are looked for
+	keyRewrapInterval = time.Hour
+	// keyRewrapBatchSize is how many data keys are wrapped again at once
+	keyRewrapBatchSize = 100
+	// blobEncryptBatchSize is how many queued blobs stored unencrypted the encrypter claims at once
+	blobEncryptBatchSize = 10
+	// blobEncryptPollInterval is how long the encrypter waits when no blob is queued
+	blobEncryptPollInterval = time.Minute
+)
+
+// dataKeys holds the data keys already unwrapped by their id, wrapping a key again doesn't change it
+var dataKeys sync.Map
+
+// encryptionKey is an unwrapped data key of an organization
+type encryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+// errEncryptionNotConfigured is returned when content is stored encrypted but no master keys are configured to
+// unwrap its data key
+var errEncryptionNotConfigured = errors.New("file contents are encrypted but no storage master keys are configured")
+
+// dataKey returns the unwrapped data key with the given id
+func dataKey(db *pgxpool.Pool, keyID string) ([]byte, error) {
+	if key, ok := dataKeys.Load(keyID); ok {
+		return key.([]byte), nil
+	}
+	if encryption.Manager == nil {
+		return nil, errEncryptionNotConfigured
+	}
+
+	var wrappedKey []byte
+	var masterKeyID string
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT wrapped_key, master_key_id FROM encryptionkeys WHERE id = $1;",
+		keyID,
+	).Scan(&wrappedKey, &masterKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := encryption.Manager.Unwrap(masterKeyID, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKeys.Store(keyID, key)
+	return key, nil
+}
+
+// addEncryptionKey adds a new data key to an organization wrapped by the current master key and makes it the
+// active key, the key it replaces is kept for the content encrypted with it
+func addEncryptionKey(tx pgx.Tx, organizationID string) (string, error) {
+	key, err := encryption.GenerateDataKey()
+	if err != nil {
+		return "", err
+	}
+	wrappedKey, err := encryption.Manager.Wrap(key)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(context.Background(), "UPDATE encryptionkeys SET active = false WHERE organization_id = $1 AND active;", organizationID)
+	if err != nil {
+		return "", err
+	}
+
+	keyID := uuid.New().String()
+	_, err = tx.Exec(
+		context.Background(),
+		`
+			INSERT INTO encryptionkeys (id, organization_id, version, wrapped_key, master_key_id, active, created_at, wrapped_at)
+			SELECT $1, $2, COALESCE(MAX(version), 0) + 1, $3, $4, true, NOW(), NOW()
+			FROM encryptionkeys WHERE organization_id = $2;
+		`,
+		keyID, organizationID, wrappedKey, encryption.Manager.KeyID(),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	dataKeys.Store(keyID, key)
+	return keyID, nil
+}
+
+// lockOrganizationKeys locks the organization in a transaction so its data keys are only added one at a time
+func lockOrganizationKeys(tx pgx.Tx, organizationID string) error {
+	var locked string
+	return tx.QueryRow(
+		context.Background(),
+		"SELECT organization_id FROM organizations WHERE organization_id = $1 FOR UPDATE;",
+		organizationID,
+	).Scan(&locked)
+}
+
+// activeEncryptionKey returns the data key new content of an organization is encrypted with, the first key of
+// the organization is added when it has none. It returns nil when encryption isn't configured
+func activeEncryptionKey(db *pgxpool.Pool, organizationID string) (*encryptionKey, error) {
+	if encryption.Manager == nil {
+		return nil, nil
+	}
+
+	var keyID string
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT id FROM encryptionkeys WHERE organization_id = $1 AND active;",
+		organizationID,
+	).Scan(&keyID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		keyID, err = addFirstEncryptionKey(db, organizationID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := dataKey(db, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptionKey{ID: keyID, Key: key}, nil
+}
+
+// addFirstEncryptionKey adds the first data key of an organization, unless another request added it meanwhile
+func addFirstEncryptionKey(db *pgxpool.Pool, organizationID string) (string, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := lockOrganizationKeys(tx, organizationID); err != nil {
+		return "", err
+	}
+
+	var keyID string
+	err = tx.QueryRow(
+		context.Background(),
+		"SELECT id FROM encryptionkeys WHERE organization_id = $1 AND active;",
+		organizationID,
+	).Scan(&keyID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		keyID, err = addEncryptionKey(tx, organizationID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return keyID, tx.Commit(context.Background())
+}
+
+// storedEncryptionKey returns the data key an object is encrypted with and the size of its content, a nil key
+// for objects stored unencrypted
+func storedEncryptionKey(db *pgxpool.Pool, filePath string) (*string, int64, error) {
+	var keyID *string
+	var size int64
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT encryption_key_id, file_size FROM blobs WHERE file_path = $1;",
+		filePath,
+	).Scan(&keyID, &size)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, 0, nil
+	}
+	return keyID, size, err
+}
+
+// decryptedBody is the body of an encrypted object, read decrypted
+type decryptedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// openStoredFile opens an object for reading like spaces.GetFile, encrypted objects are decrypted while they are
+// read and their ContentLength is the size of the decrypted content. The caller must close its Body
+func openStoredFile(db *pgxpool.Pool, filePath string) (*s3.GetObjectOutput, error) {
+	keyID, size, err := storedEncryptionKey(db, filePath)
+	if err != nil {
+		return nil, err
+	}
+	return openEncryptedObject(db, filePath, keyID, size)
+}
+
+// openEncryptedObject opens an object encrypted with the data key keyID identifies, of content size bytes, like
+// openStoredFile. Objects with a nil key are read as they are stored
+func openEncryptedObject(db *pgxpool.Pool, filePath string, keyID *string, size int64) (*s3.GetObjectOutput, error) {
+	var key []byte
+	var err error
+	if keyID != nil {
+		if key, err = dataKey(db, *keyID); err != nil {
+			return nil, err
+		}
+	}
+
+	object, err := spaces.GetFile(filePath)
+	if err != nil || keyID == nil {
+		return object, err
+	}
+
+	reader, err := encryption.NewReader(object.Body, key)
+	if err != nil {
+		object.Body.Close()
+		return nil, err
+	}
+	object.Body = decryptedBody{Reader: reader, Closer: object.Body}
+	object.ContentLength = &size
+	object.ContentType = nil
+	return object, nil
+}
+
+// sendStoredFile responds with an object opened by openStoredFile, the browser shows it inline or saves it as
+// fileName depending on the disposition
+func sendStoredFile(c *fiber.Ctx, object *s3.GetObjectOutput, fileName string, disposition string) error {
+	contentType := ""
+	if object.ContentType != nil {
+		contentType = *object.ContentType
+		c.Set(fiber.HeaderContentType, contentType)
+	}
+	// The content type is whatever the uploader sent, so only types browsers can't run scripts from are shown
+	if disposition == "inline" && !inlineContentType(contentType) {
+		disposition = "attachment"
+	}
+	c.Set(fiber.HeaderContentDisposition, disposition+"; filename="+strconv.Quote(fileName))
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderContentSecurityPolicy, "sandbox")
+	size := -1
+	if object.ContentLength != nil {
+		size = int(*object.ContentLength)
+	}
+	return c.SendStream(object.Body, size)
+}
+
+// inlineContentTypes are the content types served inline, others are always downloaded
+var inlineContentTypes = map[string]bool{
+	"application/pdf": true,
+	"audio/mpeg":      true,
+	"audio/ogg":       true,
+	"audio/wav":       true,
+	"image/gif":       true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/webp":      true,
+	"text/plain":      true,
+	"video/mp4":       true,
+	"video/webm":      true,
+}
+
+// inlineContentType reports whether content of a content type can be shown in the browser
+func inlineContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && inlineContentTypes[mediaType]
+}
+
+// putEncryptedObject stores content as the object with the given key, encrypted with the data key keyID
+// identifies unless it is nil, and returns its file path
+func putEncryptedObject(db *pgxpool.Pool, content []byte, keyID *string, key string) (string, error) {
+	if keyID == nil {
+		return spaces.PutObject(bytes.NewReader(content), int64(len(content)), key)
+	}
+
+	contentKey, err := dataKey(db, *keyID)
+	if err != nil {
+		return "", err
+	}
+
+	var sealed bytes.Buffer
+	writer, err := encryption.NewWriter(&sealed, contentKey)
+	if err != nil {
+		return "", err
+	}
+	if _, err := writer.Write(content); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return spaces.PutObject(bytes.NewReader(sealed.Bytes()), int64(sealed.Len()), key)
+}
+
+// spooledContent is content copied to a temporary file on its way to storage, encrypted when it has a key
+type spooledContent struct {
+	File *os.File
+	// Hash is the hex SHA-256 of the content before it was encrypted and Size its size
+	Hash string
+	Size int64
+	// KeyID is the data key the file is encrypted with, nil when it isn't
+	KeyID *string
+}
+
+// spoolContent copies content to a temporary file while hashing it, encrypted with the given data key unless
+// it is nil. Objects are uploaded from a file since uploads need content that can be read again. The caller
+// must Close the spooled content
+func spoolContent(content io.Reader, key *encryptionKey) (*spooledContent, error) {
+	file, err := os.CreateTemp("", "spooled-content-*")
+	if err != nil {
+		return nil, err
+	}
+	spool := &spooledContent{File: file}
+
+	var writer io.Writer = file
+	var encrypter *encryption.Writer
+	if key != nil {
+		if encrypter, err = encryption.NewWriter(file, key.Key); err != nil {
+			spool.Close()
+			return nil, err
+		}
+		writer = encrypter
+		spool.KeyID = &key.ID
+	}
+
+	hash := sha256.New()
+	spool.Size, err = io.Copy(io.MultiWriter(writer, hash), content)
+	if err == nil && encrypter != nil {
+		err = encrypter.Close()
+	}
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+
+	spool.Hash = hex.EncodeToString(hash.Sum(nil))
+	return spool, nil
+}
+
+// store uploads the spooled content as the object with the given key
+func (spool *spooledContent) store(key string) error {
+	size, err := spool.File.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := spool.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err = spaces.PutObject(spool.File, size, key)
+	return err
+}
+
+// Close removes the temporary file
+func (spool *spooledContent) Close() {
+	spool.File.Close()
+	os.Remove(spool.File.Name())
+}
+
+// StartKeyRewrapper wraps the data keys of organizations with the current master key in the background, so
+// master keys can be rotated by configuring a new one first and removing the old one once nothing uses it
+func StartKeyRewrapper(db *pgxpool.Pool) {
+	if encryption.Manager == nil {
+		return
+	}
+
+	go func() {
+		for {
+			if rewrapEncryptionKeys(db) < keyRewrapBatchSize {
+				time.Sleep(keyRewrapInterval)
+			}
+		}
+	}()
+}
+
+// saveRewrappedKey stores a data key wrapped by another master key along with its audit entry, keys wrapped again
+// meanwhile are left as they are
+func saveRewrappedKey(db *pgxpool.Pool, keyID string, organizationID string, oldMasterKeyID string, masterKeyID string, wrapped []byte) (bool, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(context.Background())
+
+	commandTag, err := tx.Exec(
+		context.Background(),
+		`
+			UPDATE encryptionkeys SET wrapped_key = $1, master_key_id = $2, wrapped_at = NOW(), rewrap_error = NULL, rewrap_attempted_at = NULL
+			WHERE id = $3 AND master_key_id = $4;
+		`,
+		wrapped, masterKeyID, keyID, oldMasterKeyID,
+	)
+	if err != nil || commandTag.RowsAffected() == 0 {
+		return false, err
+	}
+
+	err = recordSystemAuditTx(tx, auditEvent{
+		OrganizationID: organizationID,
+		Action:         "encryption.key_rewrap",
+		TargetType:     "encryption_key",
+		TargetID:       keyID,
+		Before:         fiber.Map{"master_key_id": oldMasterKeyID},
+		After:          fiber.Map{"master_key_id": masterKeyID},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(context.Background())
+}
+
+// wrappedKey is a data key wrapped by an old master key
+type wrappedKey struct {
+	ID, OrganizationID, MasterKeyID string
+	Key                             []byte
+}
+
+// rewrapEncryptionKeys wraps a batch of data keys wrapped by an old master key with the current one and returns
+// how many it took. Keys that can't be wrapped again, such as keys whose master key isn't configured anymore,
+// are marked with the error and passed over for keyRewrapInterval so they don't hold up the keys behind them
+func rewrapEncryptionKeys(db *pgxpool.Pool) int {
+	masterKeyID := encryption.Manager.KeyID()
+	rows, err := db.Query(
+		context.Background(),
+		`
+			SELECT id, organization_id, wrapped_key, master_key_id FROM encryptionkeys
+			WHERE master_key_id <> $1 AND (rewrap_attempted_at IS NULL OR rewrap_attempted_at < $2)
+			ORDER BY wrapped_at LIMIT $3;
+		`,
+		masterKeyID, time.Now().Add(-keyRewrapInterval), keyRewrapBatchSize,
+	)
+	if err != nil {
+		log.Println("Error fetching keys to wrap again: ", err)
+		return 0
+	}
+
+	var keys []wrappedKey
+	for rows.Next() {
+		var key wrappedKey
+		if err := rows.Scan(&key.ID, &key.OrganizationID, &key.Key, &key.MasterKeyID); err != nil {
+			log.Println("Error scanning row: ", err)
+			break
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+
+	for _, key := range keys {
+		if rewrapErr := rewrapEncryptionKey(db, key, masterKeyID); rewrapErr != nil {
+			log.Printf("Error wrapping key %s again: %v", key.ID, rewrapErr)
+			_, err := db.Exec(
+				context.Background(),
+				"UPDATE encryptionkeys SET rewrap_error = $1, rewrap_attempted_at = NOW() WHERE id = $2;",
+				rewrapErr.Error(), key.ID,
+			)
+			if err != nil {
+				log.Printf("Error saving wrapping failure of key %s: %v", key.ID, err)
+			}
+		}
+	}
+
+	return len(keys)
+}
+
+// rewrapEncryptionKey wraps a data key with the current master key
+func rewrapEncryptionKey(db *pgxpool.Pool, key wrappedKey, masterKeyID string) error {
+	dataKey, err := encryption.Manager.Unwrap(key.MasterKeyID, key.Key)
+	if err != nil {
+		return err
+	}
+	wrapped, err := encryption.Manager.Wrap(dataKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = saveRewrappedKey(db, key.ID, key.OrganizationID, key.MasterKeyID, masterKeyID, wrapped)
+	return err
+}
+
+// StartBlobEncrypter encrypts in the background the blobs stored before encryption was configured, with the key
+// of their organization. Each blob is moved to an object of its own and the unencrypted one is deleted
+func StartBlobEncrypter(db *pgxpool.Pool) {
+	if encryption.Manager == nil || spaces.S3Client == nil {
+		return
+	}
+
+	_, err := db.Exec(
+		context.Background(),
+		`
+			INSERT INTO pendingencryptions (blob_id, queued_at, next_attempt_at)
+			SELECT id, NOW(), NOW() FROM blobs WHERE encryption_key_id IS NULL
+			ON CONFLICT (blob_id) DO NOTHING;
+		`,
+	)
+	if err != nil {
+		log.Println("Error queuing blobs for encryption: ", err)
+	}
+
+	go func() {
+		for {
+			if encryptQueuedBlobs(db) == 0 {
+				time.Sleep(blobEncryptPollInterval)
+			}
+		}
+	}()
+}
+
+// encryptQueuedBlobs encrypts a batch of queued blobs and returns how many it took. Claimed blobs are put back
+// for a while so a failing blob doesn't hold up the queue, failures are retried later and later
+func encryptQueuedBlobs(db *pgxpool.Pool) int {
+	rows, err := db.Query(
+		context.Background(),
+		`
+			UPDATE pendingencryptions SET attempts = attempts + 1, next_attempt_at = NOW() + INTERVAL '15 minutes'
+			WHERE blob_id IN (
+				SELECT blob_id FROM pendingencryptions WHERE next_attempt_at <= NOW()
+				ORDER BY queued_at LIMIT $1 FOR UPDATE SKIP LOCKED
+			)
+			RETURNING blob_id;
+		`,
+		blobEncryptBatchSize,
+	)
+	if err != nil {
+		log.Println("Error claiming blobs to encrypt: ", err)
+		return 0
+	}
+
+	var blobIDs []string
+	for rows.Next() {
+		var blobID string
+		if err := rows.Scan(&blobID); err != nil {
+			log.Println("Error scanning row: ", err)
+			break
+		}
+		blobIDs = append(blobIDs, blobID)
+	}
+	rows.Close()
+
+	for _, blobID := range blobIDs {
+		if encryptErr := encryptQueuedBlob(db, blobID); encryptErr != nil {
+			log.Printf("Error encrypting blob %s: %v", blobID, encryptErr)
+			_, err := db.Exec(
+				context.Background(),
+				`
+					UPDATE pendingencryptions SET error = $1, next_attempt_at = NOW() + LEAST(attempts, 24) * INTERVAL '1 hour'
+					WHERE blob_id = $2;
+				`,
+				encryptErr.Error(), blobID,
+			)
+			if err != nil {
+				log.Printf("Error saving encryption failure of blob %s: %v", blobID, err)
+			}
+		}
+	}
+
+	return len(blobIDs)
+}
+
+// encryptQueuedBlob encrypts a blob stored unencrypted to an object of its own, then points the blob and the files
+// and versions holding its content at it. Its thumbnails are deleted and generated again encrypted
+func encryptQueuedBlob(db *pgxpool.Pool, blobID string) error {
+	var organizationID, hash, filePath string
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT organization_id, hash, file_path FROM blobs WHERE id = $1 AND encryption_key_id IS NULL;",
+		blobID,
+	).Scan(&organizationID, &hash, &filePath)
+	if errors.Is(err, pgx.ErrNoRows) {
+		_, err := db.Exec(context.Background(), "DELETE FROM pendingencryptions WHERE blob_id = $1;", blobID)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	key, err := activeEncryptionKey(db, organizationID)
+	if err != nil {
+		return err
+	}
+
+	object, err := spaces.GetFile(filePath)
+	if err != nil {
+		return err
+	}
+	spool, err := spoolContent(object.Body, key)
+	object.Body.Close()
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+	if spool.Hash != hash {
+		return errors.New("stored content doesn't match its hash")
+	}
+
+	encryptedKey := blobKey(organizationID, blobID) + "." + key.ID
+	if err := spool.store(encryptedKey); err != nil {
+		return err
+	}
+	encryptedPath := spaces.FilePath(encryptedKey)
+
+	moved, err := moveEncryptedBlob(db, blobID, filePath, encryptedPath, key.ID)
+	if err != nil || !moved {
+		if err := spaces.DeleteFile(encryptedPath); err != nil {
+			log.Println("Error deleting encrypted copy from Spaces: ", err)
+		}
+		return err
+	}
+
+	if err := spaces.DeleteFile(filePath); err != nil {
+		log.Println("Error deleting unencrypted blob from Spaces: ", err)
+	}
+	return nil
+}
+
+// moveEncryptedBlob points a blob and the files and versions holding its content at the encrypted copy of its
+// object. It reports false when the blob was moved or deleted meanwhile
+func moveEncryptedBlob(db *pgxpool.Pool, blobID string, filePath string, encryptedPath string, keyID string) (bool, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(context.Background())
+
+	commandTag, err := tx.Exec(
+		context.Background(),
+		"UPDATE blobs SET file_path = $1, encryption_key_id = $2 WHERE id = $3 AND file_path = $4 AND encryption_key_id IS NULL;",
+		encryptedPath, keyID, blobID, filePath,
+	)
+	if err != nil {
+		return false, err
+	}
+	if commandTag.RowsAffected() == 0 {
+		_, err := tx.Exec(context.Background(), "DELETE FROM pendingencryptions WHERE blob_id = $1;", blobID)
+		if err != nil {
+			return false, err
+		}
+		return false, tx.Commit(context.Background())
+	}
+
+	for _, query := range []string{
+		"UPDATE files SET file_path = $1 WHERE blob_id = $2;",
+		"UPDATE fileversions SET file_path = $1 WHERE blob_id = $2;",
+	} {
+		if _, err := tx.Exec(context.Background(), query, encryptedPath, blobID); err != nil {
+			return false, err
+		}
+	}
+
+	rows, err := tx.Query(context.Background(), "DELETE FROM thumbnails WHERE blob_id = $1 RETURNING file_path;", blobID)
+	if err != nil {
+		return false, err
+	}
+	var thumbnailPaths []string
+	for rows.Next() {
+		var thumbnailPath string
+		if err := rows.Scan(&thumbnailPath); err != nil {
+			rows.Close()
+			return false, err
+		}
+		thumbnailPaths = append(thumbnailPaths, thumbnailPath)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(context.Background(), "UPDATE previews SET status = 'pending', queued_at = NOW() WHERE blob_id = $1;", blobID)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(context.Background(), "DELETE FROM pendingencryptions WHERE blob_id = $1;", blobID); err != nil {
+		return false, err
+	}
+
+	// Thumbnails are deleted while their preview is locked so the ones generated again aren't
+	for _, thumbnailPath := range thumbnailPaths {
+		if err := deleteStoredObject(thumbnailPath); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit(context.Background())
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"server/encryption"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// testMasterKey returns a new master key listed as <id>:<base64 key>
+func testMasterKey(keyID string) string {
+	key := make([]byte, encryption.KeySize)
+	rand.Read(key)
+	return keyID + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+// testKeyManager sets encryption.Manager to the given master keys until the test ends
+func testKeyManager(t *testing.T, masterKeys ...string) {
+	t.Helper()
+
+	manager, err := encryption.NewConfigKeyManager(strings.Join(masterKeys, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := encryption.Manager
+	encryption.Manager = manager
+	t.Cleanup(func() { encryption.Manager = previous })
+}
+
+// testEncryptionKey inserts a new data key of an organization wrapped by the current master key, or stored as
+// if wrapped by masterKeyID when it is another key, and returns its id
+func testEncryptionKey(t *testing.T, db *pgxpool.Pool, organizationID string, version int, masterKeyID string, wrappedAt time.Time) string {
+	t.Helper()
+
+	wrapped := []byte("wrapped by a master key that isn't configured")
+	if masterKeyID == encryption.Manager.KeyID() {
+		key, err := encryption.GenerateDataKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wrapped, err = encryption.Manager.Wrap(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keyID := uuid.New().String()
+	_, err := db.Exec(
+		context.Background(),
+		`
+			INSERT INTO encryptionkeys (id, organization_id, version, wrapped_key, master_key_id, active, wrapped_at)
+			VALUES ($1, $2, $3, $4, $5, false, $6);
+		`,
+		keyID, organizationID, version, wrapped, masterKeyID, wrappedAt,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyID
+}
+
+func TestRewrapEncryptionKeysPassesFailures(t *testing.T) {
+	db := testDB(t)
+
+	// The key behind the failures is wrapped by "old" before "new" takes over
+	oldKey := testMasterKey("old")
+	testKeyManager(t, oldKey)
+	creatorID := testUser(t, db, "creator@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+
+	// A full batch of keys whose master key is gone comes before the key that can be wrapped again
+	for i := 1; i <= keyRewrapBatchSize; i++ {
+		testEncryptionKey(t, db, organizationID, i, "gone", time.Now().Add(-2*time.Hour))
+	}
+	rotated := testEncryptionKey(t, db, organizationID, keyRewrapBatchSize+1, "old", time.Now().Add(-time.Hour))
+
+	testKeyManager(t, testMasterKey("new"), oldKey)
+
+	if taken := rewrapEncryptionKeys(db); taken != keyRewrapBatchSize {
+		t.Fatalf("first pass took %d keys, want %d", taken, keyRewrapBatchSize)
+	}
+	if taken := rewrapEncryptionKeys(db); taken != 1 {
+		t.Fatalf("second pass took %d keys, want the key behind the failures", taken)
+	}
+	if taken := rewrapEncryptionKeys(db); taken != 0 {
+		t.Errorf("third pass took %d keys, want failures left until they are due again", taken)
+	}
+
+	var masterKeyID string
+	var rewrapError *string
+	if err := db.QueryRow(context.Background(), "SELECT master_key_id, rewrap_error FROM encryptionkeys WHERE id = $1;", rotated).Scan(&masterKeyID, &rewrapError); err != nil {
+		t.Fatal(err)
+	}
+	if masterKeyID != "new" || rewrapError != nil {
+		t.Errorf("key behind the failures is wrapped by %s with error %v, want new", masterKeyID, rewrapError)
+	}
+
+	var failed int
+	if err := db.QueryRow(context.Background(), "SELECT COUNT(*) FROM encryptionkeys WHERE master_key_id = 'gone' AND rewrap_error IS NOT NULL;").Scan(&failed); err != nil {
+		t.Fatal(err)
+	}
+	if failed != keyRewrapBatchSize {
+		t.Errorf("%d failed keys are marked, want %d", failed, keyRewrapBatchSize)
+	}
+}
+
+func TestMoveEncryptedBlob(t *testing.T) {
+	db := testDB(t)
+
+	var deleted []string
+	deleteObject := deleteStoredObject
+	deleteStoredObject = func(filePath string) error {
+		deleted = append(deleted, filePath)
+		return nil
+	}
+	t.Cleanup(func() { deleteStoredObject = deleteObject })
+
+	testKeyManager(t, testMasterKey("current"))
+	creatorID := testUser(t, db, "creator@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+	keyID := testEncryptionKey(t, db, organizationID, 1, "current", time.Now())
+	blobID := testBlob(t, db, organizationID, time.Now())
+
+	fileID := testNamedFile(t, db, organizationID, nil, "report.pdf", time.Now())
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"UPDATE files SET file_path = $1, blob_id = $2 WHERE id = $3;", []interface{}{"blobs/" + blobID, blobID, fileID}},
+		{"INSERT INTO fileversions (id, file_id, file_path, blob_id) VALUES ($1, $2, $3, $4);", []interface{}{uuid.New().String(), fileID, "blobs/" + blobID, blobID}},
+		{"INSERT INTO thumbnails (blob_id, size, file_path, file_size, width, height) VALUES ($1, 'small', 'thumbnails/small', 1, 1, 1);", []interface{}{blobID}},
+		{"UPDATE previews SET status = 'ready' WHERE blob_id = $1;", []interface{}{blobID}},
+		{"INSERT INTO pendingencryptions (blob_id) VALUES ($1);", []interface{}{blobID}},
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(context.Background(), statement.query, statement.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A blob moved meanwhile is left alone
+	moved, err := moveEncryptedBlob(db, blobID, "blobs/elsewhere", "blobs/encrypted", keyID)
+	if err != nil || moved {
+		t.Fatalf("moving a blob from another path: %v, %v", moved, err)
+	}
+	if _, err := db.Exec(context.Background(), "INSERT INTO pendingencryptions (blob_id) VALUES ($1);", blobID); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err = moveEncryptedBlob(db, blobID, "blobs/"+blobID, "blobs/encrypted", keyID)
+	if err != nil || !moved {
+		t.Fatalf("moving the blob: %v, %v", moved, err)
+	}
+
+	var filePath, status string
+	var fileBlobID, blobKeyID *string
+	var versions, thumbnails, pending int
+	err = db.QueryRow(
+		context.Background(),
+		`
+			SELECT f.file_path, f.blob_id, b.encryption_key_id, p.status,
+				(SELECT COUNT(*) FROM fileversions WHERE blob_id = b.id AND file_path = b.file_path),
+				(SELECT COUNT(*) FROM thumbnails WHERE blob_id = b.id),
+				(SELECT COUNT(*) FROM pendingencryptions WHERE blob_id = b.id)
+			FROM files f JOIN blobs b ON b.id = $2 JOIN previews p ON p.blob_id = b.id
+			WHERE f.id = $1;
+		`,
+		fileID, blobID,
+	).Scan(&filePath, &fileBlobID, &blobKeyID, &status, &versions, &thumbnails, &pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filePath != "blobs/encrypted" || fileBlobID == nil || *fileBlobID != blobID {
+		t.Errorf("file points at %s, blob %v, want the moved blob", filePath, fileBlobID)
+	}
+	if blobKeyID == nil || *blobKeyID != keyID || versions != 1 {
+		t.Errorf("blob has key %v and %d versions at its path, want %s and 1", blobKeyID, versions, keyID)
+	}
+	if thumbnails != 0 || status != "pending" || pending != 0 {
+		t.Errorf("%d thumbnails left, preview %s, %d queued, want thumbnails generated again", thumbnails, status, pending)
+	}
+	if refCount, _ := blobReferences(t, db, blobID); refCount != 2 {
+		t.Errorf("blob has %d references, want 2", refCount)
+	}
+	if len(deleted) != 1 || deleted[0] != "thumbnails/small" {
+		t.Errorf("deleted objects %v, want the thumbnail", deleted)
+	}
+}
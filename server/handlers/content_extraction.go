@@ -0,0 +1,412 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	// contentMaxText is the most text kept from a single file for search
+	contentMaxText = 512 << 10
+	// contentMaxInflated is the most bytes a single compressed part or stream of a file may inflate to
+	contentMaxInflated = 16 << 20
+	// contentMaxInflatedTotal is the most bytes inflated from all the parts or streams of a file together
+	contentMaxInflatedTotal = 64 << 20
+)
+
+// contentExtractor returns the function extracting the text of a file from its content, or nil when the format
+// of the file isn't supported for search
+func contentExtractor(name string) func(data []byte) (string, error) {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".txt", ".text", ".md", ".markdown", ".csv", ".tsv", ".log", ".json", ".yaml", ".yml":
+		return extractPlainText
+	case ".pdf":
+		return extractPDFText
+	case ".docx":
+		return officeExtractor("word/document.xml")
+	case ".pptx":
+		return officeExtractor("ppt/slides/slide")
+	case ".xlsx":
+		return officeExtractor("xl/sharedStrings.xml")
+	case ".odt", ".ods", ".odp":
+		return officeExtractor("content.xml")
+	}
+	return nil
+}
+
+// limitText cuts text to the size kept for search without splitting a character
+func limitText(text string) string {
+	if len(text) <= contentMaxText {
+		return text
+	}
+	return strings.ToValidUTF8(text[:contentMaxText], "")
+}
+
+// textBuilder collects extracted text, it starts lines only once and stops taking text once full
+type textBuilder struct {
+	strings.Builder
+}
+
+func (text *textBuilder) full() bool {
+	return text.Len() >= contentMaxText
+}
+
+func (text *textBuilder) newLine() {
+	if text.Len() > 0 && !strings.HasSuffix(text.String(), "\n") {
+		text.WriteByte('\n')
+	}
+}
+
+func extractPlainText(data []byte) (string, error) {
+	if bytes.IndexByte(data, 0) >= 0 {
+		return "", errors.New("file is not text")
+	}
+	return limitText(strings.ToValidUTF8(string(data), "")), nil
+}
+
+// officeExtractor extracts the text of Office Open XML and OpenDocument files, which are ZIP archives holding
+// XML parts. Parts whose name starts with part are read in order
+func officeExtractor(part string) func(data []byte) (string, error) {
+	return func(data []byte) (string, error) {
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return "", err
+		}
+
+		var parts []*zip.File
+		for _, file := range reader.File {
+			if strings.HasPrefix(file.Name, part) && strings.HasSuffix(file.Name, ".xml") {
+				parts = append(parts, file)
+			}
+		}
+		// Slides are numbered without padding, slide10 comes after slide9
+		sort.SliceStable(parts, func(i, j int) bool {
+			if len(parts[i].Name) != len(parts[j].Name) {
+				return len(parts[i].Name) < len(parts[j].Name)
+			}
+			return parts[i].Name < parts[j].Name
+		})
+
+		var text textBuilder
+		var inflated uint64
+		for _, file := range parts {
+			if text.full() {
+				break
+			}
+			// The reader fails on parts inflating past their declared size, so checking that size caps them
+			if file.UncompressedSize64 > contentMaxInflated {
+				return "", fmt.Errorf("document part %s inflates to more than %d MB", file.Name, contentMaxInflated>>20)
+			}
+			if inflated += file.UncompressedSize64; inflated > contentMaxInflatedTotal {
+				return "", fmt.Errorf("document parts inflate to more than %d MB", contentMaxInflatedTotal>>20)
+			}
+
+			body, err := file.Open()
+			if err != nil {
+				return "", err
+			}
+			err = xmlText(body, &text)
+			body.Close()
+			if err != nil {
+				return "", err
+			}
+			text.newLine()
+		}
+
+		return limitText(strings.TrimSpace(text.String())), nil
+	}
+}
+
+// xmlText collects the character data of an Office document part, paragraphs, rows and shared strings end lines
+func xmlText(body io.Reader, text *textBuilder) error {
+	decoder := xml.NewDecoder(body)
+	decoder.Strict = false
+
+	for !text.full() {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch element := token.(type) {
+		case xml.CharData:
+			text.Write(element)
+		case xml.StartElement:
+			if element.Name.Local == "tab" || element.Name.Local == "s" {
+				text.WriteByte(' ')
+			}
+		case xml.EndElement:
+			switch element.Name.Local {
+			case "p", "tr", "si", "br", "h":
+				text.newLine()
+			case "tc", "table-cell":
+				text.WriteByte(' ')
+			}
+		}
+	}
+
+	return nil
+}
+
+// extractPDFText recovers the text shown by the content streams of a PDF, uncompressed or Flate compressed.
+// Text in fonts with custom encodings, common with embedded subsets, can't be recovered and comes out garbled
+func extractPDFText(data []byte) (string, error) {
+	if !bytes.HasPrefix(data, []byte("%PDF")) {
+		return "", errors.New("file is not a PDF")
+	}
+
+	var text textBuilder
+	inflated := 0
+	for offset := 0; offset < len(data) && !text.full() && inflated < contentMaxInflatedTotal; {
+		start := bytes.Index(data[offset:], []byte("stream"))
+		if start < 0 {
+			break
+		}
+		start += offset
+		offset = start + len("stream")
+
+		// endstream is matched by the search too, only the opening keyword starts a stream
+		if start >= 3 && string(data[start-3:start]) == "end" {
+			continue
+		}
+
+		streamStart := offset
+		if streamStart < len(data) && data[streamStart] == '\r' {
+			streamStart++
+		}
+		if streamStart < len(data) && data[streamStart] == '\n' {
+			streamStart++
+		}
+		end := bytes.Index(data[streamStart:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		end += streamStart
+		offset = end + len("endstream")
+
+		dictionary := data[max(0, start-1024):start]
+		if object := bytes.LastIndex(dictionary, []byte(" obj")); object >= 0 {
+			dictionary = dictionary[object:]
+		}
+
+		content, ok := pdfStreamContent(dictionary, data[streamStart:end])
+		inflated += len(content)
+		if ok && bytes.Contains(content, []byte("BT")) {
+			pdfContentText(content, &text)
+		}
+	}
+
+	extracted := strings.TrimSpace(text.String())
+	if extracted == "" {
+		return "", errors.New("no text found in the PDF")
+	}
+	return limitText(extracted), nil
+}
+
+// pdfStreamContent decodes a stream with the given dictionary, streams with filters other than Flate are skipped
+func pdfStreamContent(dictionary []byte, stream []byte) ([]byte, bool) {
+	if bytes.Contains(dictionary, []byte("/Image")) || bytes.Contains(dictionary, []byte("/FontFile")) {
+		return nil, false
+	}
+	if !bytes.Contains(dictionary, []byte("/Filter")) {
+		return stream, true
+	}
+
+	filters := bytes.Count(dictionary, []byte("Decode")) - bytes.Count(dictionary, []byte("DecodeParms"))
+	if !bytes.Contains(dictionary, []byte("/FlateDecode")) || filters != 1 {
+		return nil, false
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		return nil, false
+	}
+	defer reader.Close()
+
+	// Streams are often followed by padding that trips the checksum, what was inflated is still used. Streams
+	// inflating past the limit are cut there
+	content, _ := io.ReadAll(io.LimitReader(reader, contentMaxInflated))
+	return content, len(content) > 0
+}
+
+// pdfContentText writes the strings shown by the text operators of a content stream, lines end where text moves
+// to a new line and wide gaps in TJ arrays become spaces
+func pdfContentText(content []byte, text *textBuilder) {
+	var operands []string
+	inArray := false
+
+	for i := 0; i < len(content) && !text.full(); {
+		switch char := content[i]; {
+		case char == '(':
+			value, next := pdfLiteralString(content, i)
+			operands = append(operands, value)
+			i = next
+		case char == '<' && i+1 < len(content) && content[i+1] == '<':
+			i += 2
+		case char == '<':
+			value, next := pdfHexString(content, i)
+			operands = append(operands, value)
+			i = next
+		case char == '[':
+			inArray = true
+			i++
+		case char == ']':
+			inArray = false
+			i++
+		case char == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case pdfWhitespace(char) || char == '>' || char == '{' || char == '}' || char == ')':
+			i++
+		case char == '/':
+			// Names like /F1 are operands of operators that don't show text
+			for i++; i < len(content) && !pdfDelimiter(content[i]); i++ {
+			}
+		default:
+			start := i
+			for i < len(content) && !pdfDelimiter(content[i]) {
+				i++
+			}
+
+			token := string(content[start:i])
+			if number, err := strconv.ParseFloat(token, 64); err == nil {
+				if inArray && number <= -200 {
+					operands = append(operands, " ")
+				}
+				continue
+			}
+
+			switch token {
+			case "Tj", "TJ":
+				text.WriteString(strings.Join(operands, ""))
+			case "'", "\"":
+				text.newLine()
+				text.WriteString(strings.Join(operands, ""))
+			case "T*", "Td", "TD", "ET":
+				text.newLine()
+			}
+			operands = operands[:0]
+		}
+	}
+	text.newLine()
+}
+
+func pdfWhitespace(char byte) bool {
+	return char == ' ' || char == '\n' || char == '\r' || char == '\t' || char == '\f' || char == 0
+}
+
+// pdfDelimiter reports the characters that end a token in a content stream
+func pdfDelimiter(char byte) bool {
+	return pdfWhitespace(char) || strings.IndexByte("()<>[]{}/%", char) >= 0
+}
+
+// pdfLiteralString reads the string in parentheses starting at start, returning it and the offset after it
+func pdfLiteralString(content []byte, start int) (string, int) {
+	var value []byte
+	depth := 0
+	i := start
+	for ; i < len(content); i++ {
+		char := content[i]
+		switch {
+		case char == '\\' && i+1 < len(content):
+			i++
+			switch escaped := content[i]; escaped {
+			case 'n':
+				value = append(value, '\n')
+			case 'r':
+				value = append(value, '\r')
+			case 't':
+				value = append(value, '\t')
+			case 'b', 'f', '\r', '\n':
+			default:
+				if escaped >= '0' && escaped <= '7' {
+					octal := 0
+					for digits := 0; digits < 3 && i < len(content) && content[i] >= '0' && content[i] <= '7'; digits++ {
+						octal = octal*8 + int(content[i]-'0')
+						i++
+					}
+					i--
+					value = append(value, byte(octal))
+				} else {
+					value = append(value, escaped)
+				}
+			}
+		case char == '(':
+			depth++
+			if depth > 1 {
+				value = append(value, char)
+			}
+		case char == ')':
+			depth--
+			if depth == 0 {
+				return pdfDecodeString(value), i + 1
+			}
+			value = append(value, char)
+		default:
+			value = append(value, char)
+		}
+	}
+	return pdfDecodeString(value), i
+}
+
+// pdfHexString reads the string in angle brackets starting at start, returning it and the offset after it
+func pdfHexString(content []byte, start int) (string, int) {
+	var digits []byte
+	i := start + 1
+	for ; i < len(content) && content[i] != '>'; i++ {
+		if char := content[i]; (char >= '0' && char <= '9') || (char >= 'a' && char <= 'f') || (char >= 'A' && char <= 'F') {
+			digits = append(digits, char)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+
+	value := make([]byte, len(digits)/2)
+	for j := range value {
+		parsed, _ := strconv.ParseUint(string(digits[2*j:2*j+2]), 16, 8)
+		value[j] = byte(parsed)
+	}
+	return pdfDecodeString(value), i + 1
+}
+
+// pdfDecodeString turns the bytes of a PDF string into text, UTF-16 when marked so and Latin-1 otherwise.
+// Control characters are dropped
+func pdfDecodeString(value []byte) string {
+	var runes []rune
+	if len(value) >= 2 && value[0] == 0xfe && value[1] == 0xff {
+		units := make([]uint16, 0, len(value)/2)
+		for i := 2; i+1 < len(value); i += 2 {
+			units = append(units, uint16(value[i])<<8|uint16(value[i+1]))
+		}
+		runes = utf16.Decode(units)
+	} else {
+		for _, char := range value {
+			runes = append(runes, rune(char))
+		}
+	}
+
+	var decoded strings.Builder
+	for _, char := range runes {
+		if char >= 0x20 && char != utf8.RuneError && (char < 0x7f || char > 0x9f) {
+			decoded.WriteRune(char)
+		} else if char == '\n' || char == '\t' {
+			decoded.WriteByte(' ')
+		}
+	}
+	return decoded.String()
+}
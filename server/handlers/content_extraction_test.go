@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testZip builds a ZIP archive holding the given files, in order
+func testZip(t *testing.T, files ...string) []byte {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	for i := 0; i+1 < len(files); i += 2 {
+		file, err := archive.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// testPDF builds a PDF holding the given streams, compressed with Flate when compressed is set
+func testPDF(t *testing.T, compressed bool, streams ...string) []byte {
+	t.Helper()
+
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	for i, stream := range streams {
+		content := []byte(stream)
+		filter := ""
+		if compressed {
+			var deflated bytes.Buffer
+			writer := zlib.NewWriter(&deflated)
+			writer.Write(content)
+			writer.Close()
+			content, filter = deflated.Bytes(), " /Filter /FlateDecode"
+		}
+		fmt.Fprintf(&pdf, "%d 0 obj\n<< /Length %d%s >>\nstream\n", i+1, len(content), filter)
+		pdf.Write(content)
+		pdf.WriteString("\nendstream\nendobj\n")
+	}
+	pdf.WriteString("%%EOF\n")
+	return pdf.Bytes()
+}
+
+func TestContentExtractors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"notes.md", []byte("# Notes\nfirst line"), "# Notes\nfirst line"},
+		{
+			"report.docx",
+			testZip(t,
+				"[Content_Types].xml", `<Types/>`,
+				"word/document.xml", `<w:document xmlns:w="w"><w:body><w:p><w:r><w:t>Quarterly</w:t></w:r><w:tab/><w:r><w:t>report</w:t></w:r></w:p><w:p><w:r><w:t>Second paragraph</w:t></w:r></w:p></w:body></w:document>`,
+			),
+			"Quarterly report\nSecond paragraph",
+		},
+		{
+			"deck.pptx",
+			testZip(t,
+				"ppt/slides/slide10.xml", `<p:sld xmlns:p="p" xmlns:a="a"><a:p><a:r><a:t>Tenth</a:t></a:r></a:p></p:sld>`,
+				"ppt/slides/slide2.xml", `<p:sld xmlns:p="p" xmlns:a="a"><a:p><a:r><a:t>Second</a:t></a:r></a:p></p:sld>`,
+				"ppt/slides/slide1.xml", `<p:sld xmlns:p="p" xmlns:a="a"><a:p><a:r><a:t>First</a:t></a:r></a:p></p:sld>`,
+				"ppt/slides/_rels/slide1.xml.rels", `<Relationships/>`,
+			),
+			"First\nSecond\nTenth",
+		},
+		{
+			"budget.xlsx",
+			testZip(t, "xl/sharedStrings.xml", `<sst><si><t>Item</t></si><si><t>Amount</t></si></sst>`),
+			"Item\nAmount",
+		},
+		{
+			"letter.odt",
+			testZip(t, "content.xml", `<office:document-content xmlns:office="o" xmlns:text="t"><office:body><office:text><text:h>Title</text:h><text:p>Dear<text:s/>reader</text:p></office:text></office:body></office:document-content>`),
+			"Title\nDear reader",
+		},
+		{
+			"plain.pdf",
+			testPDF(t, false, "BT /F1 12 Tf 72 712 Td (Hello \\(PDF\\)) Tj ET"),
+			"Hello (PDF)",
+		},
+		{
+			"compressed.pdf",
+			testPDF(t, true, "BT (Compressed) Tj T* [(Wide)-300(gap)] TJ ET", "BT <FEFF00E9007400E9> Tj ET"),
+			"Compressed\nWide gap\nété",
+		},
+	}
+	for _, test := range tests {
+		extract := contentExtractor(test.name)
+		if extract == nil {
+			t.Errorf("%s isn't supported", test.name)
+			continue
+		}
+		text, err := extract(test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if text != test.want {
+			t.Errorf("%s: extracted %q, want %q", test.name, text, test.want)
+		}
+	}
+
+	if contentExtractor("photo.png") != nil {
+		t.Error("photo.png is supported")
+	}
+}
+
+func TestContentExtractorsRejectInvalidFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"binary.txt", []byte("text\x00more")},
+		{"broken.docx", []byte("not a zip")},
+		{"fake.pdf", []byte("not a pdf")},
+		{"empty.pdf", testPDF(t, false, "0 0 1 rg")},
+	}
+	for _, test := range tests {
+		if text, err := contentExtractor(test.name)(test.data); err == nil {
+			t.Errorf("%s: extracted %q, want an error", test.name, text)
+		}
+	}
+}
+
+func TestContentExtractorsCapInflatedSize(t *testing.T) {
+	padding := strings.Repeat(" ", contentMaxInflated)
+
+	// A part inflating past the limit isn't read
+	large := testZip(t, "word/document.xml", `<w:document xmlns:w="w"><w:p><w:t>large</w:t></w:p>`+padding+`</w:document>`)
+	if text, err := contentExtractor("large.docx")(large); err == nil {
+		t.Errorf("part inflating past the limit extracted %d bytes of text", len(text))
+	}
+
+	// Parts within the limit are read until all of them together pass the total limit. The padding is in
+	// comments so the text doesn't fill up first
+	var files []string
+	for i := 0; i <= contentMaxInflatedTotal/(contentMaxInflated-1<<10); i++ {
+		files = append(files, fmt.Sprintf("ppt/slides/slide%d.xml", i+1), "<a:t>slide</a:t><!--"+padding[:contentMaxInflated-1<<10]+"-->")
+	}
+	if text, err := contentExtractor("many.pptx")(testZip(t, files...)); err == nil {
+		t.Errorf("parts inflating past the total limit extracted %d bytes of text", len(text))
+	}
+
+	// PDF streams are cut at the limit
+	pdf := testPDF(t, true, "BT (start) Tj ET"+padding+"BT (end) Tj ET")
+	text, err := contentExtractor("large.pdf")(pdf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "start" {
+		t.Errorf("stream inflating past the limit extracted %q, want %q", text, "start")
+	}
+
+	if text := limitText(strings.Repeat("é", contentMaxText)); len(text) > contentMaxText || !strings.HasSuffix(text, "é") {
+		t.Errorf("limitText kept %d bytes ending with %q", len(text), text[len(text)-2:])
+	}
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// schemaStatements reads the statements of database/storify.sql
+func schemaStatements(t *testing.T) string {
+	t.Helper()
+
+	schema, err := os.ReadFile("../database/storify.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The schema file creates and connects to its own database
+	var statements []string
+	for _, line := range strings.Split(string(schema), "\n") {
+		if strings.HasPrefix(line, "CREATE DATABASE") || strings.HasPrefix(line, `\c`) {
+			continue
+		}
+		statements = append(statements, line)
+	}
+	return strings.Join(statements, "\n")
+}
+
+// testDB connects to TEST_DATABASE_URL and creates the schema of database/storify.sql in a schema of its own,
+// which is dropped when the test ends. Tests needing a database are skipped when the variable isn't set
+func testDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL isn't set")
+	}
+
+	admin, err := pgx.Connect(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close(context.Background())
+
+	name := "test_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	if _, err := admin.Exec(context.Background(), "CREATE SCHEMA "+name); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn, err := pgx.Connect(context.Background(), url)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(context.Background())
+		if _, err := conn.Exec(context.Background(), "DROP SCHEMA "+name+" CASCADE"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ConnConfig.RuntimeParams["search_path"] = name
+	db, err := pgxpool.ConnectConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	if _, err := db.Exec(context.Background(), schemaStatements(t)); err != nil {
+		t.Fatal("Error creating schema: ", err)
+	}
+
+	return db
+}
+
+// testUser inserts a user and returns their id
+func testUser(t *testing.T, db *pgxpool.Pool, email string) string {
+	t.Helper()
+
+	userID := uuid.New().String()
+	_, err := db.Exec(
+		context.Background(),
+		"INSERT INTO users (user_id, email, password, email_verified, created_at) VALUES ($1, $2, 'x', true, $3);",
+		userID, email, time.Now(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+// testOrganization inserts an organization created by a user and returns its id
+func testOrganization(t *testing.T, db *pgxpool.Pool, creatorID string) string {
+	t.Helper()
+
+	organizationID := uuid.New().String()
+	_, err := db.Exec(
+		context.Background(),
+		"INSERT INTO organizations (organization_id, name, created_at) VALUES ($1, 'Test', $2);",
+		organizationID, time.Now(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addUserToOrganization(db, creatorID, organizationID, "creator"); err != nil {
+		t.Fatal(err)
+	}
+	return organizationID
+}
+
+// TestSchemaRerun runs the schema over a database it already created, as a deploy of a new version does
+func TestSchemaRerun(t *testing.T) {
+	db := testDB(t)
+
+	creatorID := testUser(t, db, "creator@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+	parent := testFolder(t, db, organizationID, "", true)
+
+	if _, err := db.Exec(context.Background(), schemaStatements(t)); err != nil {
+		t.Fatal("Error running the schema again: ", err)
+	}
+
+	// The triggers are still there, once
+	child := testFolder(t, db, organizationID, parent, true)
+	var ancestors []string
+	if err := db.QueryRow(context.Background(), "SELECT ancestor_ids::text[] FROM folders WHERE id = $1;", child).Scan(&ancestors); err != nil {
+		t.Fatal(err)
+	}
+	if len(ancestors) != 1 || ancestors[0] != parent {
+		t.Errorf("folder created after the rerun has ancestors %v, want [%s]", ancestors, parent)
+	}
+}
@@ -0,0 +1,442 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"server/middleware"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	// archiveMaxEntries is the most files and folders a single ZIP download can hold
+	archiveMaxEntries = 10000
+	// archiveReaders is how many objects are read from Spaces at once while the archive is written
+	archiveReaders = 4
+	// archivePrefetch is how much of each object is read ahead of the archive writer
+	archivePrefetch = 4 << 20
+)
+
+// archiveEntry is a file, or a folder when FilePath is empty, written to a ZIP archive under Path
+type archiveEntry struct {
+	Path       string
+	FilePath   string
+	Size       int64
+	ModifiedAt time.Time
+}
+
+// archiveObject is an object opened for an archive entry, with its start already read
+type archiveObject struct {
+	Reader io.Reader
+	Body   io.Closer
+	Err    error
+}
+
+// archiveName makes a file or folder name safe to use as a single segment of a path in an archive
+func archiveName(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// uniqueArchivePath returns path, or path numbered like "report (2).pdf" when it is already in the archive
+func uniqueArchivePath(used map[string]bool, path string) string {
+	candidate := path
+	for number := 2; used[strings.ToLower(candidate)]; number++ {
+		extension := ""
+		if dot := strings.LastIndex(path, "."); dot > strings.LastIndex(path, "/")+1 {
+			extension = path[dot:]
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(path, extension), number, extension)
+	}
+	used[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// folderArchiveEntries lists the subfolders and files of a folder the user can see, outside the recycle bin,
+// under prefix followed by the folder name
+func folderArchiveEntries(db *pgxpool.Pool, userID string, folderID string, prefix string, used map[string]bool) ([]archiveEntry, error) {
+	rows, err := db.Query(
+		context.Background(),
+		`
+			WITH RECURSIVE visible AS (
+				SELECT r.id FROM folders root
+				CROSS JOIN LATERAL folder_permission_ranks($2, root.organization_id, root.id, NULL) r
+				WHERE root.id = $1 AND r.rank >= 1
+			),
+			tree AS (
+				SELECT id, ARRAY[name::text] AS names FROM folders WHERE id = $1 AND deleted = false
+				UNION ALL
+				SELECT f.id, tree.names || f.name::text
+				FROM folders f
+				JOIN tree ON f.parent_folder_id = tree.id
+				WHERE f.deleted = false AND f.id IN (SELECT id FROM visible)
+			)
+			SELECT tree.names, fi.name, fi.file_path, COALESCE(fi.file_size, 0), fi.updated_at
+			FROM tree
+			LEFT JOIN files fi ON fi.folder_id = tree.id AND fi.deleted = false
+			ORDER BY tree.names, fi.name;
+		`,
+		folderID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []archiveEntry
+	folderPaths := map[string]string{}
+	for rows.Next() {
+		var names []string
+		var fileName, filePath *string
+		var size int64
+		var modifiedAt *time.Time
+		if err := rows.Scan(&names, &fileName, &filePath, &size, &modifiedAt); err != nil {
+			return nil, err
+		}
+
+		// Folders are numbered once when their name is taken, their files follow the numbered path
+		key := strings.Join(names, "\x00")
+		path, seen := folderPaths[key]
+		if !seen {
+			parent := prefix
+			if len(names) > 1 {
+				parent = folderPaths[strings.Join(names[:len(names)-1], "\x00")] + "/"
+			}
+			path = uniqueArchivePath(used, parent+archiveName(names[len(names)-1]))
+			folderPaths[key] = path
+			entries = append(entries, archiveEntry{Path: path})
+		}
+
+		if fileName != nil {
+			entries = append(entries, archiveEntry{
+				Path:       uniqueArchivePath(used, path+"/"+archiveName(*fileName)),
+				FilePath:   *filePath,
+				Size:       size,
+				ModifiedAt: *modifiedAt,
+			})
+		}
+	}
+
+	return entries, rows.Err()
+}
+
+// openArchiveObject opens an object and reads its start so objects are fetched while earlier entries are
+// being written
+func openArchiveObject(db *pgxpool.Pool, filePath string, size int64) archiveObject {
+	object, err := openStoredFile(db, filePath)
+	if err != nil {
+		return archiveObject{Err: err}
+	}
+
+	if size <= 0 || size > archivePrefetch {
+		size = archivePrefetch
+	}
+	buffer := make([]byte, size)
+	read, err := io.ReadFull(object.Body, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		object.Body.Close()
+		return archiveObject{Err: err}
+	}
+
+	return archiveObject{Reader: io.MultiReader(bytes.NewReader(buffer[:read]), object.Body), Body: object.Body}
+}
+
+// writeArchive streams a ZIP archive of the entries, ZIP64 records are added for large archives. Up to
+// archiveReaders objects are opened with open ahead of the entry being written. Writing stops when an object
+// can't be read, a write fails or ctx is done, objects already opened ahead are then closed
+func writeArchive(ctx context.Context, w io.Writer, entries []archiveEntry, open func(entry archiveEntry) archiveObject) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	objects := make([]chan archiveObject, len(entries))
+	for i := range objects {
+		objects[i] = make(chan archiveObject, 1)
+	}
+
+	readers := make(chan struct{}, archiveReaders)
+	var opening sync.WaitGroup
+	opening.Add(1)
+	go func() {
+		defer opening.Done()
+		for i, entry := range entries {
+			if entry.FilePath == "" {
+				objects[i] <- archiveObject{}
+				continue
+			}
+
+			select {
+			case readers <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			opening.Add(1)
+			go func(i int, entry archiveEntry) {
+				defer opening.Done()
+				objects[i] <- open(entry)
+			}(i, entry)
+		}
+	}()
+	defer func() {
+		cancel()
+		opening.Wait()
+		for i := range objects {
+			select {
+			case object := <-objects[i]:
+				if object.Body != nil {
+					object.Body.Close()
+				}
+			default:
+			}
+		}
+	}()
+
+	archive := zip.NewWriter(w)
+	for i, entry := range entries {
+		var object archiveObject
+		select {
+		case object = <-objects[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if entry.FilePath == "" {
+			if _, err := archive.CreateHeader(&zip.FileHeader{Name: entry.Path + "/", Method: zip.Store, Modified: time.Now()}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		<-readers
+		if object.Err != nil {
+			return fmt.Errorf("error reading %s: %w", entry.Path, object.Err)
+		}
+
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: entry.Path, Method: zip.Deflate, Modified: entry.ModifiedAt})
+		if err == nil {
+			_, err = io.Copy(file, object.Reader)
+		}
+		object.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// streamArchive responds with a ZIP archive of the entries, written while the response is sent
+func streamArchive(c *fiber.Ctx, db *pgxpool.Pool, name string, entries []archiveEntry) error {
+	if len(entries) > archiveMaxEntries {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "Too many files to download at once"})
+	}
+
+	// The first object is opened before the status is sent, so a storage failure is still reported as an error
+	var firstPath string
+	var first archiveObject
+	for _, entry := range entries {
+		if entry.FilePath != "" {
+			firstPath = entry.Path
+			first = openArchiveObject(db, entry.FilePath, entry.Size)
+			break
+		}
+	}
+	if first.Err != nil {
+		log.Println("Error fetching file from Spaces: ", first.Err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching files", "message": first.Err.Error()})
+	}
+
+	ctx := c.Context()
+	open := func(entry archiveEntry) archiveObject {
+		if entry.Path == firstPath {
+			return first
+		}
+		return openArchiveObject(db, entry.FilePath, entry.Size)
+	}
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, "attachment; filename="+strconv.Quote(name+".zip"))
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := writeArchive(ctx, w, entries, open); err != nil {
+			// Ending the response would make an incomplete archive look downloaded, closing the connection
+			// before the last chunk makes the client see the download fail
+			log.Println("Error writing archive: ", err)
+			ctx.Conn().Close()
+			return
+		}
+		if err := w.Flush(); err != nil {
+			log.Println("Error writing archive: ", err)
+		}
+	})
+
+	return nil
+}
+
+// DownloadFile streams the content of a file, decrypted when it is stored encrypted
+func DownloadFile(c *fiber.Ctx, db *pgxpool.Pool) error {
+	fileId := c.Params("file_id")
+
+	file := auditFile(db, fileId)
+	if file == nil || file.Deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	object, err := openStoredFile(db, file.FilePath)
+	if err != nil {
+		log.Println("Error fetching file from Spaces: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching file", "message": err.Error()})
+	}
+
+	recordAudit(c, db, auditEvent{Action: "file.download", TargetType: "file", TargetID: fileId, Before: file})
+
+	return sendStoredFile(c, object, file.Name, "attachment")
+}
+
+// DownloadFolder streams a ZIP archive of a folder with its subfolders and files
+func DownloadFolder(c *fiber.Ctx, db *pgxpool.Pool) error {
+	folderId := c.Params("folder_id")
+
+	folder := auditFolder(db, folderId)
+	if folder == nil || folder.Deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Folder not found"})
+	}
+
+	entries, err := folderArchiveEntries(db, c.Locals("user_id").(string), folderId, "", map[string]bool{})
+	if err != nil {
+		log.Println("Error listing folder content: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error listing folder content", "message": err.Error()})
+	}
+
+	recordAudit(c, db, auditEvent{Action: "folder.download", TargetType: "folder", TargetID: folderId, Before: folder})
+
+	return streamArchive(c, db, folder.Name, entries)
+}
+
+// DownloadSelection streams a ZIP archive of the files and folders in the file_ids and folder_ids of the body,
+// folders come with their content. Items that can't be opened or are in the recycle bin are left out
+func DownloadSelection(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userID := c.Locals("user_id").(string)
+
+	var request struct {
+		FileIDs   []string `json:"file_ids"`
+		FolderIDs []string `json:"folder_ids"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	if len(request.FileIDs)+len(request.FolderIDs) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "No files or folders given"})
+	}
+	if len(request.FileIDs)+len(request.FolderIDs) > archiveMaxEntries {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "Too many files to download at once"})
+	}
+
+	// Tokens limited to an organization only download from it
+	tokenOrganizationID, isLimited := c.Locals("token_organization_id").(string)
+	organizationCondition := "TRUE"
+	args := []interface{}{request.FileIDs, userID}
+	if isLimited {
+		organizationCondition = "organization_id = $3"
+		args = append(args, tokenOrganizationID)
+	}
+
+	used := map[string]bool{}
+	var entries []archiveEntry
+	var organizationId string
+
+	rows, err := db.Query(
+		context.Background(),
+		`
+			SELECT name, file_path, COALESCE(file_size, 0), updated_at, organization_id FROM files
+			WHERE id = ANY($1) AND deleted = false AND file_permission_rank($2, id) >= 1 AND `+organizationCondition+`
+			ORDER BY name;
+		`,
+		args...,
+	)
+	if err != nil {
+		log.Println("Error fetching files: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching files", "message": err.Error()})
+	}
+	for rows.Next() {
+		var entry archiveEntry
+		var name string
+		if err := rows.Scan(&name, &entry.FilePath, &entry.Size, &entry.ModifiedAt, &organizationId); err != nil {
+			rows.Close()
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		entry.Path = uniqueArchivePath(used, archiveName(name))
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	for _, folderId := range request.FolderIDs {
+		folder := auditFolder(db, folderId)
+		if folder == nil || (isLimited && folder.OrganizationID != tokenOrganizationID) {
+			continue
+		}
+
+		rank, err := folderPermission(db, userID, folderId)
+		if err != nil {
+			log.Println("Error checking permissions: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+		}
+		if rank < permissionViewer {
+			continue
+		}
+
+		folderEntries, err := folderArchiveEntries(db, userID, folderId, "", used)
+		if err != nil {
+			log.Println("Error listing folder content: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error listing folder content", "message": err.Error()})
+		}
+		entries = append(entries, folderEntries...)
+		organizationId = folder.OrganizationID
+	}
+
+	if len(entries) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "None of the files or folders can be downloaded"})
+	}
+
+	recordAudit(c, db, auditEvent{
+		OrganizationID: organizationId,
+		Action:         "archive.download",
+		TargetType:     "organization",
+		TargetID:       organizationId,
+		After:          fiber.Map{"file_ids": request.FileIDs, "folder_ids": request.FolderIDs},
+	})
+
+	return streamArchive(c, db, "download", entries)
+}
+
+func RegisterDownloadRoutes(app *fiber.App, db *pgxpool.Pool) {
+	downloadGroup := app.Group("/download", middleware.AuthRequired(db))
+	read := middleware.RequireScope(db, middleware.ScopeReadFiles)
+
+	downloadGroup.Get("/file/:file_id", read, requireFilePermission(db, permissionViewer), func(c *fiber.Ctx) error {
+		return DownloadFile(c, db)
+	})
+	downloadGroup.Get("/folder/:folder_id", read, requireFolderPermission(db, permissionViewer), func(c *fiber.Ctx) error {
+		return DownloadFolder(c, db)
+	})
+	downloadGroup.Post("/selection", read, func(c *fiber.Ctx) error {
+		return DownloadSelection(c, db)
+	})
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testObjects opens archive objects holding the file path of their entry and counts how many are opened and closed.
+// The object of the entry at path missing can't be read
+type testObjects struct {
+	mu      sync.Mutex
+	opened  int
+	closed  int
+	missing string
+}
+
+func (o *testObjects) open(entry archiveEntry) archiveObject {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if entry.Path == o.missing {
+		return archiveObject{Err: errors.New("object not found")}
+	}
+	o.opened++
+	return archiveObject{Reader: strings.NewReader(entry.FilePath), Body: o}
+}
+
+func (o *testObjects) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed++
+	return nil
+}
+
+// failingWriter fails every write after the first limit bytes
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		written := w.limit
+		w.limit = 0
+		return written, errors.New("connection closed")
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+// testArchiveEntries returns a folder with count files, each holding its number followed by padding
+func testArchiveEntries(count int, padding string) []archiveEntry {
+	entries := []archiveEntry{{Path: "folder"}}
+	for i := 0; i < count; i++ {
+		entries = append(entries, archiveEntry{Path: fmt.Sprintf("folder/%d.txt", i), FilePath: fmt.Sprintf("content %d", i) + padding})
+	}
+	return entries
+}
+
+func TestWriteArchive(t *testing.T) {
+	objects := &testObjects{}
+	var buffer bytes.Buffer
+	if err := writeArchive(context.Background(), &buffer, testArchiveEntries(20, ""), objects.open); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archive.File) != 21 {
+		t.Fatalf("archive has %d entries, want 21", len(archive.File))
+	}
+	file, err := archive.File[3].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content 2" {
+		t.Errorf("%s holds %q, want %q", archive.File[3].Name, content, "content 2")
+	}
+	if objects.opened != 20 || objects.closed != 20 {
+		t.Errorf("opened %d objects and closed %d, want 20 of each", objects.opened, objects.closed)
+	}
+}
+
+func TestWriteArchiveStops(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Content that doesn't compress fills the buffer of the archive writer with the first file
+	random := make([]byte, 32<<10)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	padding := hex.EncodeToString(random)
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		w       io.Writer
+		missing string
+	}{
+		{"write error", context.Background(), &failingWriter{limit: 100}, ""},
+		{"cancelled", cancelled, io.Discard, ""},
+		{"unreadable object", context.Background(), io.Discard, "folder/0.txt"},
+	}
+	for _, test := range tests {
+		objects := &testObjects{missing: test.missing}
+		if err := writeArchive(test.ctx, test.w, testArchiveEntries(1000, padding), objects.open); err == nil {
+			t.Errorf("%s: writeArchive didn't fail", test.name)
+		}
+		if objects.opened > archiveReaders+1 {
+			t.Errorf("%s: opened %d objects after writing stopped", test.name, objects.opened)
+		}
+		if objects.closed != objects.opened {
+			t.Errorf("%s: opened %d objects and closed %d", test.name, objects.opened, objects.closed)
+		}
+	}
+}
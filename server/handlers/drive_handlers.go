@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"server/middleware"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// driveItemsQuery selects the files and folders outside the recycle bin with the same columns
+const driveItemsQuery = `
+	SELECT 'file' AS type, f.id, f.name, f.organization_id, f.folder_id AS parent_id, COALESCE(f.file_size, 0) AS size, f.created_at, f.updated_at
+	FROM files f WHERE f.deleted = false
+	UNION ALL
+	SELECT 'folder', d.id, d.name, d.organization_id, d.parent_folder_id, 0, d.created_at, d.updated_at
+	FROM folders d WHERE d.deleted = false
+`
+
+// driveSortColumns returns the columns drive listings can be sorted by, along with the date the listing is
+// about which is the default sort
+func driveSortColumns(listedAt string) map[string]sortColumn {
+	return map[string]sortColumn{
+		"name":       {Expression: "name", Type: "text"},
+		"size":       {Expression: "size", Type: "bigint", Descending: true},
+		"created_at": {Expression: "created_at", Type: "timestamptz", Descending: true},
+		"updated_at": {Expression: "updated_at", Type: "timestamptz", Descending: true},
+		listedAt:     {Expression: listedAt, Type: "timestamptz", Descending: true},
+	}
+}
+
+// touchRecentItem records that a user opened or changed a file or folder for their recent items
+func touchRecentItem(db *pgxpool.Pool, userID string, itemType string, itemID string, modified bool) {
+	column, timestamp := itemType+"_id", "accessed_at"
+	if modified {
+		timestamp = "modified_at"
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO recentitems (id, user_id, %[1]s, %[2]s) VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (user_id, %[1]s) DO UPDATE SET %[2]s = NOW();
+	`, column, timestamp)
+
+	if _, err := db.Exec(context.Background(), query, uuid.New().String(), userID, itemID); err != nil {
+		log.Println("Error recording recent item: ", err)
+	}
+}
+
+// listDriveItems responds with a page of the files and folders of a listing. The query selects the
+// driveItemsQuery columns followed by organization_name, starred_at, activity_at, shared_at and shared_by
+// for the user in $1. Items the user can no longer open are left out, the type and organization_id
+// query parameters filter the items
+func listDriveItems(c *fiber.Ctx, db *pgxpool.Pool, query string, listedAt string) error {
+	userID := c.Locals("user_id").(string)
+
+	page, err := parsePageRequest(c, driveSortColumns(listedAt), listedAt)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	items := `
+		SELECT listed.*, CASE listed.type
+			WHEN 'file' THEN file_permission_rank($1, listed.id)
+			ELSE folder_permission_rank($1, listed.id)
+		END AS rank
+		FROM (` + query + `) listed
+	`
+	where := "rank >= 1"
+	args := []interface{}{userID}
+
+	if itemType := c.Query("type"); itemType != "" {
+		if itemType != "file" && itemType != "folder" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "type must be file or folder"})
+		}
+		args = append(args, itemType)
+		where += fmt.Sprintf(" AND type = $%d", len(args))
+	}
+	if organizationId := c.Query("organization_id"); organizationId != "" {
+		args = append(args, organizationId)
+		where += fmt.Sprintf(" AND organization_id = $%d", len(args))
+	}
+
+	var total int
+	err = db.QueryRow(context.Background(), "SELECT COUNT(*) FROM ("+items+") items WHERE "+where, args...).Scan(&total)
+	if err != nil {
+		log.Println("Error counting items: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching items", "message": err.Error()})
+	}
+
+	condition, order, args := page.keyset("id", args)
+	rows, err := db.Query(
+		context.Background(),
+		fmt.Sprintf(`
+			SELECT type, id, name, organization_id, organization_name, parent_id, size, created_at, updated_at, rank,
+			starred_at, activity_at, shared_at, shared_by, %s
+			FROM (%s) items
+			WHERE %s AND %s
+			%s;
+		`, page.sortKey(), items, where, condition, order),
+		args...,
+	)
+	if err != nil {
+		log.Println("Error fetching items: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching items", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	driveItems := []models.DriveItem{}
+	var keys []pageKey
+	for rows.Next() {
+		var item models.DriveItem
+		var rank int
+		var key pageKey
+		if err := rows.Scan(
+			&item.Type,
+			&item.ID,
+			&item.Name,
+			&item.OrganizationID,
+			&item.OrganizationName,
+			&item.ParentID,
+			&item.Size,
+			&item.CreatedAt,
+			&item.UpdatedAt,
+			&rank,
+			&item.StarredAt,
+			&item.ActivityAt,
+			&item.SharedAt,
+			&item.SharedBy,
+			&key.Value,
+		); err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		item.Role = permissionRole(rank)
+		key.ID = item.ID
+		driveItems = append(driveItems, item)
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	nextCursor := page.nextCursor(keys)
+	if len(driveItems) > page.Limit {
+		driveItems = driveItems[:page.Limit]
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"items":       driveItems,
+		"next_cursor": nextCursor,
+		"total":       total,
+	})
+}
+
+// GetStarredItems lists the files and folders the logged in user starred
+func GetStarredItems(c *fiber.Ctx, db *pgxpool.Pool) error {
+	query := `
+		SELECT i.*, o.name AS organization_name, s.created_at AS starred_at, NULL::timestamptz AS activity_at,
+		NULL::timestamptz AS shared_at, NULL::uuid AS shared_by
+		FROM stars s
+		JOIN (` + driveItemsQuery + `) i ON i.id = COALESCE(s.file_id, s.folder_id)
+		JOIN organizations o ON o.organization_id = i.organization_id AND o.deleted_at IS NULL
+		WHERE s.user_id = $1
+	`
+	return listDriveItems(c, db, query, "starred_at")
+}
+
+// GetRecentItems lists the files and folders the logged in user opened or changed, latest first
+func GetRecentItems(c *fiber.Ctx, db *pgxpool.Pool) error {
+	query := `
+		SELECT i.*, o.name AS organization_name, NULL::timestamptz AS starred_at,
+		GREATEST(r.accessed_at, r.modified_at) AS activity_at, NULL::timestamptz AS shared_at, NULL::uuid AS shared_by
+		FROM recentitems r
+		JOIN (` + driveItemsQuery + `) i ON i.id = COALESCE(r.file_id, r.folder_id)
+		JOIN organizations o ON o.organization_id = i.organization_id AND o.deleted_at IS NULL
+		WHERE r.user_id = $1
+	`
+	return listDriveItems(c, db, query, "activity_at")
+}
+
+// GetSharedWithMe lists the folders shared with the logged in user across organizations, through folder
+// permissions given to them or their groups and folders shared with them or their organizations
+func GetSharedWithMe(c *fiber.Ctx, db *pgxpool.Pool) error {
+	query := `
+		WITH shared AS (
+			SELECT fs.folder_id, fs.created_by AS shared_by, fs.created_at AS shared_at
+			FROM foldershares fs
+			WHERE fs.revoked_at IS NULL AND fs.accepted_at IS NOT NULL
+			AND (fs.target_user_id = $1 OR organization_role($1, fs.target_organization_id) IS NOT NULL)
+			UNION ALL
+			SELECT fp.folder_id, fp.granted_by, fp.created_at
+			FROM folderpermissions fp
+			WHERE (fp.user_id = $1 OR fp.group_id IN (SELECT group_id FROM groupmembers WHERE user_id = $1))
+			AND fp.granted_by IS DISTINCT FROM $1
+		),
+		latest AS (
+			SELECT DISTINCT ON (folder_id) folder_id, shared_by, shared_at FROM shared ORDER BY folder_id, shared_at DESC
+		)
+		SELECT i.*, o.name AS organization_name, NULL::timestamptz AS starred_at, NULL::timestamptz AS activity_at,
+		latest.shared_at, latest.shared_by
+		FROM latest
+		JOIN (` + driveItemsQuery + `) i ON i.id = latest.folder_id
+		JOIN organizations o ON o.organization_id = i.organization_id AND o.deleted_at IS NULL
+	`
+	return listDriveItems(c, db, query, "shared_at")
+}
+
+// StarItem stars a file or folder for the logged in user
+func StarItem(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userID := c.Locals("user_id").(string)
+
+	column, itemId := "folder_id", c.Params("folder_id")
+	if fileId := c.Params("file_id"); fileId != "" {
+		column, itemId = "file_id", fileId
+	}
+
+	_, err := db.Exec(
+		context.Background(),
+		"INSERT INTO stars (id, user_id, "+column+") VALUES ($1, $2, $3) ON CONFLICT DO NOTHING;",
+		uuid.New().String(), userID, itemId,
+	)
+	if err != nil {
+		log.Println("Error starring item: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error starring item", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Item starred"})
+}
+
+// UnstarItem removes the star of the logged in user from a file or folder
+func UnstarItem(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userID := c.Locals("user_id").(string)
+
+	column, itemId := "folder_id", c.Params("folder_id")
+	if fileId := c.Params("file_id"); fileId != "" {
+		column, itemId = "file_id", fileId
+	}
+
+	_, err := db.Exec(context.Background(), "DELETE FROM stars WHERE user_id = $1 AND "+column+" = $2;", userID, itemId)
+	if err != nil {
+		log.Println("Error unstarring item: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error unstarring item", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Item unstarred"})
+}
+
+func RegisterDriveRoutes(app *fiber.App, db *pgxpool.Pool) {
+	driveGroup := app.Group("/drive", middleware.AuthRequired(db))
+	read := middleware.RequireScope(db, middleware.ScopeReadFiles)
+	write := middleware.RequireScope(db, middleware.ScopeWriteFiles)
+
+	driveGroup.Get("/starred", read, func(c *fiber.Ctx) error {
+		return GetStarredItems(c, db)
+	})
+	driveGroup.Get("/recent", read, func(c *fiber.Ctx) error {
+		return GetRecentItems(c, db)
+	})
+	driveGroup.Get("/shared", read, func(c *fiber.Ctx) error {
+		return GetSharedWithMe(c, db)
+	})
+	driveGroup.Put("/move", write, func(c *fiber.Ctx) error {
+		return MoveItems(c, db)
+	})
+	driveGroup.Post("/copy", write, func(c *fiber.Ctx) error {
+		return CopyItems(c, db)
+	})
+	driveGroup.Post("/star/file/:file_id", read, requireFilePermission(db, permissionViewer), func(c *fiber.Ctx) error {
+		return StarItem(c, db)
+	})
+	driveGroup.Post("/star/folder/:folder_id", read, requireFolderPermission(db, permissionViewer), func(c *fiber.Ctx) error {
+		return StarItem(c, db)
+	})
+	driveGroup.Delete("/star/file/:file_id", read, func(c *fiber.Ctx) error {
+		return UnstarItem(c, db)
+	})
+	driveGroup.Delete("/star/folder/:folder_id", read, func(c *fiber.Ctx) error {
+		return UnstarItem(c, db)
+	})
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"server/otp"
+	"server/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const emailVerificationPurpose = "email_verification"
+const emailVerificationTTL = 24 * time.Hour
+
+// EmailVerificationRequired reports whether unverified users are blocked from logging in,
+// it can be turned off by setting REQUIRE_EMAIL_VERIFICATION=false
+func EmailVerificationRequired() bool {
+	return os.Getenv("REQUIRE_EMAIL_VERIFICATION") != "false"
+}
+
+// sendVerificationEmail stores a single use verification token and mails it to the user
+func sendVerificationEmail(userID string, email string) error {
+	tokenID := uuid.New().String()
+	token, err := utils.GeneratePurposeToken(userID, emailVerificationPurpose, tokenID, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	if err := otp.StoreToken(emailVerificationPurpose+"_"+tokenID, userID, emailVerificationTTL); err != nil {
+		return err
+	}
+
+	return otp.SendVerificationEmail(email, token)
+}
+
+// VerifyEmail marks the user's email as verified using a token sent on registration
+func VerifyEmail(c *fiber.Ctx, db *pgxpool.Pool) error {
+	type verifyEmailRequest struct {
+		Token string `json:"token"`
+	}
+
+	var data verifyEmailRequest
+	if err := c.BodyParser(&data); err != nil || data.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid data"})
+	}
+
+	claims, err := utils.VerifyPurposeToken(data.Token, emailVerificationPurpose)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired verification token"})
+	}
+
+	userID, _ := claims["user_id"].(string)
+	tokenID, _ := claims["jti"].(string)
+
+	storedUserID, err := otp.ConsumeToken(emailVerificationPurpose + "_" + tokenID)
+	if err != nil || storedUserID != userID {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired verification token"})
+	}
+
+	_, err = db.Exec(context.Background(), "UPDATE users SET email_verified = true WHERE user_id = $1;", userID)
+	if err != nil {
+		log.Println("Error verifying email: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error verifying email", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Email verified successfully"})
+}
+
+// ResendVerificationEmail sends a new verification link to an unverified user
+func ResendVerificationEmail(c *fiber.Ctx, db *pgxpool.Pool) error {
+	type resendRequest struct {
+		Email string `json:"email"`
+	}
+
+	var data resendRequest
+	if err := c.BodyParser(&data); err != nil || data.Email == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid data"})
+	}
+
+	// Respond the same way whether the user exists or not so emails can't be enumerated
+	response := fiber.Map{"message": "If the email is registered and unverified, a verification link has been sent."}
+
+	var userID string
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT user_id FROM users WHERE email = $1 AND email_verified = false",
+		data.Email,
+	).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusOK).JSON(response)
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching user", "details": err.Error()})
+	}
+
+	if err := sendVerificationEmail(userID, data.Email); err != nil {
+		log.Println("Error sending verification email: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error sending verification email", "details": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// DeleteUnverifiedUsers deletes accounts that were never verified. The organizations
+// created for them on registration are scheduled for deletion right away, so
+// PurgeDeletedOrganizations removes them with their stored objects. Accounts are
+// kept for UNVERIFIED_ACCOUNT_TTL_DAYS days (7 by default), accounts still owning
+// an organization other members joined are kept so it isn't left without an owner
+func DeleteUnverifiedUsers(db *pgxpool.Pool) {
+	ttlDays, err := strconv.Atoi(os.Getenv("UNVERIFIED_ACCOUNT_TTL_DAYS"))
+	if err != nil || ttlDays <= 0 {
+		ttlDays = 7
+	}
+	cutoff := time.Now().Add(-time.Duration(ttlDays) * 24 * time.Hour)
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	// Only organizations where the unverified user is the sole member are removed
+	organizationsQuery := `
+		UPDATE organizations SET deleted_at = NOW(), purge_at = NOW()
+		WHERE deleted_at IS NULL AND organization_id IN (
+			SELECT uo.organization_id
+			FROM userorganizations uo
+			JOIN users u ON u.user_id = uo.user_id
+			WHERE u.email_verified = false AND u.created_at < $1 AND uo.role = 'creator'
+			AND NOT EXISTS (
+				SELECT 1 FROM userorganizations other
+				WHERE other.organization_id = uo.organization_id AND other.user_id <> uo.user_id
+			)
+		);
+	`
+	_, err = tx.Exec(context.Background(), organizationsQuery, cutoff)
+	if err != nil {
+		log.Println("Error scheduling organizations of unverified users for deletion: ", err)
+		return
+	}
+
+	commandTag, err := tx.Exec(
+		context.Background(),
+		`
+			DELETE FROM users u WHERE u.email_verified = false AND u.created_at < $1
+			AND NOT EXISTS (
+				SELECT 1 FROM userorganizations uo
+				JOIN organizations o ON o.organization_id = uo.organization_id AND o.deleted_at IS NULL
+				WHERE uo.user_id = u.user_id AND uo.role = 'creator'
+			);
+		`,
+		cutoff,
+	)
+	if err != nil {
+		log.Println("Error deleting unverified users: ", err)
+		return
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return
+	}
+
+	log.Printf("Deleted %d unverified users", commandTag.RowsAffected())
+}
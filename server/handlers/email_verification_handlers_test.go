@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDeleteUnverifiedUsers(t *testing.T) {
+	db := testDB(t)
+
+	// An unverified account alone in its organization, and one whose organization another member joined
+	aloneID := testUser(t, db, "alone@example.com")
+	aloneOrganization := testOrganization(t, db, aloneID)
+	joinedID := testUser(t, db, "joined@example.com")
+	joinedOrganization := testOrganization(t, db, joinedID)
+	memberID := testUser(t, db, "member@example.com")
+	if err := addUserToOrganization(db, memberID, joinedOrganization, "member"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Exec(
+		context.Background(),
+		"UPDATE users SET email_verified = false, created_at = $1 WHERE user_id IN ($2, $3);",
+		time.Now().Add(-30*24*time.Hour), aloneID, joinedID,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DeleteUnverifiedUsers(db)
+
+	for userID, want := range map[string]bool{aloneID: false, joinedID: true, memberID: true} {
+		var exists bool
+		if err := db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM users WHERE user_id = $1);", userID).Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if exists != want {
+			t.Errorf("user %s exists %v, want %v", userID, exists, want)
+		}
+	}
+
+	// The organization is left to the purge, which deletes its stored objects
+	for organizationID, want := range map[string]bool{aloneOrganization: true, joinedOrganization: false} {
+		var scheduled bool
+		err := db.QueryRow(
+			context.Background(),
+			"SELECT deleted_at IS NOT NULL AND purge_at <= NOW() FROM organizations WHERE organization_id = $1;",
+			organizationID,
+		).Scan(&scheduled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scheduled != want {
+			t.Errorf("organization %s scheduled for purging %v, want %v", organizationID, scheduled, want)
+		}
+	}
+}
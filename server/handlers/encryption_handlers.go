@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"log"
+
+	"server/encryption"
+	"server/middleware"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// requireKeyAdmin only lets organization admins through to the encryption keys of the organization in the
+// organization_id parameter
+func requireKeyAdmin(db *pgxpool.Pool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		isAdmin, err := isOrganizationAdmin(db, c.Locals("user_id").(string), c.Params("organization_id"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+		}
+		if !isAdmin {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can manage encryption keys"})
+		}
+
+		return c.Next()
+	}
+}
+
+// GetEncryptionKeys lists the data keys of an organization with how many blobs each one encrypts, newest first
+func GetEncryptionKeys(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+
+	rows, err := db.Query(
+		context.Background(),
+		`
+			SELECT k.id, k.organization_id, k.version, k.master_key_id, k.active,
+			(SELECT COUNT(*) FROM blobs b WHERE b.encryption_key_id = k.id), k.created_at, k.wrapped_at
+			FROM encryptionkeys k WHERE k.organization_id = $1 ORDER BY k.version DESC;
+		`,
+		organizationId,
+	)
+	if err != nil {
+		log.Println("Error fetching encryption keys: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching encryption keys", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	keys := []models.EncryptionKey{}
+	for rows.Next() {
+		var key models.EncryptionKey
+		if err := rows.Scan(&key.ID, &key.OrganizationID, &key.Version, &key.MasterKeyID, &key.Active, &key.BlobCount, &key.CreatedAt, &key.WrappedAt); err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"enabled": encryption.Manager != nil, "keys": keys})
+}
+
+// RotateEncryptionKey adds a new data key to an organization that new content is encrypted with, content already
+// stored stays readable with the key it was encrypted with
+func RotateEncryptionKey(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+
+	if encryption.Manager == nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Encryption isn't configured"})
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error rotating encryption key", "message": err.Error()})
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := lockOrganizationKeys(tx, organizationId); err != nil {
+		log.Println("Error locking organization: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error rotating encryption key", "message": err.Error()})
+	}
+
+	keyID, err := addEncryptionKey(tx, organizationId)
+	if err != nil {
+		log.Println("Error adding encryption key: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error rotating encryption key", "message": err.Error()})
+	}
+
+	var key models.EncryptionKey
+	err = tx.QueryRow(
+		context.Background(),
+		"SELECT id, organization_id, version, master_key_id, active, created_at, wrapped_at FROM encryptionkeys WHERE id = $1;",
+		keyID,
+	).Scan(&key.ID, &key.OrganizationID, &key.Version, &key.MasterKeyID, &key.Active, &key.CreatedAt, &key.WrappedAt)
+	if err != nil {
+		log.Println("Error fetching encryption key: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error rotating encryption key", "message": err.Error()})
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "encryption.key_rotate", TargetType: "encryption_key", TargetID: key.ID, After: key}); err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error rotating encryption key", "message": err.Error()})
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error rotating encryption key", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(key)
+}
+
+func RegisterEncryptionRoutes(app *fiber.App, db *pgxpool.Pool) {
+	encryptionGroup := app.Group("/encryption", middleware.AuthRequired(db))
+	read := middleware.RequireScope(db, middleware.ScopeReadFiles)
+	write := middleware.RequireScope(db, middleware.ScopeWriteFiles)
+	admin := requireKeyAdmin(db)
+
+	encryptionGroup.Get("/keys/:organization_id", read, admin, func(c *fiber.Ctx) error {
+		return GetEncryptionKeys(c, db)
+	})
+	encryptionGroup.Post("/rotate/:organization_id", write, admin, func(c *fiber.Ctx) error {
+		return RotateEncryptionKey(c, db)
+	})
+}
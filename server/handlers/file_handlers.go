@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"server/spaces"
+	"server/middleware"
 	"server/models"
 
 	"github.com/gofiber/fiber/v2"
@@ -16,59 +17,86 @@ import (
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
-//Function to get files
-func GetFiles(c *fiber.Ctx, db *pgxpool.Pool) error {
-	organizationId := c.Params("organization_id")
-	folderId := c.Params("folder_id")
+// fileColumns are the columns of files read by scanFile
+const fileColumns = `
+	id, name, folder_id, file_path, COALESCE(file_size, 0), created_at, updated_at, organization_id, deleted, deleted_at,
+	created_by, metadata, file_tag_names(id), (SELECT hash FROM blobs WHERE blobs.id = blob_id)
+`
+
+// fileSortColumns are the columns file listings can be sorted by
+var fileSortColumns = map[string]sortColumn{
+	"name":       {Expression: "name", Type: "text"},
+	"size":       {Expression: "COALESCE(file_size, 0)", Type: "bigint", Descending: true},
+	"created_at": {Expression: "created_at", Type: "timestamptz", Descending: true},
+	"updated_at": {Expression: "updated_at", Type: "timestamptz", Descending: true},
+	"deleted_at": {Expression: "COALESCE(deleted_at, updated_at)", Type: "timestamptz", Descending: true},
+}
 
-	if organizationId == ""  {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing fields"})
-	}
+var fileFilterColumns = filterColumns{
+	Name:      "name",
+	Size:      "COALESCE(file_size, 0)",
+	CreatedAt: "created_at",
+	UpdatedAt: "updated_at",
+	CreatedBy: "created_by",
+	Tags:      "file_tag_names(id)",
+	Metadata:  "metadata",
+}
 
-	var query string
-	var rows pgx.Rows
-	var err error
+// scanFile reads the fileColumns of a row into a file, the columns selected after them are read into extra
+func scanFile(row pgx.Row, extra ...interface{}) (models.File, error) {
+	var file models.File
+	dest := []interface{}{
+		&file.ID,
+		&file.Name,
+		&file.FolderID,
+		&file.FilePath,
+		&file.FileSize,
+		&file.CreatedAt,
+		&file.UpdatedAt,
+		&file.OrganizationID,
+		&file.Deleted,
+		&file.DeletedAt,
+		&file.CreatedBy,
+		&file.Metadata,
+		&file.Tags,
+		&file.ContentHash,
+	}
+	err := row.Scan(append(dest, extra...)...)
+	return file, err
+}
 
-	if organizationId != "" && folderId == "" {
-		query = `
-		SELECT *
-		FROM files 
-		WHERE organization_id = $1 AND folder_id IS NULL AND deleted = false;
-	`
+// listFiles responds with a page of the files matching where, which uses args, narrowed down by the filter
+// query parameters
+func listFiles(c *fiber.Ctx, db *pgxpool.Pool, where string, args []interface{}, defaultSort string) error {
+	page, err := parsePageRequest(c, fileSortColumns, defaultSort)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
 
-		rows, err = db.Query(
-			context.Background(),
-			query,
-			organizationId,
-		)
-	} else if organizationId != "" && folderId != "" {
-		query =`
-			SELECT *
-			FROM files 
-			WHERE folder_id = $1 AND deleted = false;
-		`		
-
-		rows, err = db.Query(
-			context.Background(),
-			query,
-			folderId,
-		)
+	filters, args, err := parseFilters(c, fileFilterColumns, args)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
+	rows, total, err := queryPage(db, page, fileColumns, "files", where+" AND "+filters, "id", args)
 	if err != nil {
 		log.Println("Error fetching files: ", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching files", "message": err.Error()})
 	}
 	defer rows.Close()
 
-	var files []models.File
+	files := []models.File{}
+	var keys []pageKey
 	for rows.Next() {
-		var file models.File
-		if err := rows.Scan(&file.ID, &file.Name, &file.FolderID, &file.FilePath, &file.FileSize, &file.CreatedAt, &file.UpdatedAt, &file.OrganizationID, &file.Deleted, &file.DeletedAt); err != nil {
+		var key pageKey
+		file, err := scanFile(rows, &key.Value)
+		if err != nil {
 			log.Println("Error scanning row: ", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
 		}
+		key.ID = file.ID
 		files = append(files, file)
+		keys = append(keys, key)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -76,45 +104,54 @@ func GetFiles(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(files)
+	nextCursor := page.nextCursor(keys)
+	if len(files) > page.Limit {
+		files = files[:page.Limit]
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"items":       files,
+		"next_cursor": nextCursor,
+		"total":       total,
+	})
+}
+
+// GetFiles lists the files at the root of an organization or in one of its folders, a page at a time
+func GetFiles(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	folderId := c.Params("folder_id")
+	userID := c.Locals("user_id").(string)
+
+	if organizationId == ""  {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing fields"})
+	}
+
+	if folderId == "" {
+		return listFiles(c, db, "organization_id = $1 AND folder_id IS NULL AND deleted = false AND organization_permission_rank($2, $1) >= 1", []interface{}{organizationId, userID}, "name")
+	}
+	return listFiles(c, db, "folder_id = $1 AND deleted = false AND folder_permission_rank($2, $1) >= 1", []interface{}{folderId, userID}, "name")
 }
 
 //Function to get files
 func GetFile(c *fiber.Ctx, db *pgxpool.Pool) error {
 	fileId := c.Params("file_id")
-	var file models.File
 
 	if fileId == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "File id missing"})
 	}
 
-	query := `
-		SELECT *
-		FROM files 
-		WHERE id = $1 AND deleted = false;
-	`
-
-	err := db.QueryRow(
+	file, err := scanFile(db.QueryRow(
 		context.Background(),
-		query,
+		"SELECT "+fileColumns+" FROM files WHERE id = $1 AND deleted = false;",
 		fileId,
-	).Scan(
-		&file.ID,
-		&file.Name,
-		&file.FolderID,
-		&file.FilePath,
-		&file.FileSize,
-		&file.CreatedAt,
-		&file.UpdatedAt,
-		&file.OrganizationID,
-		&file.Deleted,
-		&file.DeletedAt,
-	)
+	))
 
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error" : "Error fetching file", "message": err.Error()})
 	}
 
+	touchRecentItem(db, c.Locals("user_id").(string), "file", file.ID, false)
+
 	return c.Status(fiber.StatusOK).JSON(file)
 }
 
@@ -134,55 +171,117 @@ func CreateFile(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error":"Missing file name"})
 	}
 
-	if file.FolderID != nil && *file.FolderID == "null" {
+	if file.FolderID != nil && (*file.FolderID == "null" || *file.FolderID == "") {
 		file.FolderID = nil
 	}
 
-	// Check if a file with the same name already exists
-	/** 
-	var existingFile models.File
-	checkQuery := `
-		SELECT id FROM files
-		WHERE LOWER(name) = LOWER($1)
-		AND organization_id = $2
-		AND (folder_id = $3 OR (folder_id IS NULL AND $3 IS NULL))
-		AND deleted = false
-	`
-	err := db.QueryRow(
-		context.Background(),
-		checkQuery,
-		file.Name,
-		file.OrganizationID,
-		file.FolderID,
-	).Scan(&existingFile.ID)
+	strategy, err := conflictStrategy(c)
+	if err != nil {
+		return respondStatusError(c, err, "Error reading conflict strategy")
+	}
+
+	// Files belong to the organization of their folder, which keeps the storage of folders shared with
+	// other organizations accounted to the owning organization
+	if file.FolderID != nil && *file.FolderID != "" {
+		if folder := auditFolder(db, *file.FolderID); folder != nil {
+			file.OrganizationID = folder.OrganizationID
+		}
+	}
+
+	rank, err := containerPermission(db, c.Locals("user_id").(string), file.OrganizationID, file.FolderID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if rank < permissionEditor {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You need editor access to the folder"})
+	}
+
+	resolution, err := resolveNameConflict(db, strategy, "file", file.OrganizationID, file.FolderID, file.Name, "")
+	if err != nil {
+		return respondStatusError(c, err, "Error checking for existing file")
+	}
 
-	if err == nil {
-		// File with the same name exists
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "File with the same name already exists"})
-	} else if err != pgx.ErrNoRows {
-		log.Println("Error checking for existing file: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking for existing file", "message": err.Error()})
+	// Skipped uploads respond with the file already there
+	if resolution.Skip {
+		return c.Status(fiber.StatusOK).JSON(auditFile(db, resolution.ExistingID))
 	}
-	*/
+
+	// Uploads are hashed on ingest so the file points at the blob of its content from the start
+	uploadPath := file.FilePath
+	blobID, blobPath := hashOnIngest(db, file.OrganizationID, uploadPath)
+	file.FilePath = blobPath
+
+	if resolution.Replace {
+		before := auditFile(db, resolution.ExistingID)
+
+		tx, err := db.Begin(context.Background())
+		if err != nil {
+			log.Println("Error starting transaction: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error starting transaction", "message": err.Error()})
+		}
+		defer tx.Rollback(context.Background())
+
+		if err := replaceFileContent(tx, resolution.ExistingID, file.FilePath, file.FileSize, blobID, c.Locals("user_id").(string)); err != nil {
+			log.Println("Error replacing file: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error replacing file", "message": err.Error()})
+		}
+
+		after := auditFile(tx, resolution.ExistingID)
+		if err := recordAuditTx(c, tx, auditEvent{Action: "file.replace", TargetType: "file", TargetID: resolution.ExistingID, Before: before, After: after}); err != nil {
+			log.Println(err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error replacing file", "message": err.Error()})
+		}
+
+		if err := tx.Commit(context.Background()); err != nil {
+			log.Println("Error committing transaction: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error committing transaction", "message": err.Error()})
+		}
+
+		removeUpload(db, uploadPath, file.FilePath)
+		touchRecentItem(db, c.Locals("user_id").(string), "file", resolution.ExistingID, true)
+
+		return c.Status(fiber.StatusOK).JSON(after)
+	}
+	file.Name = resolution.Name
+
+	userID := c.Locals("user_id").(string)
+	file.CreatedBy = &userID
 
 	query := `
 		INSERT INTO files
-		(id, name, folder_id, file_path, file_size, created_at, updated_at, organization_id, deleted)
+		(id, name, folder_id, file_path, file_size, created_at, updated_at, organization_id, deleted, created_by, blob_id)
 		VALUES
-		($1, $2, $3, $4, $5, $6, $7, $8, $9);
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);
 	`
 
-	_, err := db.Exec(
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error starting transaction", "message": err.Error()})
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(
 		context.Background(),
 		query,
-		file.ID, file.Name, file.FolderID, file.FilePath, file.FileSize, file.CreatedAt, file.UpdatedAt, file.OrganizationID, file.Deleted,
+		file.ID, file.Name, file.FolderID, file.FilePath, file.FileSize, file.CreatedAt, file.UpdatedAt, file.OrganizationID, file.Deleted, file.CreatedBy, blobID,
 	)
 
 	if err != nil {
-		log.Println("Error creating file: ", err)
+		return respondStatusError(c, nameTaken(err), "Error creating file")
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{Action: "file.create", TargetType: "file", TargetID: file.ID, After: &file}); err != nil {
+		log.Println(err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating file", "message": err.Error()})
 	}
 
+	if err := tx.Commit(context.Background()); err != nil {
+		return respondStatusError(c, nameTaken(err), "Error creating file")
+	}
+	removeUpload(db, uploadPath, file.FilePath)
+	touchRecentItem(db, c.Locals("user_id").(string), "file", file.ID, true)
+
 	return c.Status(fiber.StatusCreated).JSON(file)
 }
 
@@ -211,15 +310,42 @@ func UpdateFile(c *fiber.Ctx, db *pgxpool.Pool) error {
 		args = append(args, file.Name)
 		argIndex++
 	}
-	if *file.FolderID != "" {
+	before := auditFile(db, fileId)
+	if before == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	if file.FolderID != nil && *file.FolderID != "" {
+		if err := checkDestination(db, c.Locals("user_id").(string), before.OrganizationID, file.FolderID); err != nil {
+			return respondStatusError(c, err, "Error checking destination folder")
+		}
+
 		updateFields = append(updateFields, fmt.Sprintf("folder_id = $%d", argIndex))
 		args = append(args, file.FolderID)
 		argIndex++
 	}
+
+	// Renamed and moved files must not take a name used in their folder
+	folderID, name := before.FolderID, before.Name
+	if file.FolderID != nil && *file.FolderID != "" {
+		folderID = file.FolderID
+	}
+	if file.Name != "" {
+		name = file.Name
+	}
+	if _, err := resolveNameConflict(db, conflictFail, "file", before.OrganizationID, folderID, name, fileId); err != nil {
+		return respondStatusError(c, err, "Error checking for existing file")
+	}
+
+	// New content is hashed on ingest like uploads of new files
+	uploadPath := file.FilePath
 	if file.FilePath != "" {
-		updateFields = append(updateFields, fmt.Sprintf("file_path = $%d", argIndex))
-		args = append(args, file.FilePath)
-		argIndex++
+		var blobID *string
+		blobID, file.FilePath = hashOnIngest(db, before.OrganizationID, uploadPath)
+
+		updateFields = append(updateFields, fmt.Sprintf("file_path = $%d", argIndex), fmt.Sprintf("blob_id = $%d", argIndex+1))
+		args = append(args, file.FilePath, blobID)
+		argIndex += 2
 	}
 
 	updateFields = append(updateFields, fmt.Sprintf("updated_at = $%d", argIndex))
@@ -238,16 +364,21 @@ func UpdateFile(c *fiber.Ctx, db *pgxpool.Pool) error {
 		WHERE id = $%d AND deleted = false;
 	`, strings.Join(updateFields, ", "), argIndex)
 
-	_, err := db.Exec(
-		context.Background(),
-		query,
-		args...,
-	)
+	err := auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(context.Background(), query, args...); err != nil {
+			return nil, err
+		}
+		return &auditEvent{Action: "file.update", TargetType: "file", TargetID: fileId, Before: before, After: auditFile(tx, fileId)}, nil
+	})
 
 	if err != nil {
-		log.Println("Error updating file: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating file", "message": err.Error()})
+		return respondStatusError(c, nameTaken(err), "Error updating file")
+	}
+
+	if uploadPath != "" {
+		removeUpload(db, uploadPath, file.FilePath)
 	}
+	touchRecentItem(db, c.Locals("user_id").(string), "file", fileId, true)
 
 	return c.Status(fiber.StatusOK).JSON(file)
 }
@@ -264,11 +395,12 @@ func MoveFileTrash(c *fiber.Ctx, db *pgxpool.Pool) error {
 
 	query := "UPDATE files SET deleted = true, deleted_at = $1 WHERE id = $2 AND deleted = false;"
 
-	_, err := db.Exec(
-		context.Background(), 
-		query, 
-		deletedAt, fileId,
-	)
+	err := auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(context.Background(), query, deletedAt, fileId); err != nil {
+			return nil, err
+		}
+		return &auditEvent{Action: "file.trash", TargetType: "file", TargetID: fileId, After: auditFile(tx, fileId)}, nil
+	})
 
 	if err != nil {
 		log.Println("Error deleting file: ", err)
@@ -286,30 +418,42 @@ func DeleteFile(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "fileId missing"})
 	}
 
+	var blobID *string
 	err := db.QueryRow(
 		context.Background(), 
-		"SELECT file_path FROM files WHERE id = $1",
+		"SELECT file_path, blob_id FROM files WHERE id = $1",
 		fileId,
-	).Scan(&file.FilePath)
+	).Scan(&file.FilePath, &blobID)
 
 	if err != nil {
 		log.Println("Error retrieving file_path", err)
 		return fmt.Errorf("failed to retrieve file_path: %w", err)
 	}
 
-	err = spaces.DeleteFile(file.FilePath)
-	if err != nil {
-    log.Println("Error deleting file from Spaces:", err)
-    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting file from Spaces"})
+	before := auditFile(db, fileId)
+
+	// Content in a blob is removed once nothing references it
+	if blobID == nil {
+		err = spaces.DeleteFile(file.FilePath)
+		if err != nil {
+			log.Println("Error deleting file from Spaces:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting file from Spaces"})
+		}
+	}
+
+	if err := deleteVersionObjects(db, "f.id = $1", fileId); err != nil {
+		log.Println("Error deleting file versions from Spaces:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting file versions from Spaces"})
 	}
 
 	query := "DELETE FROM files WHERE id = $1 AND deleted = true;"
 
-	_, err = db.Exec(
-		context.Background(), 
-		query, 
-		fileId,
-	)
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(context.Background(), query, fileId); err != nil {
+			return nil, err
+		}
+		return &auditEvent{Action: "file.delete", TargetType: "file", TargetID: fileId, Before: before}, nil
+	})
 
 	if err != nil {
 		log.Println("Error deleting file: ", err)
@@ -327,26 +471,79 @@ func RestoreFile(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "fileId missing"})
 	}
 
-	query := "UPDATE files SET deleted = false WHERE id = $1 AND deleted = true;"
+	strategy, err := conflictStrategy(c)
+	if err != nil {
+		return respondStatusError(c, err, "Error reading conflict strategy")
+	}
 
-	_, err := db.Exec(
-		context.Background(),
-		query,
-		fileId,
-	)
+	file := auditFile(db, fileId)
+	if file == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	}
 
+	resolution, err := resolveNameConflict(db, strategy, "file", file.OrganizationID, file.FolderID, file.Name, fileId)
 	if err != nil {
-		log.Println("Error restoring file: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error restoring file", "message": err.Error()})
+		return respondStatusError(c, err, "Error checking for existing file")
+	}
+
+	if resolution.Skip {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "File left in the recycle bin, its name is taken", "existing_id": resolution.ExistingID})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "File restored"})
+	// Replacing restores the content as a new version of the file holding the name
+	if resolution.Replace {
+		tx, err := db.Begin(context.Background())
+		if err != nil {
+			log.Println("Error starting transaction: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error starting transaction", "message": err.Error()})
+		}
+		defer tx.Rollback(context.Background())
+
+		if err := mergeFileInto(tx, fileId, resolution.ExistingID, c.Locals("user_id").(string)); err != nil {
+			log.Println("Error restoring file: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error restoring file", "message": err.Error()})
+		}
+
+		if err := recordAuditTx(c, tx, auditEvent{Action: "file.restore", TargetType: "file", TargetID: fileId, Before: file, After: auditFile(tx, resolution.ExistingID)}); err != nil {
+			log.Println(err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error restoring file", "message": err.Error()})
+		}
+
+		if err := tx.Commit(context.Background()); err != nil {
+			log.Println("Error committing transaction: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error committing transaction", "message": err.Error()})
+		}
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "File restored", "id": resolution.ExistingID})
+	}
+
+	query := "UPDATE files SET deleted = false, name = $2 WHERE id = $1 AND deleted = true;"
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(context.Background(), query, fileId, resolution.Name); err != nil {
+			return nil, err
+		}
+		return &auditEvent{Action: "file.restore", TargetType: "file", TargetID: fileId, After: auditFile(tx, fileId)}, nil
+	})
+
+	if err != nil {
+		return respondStatusError(c, nameTaken(err), "Error restoring file")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "File restored", "id": fileId})
 }
 
 // DeleteExpiredFiles deletes files where the current date is past the deletedAt date
 func DeleteExpiredFiles(db *pgxpool.Pool) {
-	query := "DELETE FROM files WHERE deleted = true AND deleted_at < $1;"
-	_, err := db.Exec(
+	query := "DELETE FROM files WHERE deleted = true AND deleted_at < $1 RETURNING id, organization_id, name, file_path;"
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error deleting expired files: ", err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	rows, err := tx.Query(
 		context.Background(),
 		query,
 		time.Now(),
@@ -354,79 +551,92 @@ func DeleteExpiredFiles(db *pgxpool.Pool) {
 
 	if err != nil {
 		log.Println("Error deleting expired files: ", err)
-	} else {
-		log.Println("Expired files deleted successfully")
+		return
 	}
-}
-
-// GetDeletedFiless retrieves all files where deleted = true
-//for a particular user
-func GetDeletedFiles(c *fiber.Ctx, db *pgxpool.Pool) error {
-	organizationId := c.Params("organization_id")
+	defer rows.Close()
 
-	if organizationId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "organizationId missing"})
+	var purged []models.File
+	for rows.Next() {
+		var file models.File
+		if err := rows.Scan(&file.ID, &file.OrganizationID, &file.Name, &file.FilePath); err != nil {
+			log.Println("Error scanning row: ", err)
+			return
+		}
+		purged = append(purged, file)
 	}
 
-	query := `
-		SELECT id, name, folder_id, file_path, file_size, created_at, updated_at, organization_id, deleted_at
-		FROM files
-		WHERE deleted = true AND organization_id = $1 AND folder_id IS NULL;
-	`
-
-	rows, err := db.Query(context.Background(), query, organizationId)
-
-	if err != nil {
-		log.Println("Error querying deleted files: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error querying deleted files", "message": err.Error()})
+	if err := rows.Err(); err != nil {
+		log.Println("Error deleting expired files: ", err)
+		return
 	}
-	defer rows.Close()
+	rows.Close()
 
-	var files []models.File
-	for rows.Next() {
-		var file models.File
-		err := rows.Scan(&file.ID, &file.Name, &file.FolderID, &file.FilePath, &file.FileSize, &file.CreatedAt, &file.UpdatedAt, &file.OrganizationID, &file.DeletedAt)
-		if err != nil {
-			log.Println("Error scanning file: ", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning file", "message": err.Error()})
+	for i := range purged {
+		if err := recordSystemAuditTx(tx, auditEvent{Action: "file.purge", TargetType: "file", TargetID: purged[i].ID, Before: &purged[i]}); err != nil {
+			log.Println("Error deleting expired files: ", err)
+			return
 		}
-		files = append(files, file)
 	}
 
-	if err = rows.Err(); err != nil {
-		log.Println("Error iterating over rows: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating over rows", "message": err.Error()})
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error deleting expired files: ", err)
+		return
+	}
+	log.Println("Expired files deleted successfully")
+}
+
+// GetDeletedFiles lists the files in the recycle bin at the root of an organization, a page at a time
+func GetDeletedFiles(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	if organizationId == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "organizationId missing"})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(files)
+	return listFiles(c, db, "deleted = true AND organization_id = $1 AND folder_id IS NULL AND organization_permission_rank($2, $1) >= 1", []interface{}{organizationId, userID}, "deleted_at")
 }
 
 func RegisterFileRoutes(app *fiber.App, db *pgxpool.Pool) {
 	// File routes
-	fileGroup := app.Group("/file")
+	fileGroup := app.Group("/file", middleware.AuthRequired(db))
+	read := middleware.RequireScope(db, middleware.ScopeReadFiles)
+	write := middleware.RequireScope(db, middleware.ScopeWriteFiles)
 
-	fileGroup.Post("/create", func(c *fiber.Ctx) error {
+	fileGroup.Post("/create", write, func(c *fiber.Ctx) error {
 		return CreateFile(c, db)
 	})
-	fileGroup.Put("/update/:id", func(c *fiber.Ctx) error {
+	fileGroup.Put("/update/:id", write, requireFilePermission(db, permissionEditor), func(c *fiber.Ctx) error {
 		return UpdateFile(c, db)
 	})
-	fileGroup.Get("/fetch/all/:organization_id/:folder_id?", func(c *fiber.Ctx) error {
+	fileGroup.Get("/fetch/all/:organization_id/:folder_id?", read, func(c *fiber.Ctx) error {
 		return GetFiles(c, db)
 	})
-	fileGroup.Get("/fetch/specific/:file_id", func(c *fiber.Ctx) error {
+	fileGroup.Get("/fetch/specific/:file_id", read, requireFilePermission(db, permissionViewer), func(c *fiber.Ctx) error {
 		return GetFile(c, db)
 	})
-	fileGroup.Get("/fetch/deleted/:organization_id", func(c *fiber.Ctx) error {
+	fileGroup.Get("/preview/:file_id", read, requireFilePermission(db, permissionViewer), func(c *fiber.Ctx) error {
+		return GetFilePreview(c, db)
+	})
+	fileGroup.Get("/versions/:file_id", read, requireFilePermission(db, permissionViewer), func(c *fiber.Ctx) error {
+		return GetFileVersions(c, db)
+	})
+	fileGroup.Get("/fetch/deleted/:organization_id", read, func(c *fiber.Ctx) error {
 		return GetDeletedFiles(c, db)
 	})
-	fileGroup.Delete("/delete/permanent/:file_id", func(c *fiber.Ctx) error {
+	fileGroup.Delete("/delete/permanent/:file_id", write, requireFilePermission(db, permissionEditor), func(c *fiber.Ctx) error {
 		return DeleteFile(c, db)
 	})
-	fileGroup.Put("/delete/:file_id", func(c *fiber.Ctx) error {
+	fileGroup.Put("/delete/:file_id", write, requireFilePermission(db, permissionEditor), func(c *fiber.Ctx) error {
 		return MoveFileTrash(c, db)
 	})
-	fileGroup.Put("/restore/:file_id", func(c *fiber.Ctx) error {
+	fileGroup.Put("/move/:file_id", write, func(c *fiber.Ctx) error {
+		return MoveItem(c, db)
+	})
+	fileGroup.Post("/copy/:file_id", write, func(c *fiber.Ctx) error {
+		return CopyItem(c, db)
+	})
+	fileGroup.Put("/restore/:file_id", write, requireFilePermission(db, permissionEditor), func(c *fiber.Ctx) error {
 		return RestoreFile(c, db)
 	})
 }
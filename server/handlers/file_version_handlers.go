@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"log"
+
+	"server/models"
+	"server/spaces"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// replaceFileContent makes new content the current version of a file, the content it had is kept as an
+// earlier version. blobID is the blob holding the new content, nil when it is an upload still to be hashed
+func replaceFileContent(tx pgx.Tx, fileID string, filePath string, fileSize int64, blobID *string, userID string) error {
+	// The file is locked first so the version keeps the content where the hasher may have just moved it
+	_, err := tx.Exec(context.Background(), "SELECT 1 FROM files WHERE id = $1 FOR UPDATE;", fileID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		context.Background(),
+		`
+			INSERT INTO fileversions (id, file_id, file_path, file_size, created_at, replaced_by, replaced_at, blob_id)
+			SELECT $1, id, file_path, file_size, updated_at, $2, NOW(), blob_id FROM files WHERE id = $3;
+		`,
+		uuid.New().String(), userID, fileID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		context.Background(),
+		"UPDATE files SET file_path = $1, file_size = $2, blob_id = $3, updated_at = NOW() WHERE id = $4;",
+		filePath, fileSize, blobID, fileID,
+	)
+	return err
+}
+
+// mergeFileInto replaces the content of a file with the content of another file, which is removed. The
+// earlier versions of both files are kept on the replaced file
+func mergeFileInto(tx pgx.Tx, sourceID string, targetID string, userID string) error {
+	var filePath string
+	var fileSize int64
+	var blobID *string
+	err := tx.QueryRow(
+		context.Background(),
+		"SELECT file_path, COALESCE(file_size, 0), blob_id FROM files WHERE id = $1 FOR UPDATE;",
+		sourceID,
+	).Scan(&filePath, &fileSize, &blobID)
+	if err != nil {
+		return err
+	}
+
+	if err := replaceFileContent(tx, targetID, filePath, fileSize, blobID, userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(context.Background(), "UPDATE fileversions SET file_id = $1 WHERE file_id = $2;", targetID, sourceID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(), "DELETE FROM files WHERE id = $1;", sourceID)
+	return err
+}
+
+// deleteVersionObjects removes the Spaces objects of the earlier versions of the files matched by condition
+// on files f, the versions themselves are deleted along with their file. Content in blobs is left to be removed
+// once nothing references it
+func deleteVersionObjects(db *pgxpool.Pool, condition string, args ...interface{}) error {
+	rows, err := db.Query(
+		context.Background(),
+		"SELECT v.file_path FROM fileversions v JOIN files f ON f.id = v.file_id WHERE v.blob_id IS NULL AND "+condition+";",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+
+	var filePaths []string
+	for rows.Next() {
+		var filePath string
+		if err := rows.Scan(&filePath); err != nil {
+			rows.Close()
+			return err
+		}
+		filePaths = append(filePaths, filePath)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, filePath := range filePaths {
+		if err := spaces.DeleteFile(filePath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetFileVersions lists the earlier versions of a file, latest first
+func GetFileVersions(c *fiber.Ctx, db *pgxpool.Pool) error {
+	fileId := c.Params("file_id")
+
+	rows, err := db.Query(
+		context.Background(),
+		`
+			SELECT id, file_id, COALESCE(file_size, 0), created_at, replaced_by, replaced_at
+			FROM fileversions
+			WHERE file_id = $1
+			ORDER BY replaced_at DESC;
+		`,
+		fileId,
+	)
+	if err != nil {
+		log.Println("Error fetching file versions: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching file versions", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	versions := []models.FileVersion{}
+	for rows.Next() {
+		var version models.FileVersion
+		if err := rows.Scan(&version.ID, &version.FileID, &version.FileSize, &version.CreatedAt, &version.ReplacedBy, &version.ReplacedAt); err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		versions = append(versions, version)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	return sendList(c, versions)
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"server/spaces"
+	"server/middleware"
 	"server/models"
 
 	"github.com/gofiber/fiber/v2"
@@ -16,45 +17,71 @@ import (
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
-// Function to get folders
-func GetFolders(c *fiber.Ctx, db *pgxpool.Pool) error {
-	organizationId := c.Params("organization_id")
+// folderColumns are the columns of folders read by scanFolder
+const folderColumns = "id, name, organization_id, parent_folder_id, created_at, updated_at, deleted, deleted_at, created_by, metadata, folder_tag_names(id)"
 
-	if organizationId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "organizationId missing"})
+// folderSortColumns are the columns folder listings can be sorted by
+var folderSortColumns = map[string]sortColumn{
+	"name":       {Expression: "name", Type: "text"},
+	"created_at": {Expression: "created_at", Type: "timestamptz", Descending: true},
+	"updated_at": {Expression: "updated_at", Type: "timestamptz", Descending: true},
+	"deleted_at": {Expression: "COALESCE(deleted_at, updated_at)", Type: "timestamptz", Descending: true},
+}
+
+var folderFilterColumns = filterColumns{
+	CreatedAt: "created_at",
+	UpdatedAt: "updated_at",
+	CreatedBy: "created_by",
+	Tags:      "folder_tag_names(id)",
+	Metadata:  "metadata",
+}
+
+// scanFolder reads the folderColumns of a row into a folder, the columns selected after them are read into extra
+func scanFolder(row pgx.Row, extra ...interface{}) (models.Folder, error) {
+	var folder models.Folder
+	dest := []interface{}{
+		&folder.ID,
+		&folder.Name,
+		&folder.OrganizationID,
+		&folder.ParentFolderID,
+		&folder.CreatedAt,
+		&folder.UpdatedAt,
+		&folder.Deleted,
+		&folder.DeletedAt,
+		&folder.CreatedBy,
+		&folder.Metadata,
+		&folder.Tags,
 	}
+	err := row.Scan(append(dest, extra...)...)
+	return folder, err
+}
 
-	query := `
-		SELECT id, name, organization_id, COALESCE(parent_folder_id, NULL), created_at, updated_at, deleted, deleted_at
-		FROM folders 
-		WHERE organization_id = $1 AND deleted = false;
-	`
+// listFolders responds with a page of the folders matching where, which uses args, narrowed down by the filter
+// query parameters
+func listFolders(c *fiber.Ctx, db *pgxpool.Pool, where string, args []interface{}, defaultSort string) error {
+	page, err := parsePageRequest(c, folderSortColumns, defaultSort)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
 
-	rows, err := db.Query(
-		context.Background(),
-		query,
-		organizationId,
-	)
+	filters, args, err := parseFilters(c, folderFilterColumns, args)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
 
+	rows, total, err := queryPage(db, page, folderColumns, "folders", where+" AND "+filters, "id", args)
 	if err != nil {
 		log.Println("Error fetching folders: ", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching folders", "message": err.Error()})
 	}
 	defer rows.Close()
 
-	var folders []models.Folder
+	folders := []models.Folder{}
+	var keys []pageKey
 	for rows.Next() {
-		var folder models.Folder
-		if err := rows.Scan(
-			&folder.ID, 
-			&folder.Name, 
-			&folder.OrganizationID, 
-			&folder.ParentFolderID, 
-			&folder.CreatedAt, 
-			&folder.UpdatedAt, 
-			&folder.Deleted, 
-			&folder.DeletedAt); 
-			err != nil {
+		var key pageKey
+		folder, err := scanFolder(rows, &key.Value)
+		if err != nil {
 			log.Println("Error scanning row: ", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
 		}
@@ -62,7 +89,9 @@ func GetFolders(c *fiber.Ctx, db *pgxpool.Pool) error {
 			emptyStr := ""
 			folder.ParentFolderID = &emptyStr
 		}
+		key.ID = folder.ID
 		folders = append(folders, folder)
+		keys = append(keys, key)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -70,75 +99,45 @@ func GetFolders(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(folders)
+	nextCursor := page.nextCursor(keys)
+	if len(folders) > page.Limit {
+		folders = folders[:page.Limit]
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"items":       folders,
+		"next_cursor": nextCursor,
+		"total":       total,
+	})
+}
+
+// GetFolders lists all the folders of an organization, a page at a time
+func GetFolders(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	if organizationId == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "organizationId missing"})
+	}
+
+	return listFolders(c, db, "organization_id = $1 AND deleted = false AND "+folderRankCondition("id", "$2", "$1", "NULL", "NULL", permissionViewer), []interface{}{organizationId, userID}, "name")
 }
 
 // Function to get child folders
 func GetChildFolders(c *fiber.Ctx, db *pgxpool.Pool) error {
 	organizationId := c.Params("organization_id")
 	parentFolderID := c.Params("parent_folder_id")
+	userID := c.Locals("user_id").(string)
 
 	if parentFolderID == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "parent_folder_id missing"})
 	}
 
-	var query string
-	var rows pgx.Rows
-	var err error
-
+	// A parent_folder_id of "root" lists the folders at the root of the organization
 	if parentFolderID == "root" {
-		// If parentFolderID is "root", fetch folders where parent_folder_id is NULL
-		query := `
-			SELECT id, name, organization_id, parent_folder_id, created_at, updated_at, deleted, deleted_at
-			FROM folders 
-			WHERE organization_id = $1 AND parent_folder_id IS NULL AND deleted = false;
-		`
-		rows, err = db.Query(context.Background(), query, organizationId)
-	} else {
-		// Otherwise, fetch folders where parent_folder_id matches the provided value
-		query = `
-			SELECT id, name, organization_id, parent_folder_id, created_at, updated_at, deleted, deleted_at
-			FROM folders 
-			WHERE organization_id = $1 AND parent_folder_id = $2 AND deleted = false;
-		`
-		rows, err = db.Query(context.Background(), query, organizationId, parentFolderID)
-	}
-
-	if err != nil {
-		log.Println("Error fetching folders: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching folders", "message": err.Error()})
+		return listFolders(c, db, "organization_id = $1 AND parent_folder_id IS NULL AND deleted = false AND "+folderRankCondition("id", "$2", "$1", "NULL", "1", permissionViewer), []interface{}{organizationId, userID}, "name")
 	}
-	defer rows.Close()
-
-	var folders []models.Folder
-	for rows.Next() {
-		var folder models.Folder
-		if err := rows.Scan(
-			&folder.ID, 
-			&folder.Name, 
-			&folder.OrganizationID, 
-			&folder.ParentFolderID, 
-			&folder.CreatedAt, 
-			&folder.UpdatedAt, 
-			&folder.Deleted, 
-			&folder.DeletedAt); 
-			err != nil {
-			log.Println("Error scanning row: ", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
-		}
-		if folder.ParentFolderID == nil {
-			emptyStr := ""
-			folder.ParentFolderID = &emptyStr
-		}
-		folders = append(folders, folder)
-	}
-
-	if err := rows.Err(); err != nil {
-		log.Println("Error iterating rows: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
-	}
-
-	return c.Status(fiber.StatusOK).JSON(folders)
+	return listFolders(c, db, "organization_id = $1 AND parent_folder_id = $2 AND deleted = false AND "+folderRankCondition("id", "$3", "$1", "$2", "1", permissionViewer), []interface{}{organizationId, parentFolderID, userID}, "name")
 }
 
 
@@ -182,6 +181,8 @@ func GetFolder(c *fiber.Ctx, db *pgxpool.Pool) error {
 		folder.ParentFolderID = &emptyStr
 	}
 
+	touchRecentItem(db, c.Locals("user_id").(string), "folder", folder.ID, false)
+
 	return c.Status(fiber.StatusOK).JSON(folder)
 }
 
@@ -201,49 +202,71 @@ func CreateFolder(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error":"Missing fields"})
 	}
 
-	// Check if a folder with the same name already exists
-	/** 
-	var existingFolder models.Folder
-	checkQuery := `
-		SELECT id FROM folders
-		WHERE LOWER(name) = LOWER($1)
-		AND organization_id = $2
-		AND (parent_folder_id = $3 OR (parent_folder_id IS NULL AND $3 IS NULL)) 
-		AND deleted = false
-	`
+	if folder.ParentFolderID != nil && (*folder.ParentFolderID == "null" || *folder.ParentFolderID == "") {
+		folder.ParentFolderID = nil
+	}
 
-	err := db.QueryRow(
-		context.Background(),
-		checkQuery,
-		folder.Name, folder.OrganizationID, folder.ParentFolderID,
-	).Scan(&existingFolder.ID)
+	strategy, err := conflictStrategy(c)
+	if err != nil {
+		return respondStatusError(c, err, "Error reading conflict strategy")
+	}
+
+	// Subfolders belong to the organization of their parent, which keeps folders shared with other
+	// organizations in the owning organization
+	if folder.ParentFolderID != nil && *folder.ParentFolderID != "" {
+		if parent := auditFolder(db, *folder.ParentFolderID); parent != nil {
+			folder.OrganizationID = parent.OrganizationID
+		}
+	}
+
+	rank, err := containerPermission(db, c.Locals("user_id").(string), folder.OrganizationID, folder.ParentFolderID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if rank < permissionEditor {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You need editor access to the parent folder"})
+	}
+
+	resolution, err := resolveNameConflict(db, strategy, "folder", folder.OrganizationID, folder.ParentFolderID, folder.Name, "")
+	if err != nil {
+		return respondStatusError(c, err, "Error checking for existing folder")
+	}
 
-	if err == nil {
-		// Folder with the same name exists
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Folder with the same name exists"})
-	} else if err != pgx.ErrNoRows {
-		log.Println("Error checking for existing folder: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking for existing folder", "message": err.Error()})
+	// Skipped folders respond with the folder already there
+	if resolution.Skip {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"message": "Folder already exists",
+			"id": resolution.ExistingID,
+		})
 	}
-	*/
+	folder.Name = resolution.Name
+
+	userID := c.Locals("user_id").(string)
+	folder.CreatedBy = &userID
 
 	query := `
 		INSERT INTO folders
-		(id, name, organization_id, parent_folder_id, created_at, updated_at, deleted)
+		(id, name, organization_id, parent_folder_id, created_at, updated_at, deleted, created_by)
 		VALUES
-		($1, $2, $3, $4, $5, $6, $7);
+		($1, $2, $3, $4, $5, $6, $7, $8);
 	`
 
-	_, err := db.Exec(
-		context.Background(),
-		query,
-		folder.ID, folder.Name, folder.OrganizationID, folder.ParentFolderID, folder.CreatedAt, folder.UpdatedAt, folder.Deleted,
-	)
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		_, err := tx.Exec(
+			context.Background(),
+			query,
+			folder.ID, folder.Name, folder.OrganizationID, folder.ParentFolderID, folder.CreatedAt, folder.UpdatedAt, folder.Deleted, folder.CreatedBy,
+		)
+		if err != nil {
+			return nil, err
+		}
+		return &auditEvent{Action: "folder.create", TargetType: "folder", TargetID: folder.ID, After: &folder}, nil
+	})
 
 	if err != nil {
-		log.Println("Error creating folder: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating folder", "message": err.Error()})
+		return respondStatusError(c, nameTaken(err), "Error creating folder")
 	}
+	touchRecentItem(db, c.Locals("user_id").(string), "folder", folder.ID, true)
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"message": "Folder created!",
@@ -276,7 +299,17 @@ func UpdateFolder(c *fiber.Ctx, db *pgxpool.Pool) error {
 		argIndex++
 	}
 
+	before := auditFolder(db, folderId)
+	if before == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Folder not found"})
+	}
+
 	if folder.ParentFolderID != nil && *folder.ParentFolderID != "" {
+		err := checkDestination(db, c.Locals("user_id").(string), before.OrganizationID, folder.ParentFolderID)
+		if err != nil {
+			return respondStatusError(c, err, "Error checking destination folder")
+		}
+
 		updateFields = append(updateFields, fmt.Sprintf("parent_folder_id = $%d", argIndex))
 		args = append(args, *folder.ParentFolderID)
 		argIndex++
@@ -286,6 +319,18 @@ func UpdateFolder(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "No fields to update"})
 	}
 
+	// Renamed and moved folders must not take a name used in their parent
+	parentID, name := before.ParentFolderID, before.Name
+	if folder.ParentFolderID != nil && *folder.ParentFolderID != "" {
+		parentID = folder.ParentFolderID
+	}
+	if folder.Name != "" {
+		name = folder.Name
+	}
+	if _, err := resolveNameConflict(db, conflictFail, "folder", before.OrganizationID, parentID, name, folderId); err != nil {
+		return respondStatusError(c, err, "Error checking for existing folder")
+	}
+
 	updateFields = append(updateFields, fmt.Sprintf("updated_at = $%d", argIndex))
 	args = append(args, folder.UpdatedAt)
 	argIndex++
@@ -298,11 +343,21 @@ func UpdateFolder(c *fiber.Ctx, db *pgxpool.Pool) error {
 
 	args = append(args, folderId)
 
-	_, err := db.Exec(context.Background(), query, args...)
+	err := auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if folder.ParentFolderID != nil && *folder.ParentFolderID != "" {
+			if err := checkFolderCycle(tx, folderId, folder.ParentFolderID); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := tx.Exec(context.Background(), query, args...); err != nil {
+			return nil, err
+		}
+		return &auditEvent{Action: "folder.update", TargetType: "folder", TargetID: folderId, Before: before, After: auditFolder(tx, folderId)}, nil
+	})
 	if err != nil {
-		log.Println("Error updating folder: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating folder", "message": err.Error()})
+		return respondStatusError(c, nameTaken(err), "Error updating folder")
 	}
+	touchRecentItem(db, c.Locals("user_id").(string), "folder", folderId, true)
 
 	return c.Status(fiber.StatusOK).JSON(folder)
 }
@@ -324,6 +379,16 @@ func MoveFolderTrash(c *fiber.Ctx, db *pgxpool.Pool) error {
 	}
 	defer tx.Rollback(context.Background())
 
+	// Subfolders the user can't edit would go with the folder
+	restricted, err := hasRestrictedDescendants(tx, c.Locals("user_id").(string), folderId, permissionEditor)
+	if err != nil {
+		log.Println("Error checking permissions: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if restricted {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You need editor access to all the subfolders of this folder"})
+	}
+
 	folderQuery := "UPDATE folders SET deleted = true, deleted_at = $1 WHERE (id = $2 OR parent_folder_id = $2) AND deleted = false;"
 	filesQuery := "UPDATE files SET deleted = true, deleted_at = $1 WHERE folder_id = $2 AND deleted = false;"
 
@@ -341,6 +406,11 @@ func MoveFolderTrash(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting files", "message": err.Error()})
 	}
 
+	if err := recordAuditTx(c, tx, auditEvent{Action: "folder.trash", TargetType: "folder", TargetID: folderId, After: auditFolder(tx, folderId)}); err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting folder", "message": err.Error()})
+	}
+
 	err = tx.Commit(context.Background())
 	if err != nil {
 		log.Println("Error committing transaction: ", err)
@@ -366,6 +436,18 @@ func DeleteFolder(c *fiber.Ctx, db *pgxpool.Pool) error {
 	}
 	defer tx.Rollback(context.Background())
 
+	// Subfolders the user can't edit would go with the folder
+	restricted, err := hasRestrictedDescendants(tx, c.Locals("user_id").(string), folderId, permissionEditor)
+	if err != nil {
+		log.Println("Error checking permissions: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if restricted {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You need editor access to all the subfolders of this folder"})
+	}
+
+	before := auditFolder(db, folderId)
+
 	folderQuery := "DELETE FROM folders WHERE (id =$1 OR parent_folder_id = $1) AND deleted = true"
 	filesQuery := "DELETE FROM files WHERE folder_id =$1 AND deleted = true"
 
@@ -376,10 +458,10 @@ func DeleteFolder(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting folder", "message": err.Error()})
 	}
 
-	// Select file_paths of the slected files and delete them from spaces
+	// Select file_paths of the slected files and delete them from spaces, content in blobs is removed once nothing references it
 	rows, err = db.Query(
 		context.Background(),
-		"SELECT file_path FROM files WHERE folder_id = $1",
+		"SELECT file_path FROM files WHERE folder_id = $1 AND blob_id IS NULL",
 		folderId,
 	)
 
@@ -408,6 +490,11 @@ func DeleteFolder(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
 	}
 
+	if err := deleteVersionObjects(db, "f.folder_id = $1", folderId); err != nil {
+		log.Println("Error deleting file versions from Spaces:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting file versions from Spaces"})
+	}
+
 	// Delete files
 	_, err = tx.Exec(context.Background(), filesQuery, folderId)
 	if err != nil {
@@ -415,6 +502,11 @@ func DeleteFolder(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting files", "message": err.Error()})
 	}
 
+	if err := recordAuditTx(c, tx, auditEvent{Action: "folder.delete", TargetType: "folder", TargetID: folderId, Before: before}); err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting folder", "message": err.Error()})
+	}
+
 	err = tx.Commit(context.Background())
 	if err != nil {
 		log.Println("Error committing transaction: ", err)
@@ -432,6 +524,25 @@ func RestoreFolder(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Folder id missing"})
 	}
 
+	strategy, err := conflictStrategy(c)
+	if err != nil {
+		return respondStatusError(c, err, "Error reading conflict strategy")
+	}
+
+	folder := auditFolder(db, folderId)
+	if folder == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Folder not found"})
+	}
+
+	resolution, err := resolveNameConflict(db, strategy, "folder", folder.OrganizationID, folder.ParentFolderID, folder.Name, folderId)
+	if err != nil {
+		return respondStatusError(c, err, "Error checking for existing folder")
+	}
+
+	if resolution.Skip {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Folder left in the recycle bin, its name is taken", "existing_id": resolution.ExistingID})
+	}
+
 	tx, err := db.Begin(context.Background())
 	if err != nil {
 		log.Println("Error starting transaction: ", err)
@@ -439,30 +550,32 @@ func RestoreFolder(c *fiber.Ctx, db *pgxpool.Pool) error {
 	}
 	defer tx.Rollback(context.Background())
 
-	//Restore folder
-	query := "UPDATE folders SET deleted = false WHERE (id = $1 OR parent_folder_id = $1) AND deleted = true;"
-	_, err = db.Exec(
+	//Restore folder, under a new name when renamed
+	query := "UPDATE folders SET deleted = false, name = CASE WHEN id = $1 THEN $2 ELSE name END WHERE (id = $1 OR parent_folder_id = $1) AND deleted = true;"
+	_, err = tx.Exec(
 		context.Background(),
 		query,
-		folderId,
+		folderId, resolution.Name,
 	)
 	if err != nil {
-		log.Println("Error restoring folder: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error restoring folder", "message": err.Error()})
+		return respondStatusError(c, nameTaken(err), "Error restoring folder")
 	}
 
 	// Update the files within the folders
 	filesQuery := "UPDATE files SET deleted = false WHERE folder_id = $1 AND deleted = true;"
 	_, err = tx.Exec(context.Background(), filesQuery, folderId)
 	if err != nil {
-		log.Println("Error restoring files: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error restoring files", "message": err.Error()})
+		return respondStatusError(c, nameTaken(err), "Error restoring files")
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{Action: "folder.restore", TargetType: "folder", TargetID: folderId, After: auditFolder(tx, folderId)}); err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error restoring folder", "message": err.Error()})
 	}
 
 	err = tx.Commit(context.Background())
 	if err != nil {
-		log.Println("Error committing transaction: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error committing transaction", "message": err.Error()})
+		return respondStatusError(c, nameTaken(err), "Error committing transaction")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Folder restored"})
@@ -470,8 +583,15 @@ func RestoreFolder(c *fiber.Ctx, db *pgxpool.Pool) error {
 
 // DeleteExpiredFolders deletes folders where the current date is past the deletedAt date
 func DeleteExpiredFolders(db *pgxpool.Pool) {
-	query := "DELETE FROM folders WHERE deleted = true AND deleted_at < $1;"
-	_, err := db.Exec(
+	query := "DELETE FROM folders WHERE deleted = true AND deleted_at < $1 RETURNING id, organization_id, name;"
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error deleting expired folders: ", err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	rows, err := tx.Query(
 		context.Background(),
 		query,
 		time.Now(),
@@ -479,80 +599,89 @@ func DeleteExpiredFolders(db *pgxpool.Pool) {
 
 	if err != nil {
 		log.Println("Error deleting expired folders: ", err)
-	} else {
-		log.Println("Expired folders deleted successfully")
+		return
 	}
-}
-
-// GetDeletedFolders retrieves all folders where deleted = true
-func GetDeletedFolders(c *fiber.Ctx, db *pgxpool.Pool) error {
-	organizationId := c.Params("organization_id")
+	defer rows.Close()
 
-	if organizationId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "organizationId missing"})
+	var purged []models.Folder
+	for rows.Next() {
+		var folder models.Folder
+		if err := rows.Scan(&folder.ID, &folder.OrganizationID, &folder.Name); err != nil {
+			log.Println("Error scanning row: ", err)
+			return
+		}
+		purged = append(purged, folder)
 	}
 
-	query := `
-		SELECT id, name, parent_folder_id, created_at, updated_at, deleted, deleted_at
-		FROM folders
-		WHERE deleted = true 
-		AND organization_id = $1 AND parent_folder_id IS NULL;
-	`
-	rows, err := db.Query(context.Background(), query, organizationId)
-	if err != nil {
-		log.Println("Error querying deleted folders: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error querying deleted folders", "message": err.Error()})
+	if err := rows.Err(); err != nil {
+		log.Println("Error deleting expired folders: ", err)
+		return
 	}
-	defer rows.Close()
+	rows.Close()
 
-	var folders []models.Folder
-	for rows.Next() {
-		var folder models.Folder
-		err := rows.Scan(&folder.ID, &folder.Name, &folder.ParentFolderID, &folder.CreatedAt, &folder.UpdatedAt, &folder.Deleted, &folder.DeletedAt)
-		if err != nil {
-			log.Println("Error scanning folder: ", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning folder", "message": err.Error()})
+	for i := range purged {
+		if err := recordSystemAuditTx(tx, auditEvent{Action: "folder.purge", TargetType: "folder", TargetID: purged[i].ID, Before: &purged[i]}); err != nil {
+			log.Println("Error deleting expired folders: ", err)
+			return
 		}
-		folders = append(folders, folder)
 	}
 
-	if err = rows.Err(); err != nil {
-		log.Println("Error iterating over rows: ", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating over rows", "message": err.Error()})
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error deleting expired folders: ", err)
+		return
 	}
+	log.Println("Expired folders deleted successfully")
+}
+
+// GetDeletedFolders lists the folders in the recycle bin at the root of an organization, a page at a time
+func GetDeletedFolders(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
 
-	return c.Status(fiber.StatusOK).JSON(folders)
+	if organizationId == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "organizationId missing"})
+	}
+
+	return listFolders(c, db, "deleted = true AND organization_id = $1 AND parent_folder_id IS NULL AND "+folderRankCondition("id", "$2", "$1", "NULL", "1", permissionViewer), []interface{}{organizationId, userID}, "deleted_at")
 }
 
 func RegisterFolderRoutes(app *fiber.App, db *pgxpool.Pool) {
 	// Folder routes
-	folderGroup := app.Group("/folder")
+	folderGroup := app.Group("/folder", middleware.AuthRequired(db))
+	read := middleware.RequireScope(db, middleware.ScopeReadFiles)
+	write := middleware.RequireScope(db, middleware.ScopeWriteFiles)
 
-	folderGroup.Post("/create", func(c *fiber.Ctx) error {
+	folderGroup.Post("/create", write, func(c *fiber.Ctx) error {
 		return CreateFolder(c, db)
 	})
-	folderGroup.Put("/update/:folder_id", func(c *fiber.Ctx) error {
+	folderGroup.Put("/update/:folder_id", write, requireFolderPermission(db, permissionEditor), func(c *fiber.Ctx) error {
 		return UpdateFolder(c, db)
 	})
-	folderGroup.Put("/restore/:folder_id", func(c *fiber.Ctx) error {
+	folderGroup.Put("/move/:folder_id", write, func(c *fiber.Ctx) error {
+		return MoveItem(c, db)
+	})
+	folderGroup.Post("/copy/:folder_id", write, func(c *fiber.Ctx) error {
+		return CopyItem(c, db)
+	})
+	folderGroup.Put("/restore/:folder_id", write, requireFolderPermission(db, permissionEditor), func(c *fiber.Ctx) error {
 		return RestoreFolder(c, db)
 	})
-	folderGroup.Put("/delete/:folder_id", func(c *fiber.Ctx) error {
+	folderGroup.Put("/delete/:folder_id", write, requireFolderPermission(db, permissionEditor), func(c *fiber.Ctx) error {
 		return MoveFolderTrash(c, db)
 	})
-	folderGroup.Delete("/delete/permanent/:folder_id", func(c *fiber.Ctx) error {
+	folderGroup.Delete("/delete/permanent/:folder_id", write, requireFolderPermission(db, permissionEditor), func(c *fiber.Ctx) error {
 		return DeleteFolder(c, db)
 	})
-	folderGroup.Get("/fetch/all/:organization_id", func(c *fiber.Ctx) error {
+	folderGroup.Get("/fetch/all/:organization_id", read, func(c *fiber.Ctx) error {
 		return GetFolders(c, db)
 	})
-	folderGroup.Get("/fetch/children/:organization_id/:parent_folder_id", func(c *fiber.Ctx) error {
+	folderGroup.Get("/fetch/children/:organization_id/:parent_folder_id", read, func(c *fiber.Ctx) error {
 		return GetChildFolders(c, db)
 	})
-	folderGroup.Get("/fetch/specific/:folder_id", func(c *fiber.Ctx) error {
+	folderGroup.Get("/fetch/specific/:folder_id", read, requireFolderPermission(db, permissionViewer), func(c *fiber.Ctx) error {
 		return GetFolder(c, db)
 	})
-	folderGroup.Get("/fetch/deleted/:organization_id", func(c *fiber.Ctx) error {
+	folderGroup.Get("/fetch/deleted/:organization_id", read, func(c *fiber.Ctx) error {
 		return GetDeletedFolders(c, db)
 	})
 }
@@ -0,0 +1,386 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"server/middleware"
+	"server/models"
+	"server/otp"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const folderShareColumns = `
+	fs.id, fs.folder_id, f.name, fs.organization_id, o.name, fs.target_organization_id, fs.target_user_id,
+	COALESCE(t.name, u.email, ''), fs.role, fs.created_by, fs.created_at, fs.accepted_at, fs.revoked_at
+`
+
+const folderShareJoins = `
+	FROM foldershares fs
+	JOIN folders f ON f.id = fs.folder_id
+	JOIN organizations o ON o.organization_id = fs.organization_id
+	LEFT JOIN organizations t ON t.organization_id = fs.target_organization_id
+	LEFT JOIN users u ON u.user_id = fs.target_user_id
+`
+
+// folderShareSentMessage answers shares with an email, it doesn't tell whether an account uses the email
+const folderShareSentMessage = "If a Silo account uses this email, the folder is shared with it once they accept"
+
+func scanFolderShare(row pgx.Row) (models.FolderShare, error) {
+	var share models.FolderShare
+	err := row.Scan(
+		&share.ID,
+		&share.FolderID,
+		&share.FolderName,
+		&share.OrganizationID,
+		&share.OrganizationName,
+		&share.TargetOrganizationID,
+		&share.TargetUserID,
+		&share.TargetName,
+		&share.Role,
+		&share.CreatedBy,
+		&share.CreatedAt,
+		&share.AcceptedAt,
+		&share.RevokedAt,
+	)
+	return share, err
+}
+
+// queryFolderShares runs a folder share query and collects its rows
+func queryFolderShares(db *pgxpool.Pool, query string, args ...interface{}) ([]models.FolderShare, error) {
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []models.FolderShare{}
+	for rows.Next() {
+		share, err := scanFolderShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+
+	return shares, rows.Err()
+}
+
+// CreateFolderShare shares a folder with another organization or with a user outside the organization.
+// Nothing is copied, recipients work in the folder of the owning organization which keeps its storage and
+// audit log once they accept the share. Sharing again with the same recipient changes the role. Shares
+// with an email get the same reply whether an account uses the email or not
+func CreateFolderShare(c *fiber.Ctx, db *pgxpool.Pool) error {
+	folderId := c.Params("folder_id")
+	userID := c.Locals("user_id").(string)
+
+	var share models.FolderShare
+	if err := c.BodyParser(&share); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+
+	share.Email = strings.ToLower(strings.TrimSpace(share.Email))
+	if (share.TargetOrganizationID == nil) == (share.Email == "") {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Either target_organization_id or email is required"})
+	}
+	if share.Role != "viewer" && share.Role != "editor" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Role must be viewer or editor"})
+	}
+
+	folder := auditFolder(db, folderId)
+	if folder == nil || folder.Deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Folder not found"})
+	}
+
+	var organizationName string
+	err := db.QueryRow(context.Background(), "SELECT name FROM organizations WHERE organization_id = $1;", folder.OrganizationID).Scan(&organizationName)
+	if err != nil {
+		log.Println("Error fetching organization: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching organization", "message": err.Error()})
+	}
+
+	targetColumn, targetID := "target_organization_id", ""
+	if share.TargetOrganizationID != nil {
+		targetID = *share.TargetOrganizationID
+		if targetID == folder.OrganizationID {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Use folder permissions to share within the organization"})
+		}
+
+		err = db.QueryRow(
+			context.Background(),
+			"SELECT name FROM organizations WHERE organization_id = $1 AND deleted_at IS NULL;",
+			targetID,
+		).Scan(&share.TargetName)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Organization not found"})
+		} else if err != nil {
+			log.Println("Error fetching organization: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching organization", "message": err.Error()})
+		}
+	} else {
+		targetColumn = "target_user_id"
+		err = db.QueryRow(context.Background(), "SELECT user_id FROM users WHERE LOWER(email) = $1;", share.Email).Scan(&targetID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": folderShareSentMessage})
+		} else if err != nil {
+			log.Println("Error fetching user: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching user", "message": err.Error()})
+		}
+
+		role, err := getOrganizationRole(db, targetID, folder.OrganizationID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking membership", "message": err.Error()})
+		}
+		if role != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Use folder permissions to share within the organization"})
+		}
+
+		share.TargetUserID = &targetID
+		share.TargetName = share.Email
+	}
+
+	share.FolderID = folderId
+	share.FolderName = folder.Name
+	share.OrganizationID = folder.OrganizationID
+	share.OrganizationName = organizationName
+	share.CreatedBy = &userID
+	share.Email = ""
+
+	query := `
+		INSERT INTO foldershares (id, folder_id, organization_id, ` + targetColumn + `, role, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (folder_id, ` + targetColumn + `) WHERE revoked_at IS NULL DO UPDATE SET role = EXCLUDED.role
+		RETURNING id, created_at, accepted_at;
+	`
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if err := tx.QueryRow(
+			context.Background(),
+			query,
+			uuid.New().String(), folderId, folder.OrganizationID, targetID, share.Role, userID, time.Now(),
+		).Scan(&share.ID, &share.CreatedAt, &share.AcceptedAt); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: folder.OrganizationID, Action: "folder_share.create", TargetType: "folder", TargetID: folderId, After: &share}, nil
+	})
+	if err != nil {
+		log.Println("Error sharing folder: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error sharing folder", "message": err.Error()})
+	}
+
+	if share.TargetUserID != nil {
+		if err := otp.SendFolderShareEmail(share.TargetName, folder.Name, organizationName); err != nil {
+			log.Println("Error sending folder share email: ", err)
+		}
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": folderShareSentMessage})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(share)
+}
+
+// GetFolderShares lists the organizations and external users a folder is shared with
+func GetFolderShares(c *fiber.Ctx, db *pgxpool.Pool) error {
+	folderId := c.Params("folder_id")
+
+	shares, err := queryFolderShares(
+		db,
+		`SELECT `+folderShareColumns+folderShareJoins+`
+		WHERE fs.folder_id = $1 AND fs.revoked_at IS NULL
+		ORDER BY fs.created_at;`,
+		folderId,
+	)
+	if err != nil {
+		log.Println("Error fetching folder shares: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching folder shares", "message": err.Error()})
+	}
+
+	return sendList(c, shares)
+}
+
+// RevokeFolderShare stops sharing a folder with a recipient
+func RevokeFolderShare(c *fiber.Ctx, db *pgxpool.Pool) error {
+	folderId := c.Params("folder_id")
+	shareId := c.Params("share_id")
+
+	var share models.FolderShare
+	err := auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if err := tx.QueryRow(
+			context.Background(),
+			`
+				UPDATE foldershares SET revoked_at = NOW()
+				WHERE id = $1 AND folder_id = $2 AND revoked_at IS NULL
+				RETURNING id, folder_id, organization_id, target_organization_id, target_user_id, role, revoked_at;
+			`,
+			shareId, folderId,
+		).Scan(&share.ID, &share.FolderID, &share.OrganizationID, &share.TargetOrganizationID, &share.TargetUserID, &share.Role, &share.RevokedAt); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: share.OrganizationID, Action: "folder_share.revoke", TargetType: "folder", TargetID: folderId, Before: &share}, nil
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Folder share not found"})
+	} else if err != nil {
+		log.Println("Error revoking folder share: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error revoking folder share", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Folder share revoked!"})
+}
+
+// GetIncomingFolderShares lists the folders of other organizations shared with the logged in user, and with
+// the organization in the URL when one is given, to show in the drive as shared items. Shares without an
+// accepted_at are waiting for the recipient to accept them
+func GetIncomingFolderShares(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userID := c.Locals("user_id").(string)
+
+	var organizationId *string
+	if id := c.Params("organization_id"); id != "" {
+		role, err := getOrganizationRole(db, userID, id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking membership", "message": err.Error()})
+		}
+		if role == "" {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You are not a member of this organization"})
+		}
+		organizationId = &id
+	}
+
+	shares, err := queryFolderShares(
+		db,
+		`SELECT `+folderShareColumns+folderShareJoins+`
+		WHERE fs.revoked_at IS NULL AND f.deleted = false AND o.deleted_at IS NULL
+		AND (fs.target_user_id = $1 OR fs.target_organization_id = $2)
+		ORDER BY fs.created_at DESC;`,
+		userID, organizationId,
+	)
+	if err != nil {
+		log.Println("Error fetching shared folders: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching shared folders", "message": err.Error()})
+	}
+
+	return sendList(c, shares)
+}
+
+// isFolderShareRecipient reports whether a user answers a share for its recipient: the user a folder is
+// shared with, or an admin of the organization it is shared with
+func isFolderShareRecipient(db *pgxpool.Pool, userID string, share models.FolderShare) (bool, error) {
+	if share.TargetOrganizationID != nil {
+		return isOrganizationAdmin(db, userID, *share.TargetOrganizationID)
+	}
+	return share.TargetUserID != nil && *share.TargetUserID == userID, nil
+}
+
+// getRecipientFolderShare fetches the live share in the share_id param for its recipient. When ok is false
+// the error response has been sent
+func getRecipientFolderShare(c *fiber.Ctx, db *pgxpool.Pool) (models.FolderShare, bool, error) {
+	share, err := scanFolderShare(db.QueryRow(
+		context.Background(),
+		`SELECT `+folderShareColumns+folderShareJoins+` WHERE fs.id = $1 AND fs.revoked_at IS NULL;`,
+		c.Params("share_id"),
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return share, false, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Folder share not found"})
+	} else if err != nil {
+		log.Println("Error fetching folder share: ", err)
+		return share, false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching folder share", "message": err.Error()})
+	}
+
+	allowed, err := isFolderShareRecipient(db, c.Locals("user_id").(string), share)
+	if err != nil {
+		return share, false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if !allowed {
+		// Shares of other users look the same as missing ones
+		return share, false, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Folder share not found"})
+	}
+
+	return share, true, nil
+}
+
+// AcceptFolderShare gives the recipient of a folder share access to the folder, until then the share is only
+// listed in its incoming shares
+func AcceptFolderShare(c *fiber.Ctx, db *pgxpool.Pool) error {
+	share, ok, err := getRecipientFolderShare(c, db)
+	if !ok {
+		return err
+	}
+	if share.AcceptedAt != nil {
+		return c.Status(fiber.StatusOK).JSON(share)
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if err := tx.QueryRow(
+			context.Background(),
+			"UPDATE foldershares SET accepted_at = NOW() WHERE id = $1 AND revoked_at IS NULL RETURNING accepted_at;",
+			share.ID,
+		).Scan(&share.AcceptedAt); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: share.OrganizationID, Action: "folder_share.accept", TargetType: "folder", TargetID: share.FolderID, After: &share}, nil
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Folder share not found"})
+	} else if err != nil {
+		log.Println("Error accepting folder share: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error accepting folder share", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(share)
+}
+
+// LeaveFolderShare removes a shared folder from the drive of its recipient, or declines a share that wasn't
+// accepted yet. Users leave folders shared with them, admins of a recipient organization leave folders
+// shared with it
+func LeaveFolderShare(c *fiber.Ctx, db *pgxpool.Pool) error {
+	shareId := c.Params("share_id")
+
+	share, ok, err := getRecipientFolderShare(c, db)
+	if !ok {
+		return err
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(context.Background(), "UPDATE foldershares SET revoked_at = NOW() WHERE id = $1;", shareId); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: share.OrganizationID, Action: "folder_share.leave", TargetType: "folder", TargetID: share.FolderID, Before: &share}, nil
+	})
+	if err != nil {
+		log.Println("Error leaving folder share: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error leaving folder share", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Shared folder removed"})
+}
+
+func RegisterFolderShareRoutes(app *fiber.App, db *pgxpool.Pool) {
+	sharedGroup := app.Group("/shared", middleware.AuthRequired(db))
+	read := middleware.RequireScope(db, middleware.ScopeReadFiles)
+	manage := middleware.RequireScope(db, middleware.ScopeManageMembers)
+	manager := requireFolderPermission(db, permissionManager)
+
+	sharedGroup.Post("/create/:folder_id", manage, manager, func(c *fiber.Ctx) error {
+		return CreateFolderShare(c, db)
+	})
+	sharedGroup.Get("/fetch/folder/:folder_id", read, manager, func(c *fiber.Ctx) error {
+		return GetFolderShares(c, db)
+	})
+	sharedGroup.Delete("/revoke/:folder_id/:share_id", manage, manager, func(c *fiber.Ctx) error {
+		return RevokeFolderShare(c, db)
+	})
+	sharedGroup.Get("/fetch/incoming/:organization_id?", read, func(c *fiber.Ctx) error {
+		return GetIncomingFolderShares(c, db)
+	})
+	sharedGroup.Post("/accept/:share_id", manage, func(c *fiber.Ctx) error {
+		return AcceptFolderShare(c, db)
+	})
+	sharedGroup.Delete("/leave/:share_id", manage, func(c *fiber.Ctx) error {
+		return LeaveFolderShare(c, db)
+	})
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestFolderShareNeedsAcceptance(t *testing.T) {
+	db := testDB(t)
+
+	creatorID := testUser(t, db, "creator@example.com")
+	recipientID := testUser(t, db, "recipient@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+	folderID := testFolder(t, db, organizationID, "", true)
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user_id", c.Get("X-Test-User"))
+		return c.Next()
+	})
+	app.Post("/share/:folder_id", func(c *fiber.Ctx) error {
+		return CreateFolderShare(c, db)
+	})
+	app.Post("/accept/:share_id", func(c *fiber.Ctx) error {
+		return AcceptFolderShare(c, db)
+	})
+
+	send := func(path string, userID string, body string) (int, string) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Test-User", userID)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(response)
+	}
+
+	// Sharing with an email gets the same reply whether an account uses it or not
+	status, body := send("/share/"+folderID, creatorID, `{"email": "recipient@example.com", "role": "viewer"}`)
+	unknownStatus, unknownBody := send("/share/"+folderID, creatorID, `{"email": "nobody@example.com", "role": "viewer"}`)
+	if status != unknownStatus || body != unknownBody {
+		t.Errorf("shares with an existing and a missing account differ: %d %s, %d %s", status, body, unknownStatus, unknownBody)
+	}
+
+	rank, err := folderPermission(db, recipientID, folderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rank != permissionNone {
+		t.Errorf("recipient has rank %d before accepting", rank)
+	}
+
+	var shareID string
+	err = db.QueryRow(context.Background(), "SELECT id::text FROM foldershares WHERE target_user_id = $1;", recipientID).Scan(&shareID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := send("/accept/"+shareID, creatorID, ""); status != fiber.StatusNotFound {
+		t.Errorf("someone else accepted the share, status %d", status)
+	}
+	if status, body := send("/accept/"+shareID, recipientID, ""); status != fiber.StatusOK {
+		t.Fatalf("recipient couldn't accept the share, status %d %s", status, body)
+	}
+
+	rank, err = folderPermission(db, recipientID, folderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rank != permissionViewer {
+		t.Errorf("recipient has rank %d after accepting, want viewer", rank)
+	}
+}
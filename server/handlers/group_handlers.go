@@ -0,0 +1,519 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"server/middleware"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const groupColumns = `
+	g.id, g.organization_id, g.name, g.description, g.role,
+	(SELECT COUNT(*) FROM groupmembers gm WHERE gm.group_id = g.id), g.created_by, g.created_at, g.updated_at
+`
+
+func scanGroup(row pgx.Row) (models.Group, error) {
+	var group models.Group
+	err := row.Scan(
+		&group.ID,
+		&group.OrganizationID,
+		&group.Name,
+		&group.Description,
+		&group.Role,
+		&group.MemberCount,
+		&group.CreatedBy,
+		&group.CreatedAt,
+		&group.UpdatedAt,
+	)
+	return group, err
+}
+
+// groupExists reports whether a group belongs to an organization
+func groupExists(db *pgxpool.Pool, groupID string, organizationID string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM groups WHERE id = $1 AND organization_id = $2);",
+		groupID, organizationID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// isGroupMember reports whether a user belongs to a group
+func isGroupMember(db *pgxpool.Pool, groupID string, userID string) (bool, error) {
+	var isMember bool
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM groupmembers WHERE group_id = $1 AND user_id = $2);",
+		groupID, userID,
+	).Scan(&isMember)
+	return isMember, err
+}
+
+// requireGroupAdmin rejects users who aren't admins of the organization in the URL
+func requireGroupAdmin(db *pgxpool.Pool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		isAdmin, err := isOrganizationAdmin(db, c.Locals("user_id").(string), c.Params("organization_id"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+		}
+		if !isAdmin {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can manage groups"})
+		}
+
+		return c.Next()
+	}
+}
+
+// requireGroupMember rejects users who aren't members of the organization in the URL
+func requireGroupMember(db *pgxpool.Pool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		role, err := getOrganizationRole(db, c.Locals("user_id").(string), c.Params("organization_id"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking membership", "message": err.Error()})
+		}
+		if role == "" {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You are not a member of this organization"})
+		}
+
+		return c.Next()
+	}
+}
+
+// CreateGroup creates a group in an organization, members of a group with the admin role are organization admins
+func CreateGroup(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	var group models.Group
+	if err := c.BodyParser(&group); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Group name is required"})
+	}
+	if group.Role == "" {
+		group.Role = "member"
+	}
+	if group.Role != "member" && group.Role != "admin" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Role must be member or admin"})
+	}
+
+	group.ID = uuid.New().String()
+	group.OrganizationID = organizationId
+	group.CreatedBy = &userID
+	group.CreatedAt = time.Now()
+	group.UpdatedAt = group.CreatedAt
+	group.MemberCount = 0
+
+	err := auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(
+			context.Background(),
+			`
+				INSERT INTO groups (id, organization_id, name, description, role, created_by, created_at, updated_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
+			`,
+			group.ID, group.OrganizationID, group.Name, group.Description, group.Role, userID, group.CreatedAt, group.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "group.create", TargetType: "group", TargetID: group.ID, After: &group}, nil
+	})
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A group with this name already exists"})
+	} else if err != nil {
+		log.Println("Error creating group: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating group", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(group)
+}
+
+// GetGroups lists the groups of an organization
+func GetGroups(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+
+	query := `SELECT ` + groupColumns + `
+		FROM groups g
+		WHERE g.organization_id = $1
+		ORDER BY g.name;
+	`
+	rows, err := db.Query(context.Background(), query, organizationId)
+	if err != nil {
+		log.Println("Error fetching groups: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching groups", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	groups := []models.Group{}
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		groups = append(groups, group)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	return sendList(c, groups)
+}
+
+// GetGroup returns a group and its members
+func GetGroup(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	groupId := c.Params("group_id")
+
+	query := `SELECT ` + groupColumns + `
+		FROM groups g
+		WHERE g.id = $1 AND g.organization_id = $2;
+	`
+	group, err := scanGroup(db.QueryRow(context.Background(), query, groupId, organizationId))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Group not found"})
+	} else if err != nil {
+		log.Println("Error fetching group: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching group", "message": err.Error()})
+	}
+
+	rows, err := db.Query(
+		context.Background(),
+		`
+			SELECT gm.group_id, u.user_id, u.email, u.first_name, u.last_name, gm.added_by, gm.created_at
+			FROM groupmembers gm
+			JOIN users u ON u.user_id = gm.user_id
+			WHERE gm.group_id = $1
+			ORDER BY u.first_name, u.last_name;
+		`,
+		groupId,
+	)
+	if err != nil {
+		log.Println("Error fetching group members: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching group members", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	members := []models.GroupMember{}
+	for rows.Next() {
+		var member models.GroupMember
+		if err := rows.Scan(&member.GroupID, &member.UserID, &member.Email, &member.FirstName, &member.LastName, &member.AddedBy, &member.CreatedAt); err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		members = append(members, member)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"group": group, "members": members})
+}
+
+// UpdateGroup renames a group or changes its description or role
+func UpdateGroup(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	groupId := c.Params("group_id")
+
+	var data models.Group
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	if data.Role != "" && data.Role != "member" && data.Role != "admin" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Role must be member or admin"})
+	}
+
+	query := `SELECT ` + groupColumns + `
+		FROM groups g
+		WHERE g.id = $1 AND g.organization_id = $2;
+	`
+	before, err := scanGroup(db.QueryRow(context.Background(), query, groupId, organizationId))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Group not found"})
+	} else if err != nil {
+		log.Println("Error fetching group: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching group", "message": err.Error()})
+	}
+
+	after := before
+	if name := strings.TrimSpace(data.Name); name != "" {
+		after.Name = name
+	}
+	if data.Description != nil {
+		after.Description = data.Description
+	}
+	if data.Role != "" {
+		after.Role = data.Role
+	}
+	after.UpdatedAt = time.Now()
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(
+			context.Background(),
+			"UPDATE groups SET name = $1, description = $2, role = $3, updated_at = $4 WHERE id = $5;",
+			after.Name, after.Description, after.Role, after.UpdatedAt, groupId,
+		); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "group.update", TargetType: "group", TargetID: groupId, Before: &before, After: &after}, nil
+	})
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A group with this name already exists"})
+	} else if err != nil {
+		log.Println("Error updating group: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating group", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(after)
+}
+
+// DeleteGroup deletes a group along with its folder permissions and share links
+func DeleteGroup(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	groupId := c.Params("group_id")
+
+	var group models.Group
+	err := auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if err := tx.QueryRow(
+			context.Background(),
+			"DELETE FROM groups WHERE id = $1 AND organization_id = $2 RETURNING id, organization_id, name, role;",
+			groupId, organizationId,
+		).Scan(&group.ID, &group.OrganizationID, &group.Name, &group.Role); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "group.delete", TargetType: "group", TargetID: groupId, Before: &group}, nil
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Group not found"})
+	} else if err != nil {
+		log.Println("Error deleting group: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting group", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Group deleted!"})
+}
+
+// AddGroupMembers adds members of the organization to a group
+func AddGroupMembers(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	groupId := c.Params("group_id")
+	userID := c.Locals("user_id").(string)
+
+	var data struct {
+		UserIDs []string `json:"user_ids"`
+	}
+	if err := c.BodyParser(&data); err != nil || len(data.UserIDs) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "user_ids is required"})
+	}
+
+	exists, err := groupExists(db, groupId, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching group", "message": err.Error()})
+	}
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Group not found"})
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error adding group members", "message": err.Error()})
+	}
+	defer tx.Rollback(context.Background())
+
+	// Only members of the organization can join its groups
+	rows, err := tx.Query(
+		context.Background(),
+		`
+			INSERT INTO groupmembers (group_id, user_id, added_by, created_at)
+			SELECT $1, uo.user_id, $3, NOW() FROM userorganizations uo
+			WHERE uo.organization_id = $2 AND uo.user_id::text = ANY($4)
+			ON CONFLICT DO NOTHING
+			RETURNING user_id;
+		`,
+		groupId, organizationId, userID, data.UserIDs,
+	)
+	if err != nil {
+		log.Println("Error adding group members: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error adding group members", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	added := []string{}
+	for rows.Next() {
+		var memberID string
+		if err := rows.Scan(&memberID); err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		added = append(added, memberID)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	rows.Close()
+
+	if len(added) > 0 {
+		if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "group.member_add", TargetType: "group", TargetID: groupId, After: fiber.Map{"user_ids": added}}); err != nil {
+			log.Println(err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error adding group members", "message": err.Error()})
+		}
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error adding group members", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Group members added", "added": added})
+}
+
+// RemoveGroupMember removes a user from a group
+func RemoveGroupMember(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	groupId := c.Params("group_id")
+	memberId := c.Params("user_id")
+
+	err := auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		commandTag, err := tx.Exec(
+			context.Background(),
+			`
+				DELETE FROM groupmembers gm USING groups g
+				WHERE gm.group_id = g.id AND g.id = $1 AND g.organization_id = $2 AND gm.user_id = $3;
+			`,
+			groupId, organizationId, memberId,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if commandTag.RowsAffected() == 0 {
+			return nil, pgx.ErrNoRows
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "group.member_remove", TargetType: "group", TargetID: groupId, Before: fiber.Map{"user_id": memberId}}, nil
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Group member not found"})
+	}
+	if err != nil {
+		log.Println("Error removing group member: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error removing group member", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Group member removed"})
+}
+
+// GetUserGroups lists the groups a user belongs to in an organization, including the groups provisioned
+// through SCIM, along with the role they give. Users can list their own groups, admins anyone's
+func GetUserGroups(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+	memberId := c.Params("user_id", userID)
+
+	if memberId != userID {
+		isAdmin, err := isOrganizationAdmin(db, userID, organizationId)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+		}
+		if !isAdmin {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can list the groups of other members"})
+		}
+	}
+
+	rows, err := db.Query(
+		context.Background(),
+		`
+			SELECT g.id, g.name, g.role, 'group' FROM groups g
+			JOIN groupmembers gm ON gm.group_id = g.id
+			WHERE g.organization_id = $1 AND gm.user_id = $2
+			UNION ALL
+			SELECT g.id, g.display_name, g.role, 'scim' FROM scimgroups g
+			JOIN scimgroupmembers gm ON gm.group_id = g.id
+			WHERE g.organization_id = $1 AND gm.user_id = $2
+			ORDER BY 2;
+		`,
+		organizationId, memberId,
+	)
+	if err != nil {
+		log.Println("Error fetching user groups: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching user groups", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	groups := []fiber.Map{}
+	for rows.Next() {
+		var id, name, role, source string
+		if err := rows.Scan(&id, &name, &role, &source); err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		groups = append(groups, fiber.Map{"id": id, "name": name, "role": role, "source": source})
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	role, err := getOrganizationRole(db, memberId, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking membership", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"user_id": memberId, "effective_role": role, "groups": groups})
+}
+
+func RegisterGroupRoutes(app *fiber.App, db *pgxpool.Pool) {
+	groupGroup := app.Group("/group", middleware.AuthRequired(db))
+	manage := middleware.RequireScope(db, middleware.ScopeManageMembers)
+	read := middleware.RequireScope(db, middleware.ScopeReadFiles)
+	admin := requireGroupAdmin(db)
+
+	groupGroup.Post("/create/:organization_id", manage, admin, func(c *fiber.Ctx) error {
+		return CreateGroup(c, db)
+	})
+	groupGroup.Get("/fetch/all/:organization_id", read, requireGroupMember(db), func(c *fiber.Ctx) error {
+		return GetGroups(c, db)
+	})
+	groupGroup.Get("/fetch/specific/:organization_id/:group_id", read, requireGroupMember(db), func(c *fiber.Ctx) error {
+		return GetGroup(c, db)
+	})
+	groupGroup.Get("/fetch/user/:organization_id/:user_id?", read, requireGroupMember(db), func(c *fiber.Ctx) error {
+		return GetUserGroups(c, db)
+	})
+	groupGroup.Put("/update/:organization_id/:group_id", manage, admin, func(c *fiber.Ctx) error {
+		return UpdateGroup(c, db)
+	})
+	groupGroup.Delete("/delete/:organization_id/:group_id", manage, admin, func(c *fiber.Ctx) error {
+		return DeleteGroup(c, db)
+	})
+	groupGroup.Post("/members/:organization_id/:group_id", manage, admin, func(c *fiber.Ctx) error {
+		return AddGroupMembers(c, db)
+	})
+	groupGroup.Delete("/members/:organization_id/:group_id/:user_id", manage, admin, func(c *fiber.Ctx) error {
+		return RemoveGroupMember(c, db)
+	})
+}
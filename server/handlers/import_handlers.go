@@ -0,0 +1,719 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"server/middleware"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// MaxImportArchiveSize is the largest archive that can be uploaded to be imported
+const MaxImportArchiveSize = 512 << 20
+
+// ImportPathPrefix starts the paths of the import routes, which take request bodies up to importMaxBodySize
+const ImportPathPrefix = "/import/"
+
+const (
+	// importMaxBodySize is the largest request body of an import, the archive with the form around it
+	importMaxBodySize = MaxImportArchiveSize + 1<<20
+	// importMaxPending is the most imports of an organization that can wait or run at once
+	importMaxPending = 5
+	// importMaxEntries is the most files and folders a single archive can hold
+	importMaxEntries = 10000
+	// importMaxSize is the most bytes the files of a single archive can extract to
+	importMaxSize = 4 << 30
+	// importProgressInterval is how often the progress of a running import is saved
+	importProgressInterval = time.Second
+)
+
+// Formats of the archives that can be imported
+const (
+	importFormatZip   = "zip"
+	importFormatTar   = "tar"
+	importFormatTarGz = "tar.gz"
+)
+
+// importSlots bounds how many imports extract at once, others wait as pending
+var importSlots = make(chan struct{}, 2)
+
+// importArchiveDir holds the uploaded archives until their import is done
+var importArchiveDir = filepath.Join(os.TempDir(), "storify-imports")
+
+const importJobColumns = `
+	id, organization_id, folder_id, user_id, archive_name, on_conflict, status, total_entries, total_bytes,
+	processed_entries, processed_bytes, files_created, files_replaced, folders_created, skipped_entries, error,
+	created_at, started_at, completed_at
+`
+
+// importEntry is a file or folder found in an archive, Path is cleaned and relative to the import destination
+type importEntry struct {
+	Path string
+	Dir  bool
+	Size int64
+	// Open reads the content of a file
+	Open func() (io.ReadCloser, error)
+}
+
+// importRun is an import job while its archive is extracted
+type importRun struct {
+	db  *pgxpool.Pool
+	job models.ImportJob
+	// folders maps the lowercased folder paths of the archive to the folders they were extracted to
+	folders map[string]*string
+	savedAt time.Time
+}
+
+func scanImportJob(row pgx.Row) (models.ImportJob, error) {
+	var job models.ImportJob
+	err := row.Scan(
+		&job.ID,
+		&job.OrganizationID,
+		&job.FolderID,
+		&job.UserID,
+		&job.ArchiveName,
+		&job.OnConflict,
+		&job.Status,
+		&job.TotalEntries,
+		&job.TotalBytes,
+		&job.ProcessedEntries,
+		&job.ProcessedBytes,
+		&job.FilesCreated,
+		&job.FilesReplaced,
+		&job.FoldersCreated,
+		&job.SkippedEntries,
+		&job.Error,
+		&job.CreatedAt,
+		&job.StartedAt,
+		&job.CompletedAt,
+	)
+	return job, err
+}
+
+// windowsDrivePath matches names starting with a drive like C:/, backslashes are already turned into slashes
+var windowsDrivePath = regexp.MustCompile(`^[A-Za-z]:(/|$)`)
+
+// cleanImportPath turns the name of an archive entry into a path relative to the import destination, "" is the
+// destination itself. Absolute paths and paths climbing out of the destination with .. are rejected
+func cleanImportPath(name string) (string, error) {
+	name = strings.ToValidUTF8(strings.ReplaceAll(name, "\\", "/"), "_")
+	if strings.HasPrefix(name, "/") || windowsDrivePath.MatchString(name) {
+		return "", &statusError{fiber.StatusBadRequest, "Archive entry " + name + " has an absolute path"}
+	}
+
+	segments := []string{}
+	for _, segment := range strings.Split(name, "/") {
+		switch {
+		case segment == "" || segment == ".":
+			continue
+		case segment == "..":
+			return "", &statusError{fiber.StatusBadRequest, "Archive entry " + name + " points outside the destination folder"}
+		case strings.ContainsRune(segment, 0) || utf8.RuneCountInString(segment) > 255:
+			return "", &statusError{fiber.StatusBadRequest, "Archive entry " + name + " has an invalid name"}
+		}
+		segments = append(segments, segment)
+	}
+
+	if len(segments) > maxPathDepth+1 {
+		return "", &statusError{fiber.StatusBadRequest, "Archive entry " + name + " is nested too deep"}
+	}
+
+	return strings.Join(segments, "/"), nil
+}
+
+// ignoredImportPath reports entries that operating systems add to archives, which are left out of imports
+func ignoredImportPath(entryPath string) bool {
+	base := path.Base(entryPath)
+	return strings.HasPrefix(entryPath, "__MACOSX/") || entryPath == "__MACOSX" || base == ".DS_Store" || base == "Thumbs.db"
+}
+
+// parentImportPath returns the path of the folder holding an entry, "" for entries at the top of the archive
+func parentImportPath(entryPath string) string {
+	parent := path.Dir(entryPath)
+	if parent == "." {
+		return ""
+	}
+	return parent
+}
+
+// detectArchiveFormat tells ZIP, tar and gzipped tar archives apart from their first bytes
+func detectArchiveFormat(archive *os.File) (string, error) {
+	header := make([]byte, 512)
+	n, err := archive.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return importFormatZip, nil
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return importFormatTarGz, nil
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return importFormatTar, nil
+	}
+
+	return "", &statusError{fiber.StatusBadRequest, "Archive must be a ZIP, tar or tar.gz file"}
+}
+
+// walkArchive visits the files and folders of an archive in the order they are stored. Links and other special
+// entries are left out
+func walkArchive(archivePath string, format string, visit func(entry importEntry) error) error {
+	if format == importFormatZip {
+		reader, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return &statusError{fiber.StatusBadRequest, "Archive can't be read: " + err.Error()}
+		}
+		defer reader.Close()
+
+		for _, file := range reader.File {
+			mode := file.Mode()
+			if !mode.IsDir() && !mode.IsRegular() {
+				continue
+			}
+			if file.UncompressedSize64 > importMaxSize {
+				return &statusError{fiber.StatusRequestEntityTooLarge, "Archive entry " + file.Name + " is too large"}
+			}
+
+			entryPath, err := cleanImportPath(file.Name)
+			if err != nil {
+				return err
+			}
+			if entryPath == "" || ignoredImportPath(entryPath) {
+				continue
+			}
+
+			entry := importEntry{Path: entryPath, Dir: mode.IsDir(), Size: int64(file.UncompressedSize64), Open: file.Open}
+			if err := visit(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	var stream io.Reader = archive
+	if format == importFormatTarGz {
+		gzipReader, err := gzip.NewReader(archive)
+		if err != nil {
+			return &statusError{fiber.StatusBadRequest, "Archive can't be read: " + err.Error()}
+		}
+		defer gzipReader.Close()
+		stream = gzipReader
+	}
+
+	reader := tar.NewReader(stream)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return &statusError{fiber.StatusBadRequest, "Archive can't be read: " + err.Error()}
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeDir {
+			continue
+		}
+
+		entryPath, err := cleanImportPath(header.Name)
+		if err != nil {
+			return err
+		}
+		if entryPath == "" || ignoredImportPath(entryPath) {
+			continue
+		}
+
+		entry := importEntry{
+			Path: entryPath,
+			Dir:  header.Typeflag == tar.TypeDir,
+			Size: header.Size,
+			Open: func() (io.ReadCloser, error) { return io.NopCloser(reader), nil },
+		}
+		if entry.Dir {
+			entry.Size = 0
+		}
+		if err := visit(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// scanArchive checks every path of an archive and counts its entries and the bytes they extract to, within
+// the import limits
+func scanArchive(archivePath string, format string) (int, int64, error) {
+	var entries int
+	var size int64
+	err := walkArchive(archivePath, format, func(entry importEntry) error {
+		entries++
+		size += entry.Size
+		if entries > importMaxEntries {
+			return &statusError{fiber.StatusRequestEntityTooLarge, fmt.Sprintf("Archive holds more than %d files and folders", importMaxEntries)}
+		}
+		if size > importMaxSize {
+			return &statusError{fiber.StatusRequestEntityTooLarge, fmt.Sprintf("Archive extracts to more than %d GB", importMaxSize>>30)}
+		}
+		return nil
+	})
+	return entries, size, err
+}
+
+// saveImportArchive streams the archive form file of the request to a temporary file, which outlives the
+// request for the import job. It returns the path of the file, the name the archive was uploaded with and its format
+func saveImportArchive(c *fiber.Ctx) (string, string, string, error) {
+	boundary := string(c.Request().Header.MultipartFormBoundary())
+	if boundary == "" {
+		return "", "", "", &statusError{fiber.StatusBadRequest, "Missing archive file"}
+	}
+	body := c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+
+	reader := multipart.NewReader(body, boundary)
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return "", "", "", &statusError{fiber.StatusBadRequest, "Missing archive file"}
+		} else if err != nil {
+			return "", "", "", &statusError{fiber.StatusBadRequest, "Upload can't be read: " + err.Error()}
+		}
+		if part.FormName() != "archive" || part.FileName() == "" {
+			continue
+		}
+
+		archivePath, format, err := writeImportArchive(part)
+		return archivePath, part.FileName(), format, err
+	}
+}
+
+// writeImportArchive copies an uploaded archive of up to MaxImportArchiveSize bytes to a temporary file and
+// detects its format
+func writeImportArchive(upload io.Reader) (string, string, error) {
+	if err := os.MkdirAll(importArchiveDir, 0o700); err != nil {
+		return "", "", err
+	}
+	archive, err := os.CreateTemp(importArchiveDir, "import-*")
+	if err != nil {
+		return "", "", err
+	}
+	defer archive.Close()
+
+	format := ""
+	written, err := io.Copy(archive, io.LimitReader(upload, MaxImportArchiveSize+1))
+	if err == nil && written > MaxImportArchiveSize {
+		err = &statusError{fiber.StatusRequestEntityTooLarge, fmt.Sprintf("Archive is larger than %d MB", MaxImportArchiveSize>>20)}
+	}
+	if err == nil {
+		format, err = detectArchiveFormat(archive)
+	}
+	if err != nil {
+		os.Remove(archive.Name())
+		return "", "", err
+	}
+
+	return archive.Name(), format, nil
+}
+
+// checkPendingImports refuses a new import while an organization already has importMaxPending imports waiting
+// or running
+func checkPendingImports(db dbConn, organizationID string) error {
+	var pending int
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT COUNT(*) FROM importjobs WHERE organization_id = $1 AND status IN ('pending', 'running');",
+		organizationID,
+	).Scan(&pending)
+	if err != nil {
+		return err
+	}
+	if pending >= importMaxPending {
+		return &statusError{fiber.StatusTooManyRequests, fmt.Sprintf("Organization already has %d imports in progress", importMaxPending)}
+	}
+	return nil
+}
+
+// save stores the progress of an import job
+func (run *importRun) save() {
+	_, err := run.db.Exec(
+		context.Background(),
+		`
+			UPDATE importjobs SET status = $1, processed_entries = $2, processed_bytes = $3, files_created = $4,
+			files_replaced = $5, folders_created = $6, skipped_entries = $7, error = $8, started_at = $9, completed_at = $10
+			WHERE id = $11;
+		`,
+		run.job.Status, run.job.ProcessedEntries, run.job.ProcessedBytes, run.job.FilesCreated,
+		run.job.FilesReplaced, run.job.FoldersCreated, run.job.SkippedEntries, run.job.Error, run.job.StartedAt, run.job.CompletedAt,
+		run.job.ID,
+	)
+	if err != nil {
+		log.Printf("Error saving import job %s: %v", run.job.ID, err)
+	}
+	run.savedAt = time.Now()
+}
+
+// ensureFolder returns the folder an archive folder path was extracted to, creating it and the folders above it
+// when needed. Folders that already exist are merged into, unless the conflict strategy is rename
+func (run *importRun) ensureFolder(folderPath string) (*string, error) {
+	if folderPath == "" {
+		return run.job.FolderID, nil
+	}
+	if folderID, ok := run.folders[strings.ToLower(folderPath)]; ok {
+		return folderID, nil
+	}
+
+	parentID, err := run.ensureFolder(parentImportPath(folderPath))
+	if err != nil {
+		return nil, err
+	}
+
+	name := path.Base(folderPath)
+	existingID, err := findNameConflict(run.db, "folder", run.job.OrganizationID, parentID, name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if existingID != "" && run.job.OnConflict != conflictRename {
+		rank, err := containerPermission(run.db, run.job.UserID, run.job.OrganizationID, &existingID)
+		if err != nil {
+			return nil, err
+		}
+		if rank < permissionEditor {
+			return nil, &statusError{fiber.StatusForbidden, "You need editor access to the folder " + folderPath}
+		}
+
+		run.folders[strings.ToLower(folderPath)] = &existingID
+		return &existingID, nil
+	}
+
+	if existingID != "" {
+		if name, err = availableName(run.db, nil, "folder", run.job.OrganizationID, parentID, name); err != nil {
+			return nil, err
+		}
+	}
+
+	folderID := uuid.New().String()
+	_, err = run.db.Exec(
+		context.Background(),
+		`
+			INSERT INTO folders
+			(id, name, organization_id, parent_folder_id, created_at, updated_at, deleted, created_by)
+			VALUES
+			($1, $2, $3, $4, $5, $6, $7, $8);
+		`,
+		folderID, name, run.job.OrganizationID, parentID, time.Now(), time.Now(), false, run.job.UserID,
+	)
+	if err != nil {
+		return nil, nameTaken(err)
+	}
+
+	run.job.FoldersCreated++
+	run.folders[strings.ToLower(folderPath)] = &folderID
+	return &folderID, nil
+}
+
+// uploadEntry stores the content of an archive file in the blob of its hash and returns the id and file path of
+// the blob, content the organization already has isn't uploaded again. The content is checked against the size
+// in the archive, which the import limits were checked with
+func (run *importRun) uploadEntry(entry importEntry) (string, string, error) {
+	key, err := activeEncryptionKey(run.db, run.job.OrganizationID)
+	if err != nil {
+		return "", "", err
+	}
+
+	body, err := entry.Open()
+	if err != nil {
+		return "", "", &statusError{fiber.StatusBadRequest, "Archive entry " + entry.Path + " can't be read: " + err.Error()}
+	}
+	defer body.Close()
+
+	spool, err := spoolContent(io.LimitReader(body, entry.Size+1), key)
+	if err != nil {
+		return "", "", &statusError{fiber.StatusBadRequest, "Archive entry " + entry.Path + " can't be read: " + err.Error()}
+	}
+	defer spool.Close()
+	if spool.Size != entry.Size {
+		return "", "", &statusError{fiber.StatusBadRequest, "Archive entry " + entry.Path + " doesn't match its recorded size"}
+	}
+
+	return storeBlob(run.db, run.job.OrganizationID, spool.Hash, spool.Size, spool.KeyID, spool.store)
+}
+
+// extractFile adds an archive file to the folder extracted for its path, applying the conflict strategy of the job
+func (run *importRun) extractFile(entry importEntry) error {
+	parentID, err := run.ensureFolder(parentImportPath(entry.Path))
+	if err != nil {
+		return err
+	}
+
+	name := path.Base(entry.Path)
+	resolution, err := resolveNameConflict(run.db, run.job.OnConflict, "file", run.job.OrganizationID, parentID, name, "")
+	if err != nil {
+		return err
+	}
+	if resolution.Skip {
+		run.job.SkippedEntries++
+		return nil
+	}
+
+	blobID, filePath, err := run.uploadEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	// Blobs left unreferenced by a failure are removed after their grace period
+	if resolution.Replace {
+		err = run.replaceFile(resolution.ExistingID, filePath, entry.Size, blobID)
+	} else {
+		_, err = run.db.Exec(
+			context.Background(),
+			`
+				INSERT INTO files
+				(id, name, folder_id, file_path, file_size, created_at, updated_at, organization_id, deleted, created_by, blob_id)
+				VALUES
+				($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);
+			`,
+			uuid.New().String(), resolution.Name, parentID, filePath, entry.Size, time.Now(), time.Now(), run.job.OrganizationID, false, run.job.UserID, blobID,
+		)
+		err = nameTaken(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if resolution.Replace {
+		run.job.FilesReplaced++
+	} else {
+		run.job.FilesCreated++
+	}
+	return nil
+}
+
+// replaceFile makes extracted content the current version of an existing file
+func (run *importRun) replaceFile(fileID string, filePath string, fileSize int64, blobID string) error {
+	tx, err := run.db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := replaceFileContent(tx, fileID, filePath, fileSize, &blobID, run.job.UserID); err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// runImport extracts the archive of an import job and removes it when done. The files and folders extracted
+// before a failure are kept, the job reports how far it got
+func runImport(db *pgxpool.Pool, job models.ImportJob, archivePath string, format string) {
+	defer os.Remove(archivePath)
+
+	importSlots <- struct{}{}
+	defer func() { <-importSlots }()
+
+	run := &importRun{db: db, job: job, folders: map[string]*string{}}
+	startedAt := time.Now()
+	run.job.Status, run.job.StartedAt = "running", &startedAt
+	run.save()
+
+	err := walkArchive(archivePath, format, func(entry importEntry) error {
+		var err error
+		if entry.Dir {
+			_, err = run.ensureFolder(entry.Path)
+		} else {
+			err = run.extractFile(entry)
+		}
+		if err != nil {
+			return err
+		}
+
+		run.job.ProcessedEntries++
+		run.job.ProcessedBytes += entry.Size
+		if time.Since(run.savedAt) >= importProgressInterval {
+			run.save()
+		}
+		return nil
+	})
+
+	completedAt := time.Now()
+	run.job.Status, run.job.CompletedAt = "completed", &completedAt
+	if err != nil {
+		log.Printf("Error importing archive for job %s: %v", job.ID, err)
+		message := err.Error()
+		run.job.Status, run.job.Error = "failed", &message
+	}
+	run.save()
+}
+
+// FailInterruptedImports marks the imports that were running when the server stopped as failed and removes the
+// archives they left behind
+func FailInterruptedImports(db *pgxpool.Pool) {
+	if err := os.RemoveAll(importArchiveDir); err != nil {
+		log.Println("Error removing interrupted import archives: ", err)
+	}
+
+	_, err := db.Exec(
+		context.Background(),
+		`
+			UPDATE importjobs SET status = 'failed', error = 'Import was interrupted by a server restart', completed_at = NOW()
+			WHERE status IN ('pending', 'running');
+		`,
+	)
+	if err != nil {
+		log.Println("Error failing interrupted imports: ", err)
+	}
+}
+
+// ImportArchive takes a ZIP, tar or tar.gz archive uploaded as the archive form file and extracts its folders
+// and files into a folder, or into the root of an organization, in the background. The archive is checked
+// before the job starts and the on_conflict query parameter applies to the files in it
+func ImportArchive(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userID := c.Locals("user_id").(string)
+	organizationId := c.Params("organization_id")
+	var folderId *string
+	if id := c.Params("folder_id"); id != "" {
+		folder := auditFolder(db, id)
+		if folder == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Folder not found"})
+		}
+		organizationId, folderId = folder.OrganizationID, &folder.ID
+	}
+
+	strategy, err := conflictStrategy(c)
+	if err != nil {
+		return respondStatusError(c, err, "Error reading conflict strategy")
+	}
+
+	if err := checkDestination(db, userID, organizationId, folderId); err != nil {
+		return respondStatusError(c, err, "Error checking destination")
+	}
+
+	if err := checkPendingImports(db, organizationId); err != nil {
+		return respondStatusError(c, err, "Error checking imports")
+	}
+
+	archivePath, uploadName, format, err := saveImportArchive(c)
+	if err != nil {
+		return respondStatusError(c, err, "Error saving archive")
+	}
+
+	entries, size, err := scanArchive(archivePath, format)
+	if err == nil && entries == 0 {
+		err = &statusError{fiber.StatusBadRequest, "Archive is empty"}
+	}
+	if err != nil {
+		os.Remove(archivePath)
+		return respondStatusError(c, err, "Error reading archive")
+	}
+
+	archiveName := strings.ToValidUTF8(path.Base(strings.ReplaceAll(uploadName, "\\", "/")), "_")
+	if runes := []rune(archiveName); len(runes) > 255 {
+		archiveName = string(runes[:255])
+	}
+
+	job := models.ImportJob{
+		ID:             uuid.New().String(),
+		OrganizationID: organizationId,
+		FolderID:       folderId,
+		UserID:         userID,
+		ArchiveName:    archiveName,
+		OnConflict:     strategy,
+		Status:         "pending",
+		TotalEntries:   entries,
+		TotalBytes:     size,
+		CreatedAt:      time.Now(),
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		// Imports of an organization are counted again under a lock, others may have started during the upload
+		if _, err := tx.Exec(context.Background(), "SELECT 1 FROM organizations WHERE organization_id = $1 FOR UPDATE;", organizationId); err != nil {
+			return nil, err
+		}
+		if err := checkPendingImports(tx, organizationId); err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.Exec(
+			context.Background(),
+			`
+				INSERT INTO importjobs
+				(id, organization_id, folder_id, user_id, archive_name, on_conflict, status, total_entries, total_bytes, created_at)
+				VALUES
+				($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);
+			`,
+			job.ID, job.OrganizationID, job.FolderID, job.UserID, job.ArchiveName, job.OnConflict, job.Status,
+			job.TotalEntries, job.TotalBytes, job.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "archive.import", TargetType: "import_job", TargetID: job.ID, After: &job}, nil
+	})
+	if err != nil {
+		os.Remove(archivePath)
+		return respondStatusError(c, err, "Error creating import job")
+	}
+
+	go runImport(db, job, archivePath, format)
+
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+// GetImportJob returns the status and progress of an import started by the user
+func GetImportJob(c *fiber.Ctx, db *pgxpool.Pool) error {
+	job, err := scanImportJob(db.QueryRow(
+		context.Background(),
+		"SELECT "+importJobColumns+" FROM importjobs WHERE id = $1 AND organization_id = $2 AND user_id = $3;",
+		c.Params("job_id"), c.Params("organization_id"), c.Locals("user_id").(string),
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Import job not found"})
+	} else if err != nil {
+		log.Println("Error fetching import job: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching import job", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(job)
+}
+
+func RegisterImportRoutes(app *fiber.App, db *pgxpool.Pool) {
+	importGroup := app.Group("/import", middleware.AuthRequired(db))
+	read := middleware.RequireScope(db, middleware.ScopeReadFiles)
+	write := middleware.RequireScope(db, middleware.ScopeWriteFiles)
+
+	bodyLimit := middleware.BodyLimit(importMaxBodySize)
+
+	importGroup.Post("/folder/:folder_id", write, bodyLimit, func(c *fiber.Ctx) error {
+		return ImportArchive(c, db)
+	})
+	importGroup.Post("/organization/:organization_id", write, bodyLimit, func(c *fiber.Ctx) error {
+		return ImportArchive(c, db)
+	})
+	importGroup.Get("/jobs/:organization_id/:job_id", read, func(c *fiber.Ctx) error {
+		return GetImportJob(c, db)
+	})
+}
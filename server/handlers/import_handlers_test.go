@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestCleanImportPath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		err  bool
+	}{
+		{"report.pdf", "report.pdf", false},
+		{"./docs//2024/report.pdf", "docs/2024/report.pdf", false},
+		{"docs\\2024\\report.pdf", "docs/2024/report.pdf", false},
+		{"docs/", "docs", false},
+		{".", "", false},
+		{"a:b.txt", "a:b.txt", false},
+		{"notes/c:d", "notes/c:d", false},
+		{"ab:/c.txt", "ab:/c.txt", false},
+		{"/etc/passwd", "", true},
+		{"\\etc\\passwd", "", true},
+		{"C:", "", true},
+		{"C:/Windows/win.ini", "", true},
+		{"c:\\Windows\\win.ini", "", true},
+		{"../outside.txt", "", true},
+		{"docs/../../outside.txt", "", true},
+		{"docs/nul\x00.txt", "", true},
+		{strings.Repeat("a", 256), "", true},
+		{strings.Repeat("a/", maxPathDepth+2), "", true},
+	}
+	for _, test := range tests {
+		path, err := cleanImportPath(test.name)
+		if test.err {
+			var statusErr *statusError
+			if !errors.As(err, &statusErr) || statusErr.Status != fiber.StatusBadRequest {
+				t.Errorf("cleanImportPath(%q) = %q, %v, want a bad request", test.name, path, err)
+			}
+			continue
+		}
+		if err != nil || path != test.path {
+			t.Errorf("cleanImportPath(%q) = %q, %v, want %q", test.name, path, err, test.path)
+		}
+	}
+}
+
+func TestSaveImportArchive(t *testing.T) {
+	dir := importArchiveDir
+	importArchiveDir = t.TempDir()
+	t.Cleanup(func() { importArchiveDir = dir })
+
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+	file, err := zipWriter.Create("docs/report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("report"))
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New(fiber.Config{StreamRequestBody: true, DisablePreParseMultipartForm: true})
+	app.Post("/", func(c *fiber.Ctx) error {
+		archivePath, name, format, err := saveImportArchive(c)
+		if err != nil {
+			return respondStatusError(c, err, "Error saving archive")
+		}
+		defer os.Remove(archivePath)
+
+		entries, _, err := scanArchive(archivePath, format)
+		if err != nil {
+			return respondStatusError(c, err, "Error reading archive")
+		}
+		return c.JSON(fiber.Map{"name": name, "format": format, "entries": entries})
+	})
+
+	tests := []struct {
+		field   string
+		content []byte
+		status  int
+		want    string
+	}{
+		{"archive", archive.Bytes(), fiber.StatusOK, `{"entries":1,"format":"zip","name":"docs.zip"}`},
+		{"other", archive.Bytes(), fiber.StatusBadRequest, `{"error":"Missing archive file"}`},
+		{"archive", []byte("not an archive"), fiber.StatusBadRequest, `{"error":"Archive must be a ZIP, tar or tar.gz file"}`},
+	}
+	for _, test := range tests {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("note", "ignored")
+		part, err := form.CreateFormFile(test.field, "docs.zip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(test.content)
+		form.Close()
+
+		req := httptest.NewRequest("POST", "/", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != test.status || string(got) != test.want {
+			t.Errorf("upload as %s: %d %s, want %d %s", test.field, resp.StatusCode, got, test.status, test.want)
+		}
+	}
+
+	left, err := os.ReadDir(importArchiveDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("%d archives left behind", len(left))
+	}
+}
@@ -0,0 +1,497 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"server/middleware"
+	"server/models"
+	"server/otp"
+	"server/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const invitationTTL = 7 * 24 * time.Hour
+
+const invitationColumns = `
+	i.id, i.organization_id, o.name, i.email, i.role, i.status, i.invited_by, i.expires_at, i.created_at, i.accepted_at
+`
+
+func scanInvitation(row pgx.Row) (models.Invitation, error) {
+	var invitation models.Invitation
+	err := row.Scan(
+		&invitation.ID,
+		&invitation.OrganizationID,
+		&invitation.OrganizationName,
+		&invitation.Email,
+		&invitation.Role,
+		&invitation.Status,
+		&invitation.InvitedBy,
+		&invitation.ExpiresAt,
+		&invitation.CreatedAt,
+		&invitation.AcceptedAt,
+	)
+	return invitation, err
+}
+
+// getPendingInvitationByToken fetches the pending, unexpired invitation matching a token
+func getPendingInvitationByToken(db *pgxpool.Pool, token string) (models.Invitation, error) {
+	query := `SELECT ` + invitationColumns + `
+		FROM invitations i
+		JOIN organizations o ON o.organization_id = i.organization_id
+		WHERE i.token_hash = $1 AND i.status = 'pending' AND i.expires_at > NOW();
+	`
+	return scanInvitation(db.QueryRow(context.Background(), query, utils.HashToken(token)))
+}
+
+// issueInvitationToken gives an invitation a new token and expiry then mails it
+func issueInvitationToken(db dbConn, invitation models.Invitation) error {
+	token, err := utils.GenerateSecureToken("")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		context.Background(),
+		"UPDATE invitations SET token_hash = $1, expires_at = $2 WHERE id = $3;",
+		utils.HashToken(token), time.Now().Add(invitationTTL), invitation.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return otp.SendInvitationEmail(invitation.Email, invitation.OrganizationName, token)
+}
+
+// CreateInvitation invites someone to an organization by email with a role
+func CreateInvitation(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	isAdmin, err := isOrganizationAdmin(db, userID, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if !isAdmin {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can invite members"})
+	}
+
+	var invitation models.Invitation
+	if err := c.BodyParser(&invitation); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Bad request!"})
+	}
+
+	invitation.Email = strings.ToLower(strings.TrimSpace(invitation.Email))
+	if invitation.Email == "" || !strings.Contains(invitation.Email, "@") {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing fields"})
+	}
+
+	if invitation.Role == "" {
+		invitation.Role = "member"
+	}
+	if invitation.Role != "member" && invitation.Role != "admin" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Role must be member or admin"})
+	}
+
+	var isMember bool
+	err = db.QueryRow(
+		context.Background(),
+		`
+			SELECT EXISTS (
+				SELECT 1 FROM userorganizations uo
+				JOIN users u ON u.user_id = uo.user_id
+				WHERE uo.organization_id = $1 AND LOWER(u.email) = $2
+			);
+		`,
+		organizationId, invitation.Email,
+	).Scan(&isMember)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking membership", "message": err.Error()})
+	}
+	if isMember {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "User is already a member of the organization"})
+	}
+
+	err = db.QueryRow(
+		context.Background(),
+		"SELECT name FROM organizations WHERE organization_id = $1",
+		organizationId,
+	).Scan(&invitation.OrganizationName)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching the organization", "message": err.Error()})
+	}
+
+	// Expired invitations no longer block a new one
+	_, err = db.Exec(
+		context.Background(),
+		"UPDATE invitations SET status = 'expired' WHERE organization_id = $1 AND email = $2 AND status = 'pending' AND expires_at <= NOW();",
+		organizationId, invitation.Email,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating invitation", "message": err.Error()})
+	}
+
+	invitation.ID = uuid.New().String()
+	invitation.OrganizationID = organizationId
+	invitation.Status = "pending"
+	invitation.InvitedBy = &userID
+	invitation.CreatedAt = time.Now()
+	invitation.ExpiresAt = invitation.CreatedAt.Add(invitationTTL)
+
+	// The token is set by issueInvitationToken, the placeholder only satisfies the unique constraint
+	query := `
+		INSERT INTO invitations (id, organization_id, email, role, token_hash, status, invited_by, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);
+	`
+	// The invitation isn't kept if it can't be sent
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		_, err := tx.Exec(
+			context.Background(),
+			query,
+			invitation.ID, invitation.OrganizationID, invitation.Email, invitation.Role, utils.HashToken(invitation.ID),
+			invitation.Status, userID, invitation.ExpiresAt, invitation.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := issueInvitationToken(tx, invitation); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "invitation.create", TargetType: "invitation", TargetID: invitation.ID, After: &invitation}, nil
+	})
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.ConstraintName == "invitations_pending_email_idx" {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A pending invitation already exists for this email"})
+		}
+		log.Println("Error creating invitation: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating invitation", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "Invitation sent!", "id": invitation.ID})
+}
+
+// GetInvitations lists the invitations of an organization, optionally filtered by status
+func GetInvitations(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	isAdmin, err := isOrganizationAdmin(db, userID, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if !isAdmin {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can view invitations"})
+	}
+
+	query := `SELECT ` + invitationColumns + `
+		FROM invitations i
+		JOIN organizations o ON o.organization_id = i.organization_id
+		WHERE i.organization_id = $1 AND ($2 = '' OR i.status::text = $2)
+		ORDER BY i.created_at DESC;
+	`
+	rows, err := db.Query(context.Background(), query, organizationId, c.Query("status"))
+	if err != nil {
+		log.Println("Error fetching invitations: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching invitations", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	invitations := []models.Invitation{}
+	for rows.Next() {
+		invitation, err := scanInvitation(rows)
+		if err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		if invitation.Status == "pending" && invitation.ExpiresAt.Before(time.Now()) {
+			invitation.Status = "expired"
+		}
+		invitations = append(invitations, invitation)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	return sendList(c, invitations)
+}
+
+// getInvitationForAdmin fetches a pending invitation of the organization in the url after checking the
+// caller administers it, when it returns false the error response has already been sent
+func getInvitationForAdmin(c *fiber.Ctx, db *pgxpool.Pool) (models.Invitation, bool, error) {
+	organizationId := c.Params("organization_id")
+
+	isAdmin, err := isOrganizationAdmin(db, c.Locals("user_id").(string), organizationId)
+	if err != nil {
+		return models.Invitation{}, false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if !isAdmin {
+		return models.Invitation{}, false, c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can manage invitations"})
+	}
+
+	query := `SELECT ` + invitationColumns + `
+		FROM invitations i
+		JOIN organizations o ON o.organization_id = i.organization_id
+		WHERE i.id = $1 AND i.organization_id = $2;
+	`
+	invitation, err := scanInvitation(db.QueryRow(context.Background(), query, c.Params("invitation_id"), organizationId))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return invitation, false, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Invitation not found"})
+	} else if err != nil {
+		return invitation, false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching invitation", "message": err.Error()})
+	}
+
+	if invitation.Status != "pending" {
+		return invitation, false, c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Invitation is no longer pending"})
+	}
+
+	return invitation, true, nil
+}
+
+// ResendInvitation mails a pending invitation again with a fresh token and expiry
+func ResendInvitation(c *fiber.Ctx, db *pgxpool.Pool) error {
+	invitation, ok, err := getInvitationForAdmin(c, db)
+	if !ok {
+		return err
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if err := issueInvitationToken(tx, invitation); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: invitation.OrganizationID, Action: "invitation.resend", TargetType: "invitation", TargetID: invitation.ID}, nil
+	})
+	if err != nil {
+		log.Println("Error resending invitation: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error resending invitation", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Invitation resent!"})
+}
+
+// RevokeInvitation revokes a pending invitation so its link stops working
+func RevokeInvitation(c *fiber.Ctx, db *pgxpool.Pool) error {
+	invitation, ok, err := getInvitationForAdmin(c, db)
+	if !ok {
+		return err
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(context.Background(), "UPDATE invitations SET status = 'revoked' WHERE id = $1;", invitation.ID); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: invitation.OrganizationID, Action: "invitation.revoke", TargetType: "invitation", TargetID: invitation.ID, Before: &invitation}, nil
+	})
+	if err != nil {
+		log.Println("Error revoking invitation: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error revoking invitation", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Invitation revoked!"})
+}
+
+// GetInvitation returns the details of an invitation from its token, so the client
+// can show it and decide between logging in and registering
+func GetInvitation(c *fiber.Ctx, db *pgxpool.Pool) error {
+	token := c.Query("token")
+	if token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing token"})
+	}
+
+	invitation, err := getPendingInvitationByToken(db, token)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Invalid or expired invitation"})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching invitation", "message": err.Error()})
+	}
+
+	var accountExists bool
+	err = db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(email) = $1);", invitation.Email).Scan(&accountExists)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching user", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"organization_id":   invitation.OrganizationID,
+		"organization_name": invitation.OrganizationName,
+		"email":             invitation.Email,
+		"role":              invitation.Role,
+		"expires_at":        invitation.ExpiresAt,
+		"account_exists":    accountExists,
+	})
+}
+
+// completeInvitation adds the user to the organization and marks the invitation accepted
+func completeInvitation(db dbConn, invitation models.Invitation, userID string) error {
+	if err := addUserToOrganization(db, userID, invitation.OrganizationID, invitation.Role); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(
+		context.Background(),
+		"UPDATE invitations SET status = 'accepted', accepted_at = NOW() WHERE id = $1;",
+		invitation.ID,
+	)
+	return err
+}
+
+// AcceptInvitation accepts an invitation for the logged in user, whose email must match it
+func AcceptInvitation(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userID := c.Locals("user_id").(string)
+
+	type acceptRequest struct {
+		Token string `json:"token"`
+	}
+
+	var data acceptRequest
+	if err := c.BodyParser(&data); err != nil || data.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid data"})
+	}
+
+	invitation, err := getPendingInvitationByToken(db, data.Token)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Invalid or expired invitation"})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching invitation", "message": err.Error()})
+	}
+
+	var email string
+	if err := db.QueryRow(context.Background(), "SELECT email FROM users WHERE user_id = $1", userID).Scan(&email); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching user", "message": err.Error()})
+	}
+
+	if !strings.EqualFold(email, invitation.Email) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "This invitation was sent to a different email"})
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if err := completeInvitation(tx, invitation, userID); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: invitation.OrganizationID, Action: "invitation.accept", TargetType: "invitation", TargetID: invitation.ID, After: fiber.Map{"role": invitation.Role}}, nil
+	})
+	if err != nil {
+		log.Println("Error accepting invitation: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error accepting invitation", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Invitation accepted!", "organization_id": invitation.OrganizationID})
+}
+
+// AcceptInvitationRegister registers the invitee and accepts the invitation, the email
+// counts as verified since the invitation link was delivered to it
+func AcceptInvitationRegister(c *fiber.Ctx, db *pgxpool.Pool) error {
+	type registerRequest struct {
+		Token       string `json:"token"`
+		FirstName   string `json:"first_name"`
+		LastName    string `json:"last_name"`
+		PhoneNumber string `json:"phone_number"`
+		Password    string `json:"password"`
+	}
+
+	var data registerRequest
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid data"})
+	}
+
+	if data.Token == "" || data.Password == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing required fields"})
+	}
+
+	invitation, err := getPendingInvitationByToken(db, data.Token)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Invalid or expired invitation"})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching invitation", "message": err.Error()})
+	}
+
+	if err := utils.ValidatePassword(data.Password); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Weak password", "message": err.Error()})
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(data.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error hashing password", "message": err.Error()})
+	}
+
+	userID := uuid.New().String()
+	err = db.QueryRow(
+		context.Background(),
+		`
+			INSERT INTO
+			users (user_id, first_name, last_name, email, phone_number, password, email_verified, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, true, $7)
+			ON CONFLICT (email) DO NOTHING
+			RETURNING user_id
+		`,
+		userID, data.FirstName, data.LastName, invitation.Email, data.PhoneNumber, string(hashedPassword), time.Now(),
+	).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Email already exists, log in to accept the invitation"})
+	} else if err != nil {
+		log.Println("Error registering user: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error registering user", "details": err.Error()})
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if err := completeInvitation(tx, invitation, userID); err != nil {
+			return nil, err
+		}
+		return &auditEvent{
+			OrganizationID: invitation.OrganizationID,
+			ActorID:        userID,
+			Action:         "invitation.accept",
+			TargetType:     "invitation",
+			TargetID:       invitation.ID,
+			After:          fiber.Map{"role": invitation.Role},
+		}, nil
+	})
+	if err != nil {
+		log.Println("Error accepting invitation: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error accepting invitation", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message":         "User registered and invitation accepted",
+		"user_id":         userID,
+		"organization_id": invitation.OrganizationID,
+	})
+}
+
+func RegisterInvitationRoutes(app *fiber.App, db *pgxpool.Pool) {
+	invitationGroup := app.Group("/invitation")
+	manage := middleware.RequireScope(db, middleware.ScopeManageMembers)
+
+	invitationGroup.Post("/create/:organization_id", middleware.AuthRequired(db), manage, func(c *fiber.Ctx) error {
+		return CreateInvitation(c, db)
+	})
+	invitationGroup.Get("/fetch/all/:organization_id", middleware.AuthRequired(db), manage, func(c *fiber.Ctx) error {
+		return GetInvitations(c, db)
+	})
+	invitationGroup.Put("/resend/:organization_id/:invitation_id", middleware.AuthRequired(db), manage, func(c *fiber.Ctx) error {
+		return ResendInvitation(c, db)
+	})
+	invitationGroup.Delete("/revoke/:organization_id/:invitation_id", middleware.AuthRequired(db), manage, func(c *fiber.Ctx) error {
+		return RevokeInvitation(c, db)
+	})
+	invitationGroup.Get("/fetch/specific", func(c *fiber.Ctx) error {
+		return GetInvitation(c, db)
+	})
+	invitationGroup.Post("/accept", middleware.AuthRequired(db), middleware.SessionRequired(), func(c *fiber.Ctx) error {
+		return AcceptInvitation(c, db)
+	})
+	invitationGroup.Post("/accept/register", func(c *fiber.Ctx) error {
+		return AcceptInvitationRegister(c, db)
+	})
+}
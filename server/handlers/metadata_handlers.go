@@ -0,0 +1,498 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"server/middleware"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	// metadataMaxText is the longest text value a metadata field can hold
+	metadataMaxText = 1000
+	// metadataMaxOptions is the most options a select field can have
+	metadataMaxOptions = 100
+)
+
+// metadataKeyPattern matches the keys of metadata fields, they are used in the metadata.<key> listing filters
+var metadataKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// metadataTypes are the types of values metadata fields can hold
+var metadataTypes = map[string]bool{"text": true, "number": true, "date": true, "boolean": true, "select": true}
+
+const metadataFieldColumns = "id, organization_id, key, label, type, options, created_at, updated_at"
+
+func scanMetadataField(row pgx.Row) (models.MetadataField, error) {
+	var field models.MetadataField
+	err := row.Scan(
+		&field.ID,
+		&field.OrganizationID,
+		&field.Key,
+		&field.Label,
+		&field.Type,
+		&field.Options,
+		&field.CreatedAt,
+		&field.UpdatedAt,
+	)
+	return field, err
+}
+
+// metadataValuesRequest is the body of requests setting the metadata of a file or folder. Values are merged into
+// the metadata of the item and null values remove their key
+type metadataValuesRequest struct {
+	Values map[string]interface{} `json:"values"`
+}
+
+// cleanMetadataOptions trims the options of a select field and drops empty and repeated ones
+func cleanMetadataOptions(options []string) ([]string, error) {
+	cleaned := []string{}
+	seen := map[string]bool{}
+	for _, option := range options {
+		option = strings.TrimSpace(option)
+		if option == "" || seen[option] {
+			continue
+		}
+		if len(option) > 100 {
+			return nil, errors.New("options must be at most 100 characters")
+		}
+		seen[option] = true
+		cleaned = append(cleaned, option)
+	}
+	if len(cleaned) > metadataMaxOptions {
+		return nil, fmt.Errorf("a select field can have at most %d options", metadataMaxOptions)
+	}
+	return cleaned, nil
+}
+
+// metadataValue checks a value against the type of its field and returns it as stored. Dates are stored as
+// YYYY-MM-DD days or RFC 3339 timestamps in UTC so they sort as text
+func metadataValue(field models.MetadataField, value interface{}) (interface{}, error) {
+	switch field.Type {
+	case "text":
+		if text, ok := value.(string); ok && len(text) <= metadataMaxText {
+			return text, nil
+		}
+		return nil, fmt.Errorf("%s must be text of at most %d characters", field.Key, metadataMaxText)
+	case "number":
+		if number, ok := value.(float64); ok {
+			return number, nil
+		}
+		return nil, errors.New(field.Key + " must be a number")
+	case "date":
+		if text, ok := value.(string); ok {
+			if day, err := time.Parse("2006-01-02", text); err == nil {
+				return day.Format("2006-01-02"), nil
+			}
+			if timestamp, err := time.Parse(time.RFC3339, text); err == nil {
+				return timestamp.UTC().Format(time.RFC3339), nil
+			}
+		}
+		return nil, errors.New(field.Key + " must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+	case "boolean":
+		if boolean, ok := value.(bool); ok {
+			return boolean, nil
+		}
+		return nil, errors.New(field.Key + " must be true or false")
+	case "select":
+		if text, ok := value.(string); ok {
+			for _, option := range field.Options {
+				if option == text {
+					return text, nil
+				}
+			}
+		}
+		return nil, errors.New(field.Key + " must be one of " + strings.Join(field.Options, ", "))
+	}
+	return nil, errors.New(field.Key + " has an unknown type")
+}
+
+// parseMetadataValues reads a metadata request and checks its values against the metadata fields of the
+// organization, returning the values to set and the keys to remove
+func parseMetadataValues(c *fiber.Ctx, db *pgxpool.Pool, organizationID string) (map[string]interface{}, []string, error) {
+	var request metadataValuesRequest
+	if err := c.BodyParser(&request); err != nil {
+		return nil, nil, &statusError{fiber.StatusBadRequest, "Invalid input"}
+	}
+	if len(request.Values) == 0 {
+		return nil, nil, &statusError{fiber.StatusBadRequest, "values are required"}
+	}
+
+	rows, err := db.Query(
+		context.Background(),
+		"SELECT "+metadataFieldColumns+" FROM metadatafields WHERE organization_id = $1;",
+		organizationID,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	fields := map[string]models.MetadataField{}
+	for rows.Next() {
+		field, err := scanMetadataField(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		fields[field.Key] = field
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	values := map[string]interface{}{}
+	removed := []string{}
+	for key, value := range request.Values {
+		field, ok := fields[key]
+		if !ok {
+			return nil, nil, &statusError{fiber.StatusBadRequest, "Unknown metadata field " + key}
+		}
+		if value == nil {
+			removed = append(removed, key)
+			continue
+		}
+
+		stored, err := metadataValue(field, value)
+		if err != nil {
+			return nil, nil, &statusError{fiber.StatusBadRequest, err.Error()}
+		}
+		values[key] = stored
+	}
+
+	return values, removed, nil
+}
+
+// CreateMetadataField adds a metadata field to an organization, its key and type can't be changed afterwards
+func CreateMetadataField(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+
+	var field models.MetadataField
+	if err := c.BodyParser(&field); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+
+	if !metadataKeyPattern.MatchString(field.Key) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "key must start with a lowercase letter followed by up to 63 lowercase letters, digits or underscores"})
+	}
+	field.Label = strings.TrimSpace(field.Label)
+	if field.Label == "" {
+		field.Label = field.Key
+	}
+	if len(field.Label) > 100 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "label must be at most 100 characters"})
+	}
+	if !metadataTypes[field.Type] {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "type must be text, number, date, boolean or select"})
+	}
+
+	options, err := cleanMetadataOptions(field.Options)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if field.Type == "select" && len(options) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "A select field needs options"})
+	}
+	if field.Type != "select" {
+		options = []string{}
+	}
+
+	field.ID = uuid.New().String()
+	field.OrganizationID = organizationId
+	field.Options = options
+	field.CreatedAt = time.Now()
+	field.UpdatedAt = field.CreatedAt
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(
+			context.Background(),
+			`
+				INSERT INTO metadatafields (id, organization_id, key, label, type, options, created_at, updated_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
+			`,
+			field.ID, field.OrganizationID, field.Key, field.Label, field.Type, field.Options, field.CreatedAt, field.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "metadata_field.create", TargetType: "metadata_field", TargetID: field.ID, After: &field}, nil
+	})
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A metadata field with this key already exists"})
+	} else if err != nil {
+		log.Println("Error creating metadata field: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating metadata field", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(field)
+}
+
+// GetMetadataFields lists the metadata fields of an organization
+func GetMetadataFields(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+
+	rows, err := db.Query(
+		context.Background(),
+		"SELECT "+metadataFieldColumns+" FROM metadatafields WHERE organization_id = $1 ORDER BY key;",
+		organizationId,
+	)
+	if err != nil {
+		log.Println("Error fetching metadata fields: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching metadata fields", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	fields := []models.MetadataField{}
+	for rows.Next() {
+		field, err := scanMetadataField(rows)
+		if err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		fields = append(fields, field)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	return sendList(c, fields)
+}
+
+// UpdateMetadataField changes the label of a metadata field or the options of a select field. Values saved
+// before options were removed are kept
+func UpdateMetadataField(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	fieldId := c.Params("field_id")
+
+	var data models.MetadataField
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+
+	before, err := scanMetadataField(db.QueryRow(
+		context.Background(),
+		"SELECT "+metadataFieldColumns+" FROM metadatafields WHERE id = $1 AND organization_id = $2;",
+		fieldId, organizationId,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Metadata field not found"})
+	} else if err != nil {
+		log.Println("Error fetching metadata field: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching metadata field", "message": err.Error()})
+	}
+
+	if (data.Key != "" && data.Key != before.Key) || (data.Type != "" && data.Type != before.Type) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "The key and type of a metadata field can't be changed"})
+	}
+
+	after := before
+	if label := strings.TrimSpace(data.Label); label != "" {
+		if len(label) > 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "label must be at most 100 characters"})
+		}
+		after.Label = label
+	}
+	if data.Options != nil {
+		if before.Type != "select" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Only select fields have options"})
+		}
+		options, err := cleanMetadataOptions(data.Options)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if len(options) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "A select field needs options"})
+		}
+		after.Options = options
+	}
+	after.UpdatedAt = time.Now()
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(
+			context.Background(),
+			"UPDATE metadatafields SET label = $1, options = $2, updated_at = $3 WHERE id = $4;",
+			after.Label, after.Options, after.UpdatedAt, fieldId,
+		); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "metadata_field.update", TargetType: "metadata_field", TargetID: fieldId, Before: &before, After: &after}, nil
+	})
+	if err != nil {
+		log.Println("Error updating metadata field: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating metadata field", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(after)
+}
+
+// DeleteMetadataField deletes a metadata field and removes its values from the files and folders of the organization
+func DeleteMetadataField(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	fieldId := c.Params("field_id")
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting metadata field", "message": err.Error()})
+	}
+	defer tx.Rollback(context.Background())
+
+	field, err := scanMetadataField(tx.QueryRow(
+		context.Background(),
+		"DELETE FROM metadatafields WHERE id = $1 AND organization_id = $2 RETURNING "+metadataFieldColumns+";",
+		fieldId, organizationId,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Metadata field not found"})
+	} else if err != nil {
+		log.Println("Error deleting metadata field: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting metadata field", "message": err.Error()})
+	}
+
+	for _, table := range []string{"files", "folders"} {
+		_, err := tx.Exec(
+			context.Background(),
+			"UPDATE "+table+" SET metadata = metadata - $1::text WHERE organization_id = $2 AND metadata ? $1::text;",
+			field.Key, organizationId,
+		)
+		if err != nil {
+			log.Println("Error removing metadata values: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting metadata field", "message": err.Error()})
+		}
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "metadata_field.delete", TargetType: "metadata_field", TargetID: fieldId, Before: &field}); err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting metadata field", "message": err.Error()})
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting metadata field", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Metadata field deleted!"})
+}
+
+// SetFileMetadata sets or removes metadata values of a file
+func SetFileMetadata(c *fiber.Ctx, db *pgxpool.Pool) error {
+	fileId := c.Params("file_id")
+
+	before, err := scanFile(db.QueryRow(
+		context.Background(),
+		"SELECT "+fileColumns+" FROM files WHERE id = $1 AND deleted = false;",
+		fileId,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	} else if err != nil {
+		log.Println("Error fetching file: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching file", "message": err.Error()})
+	}
+
+	values, removed, err := parseMetadataValues(c, db, before.OrganizationID)
+	if err != nil {
+		return respondStatusError(c, err, "Error updating metadata")
+	}
+
+	var after models.File
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		var err error
+		after, err = scanFile(tx.QueryRow(
+			context.Background(),
+			"UPDATE files SET metadata = (metadata || $1::jsonb) - $2::text[], updated_at = NOW() WHERE id = $3 RETURNING "+fileColumns+";",
+			values, removed, fileId,
+		))
+		if err != nil {
+			return nil, err
+		}
+		return &auditEvent{Action: "file.metadata_update", TargetType: "file", TargetID: fileId, Before: &before, After: &after}, nil
+	})
+	if err != nil {
+		log.Println("Error updating metadata: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating metadata", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(after)
+}
+
+// SetFolderMetadata sets or removes metadata values of a folder
+func SetFolderMetadata(c *fiber.Ctx, db *pgxpool.Pool) error {
+	folderId := c.Params("folder_id")
+
+	before, err := scanFolder(db.QueryRow(
+		context.Background(),
+		"SELECT "+folderColumns+" FROM folders WHERE id = $1 AND deleted = false;",
+		folderId,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Folder not found"})
+	} else if err != nil {
+		log.Println("Error fetching folder: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching folder", "message": err.Error()})
+	}
+
+	values, removed, err := parseMetadataValues(c, db, before.OrganizationID)
+	if err != nil {
+		return respondStatusError(c, err, "Error updating metadata")
+	}
+
+	var after models.Folder
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		var err error
+		after, err = scanFolder(tx.QueryRow(
+			context.Background(),
+			"UPDATE folders SET metadata = (metadata || $1::jsonb) - $2::text[], updated_at = NOW() WHERE id = $3 RETURNING "+folderColumns+";",
+			values, removed, folderId,
+		))
+		if err != nil {
+			return nil, err
+		}
+		return &auditEvent{Action: "folder.metadata_update", TargetType: "folder", TargetID: folderId, Before: &before, After: &after}, nil
+	})
+	if err != nil {
+		log.Println("Error updating metadata: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating metadata", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(after)
+}
+
+func RegisterMetadataRoutes(app *fiber.App, db *pgxpool.Pool) {
+	metadataGroup := app.Group("/metadata", middleware.AuthRequired(db))
+	read := middleware.RequireScope(db, middleware.ScopeReadFiles)
+	write := middleware.RequireScope(db, middleware.ScopeWriteFiles)
+	admin := requireLabelAdmin(db)
+
+	metadataGroup.Post("/field/create/:organization_id", write, admin, func(c *fiber.Ctx) error {
+		return CreateMetadataField(c, db)
+	})
+	metadataGroup.Get("/field/fetch/all/:organization_id", read, requireGroupMember(db), func(c *fiber.Ctx) error {
+		return GetMetadataFields(c, db)
+	})
+	metadataGroup.Put("/field/update/:organization_id/:field_id", write, admin, func(c *fiber.Ctx) error {
+		return UpdateMetadataField(c, db)
+	})
+	metadataGroup.Delete("/field/delete/:organization_id/:field_id", write, admin, func(c *fiber.Ctx) error {
+		return DeleteMetadataField(c, db)
+	})
+	metadataGroup.Put("/file/:file_id", write, requireFilePermission(db, permissionEditor), func(c *fiber.Ctx) error {
+		return SetFileMetadata(c, db)
+	})
+	metadataGroup.Put("/folder/:folder_id", write, requireFolderPermission(db, permissionEditor), func(c *fiber.Ctx) error {
+		return SetFolderMetadata(c, db)
+	})
+}
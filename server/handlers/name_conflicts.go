@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Strategies for an item added to a folder that already holds an item with its name, chosen with the
+// on_conflict query parameter. Replacing keeps the content of the existing file as an earlier version
+const (
+	conflictFail    = "fail"
+	conflictRename  = "rename"
+	conflictReplace = "replace"
+	conflictSkip    = "skip"
+)
+
+// numberedName matches names already renamed after a conflict, like "report (2)"
+var numberedName = regexp.MustCompile(`^(.*) \((\d+)\)$`)
+
+// nameResolution is how an item is added to a folder after looking for items with its name
+type nameResolution struct {
+	Name string
+	// ExistingID is the item with the name when it is replaced or the new item is skipped
+	ExistingID string
+	Replace    bool
+	Skip       bool
+}
+
+// batchNames holds the names items of one request take in their destination folder, by item type and name
+// in lower case, with the id of the item taking each. Items of a request are all resolved before any is
+// saved, so the names they take count as taken for the items after them
+type batchNames map[string]string
+
+func (batch batchNames) key(itemType string, name string) string {
+	return itemType + "/" + strings.ToLower(name)
+}
+
+// conflictStrategy reads the on_conflict query parameter, failing is the default
+func conflictStrategy(c *fiber.Ctx) (string, error) {
+	strategy := c.Query("on_conflict", conflictFail)
+	switch strategy {
+	case conflictFail, conflictRename, conflictReplace, conflictSkip:
+		return strategy, nil
+	}
+	return "", &statusError{fiber.StatusBadRequest, "on_conflict must be fail, rename, replace or skip"}
+}
+
+// findNameConflict returns the id of the file or folder named name, ignoring case, in a folder or at the
+// root of an organization when parentID is nil, or "" when the name is free. The item excludeID is left
+// out so items keep their own name
+func findNameConflict(db *pgxpool.Pool, itemType string, organizationID string, parentID *string, name string, excludeID string) (string, error) {
+	table, parentColumn := "files", "folder_id"
+	if itemType == "folder" {
+		table, parentColumn = "folders", "parent_folder_id"
+	}
+
+	var existingID string
+	err := db.QueryRow(
+		context.Background(),
+		fmt.Sprintf(`
+			SELECT id FROM %s
+			WHERE COALESCE(%s, organization_id) = COALESCE($1::uuid, $2::uuid) AND LOWER(name) = LOWER($3)
+			AND deleted = false AND id::text <> $4
+			LIMIT 1;
+		`, table, parentColumn),
+		parentID, organizationID, name, excludeID,
+	).Scan(&existingID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return existingID, err
+}
+
+// availableName returns the first free name out of "name (2)", "name (3)" and so on, file extensions stay
+// at the end and names already numbered count on from their number. Names taken in batch aren't free
+func availableName(db *pgxpool.Pool, batch batchNames, itemType string, organizationID string, parentID *string, name string) (string, error) {
+	base, extension := name, ""
+	if itemType == "file" {
+		if ext := path.Ext(name); ext != "" && ext != name {
+			base, extension = strings.TrimSuffix(name, ext), ext
+		}
+	}
+
+	number := 2
+	if match := numberedName.FindStringSubmatch(base); match != nil {
+		base = match[1]
+		if current, err := strconv.Atoi(match[2]); err == nil {
+			number = current + 1
+		}
+	}
+
+	for attempts := 0; attempts < 1000; attempts, number = attempts+1, number+1 {
+		candidate := fmt.Sprintf("%s (%d)%s", base, number, extension)
+		if batch[batch.key(itemType, candidate)] != "" {
+			continue
+		}
+		existingID, err := findNameConflict(db, itemType, organizationID, parentID, candidate, "")
+		if err != nil {
+			return "", err
+		}
+		if existingID == "" {
+			return candidate, nil
+		}
+	}
+
+	return "", &statusError{fiber.StatusConflict, "No free name left for " + name}
+}
+
+// resolveNameConflict applies a conflict strategy to an item named name added to a folder, or to the root of
+// an organization when parentID is nil. Folders can't be replaced
+func resolveNameConflict(db *pgxpool.Pool, strategy string, itemType string, organizationID string, parentID *string, name string, excludeID string) (nameResolution, error) {
+	return resolveBatchNameConflict(db, nil, strategy, itemType, organizationID, parentID, name, excludeID)
+}
+
+// resolveBatchNameConflict resolves the name of the item excludeID like resolveNameConflict, for items added to
+// the same folder together. Names taken earlier in batch count as taken, the name the item takes is added to it
+func resolveBatchNameConflict(db *pgxpool.Pool, batch batchNames, strategy string, itemType string, organizationID string, parentID *string, name string, excludeID string) (nameResolution, error) {
+	resolution, err := applyConflictStrategy(db, batch, strategy, itemType, organizationID, parentID, name, excludeID)
+	if err == nil && batch != nil && !resolution.Skip && !resolution.Replace {
+		batch[batch.key(itemType, resolution.Name)] = excludeID
+	}
+	return resolution, err
+}
+
+func applyConflictStrategy(db *pgxpool.Pool, batch batchNames, strategy string, itemType string, organizationID string, parentID *string, name string, excludeID string) (nameResolution, error) {
+	resolution := nameResolution{Name: name}
+
+	existingID := batch[batch.key(itemType, name)]
+	if existingID == "" {
+		var err error
+		existingID, err = findNameConflict(db, itemType, organizationID, parentID, name, excludeID)
+		if err != nil || existingID == "" {
+			return resolution, err
+		}
+	}
+
+	var err error
+	switch strategy {
+	case conflictRename:
+		resolution.Name, err = availableName(db, batch, itemType, organizationID, parentID, name)
+	case conflictSkip:
+		resolution.ExistingID, resolution.Skip = existingID, true
+	case conflictReplace:
+		if itemType == "folder" {
+			return resolution, &statusError{fiber.StatusConflict, "A folder named " + name + " already exists, folders can't be replaced"}
+		}
+		resolution.ExistingID, resolution.Replace = existingID, true
+	default:
+		return resolution, &statusError{fiber.StatusConflict, "A " + itemType + " named " + name + " already exists"}
+	}
+
+	return resolution, err
+}
+
+// nameTaken turns violations of the unique name indexes, from items added at the same time, into a
+// conflict. Other errors are returned as is
+func nameTaken(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return &statusError{fiber.StatusConflict, "An item with the same name already exists"}
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// testNamedFile inserts a file with a name in a folder, or at the root when folderID is nil
+func testNamedFile(t *testing.T, db *pgxpool.Pool, organizationID string, folderID *string, name string, createdAt time.Time) string {
+	t.Helper()
+
+	fileID := uuid.New().String()
+	_, err := db.Exec(
+		context.Background(),
+		"INSERT INTO files (id, name, folder_id, organization_id, file_path, created_at) VALUES ($1, $2, $3, $4, '', $5);",
+		fileID, name, folderID, organizationID, createdAt,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileID
+}
+
+func TestNumberDuplicateNames(t *testing.T) {
+	db := testDB(t)
+
+	creatorID := testUser(t, db, "creator@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+
+	// Items from before names were unique
+	if _, err := db.Exec(context.Background(), "DROP INDEX folders_name_idx; DROP INDEX files_name_idx;"); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	names := map[string]string{}
+	for i, name := range []string{"Docs", "docs", "Docs (2)"} {
+		folderID := uuid.New().String()
+		_, err := db.Exec(
+			context.Background(),
+			"INSERT INTO folders (id, name, organization_id, created_at) VALUES ($1, $2, $3, $4);",
+			folderID, name, organizationID, start.Add(time.Duration(i)*time.Second),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[folderID] = []string{"Docs", "docs (2)", "Docs (2) (2)"}[i]
+	}
+	for i, name := range []string{"report.pdf", "Report.PDF", ".bashrc", ".bashrc"} {
+		fileID := testNamedFile(t, db, organizationID, nil, name, start.Add(time.Duration(i)*time.Second))
+		names[fileID] = []string{"report.pdf", "Report (2).PDF", ".bashrc", ".bashrc (2)"}[i]
+	}
+
+	if _, err := db.Exec(context.Background(), "SELECT number_duplicate_names();"); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range names {
+		var name string
+		err := db.QueryRow(context.Background(), "SELECT name FROM folders WHERE id = $1 UNION ALL SELECT name FROM files WHERE id = $1;", id).Scan(&name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != want {
+			t.Errorf("item was renamed to %q, want %q", name, want)
+		}
+	}
+}
+
+func TestResolveBatchNameConflict(t *testing.T) {
+	db := testDB(t)
+
+	creatorID := testUser(t, db, "creator@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+	folderID := testFolder(t, db, organizationID, "", true)
+	testNamedFile(t, db, organizationID, &folderID, "a.txt", time.Now())
+
+	batch := batchNames{}
+	var renamed []string
+	for i := 0; i < 2; i++ {
+		resolution, err := resolveBatchNameConflict(db, batch, conflictRename, "file", organizationID, &folderID, "a.txt", uuid.New().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		renamed = append(renamed, resolution.Name)
+	}
+	if renamed[0] != "a (2).txt" || renamed[1] != "a (3).txt" {
+		t.Errorf("files moved together were renamed to %v, want a (2).txt and a (3).txt", renamed)
+	}
+
+	if _, err := resolveBatchNameConflict(db, batch, conflictFail, "file", organizationID, &folderID, "b.txt", uuid.New().String()); err != nil {
+		t.Fatal(err)
+	}
+	_, err := resolveBatchNameConflict(db, batch, conflictFail, "file", organizationID, &folderID, "B.txt", uuid.New().String())
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) {
+		t.Errorf("a second file named b.txt in the batch wasn't a conflict, %v", err)
+	}
+
+	// Folders don't take the names of files
+	if _, err := resolveBatchNameConflict(db, batch, conflictFail, "folder", organizationID, &folderID, "b.txt", uuid.New().String()); err != nil {
+		t.Errorf("a folder named like a file of the batch was a conflict, %v", err)
+	}
+}
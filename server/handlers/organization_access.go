@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// dbConn is a pool or a transaction, so helpers can be part of a larger change
+type dbConn interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// getOrganizationRole returns the effective role of a user in an organization, their own role raised by the
+// roles of their groups, or an empty string if they aren't a member or the organization is scheduled for deletion
+func getOrganizationRole(db dbConn, userID string, organizationID string) (string, error) {
+	var role *string
+	err := db.QueryRow(context.Background(), "SELECT organization_role($1, $2);", userID, organizationID).Scan(&role)
+	if err != nil || role == nil {
+		return "", err
+	}
+
+	return *role, nil
+}
+
+// hasOrganizationRole reports whether a user has one of the given roles in an organization
+func hasOrganizationRole(db *pgxpool.Pool, userID string, organizationID string, roles ...string) (bool, error) {
+	role, err := getOrganizationRole(db, userID, organizationID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, allowed := range roles {
+		if role == allowed {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// isOrganizationAdmin reports whether a user is the creator or an admin of an organization
+func isOrganizationAdmin(db *pgxpool.Pool, userID string, organizationID string) (bool, error) {
+	return hasOrganizationRole(db, userID, organizationID, "creator", "admin")
+}
+
+// isOrganizationCreator reports whether a user is the creator of an organization, including organizations
+// scheduled for deletion
+func isOrganizationCreator(db *pgxpool.Pool, userID string, organizationID string) (bool, error) {
+	var isCreator bool
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM userorganizations WHERE user_id = $1 AND organization_id = $2 AND role = 'creator');",
+		userID, organizationID,
+	).Scan(&isCreator)
+	return isCreator, err
+}
+
+// addUserToOrganization adds a user to an organization with a role unless they are already a member
+func addUserToOrganization(db dbConn, userID string, organizationID string, role string) error {
+	currentRole, err := getOrganizationRole(db, userID, organizationID)
+	if err != nil || currentRole != "" {
+		return err
+	}
+
+	_, err = db.Exec(
+		context.Background(),
+		"INSERT INTO userorganizations (id, user_id, organization_id, role, created_at) VALUES ($1, $2, $3, $4, $5);",
+		uuid.New().String(), userID, organizationID, role, time.Now(),
+	)
+	return err
+}
@@ -2,8 +2,13 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"log"
+	"os"
+	"server/middleware"
 	"server/models"
+	"server/spaces"
+	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -53,7 +58,14 @@ func CreateOrganization(c *fiber.Ctx, db *pgxpool.Pool) error {
 
 	query := "INSERT INTO organizations(organization_id, name, created_at) VALUES ($1, $2, $3);"
 
-	_, err = db.Exec(
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating organization", "message": err.Error()})
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(
 		context.Background(),
 		query,
 		organization.OrganizationID, organization.Name, organization.CreatedAt,
@@ -78,7 +90,7 @@ func CreateOrganization(c *fiber.Ctx, db *pgxpool.Pool) error {
 		VALUES ($1, $2, $3, $4, $5);
 	`
 
-	_, err = db.Exec(
+	_, err = tx.Exec(
 		context.Background(),
 		query,
 		userOrganization.ID, userOrganization.UserID, userOrganization.OrganizationID, userOrganization.Role, userOrganization.CreatedAt,
@@ -89,6 +101,16 @@ func CreateOrganization(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating user organization", "message": err.Error()})
 	}
 
+	if err := recordAuditTx(c, tx, auditEvent{Action: "organization.create", TargetType: "organization", TargetID: organization.OrganizationID, After: &organization}); err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating organization", "message": err.Error()})
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating organization", "message": err.Error()})
+	}
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Organization created successfully!"})
 }
 
@@ -111,49 +133,88 @@ func UpdateOrganization(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing fields"})
 	}
 
+	before := auditOrganizationSnapshot(db, organizationId)
+
 	query := `
 		UPDATE organizations
 		SET name = $1
 		WHERE organization_id = $2;
 	`
 
-	commandTag, err := db.Exec(
-		context.Background(),
-		query,
-		organization.Name, organizationId,
-	)
+	err := auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		commandTag, err := tx.Exec(
+			context.Background(),
+			query,
+			organization.Name, organizationId,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if commandTag.RowsAffected() == 0 {
+			return nil, pgx.ErrNoRows
+		}
+		return &auditEvent{Action: "organization.update", TargetType: "organization", TargetID: organizationId, Before: before, After: auditOrganizationSnapshot(tx, organizationId)}, nil
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Organization not found"})
+	}
 
 	if err != nil {
 		log.Println("Error updating organization")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating organization", "message": err.Error()})
 	}
 
-	if commandTag.RowsAffected() == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Organization not found"})
-	}
-
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Organization updated successfully!"})
 }
 
+// organizationDeletionGracePeriod is how long a deleted organization can be restored before it is purged,
+// ORGANIZATION_DELETION_GRACE_DAYS days (30 by default)
+func organizationDeletionGracePeriod() time.Duration {
+	graceDays, err := strconv.Atoi(os.Getenv("ORGANIZATION_DELETION_GRACE_DAYS"))
+	if err != nil || graceDays <= 0 {
+		graceDays = 30
+	}
+	return time.Duration(graceDays) * 24 * time.Hour
+}
+
 /**
-	* DeleteOrganization - deletes an organization
+	* DeleteOrganization - schedules an organization for deletion, it can be restored
+	* and exported until it is purged
 	* @c - fiber
 	* @db - database
 	* Return - error or Ok
 */
 func DeleteOrganization(c *fiber.Ctx, db *pgxpool.Pool) error {
 	organization_id := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
 
 	if organization_id == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Organization ID missing"})
 	}
 
-	query := "DELETE FROM organizations WHERE organization_id = $1;"
+	isCreator, err := hasOrganizationRole(db, userID, organization_id, "creator")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if !isCreator {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only the organization creator can delete it"})
+	}
+
+	purgeAt := time.Now().Add(organizationDeletionGracePeriod())
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting organization", "message": err.Error()})
+	}
+	defer tx.Rollback(context.Background())
+
+	query := "UPDATE organizations SET deleted_at = NOW(), purge_at = $1 WHERE organization_id = $2 AND deleted_at IS NULL;"
 
-	_, err := db.Exec(
+	_, err = tx.Exec(
 		context.Background(),
 		query,
-		organization_id,
+		purgeAt, organization_id,
 	)
 
 	if err != nil {
@@ -161,48 +222,365 @@ func DeleteOrganization(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting organization", "message": err.Error()})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{"error": "Organization deleted!"})
+	// Pending ownership transfers and invitations can't be completed for a deleted organization
+	_, err = tx.Exec(
+		context.Background(),
+		"UPDATE ownershiptransfers SET status = 'cancelled', responded_at = NOW() WHERE organization_id = $1 AND status = 'pending';",
+		organization_id,
+	)
+	if err != nil {
+		log.Println("Error cancelling ownership transfers: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting organization", "message": err.Error()})
+	}
+
+	_, err = tx.Exec(
+		context.Background(),
+		"UPDATE invitations SET status = 'revoked' WHERE organization_id = $1 AND status = 'pending';",
+		organization_id,
+	)
+	if err != nil {
+		log.Println("Error revoking invitations: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting organization", "message": err.Error()})
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{Action: "organization.delete", TargetType: "organization", TargetID: organization_id, After: auditOrganizationSnapshot(tx, organization_id)}); err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting organization", "message": err.Error()})
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting organization", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":    "Organization scheduled for deletion, export or restore it before it is purged",
+		"purge_at":   purgeAt,
+		"export_url": "/organization/export/" + organization_id,
+	})
 }
 
-// Function to get all organizations for a specific user
-func GetOrganizations(c *fiber.Ctx, db *pgxpool.Pool) error {
-	userId := c.Params("user_id")
+// RestoreOrganization cancels the scheduled deletion of an organization
+func RestoreOrganization(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
 
-	if userId == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing user_id in params"})
+	isCreator, err := isOrganizationCreator(db, userID, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if !isCreator {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only the organization creator can restore it"})
 	}
 
-	query := `
-		SELECT org.*
-		FROM organizations org
-		JOIN userorganizations uo ON org.organization_id = uo.organization_id 
-		WHERE uo.user_id = $1;
-	`
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		commandTag, err := tx.Exec(
+			context.Background(),
+			"UPDATE organizations SET deleted_at = NULL, purge_at = NULL WHERE organization_id = $1 AND deleted_at IS NOT NULL AND purge_at > NOW();",
+			organizationId,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if commandTag.RowsAffected() == 0 {
+			return nil, pgx.ErrNoRows
+		}
+		return &auditEvent{Action: "organization.restore", TargetType: "organization", TargetID: organizationId, After: auditOrganizationSnapshot(tx, organizationId)}, nil
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Organization isn't scheduled for deletion"})
+	}
+	if err != nil {
+		log.Println("Error restoring organization: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error restoring organization", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Organization restored!"})
+}
+
+// ExportOrganization returns the folders and files of an organization with temporary download links,
+// it is also available while the organization is scheduled for deletion
+func ExportOrganization(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	var organization models.Organization
+	var role string
+	err := db.QueryRow(
+		context.Background(),
+		`
+			SELECT o.organization_id, o.name, o.created_at, o.deleted_at, o.purge_at, uo.role
+			FROM organizations o
+			JOIN userorganizations uo ON uo.organization_id = o.organization_id
+			WHERE o.organization_id = $1 AND uo.user_id = $2;
+		`,
+		organizationId, userID,
+	).Scan(&organization.OrganizationID, &organization.Name, &organization.CreatedAt, &organization.DeletedAt, &organization.PurgeAt, &role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Organization not found"})
+	} else if err != nil {
+		log.Println("Error fetching organization: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching the organization", "message": err.Error()})
+	}
+
+	if role != "creator" && role != "admin" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can export it"})
+	}
 
 	rows, err := db.Query(
 		context.Background(),
-		query,
-		userId,
+		"SELECT id, name, organization_id, parent_folder_id, created_at, updated_at, deleted, deleted_at FROM folders WHERE organization_id = $1;",
+		organizationId,
 	)
+	if err != nil {
+		log.Println("Error fetching folders: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching folders", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	folders := []models.Folder{}
+	for rows.Next() {
+		var folder models.Folder
+		if err := rows.Scan(
+			&folder.ID,
+			&folder.Name,
+			&folder.OrganizationID,
+			&folder.ParentFolderID,
+			&folder.CreatedAt,
+			&folder.UpdatedAt,
+			&folder.Deleted,
+			&folder.DeletedAt,
+		); err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		folders = append(folders, folder)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
 
+	rows, err = db.Query(
+		context.Background(),
+		`SELECT f.id, f.name, f.folder_id, f.file_path, f.file_size, f.created_at, f.updated_at, f.organization_id, f.deleted, f.deleted_at,
+		b.encryption_key_id IS NOT NULL FROM files f LEFT JOIN blobs b ON b.id = f.blob_id WHERE f.organization_id = $1;`,
+		organizationId,
+	)
+	if err != nil {
+		log.Println("Error fetching files: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching files", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	type exportedFile struct {
+		models.File
+		DownloadURL string `json:"download_url"`
+	}
+
+	files := []exportedFile{}
+	for rows.Next() {
+		var file exportedFile
+		var encrypted bool
+		if err := rows.Scan(
+			&file.ID,
+			&file.Name,
+			&file.FolderID,
+			&file.FilePath,
+			&file.FileSize,
+			&file.CreatedAt,
+			&file.UpdatedAt,
+			&file.OrganizationID,
+			&file.Deleted,
+			&file.DeletedAt,
+			&encrypted,
+		); err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+
+		// Encrypted files are only downloaded decrypted through the server
+		if encrypted {
+			file.DownloadURL = "/download/file/" + file.ID
+			files = append(files, file)
+			continue
+		}
+
+		file.DownloadURL, err = spaces.PresignDownload(file.FilePath, file.Name, 24*time.Hour)
+		if err != nil {
+			log.Println("Error creating download link: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating download link", "message": err.Error()})
+		}
+		files = append(files, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	recordAudit(c, db, auditEvent{Action: "organization.export", TargetType: "organization", TargetID: organizationId, OrganizationID: organizationId})
+
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+organization.OrganizationID+`.json"`)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"organization": organization,
+		"folders":      folders,
+		"files":        files,
+	})
+}
+
+// PurgeDeletedOrganizations permanently deletes organizations whose grace period has ended,
+// along with their folders, files and Spaces objects
+func PurgeDeletedOrganizations(db *pgxpool.Pool) {
+	rows, err := db.Query(context.Background(), "SELECT organization_id FROM organizations WHERE purge_at <= NOW();")
+	if err != nil {
+		log.Println("Error fetching organizations to purge: ", err)
+		return
+	}
+
+	var organizationIds []string
+	for rows.Next() {
+		var organizationId string
+		if err := rows.Scan(&organizationId); err != nil {
+			log.Println("Error scanning row: ", err)
+			rows.Close()
+			return
+		}
+		organizationIds = append(organizationIds, organizationId)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return
+	}
+
+	for _, organizationId := range organizationIds {
+		if err := purgeOrganization(db, organizationId); err != nil {
+			// The organization is kept so the purge is retried on the next run
+			log.Printf("Error purging organization %s: %v", organizationId, err)
+		}
+	}
+}
+
+// purgeOrganization deletes the Spaces objects of an organization then the organization,
+// its folders, files, blobs and previews are removed by the cascade
+func purgeOrganization(db *pgxpool.Pool, organizationId string) error {
+	rows, err := db.Query(
+		context.Background(),
+		`
+			SELECT file_path FROM files WHERE organization_id = $1 AND blob_id IS NULL
+			UNION ALL
+			SELECT file_path FROM blobs WHERE organization_id = $1
+			UNION ALL
+			SELECT t.file_path FROM thumbnails t JOIN blobs b ON b.id = t.blob_id WHERE b.organization_id = $1;
+		`,
+		organizationId,
+	)
+	if err != nil {
+		return err
+	}
+
+	var filePaths []string
+	for rows.Next() {
+		var filePath string
+		if err := rows.Scan(&filePath); err != nil {
+			rows.Close()
+			return err
+		}
+		filePaths = append(filePaths, filePath)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, filePath := range filePaths {
+		if err := spaces.DeleteFile(filePath); err != nil {
+			return err
+		}
+	}
+
+	if err := deleteVersionObjects(db, "f.organization_id = $1", organizationId); err != nil {
+		return err
+	}
+
+	before := auditOrganizationSnapshot(db, organizationId)
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	commandTag, err := tx.Exec(
+		context.Background(),
+		"DELETE FROM organizations WHERE organization_id = $1 AND purge_at <= NOW();",
+		organizationId,
+	)
+	if err != nil || commandTag.RowsAffected() == 0 {
+		return err
+	}
+
+	if err := recordSystemAuditTx(tx, auditEvent{Action: "organization.purge", TargetType: "organization", TargetID: organizationId, Before: before}); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// Function to get all organizations for a specific user
+// organizationSortColumns are the columns organization listings can be sorted by
+var organizationSortColumns = map[string]sortColumn{
+	"name":       {Expression: "org.name", Type: "text"},
+	"created_at": {Expression: "COALESCE(org.created_at, 'epoch')", Type: "timestamptz", Descending: true},
+}
+
+// listOrganizations responds with a page of the organizations matching where, a condition on the organizations
+// org joined with the memberships uo that uses args
+func listOrganizations(c *fiber.Ctx, db *pgxpool.Pool, where string, args []interface{}) error {
+	page, err := parsePageRequest(c, organizationSortColumns, "name")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	filters, args, err := parseFilters(c, filterColumns{CreatedAt: "org.created_at"}, args)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	rows, total, err := queryPage(
+		db, page,
+		"org.organization_id, org.name, org.created_at, org.deleted_at, org.purge_at",
+		"organizations org JOIN userorganizations uo ON org.organization_id = uo.organization_id",
+		where+" AND "+filters, "org.organization_id", args,
+	)
 	if err != nil {
 		log.Println("Error fetching organizations: ", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching organizations", "message": err.Error()})
 	}
 	defer rows.Close()
 
-	var organizations []models.Organization
+	organizations := []models.Organization{}
+	var keys []pageKey
 	for rows.Next() {
 		var organization models.Organization
+		var key pageKey
 		if err := rows.Scan(
-			&organization.OrganizationID, 
-			&organization.Name, 
+			&organization.OrganizationID,
+			&organization.Name,
 			&organization.CreatedAt,
-			); err != nil {
+			&organization.DeletedAt,
+			&organization.PurgeAt,
+			&key.Value,
+		); err != nil {
 			log.Println("Error scanning row: ", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
 		}
+		key.ID = organization.OrganizationID
 		organizations = append(organizations, organization)
+		keys = append(keys, key)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -210,7 +588,28 @@ func GetOrganizations(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(organizations)
+	nextCursor := page.nextCursor(keys)
+	if len(organizations) > page.Limit {
+		organizations = organizations[:page.Limit]
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"items":       organizations,
+		"next_cursor": nextCursor,
+		"total":       total,
+	})
+}
+
+// GetOrganizations lists the organizations a user belongs to, a page at a time. Deleted organizations are only
+// listed for their creator, who can still restore them
+func GetOrganizations(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userId := c.Params("user_id")
+
+	if userId == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing user_id in params"})
+	}
+
+	return listOrganizations(c, db, "uo.user_id = $1 AND (org.deleted_at IS NULL OR uo.role = 'creator')", []interface{}{userId})
 }
 
 //Function to fetch an organization
@@ -222,13 +621,13 @@ func GetOrganization(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing organization_id"})
 	}
 
-	query := "SELECT organization_id, name, created_at FROM organizations WHERE organization_id = $1;"
+	query := "SELECT organization_id, name, created_at, deleted_at, purge_at FROM organizations WHERE organization_id = $1;"
 
 	err := db.QueryRow(
 		context.Background(),
 		query,
 		organization_id,
-	).Scan(&organization.OrganizationID, &organization.Name, &organization.CreatedAt)
+	).Scan(&organization.OrganizationID, &organization.Name, &organization.CreatedAt, &organization.DeletedAt, &organization.PurgeAt)
 
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error":"Error fetching the organization", "message": err.Error()})
@@ -252,7 +651,13 @@ func RegisterOrganizationRoutes(app *fiber.App, db *pgxpool.Pool) {
 	organizationGroup.Get("/fetch/all/:user_id", func(c *fiber.Ctx) error {
 		return GetOrganizations(c, db)
 	})
-	organizationGroup.Delete("/delete/:organization_id", func(c *fiber.Ctx) error {
+	organizationGroup.Delete("/delete/:organization_id", middleware.AuthRequired(db), middleware.SessionRequired(), func(c *fiber.Ctx) error {
 		return DeleteOrganization(c, db)
 	})
+	organizationGroup.Put("/restore/:organization_id", middleware.AuthRequired(db), middleware.SessionRequired(), func(c *fiber.Ctx) error {
+		return RestoreOrganization(c, db)
+	})
+	organizationGroup.Get("/export/:organization_id", middleware.AuthRequired(db), middleware.RequireScope(db, middleware.ScopeReadFiles), func(c *fiber.Ctx) error {
+		return ExportOrganization(c, db)
+	})
 }
@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"server/middleware"
+	"server/models"
+	"server/otp"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const ownershipTransferTTL = 7 * 24 * time.Hour
+
+// getPendingOwnershipTransfer fetches the pending, unexpired ownership transfer of an organization
+func getPendingOwnershipTransfer(db *pgxpool.Pool, organizationID string) (models.OwnershipTransfer, error) {
+	var transfer models.OwnershipTransfer
+	err := db.QueryRow(
+		context.Background(),
+		`
+			SELECT id, organization_id, from_user_id, to_user_id, status, expires_at, created_at, responded_at
+			FROM ownershiptransfers
+			WHERE organization_id = $1 AND status = 'pending' AND expires_at > NOW();
+		`,
+		organizationID,
+	).Scan(
+		&transfer.ID,
+		&transfer.OrganizationID,
+		&transfer.FromUserID,
+		&transfer.ToUserID,
+		&transfer.Status,
+		&transfer.ExpiresAt,
+		&transfer.CreatedAt,
+		&transfer.RespondedAt,
+	)
+	return transfer, err
+}
+
+// CreateOwnershipTransfer asks a member of an organization to become its creator
+func CreateOwnershipTransfer(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	isCreator, err := hasOrganizationRole(db, userID, organizationId, "creator")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if !isCreator {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only the organization creator can transfer ownership"})
+	}
+
+	var data struct {
+		UserID string `json:"user_id"`
+	}
+	if err := c.BodyParser(&data); err != nil || data.UserID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing fields"})
+	}
+	if data.UserID == userID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "You already own this organization"})
+	}
+
+	role, err := getOrganizationRole(db, data.UserID, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking membership", "message": err.Error()})
+	}
+	if role == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "The new owner must be a member of the organization"})
+	}
+
+	var email, organizationName string
+	err = db.QueryRow(
+		context.Background(),
+		"SELECT u.email, o.name FROM users u, organizations o WHERE u.user_id = $1 AND o.organization_id = $2;",
+		data.UserID, organizationId,
+	).Scan(&email, &organizationName)
+	if err != nil {
+		log.Println("Error fetching the new owner: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching the new owner", "message": err.Error()})
+	}
+
+	// Expired requests would otherwise block a new one
+	_, err = db.Exec(
+		context.Background(),
+		"UPDATE ownershiptransfers SET status = 'cancelled' WHERE organization_id = $1 AND status = 'pending' AND expires_at <= NOW();",
+		organizationId,
+	)
+	if err != nil {
+		log.Println("Error expiring ownership transfers: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating ownership transfer", "message": err.Error()})
+	}
+
+	transfer := models.OwnershipTransfer{
+		ID:             uuid.New().String(),
+		OrganizationID: organizationId,
+		FromUserID:     userID,
+		ToUserID:       data.UserID,
+		Status:         "pending",
+		ExpiresAt:      time.Now().Add(ownershipTransferTTL),
+		CreatedAt:      time.Now(),
+	}
+
+	query := `
+		INSERT INTO ownershiptransfers (id, organization_id, from_user_id, to_user_id, status, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);
+	`
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(
+			context.Background(),
+			query,
+			transfer.ID, transfer.OrganizationID, transfer.FromUserID, transfer.ToUserID, transfer.Status, transfer.ExpiresAt, transfer.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "ownership_transfer.create", TargetType: "user", TargetID: data.UserID, After: &transfer}, nil
+	})
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.ConstraintName == "ownershiptransfers_pending_idx" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "An ownership transfer is already pending"})
+	} else if err != nil {
+		log.Println("Error creating ownership transfer: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating ownership transfer", "message": err.Error()})
+	}
+
+	if err := otp.SendOwnershipTransferEmail(email, organizationName, organizationId); err != nil {
+		log.Println("Error sending ownership transfer email: ", err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(transfer)
+}
+
+// GetOwnershipTransfer returns the pending ownership transfer of an organization to its creator or the new owner
+func GetOwnershipTransfer(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	transfer, err := getPendingOwnershipTransfer(db, organizationId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No pending ownership transfer"})
+	} else if err != nil {
+		log.Println("Error fetching ownership transfer: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching ownership transfer", "message": err.Error()})
+	}
+
+	if transfer.FromUserID != userID && transfer.ToUserID != userID {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No pending ownership transfer"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(transfer)
+}
+
+// AcceptOwnershipTransfer makes the new owner the creator of the organization, the previous creator becomes an admin
+func AcceptOwnershipTransfer(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	transfer, err := getPendingOwnershipTransfer(db, organizationId)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && transfer.ToUserID != userID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No pending ownership transfer"})
+	} else if err != nil {
+		log.Println("Error fetching ownership transfer: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching ownership transfer", "message": err.Error()})
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error accepting ownership transfer", "message": err.Error()})
+	}
+	defer tx.Rollback(context.Background())
+
+	commandTag, err := tx.Exec(
+		context.Background(),
+		"UPDATE userorganizations SET role = 'admin' WHERE user_id = $1 AND organization_id = $2 AND role = 'creator';",
+		transfer.FromUserID, organizationId,
+	)
+	if err != nil {
+		log.Println("Error updating previous owner: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error accepting ownership transfer", "message": err.Error()})
+	}
+	if commandTag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "The requester is no longer the organization creator"})
+	}
+
+	commandTag, err = tx.Exec(
+		context.Background(),
+		"UPDATE userorganizations SET role = 'creator' WHERE user_id = $1 AND organization_id = $2;",
+		userID, organizationId,
+	)
+	if err != nil {
+		log.Println("Error updating new owner: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error accepting ownership transfer", "message": err.Error()})
+	}
+	if commandTag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "You are no longer a member of this organization"})
+	}
+
+	_, err = tx.Exec(
+		context.Background(),
+		"UPDATE ownershiptransfers SET status = 'accepted', responded_at = NOW() WHERE id = $1;",
+		transfer.ID,
+	)
+	if err != nil {
+		log.Println("Error updating ownership transfer: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error accepting ownership transfer", "message": err.Error()})
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{
+		OrganizationID: organizationId,
+		Action:         "ownership_transfer.accept",
+		TargetType:     "user",
+		TargetID:       userID,
+		Before:         fiber.Map{"creator": transfer.FromUserID},
+		After:          fiber.Map{"creator": userID},
+	}); err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error accepting ownership transfer", "message": err.Error()})
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error accepting ownership transfer", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "You are now the owner of the organization!"})
+}
+
+// DeclineOwnershipTransfer lets the new owner refuse a pending ownership transfer
+func DeclineOwnershipTransfer(c *fiber.Ctx, db *pgxpool.Pool) error {
+	return closeOwnershipTransfer(c, db, "to_user_id", "declined", "ownership_transfer.decline")
+}
+
+// CancelOwnershipTransfer lets the creator withdraw a pending ownership transfer
+func CancelOwnershipTransfer(c *fiber.Ctx, db *pgxpool.Pool) error {
+	return closeOwnershipTransfer(c, db, "from_user_id", "cancelled", "ownership_transfer.cancel")
+}
+
+// closeOwnershipTransfer sets the status of the pending ownership transfer of an organization
+// if the logged in user is on the given side of it
+func closeOwnershipTransfer(c *fiber.Ctx, db *pgxpool.Pool, userColumn string, status string, action string) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	err := auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		commandTag, err := tx.Exec(
+			context.Background(),
+			"UPDATE ownershiptransfers SET status = $1, responded_at = NOW() WHERE organization_id = $2 AND "+userColumn+" = $3 AND status = 'pending';",
+			status, organizationId, userID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if commandTag.RowsAffected() == 0 {
+			return nil, pgx.ErrNoRows
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: action, TargetType: "organization", TargetID: organizationId}, nil
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No pending ownership transfer"})
+	}
+	if err != nil {
+		log.Println("Error updating ownership transfer: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating ownership transfer", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Ownership transfer " + status})
+}
+
+func RegisterOwnershipTransferRoutes(app *fiber.App, db *pgxpool.Pool) {
+	transferGroup := app.Group("/organization/transfer", middleware.AuthRequired(db), middleware.SessionRequired())
+
+	transferGroup.Post("/create/:organization_id", func(c *fiber.Ctx) error {
+		return CreateOwnershipTransfer(c, db)
+	})
+	transferGroup.Get("/fetch/:organization_id", func(c *fiber.Ctx) error {
+		return GetOwnershipTransfer(c, db)
+	})
+	transferGroup.Put("/accept/:organization_id", func(c *fiber.Ctx) error {
+		return AcceptOwnershipTransfer(c, db)
+	})
+	transferGroup.Put("/decline/:organization_id", func(c *fiber.Ctx) error {
+		return DeclineOwnershipTransfer(c, db)
+	})
+	transferGroup.Delete("/cancel/:organization_id", func(c *fiber.Ctx) error {
+		return CancelOwnershipTransfer(c, db)
+	})
+}
@@ -0,0 +1,323 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// sortColumn is a column a listing can be sorted by. Expression must never be NULL, Type is the SQL type
+// the cursor value is cast back to and Descending is the default order
+type sortColumn struct {
+	Expression string
+	Type       string
+	Descending bool
+}
+
+// pageRequest is a page of a listing read from the limit, sort, order and cursor query parameters
+type pageRequest struct {
+	Limit      int
+	Sort       sortColumn
+	Descending bool
+	// After holds the sort value and id of the last item of the previous page
+	After []string
+}
+
+// filterColumns are the expressions a listing applies the filter query parameters to, filters without an
+// expression aren't supported by the listing
+type filterColumns struct {
+	// Name is matched against the extensions of the type filter
+	Name      string
+	Size      string
+	CreatedAt string
+	UpdatedAt string
+	CreatedBy string
+	// Tags is the array of tag names of an item and Metadata its metadata object
+	Tags     string
+	Metadata string
+}
+
+// pageKey is the position of an item in a listing, the sort value as text and the id
+type pageKey struct {
+	Value string
+	ID    string
+}
+
+// parsePageRequest reads the page of a listing from the request, sort must be one of columns
+func parsePageRequest(c *fiber.Ctx, columns map[string]sortColumn, defaultSort string) (pageRequest, error) {
+	var page pageRequest
+
+	limit, err := strconv.Atoi(c.Query("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		return page, errors.New("limit must be between 1 and 500")
+	}
+	page.Limit = limit
+
+	column, ok := columns[c.Query("sort", defaultSort)]
+	if !ok {
+		return page, errors.New("unsupported sort column")
+	}
+	page.Sort = column
+
+	switch c.Query("order") {
+	case "":
+		page.Descending = column.Descending
+	case "asc":
+		page.Descending = false
+	case "desc":
+		page.Descending = true
+	default:
+		return page, errors.New("order must be asc or desc")
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || json.Unmarshal(decoded, &page.After) != nil || len(page.After) != 2 {
+			return page, errors.New("invalid cursor")
+		}
+	}
+
+	return page, nil
+}
+
+// keyset returns the condition selecting the items after the cursor, or TRUE on the first page, and the
+// ORDER BY and LIMIT clauses. One more item than the limit is fetched to know if there is a next page
+func (page pageRequest) keyset(idExpression string, args []interface{}) (string, string, []interface{}) {
+	direction, operator := "ASC", ">"
+	if page.Descending {
+		direction, operator = "DESC", "<"
+	}
+
+	condition := "TRUE"
+	if page.After != nil {
+		args = append(args, page.After[0], page.After[1])
+		condition = fmt.Sprintf(
+			"(%s, %s) %s ($%d::text::%s, $%d::text::uuid)",
+			page.Sort.Expression, idExpression, operator, len(args)-1, page.Sort.Type, len(args),
+		)
+	}
+
+	order := fmt.Sprintf(
+		"ORDER BY %s %s, %s %s LIMIT %d",
+		page.Sort.Expression, direction, idExpression, direction, page.Limit+1,
+	)
+
+	return condition, order, args
+}
+
+// sortKey selects the sort value of an item as text to build the next cursor from
+func (page pageRequest) sortKey() string {
+	return page.Sort.Expression + "::text"
+}
+
+// nextCursor returns the cursor of the page after this one, or nil when the keys fetched fit in the page
+func (page pageRequest) nextCursor(keys []pageKey) *string {
+	if len(keys) <= page.Limit {
+		return nil
+	}
+
+	last := keys[page.Limit-1]
+	encoded, _ := json.Marshal([]string{last.Value, last.ID})
+	cursor := base64.RawURLEncoding.EncodeToString(encoded)
+	return &cursor
+}
+
+// parseFilterTime reads a date filter, either an RFC 3339 timestamp or a YYYY-MM-DD day
+func parseFilterTime(value string) (time.Time, error) {
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// parseFilters reads the type, min_size, max_size, created_after, created_before, updated_after, updated_before,
+// created_by, tag and metadata query parameters into a condition on columns, appending its arguments to args. Type
+// is a comma separated list of file extensions, after dates are inclusive and before dates exclusive. Tag is a
+// comma separated list of tag names items must all carry
+func parseFilters(c *fiber.Ctx, columns filterColumns, args []interface{}) (string, []interface{}, error) {
+	conditions := []string{"TRUE"}
+	add := func(condition string, values ...interface{}) {
+		for _, value := range values {
+			args = append(args, value)
+			condition = strings.Replace(condition, "$?", fmt.Sprintf("$%d", len(args)), 1)
+		}
+		conditions = append(conditions, condition)
+	}
+
+	if types := c.Query("type"); types != "" {
+		if columns.Name == "" {
+			return "", args, errors.New("type filter is not supported here")
+		}
+		extensions := []string{}
+		for _, extension := range strings.Split(types, ",") {
+			if extension = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(extension), ".")); extension != "" {
+				extensions = append(extensions, extension)
+			}
+		}
+		add(`LOWER(substring(`+columns.Name+` from '\.([^.]+)$')) = ANY($?)`, extensions)
+	}
+
+	sizes := []struct {
+		param    string
+		operator string
+	}{{"min_size", ">="}, {"max_size", "<="}}
+	for _, size := range sizes {
+		value := c.Query(size.param)
+		if value == "" {
+			continue
+		}
+		if columns.Size == "" {
+			return "", args, errors.New(size.param + " filter is not supported here")
+		}
+		bytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || bytes < 0 {
+			return "", args, errors.New(size.param + " must be a number of bytes")
+		}
+		add(columns.Size+" "+size.operator+" $?", bytes)
+	}
+
+	dates := []struct {
+		param    string
+		column   string
+		operator string
+	}{
+		{"created_after", columns.CreatedAt, ">="},
+		{"created_before", columns.CreatedAt, "<"},
+		{"updated_after", columns.UpdatedAt, ">="},
+		{"updated_before", columns.UpdatedAt, "<"},
+	}
+	for _, date := range dates {
+		value := c.Query(date.param)
+		if value == "" {
+			continue
+		}
+		if date.column == "" {
+			return "", args, errors.New(date.param + " filter is not supported here")
+		}
+		parsed, err := parseFilterTime(value)
+		if err != nil {
+			return "", args, errors.New(date.param + " must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+		}
+		add(date.column+" "+date.operator+" $?", parsed)
+	}
+
+	if createdBy := c.Query("created_by"); createdBy != "" {
+		if columns.CreatedBy == "" {
+			return "", args, errors.New("created_by filter is not supported here")
+		}
+		if _, err := uuid.Parse(createdBy); err != nil {
+			return "", args, errors.New("created_by must be a user id")
+		}
+		add(columns.CreatedBy+" = $?::uuid", createdBy)
+	}
+
+	if tags := c.Query("tag"); tags != "" {
+		if columns.Tags == "" {
+			return "", args, errors.New("tag filter is not supported here")
+		}
+		names := []string{}
+		for _, name := range strings.Split(tags, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				names = append(names, name)
+			}
+		}
+		add("ARRAY(SELECT LOWER(tag_name) FROM unnest("+columns.Tags+") tag_name) @> $?::text[]", names)
+	}
+
+	metadataFilters, err := parseMetadataFilters(c)
+	if err != nil {
+		return "", args, err
+	}
+	if len(metadataFilters) > 0 && columns.Metadata == "" {
+		return "", args, errors.New("metadata filters are not supported here")
+	}
+	for _, filter := range metadataFilters {
+		switch number, err := strconv.ParseFloat(filter.Value, 64); {
+		case filter.Operator == "=":
+			add(columns.Metadata+" ->> $?::text = $?", filter.Key, filter.Value)
+		case err == nil:
+			// CASE keeps text values from being cast to numbers
+			add("CASE WHEN jsonb_typeof("+columns.Metadata+" -> $?::text) = 'number' THEN ("+columns.Metadata+" ->> $?::text)::numeric "+filter.Operator+" $?::numeric ELSE false END", filter.Key, filter.Key, number)
+		default:
+			add("(jsonb_typeof("+columns.Metadata+" -> $?::text) = 'string' AND "+columns.Metadata+" ->> $?::text "+filter.Operator+" $?)", filter.Key, filter.Key, filter.Value)
+		}
+	}
+
+	return strings.Join(conditions, " AND "), args, nil
+}
+
+// metadataFilter is a condition on the metadata value of a key
+type metadataFilter struct {
+	Key      string
+	Operator string
+	Value    string
+}
+
+// parseMetadataFilters reads the metadata.<key>, metadata.<key>.gte and metadata.<key>.lte query parameters, in
+// the order of their keys. Equality compares the values as text, ranges compare numbers when the bound is a number
+// and text otherwise, which orders dates too
+func parseMetadataFilters(c *fiber.Ctx) ([]metadataFilter, error) {
+	var filters []metadataFilter
+	var err error
+	c.Context().QueryArgs().VisitAll(func(param []byte, value []byte) {
+		name := string(param)
+		if err != nil || !strings.HasPrefix(name, "metadata.") {
+			return
+		}
+
+		filter := metadataFilter{Key: strings.TrimPrefix(name, "metadata."), Operator: "=", Value: string(value)}
+		if key, ok := strings.CutSuffix(filter.Key, ".gte"); ok {
+			filter.Key, filter.Operator = key, ">="
+		} else if key, ok := strings.CutSuffix(filter.Key, ".lte"); ok {
+			filter.Key, filter.Operator = key, "<="
+		}
+		if !metadataKeyPattern.MatchString(filter.Key) {
+			err = errors.New(name + " is not a metadata filter")
+			return
+		}
+		filters = append(filters, filter)
+	})
+
+	sort.SliceStable(filters, func(i, j int) bool {
+		return filters[i].Key < filters[j].Key
+	})
+	return filters, err
+}
+
+// queryPage counts the rows of a listing matching where and fetches the page of them, selecting columns followed
+// by the sort key of each row. from is the FROM clause of the listing and idExpression the id of its rows
+func queryPage(db *pgxpool.Pool, page pageRequest, columns string, from string, where string, idExpression string, args []interface{}) (pgx.Rows, int, error) {
+	var total int
+	err := db.QueryRow(context.Background(), "SELECT COUNT(*) FROM "+from+" WHERE "+where+";", args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	condition, order, args := page.keyset(idExpression, args)
+	rows, err := db.Query(
+		context.Background(),
+		fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s AND %s %s;", columns, page.sortKey(), from, where, condition, order),
+		args...,
+	)
+	return rows, total, err
+}
+
+// sendList responds with a listing returned whole, in the envelope of paginated listings without a next page
+func sendList[T any](c *fiber.Ctx, items []T) error {
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"items":       items,
+		"next_cursor": nil,
+		"total":       len(items),
+	})
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestSendList(t *testing.T) {
+	tests := []struct {
+		items []string
+		want  string
+	}{
+		{[]string{}, `{"items":[],"next_cursor":null,"total":0}`},
+		{[]string{"a", "b"}, `{"items":["a","b"],"next_cursor":null,"total":2}`},
+	}
+	for _, test := range tests {
+		app := fiber.New()
+		app.Get("/", func(c *fiber.Ctx) error {
+			return sendList(c, test.items)
+		})
+
+		resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != test.want {
+			t.Errorf("sendList(%v) = %s, want %s", test.items, body, test.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"server/otp"
+	"server/sessions"
+	"server/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordResetPurpose = "password_reset"
+const passwordResetTTL = 30 * time.Minute
+
+// updatePassword hashes and stores a new password then revokes all the user's sessions and personal access tokens
+func updatePassword(db dbConn, userID string, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		context.Background(),
+		"UPDATE users SET password = $1 WHERE user_id = $2;",
+		string(hashedPassword), userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		context.Background(),
+		"UPDATE personalaccesstokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL;",
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return sessions.RevokeUserSessions(db, userID)
+}
+
+// ForgotPassword mails a single use password reset link to the user
+func ForgotPassword(c *fiber.Ctx, db *pgxpool.Pool) error {
+	type forgotPasswordRequest struct {
+		Email string `json:"email"`
+	}
+
+	var data forgotPasswordRequest
+	if err := c.BodyParser(&data); err != nil || data.Email == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid data"})
+	}
+
+	// Respond the same way whether the user exists or not so emails can't be enumerated
+	response := fiber.Map{"message": "If the email is registered, a reset link has been sent."}
+
+	var userID string
+	err := db.QueryRow(context.Background(), "SELECT user_id FROM users WHERE email = $1", data.Email).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusOK).JSON(response)
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching user", "details": err.Error()})
+	}
+
+	tokenID := uuid.New().String()
+	token, err := utils.GeneratePurposeToken(userID, passwordResetPurpose, tokenID, passwordResetTTL)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error generating reset token"})
+	}
+
+	if err := otp.StoreToken(passwordResetPurpose+"_"+tokenID, userID, passwordResetTTL); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error storing reset token"})
+	}
+
+	// A failed send answers like an unknown email too, a 500 would tell the account exists
+	if err := otp.SendPasswordResetEmail(data.Email, token); err != nil {
+		log.Println("Error sending password reset email: ", err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// ResetPassword sets a new password using a token sent by ForgotPassword
+func ResetPassword(c *fiber.Ctx, db *pgxpool.Pool) error {
+	type resetPasswordRequest struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	var data resetPasswordRequest
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid data"})
+	}
+
+	if data.Token == "" || data.Password == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing required fields"})
+	}
+
+	claims, err := utils.VerifyPurposeToken(data.Token, passwordResetPurpose)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired reset token"})
+	}
+
+	userID, _ := claims["user_id"].(string)
+	tokenID, _ := claims["jti"].(string)
+
+	if err := utils.ValidatePassword(data.Password); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Weak password", "message": err.Error()})
+	}
+
+	// The token is consumed here so it can only ever be used once
+	storedUserID, err := otp.ConsumeToken(passwordResetPurpose + "_" + tokenID)
+	if err != nil || storedUserID != userID {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired reset token"})
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if err := updatePassword(tx, userID, data.Password); err != nil {
+			return nil, err
+		}
+		return &auditEvent{ActorID: userID, Action: "auth.password_reset", TargetType: "user", TargetID: userID}, nil
+	})
+	if err != nil {
+		log.Println("Error resetting password: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error resetting password", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Password reset successfully"})
+}
+
+// ChangePassword changes the password of the logged in user after checking the current one
+func ChangePassword(c *fiber.Ctx, db *pgxpool.Pool) error {
+	type changePasswordRequest struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	userID := c.Locals("user_id").(string)
+
+	var data changePasswordRequest
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid data"})
+	}
+
+	if data.CurrentPassword == "" || data.NewPassword == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing required fields"})
+	}
+
+	var storedPassword string
+	err := db.QueryRow(context.Background(), "SELECT password FROM users WHERE user_id = $1", userID).Scan(&storedPassword)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching user", "details": err.Error()})
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(data.CurrentPassword)); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+
+	if data.CurrentPassword == data.NewPassword {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "New password must be different from the current password"})
+	}
+
+	if err := utils.ValidatePassword(data.NewPassword); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Weak password", "message": err.Error()})
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if err := updatePassword(tx, userID, data.NewPassword); err != nil {
+			return nil, err
+		}
+		return &auditEvent{Action: "auth.password_change", TargetType: "user", TargetID: userID}, nil
+	})
+	if err != nil {
+		log.Println("Error changing password: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error changing password", "message": err.Error()})
+	}
+
+	// All sessions including the current one have been revoked
+	c.ClearCookie("auth_token")
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Password changed successfully, please log in again"})
+}
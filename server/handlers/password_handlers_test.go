@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestUpdatePasswordRevokesCredentials(t *testing.T) {
+	db := testDB(t)
+
+	userID := testUser(t, db, "user@example.com")
+	otherID := testUser(t, db, "other@example.com")
+	for _, owner := range []string{userID, otherID} {
+		_, err := db.Exec(
+			context.Background(),
+			"INSERT INTO sessions (id, user_id, created_at, expires_at) VALUES ($1, $2, NOW(), $3);",
+			uuid.New().String(), owner, time.Now().Add(time.Hour),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(
+			context.Background(),
+			"INSERT INTO personalaccesstokens (id, user_id, name, token_hash) VALUES ($1, $2, 'cli', $3);",
+			uuid.New().String(), owner, uuid.New().String(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := updatePassword(db, userID, "N3w-password!"); err != nil {
+		t.Fatal(err)
+	}
+
+	for owner, want := range map[string]int{userID: 0, otherID: 2} {
+		var active int
+		err := db.QueryRow(
+			context.Background(),
+			`
+				SELECT (SELECT COUNT(*) FROM sessions WHERE user_id = $1 AND revoked_at IS NULL)
+					+ (SELECT COUNT(*) FROM personalaccesstokens WHERE user_id = $1 AND revoked_at IS NULL);
+			`,
+			owner,
+		).Scan(&active)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if active != want {
+			t.Errorf("user %s has %d active sessions and tokens, want %d", owner, active, want)
+		}
+	}
+}
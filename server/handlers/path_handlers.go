@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"server/middleware"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// maxPathDepth is the most folders a path can go through
+const maxPathDepth = 100
+
+// splitPath splits a slash path like /Finance/2024/Invoices into the names along it
+func splitPath(itemPath string) ([]string, error) {
+	trimmed := strings.Trim(itemPath, "/")
+	if trimmed == "" {
+		return nil, errors.New("path must name a folder or file")
+	}
+
+	names := strings.Split(trimmed, "/")
+	if len(names) > maxPathDepth+1 {
+		return nil, errors.New("path is too deep")
+	}
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." {
+			return nil, errors.New("path has an empty, . or .. segment")
+		}
+	}
+
+	return names, nil
+}
+
+// getDriveItem returns a file or folder with the permission the user has on it, or nil when it doesn't exist
+// or is in the recycle bin
+func getDriveItem(db *pgxpool.Pool, userID string, itemType string, itemID string) (*models.DriveItem, error) {
+	var item models.DriveItem
+	var rank int
+	err := db.QueryRow(
+		context.Background(),
+		`
+			SELECT i.type, i.id, i.name, i.organization_id, o.name, i.parent_id, i.size, i.created_at, i.updated_at,
+			CASE i.type WHEN 'file' THEN file_permission_rank($1, i.id) ELSE folder_permission_rank($1, i.id) END
+			FROM (`+driveItemsQuery+`) i
+			JOIN organizations o ON o.organization_id = i.organization_id
+			WHERE i.id = $2 AND i.type = $3;
+		`,
+		userID, itemID, itemType,
+	).Scan(
+		&item.Type,
+		&item.ID,
+		&item.Name,
+		&item.OrganizationID,
+		&item.OrganizationName,
+		&item.ParentID,
+		&item.Size,
+		&item.CreatedAt,
+		&item.UpdatedAt,
+		&rank,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	item.Role = permissionRole(rank)
+	return &item, nil
+}
+
+// getAncestors returns the folders holding a file or folder, root first, leaving out those the user can't see
+func getAncestors(db *pgxpool.Pool, userID string, itemType string, itemID string) ([]models.Breadcrumb, error) {
+	// The ancestors of a file are its folder with the ancestors of the folder
+	chain := "f.ancestor_ids"
+	folder := "$1"
+	if itemType == "file" {
+		chain = "f.ancestor_ids || f.id"
+		folder = "(SELECT folder_id FROM files WHERE id = $1)"
+	}
+
+	rows, err := db.Query(
+		context.Background(),
+		`
+			SELECT a.id, a.name
+			FROM folders f
+			CROSS JOIN LATERAL unnest(`+chain+`) WITH ORDINALITY AS chain(id, depth)
+			JOIN folders a ON a.id = chain.id
+			WHERE f.id = `+folder+` AND folder_permission_rank($2, a.id) >= 1
+			ORDER BY chain.depth;
+		`,
+		itemID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ancestors := []models.Breadcrumb{}
+	for rows.Next() {
+		var ancestor models.Breadcrumb
+		if err := rows.Scan(&ancestor.ID, &ancestor.Name); err != nil {
+			return nil, err
+		}
+		ancestors = append(ancestors, ancestor)
+	}
+
+	return ancestors, rows.Err()
+}
+
+// respondWithAncestors responds with an item, the folders holding it and its path
+func respondWithAncestors(c *fiber.Ctx, db *pgxpool.Pool, item *models.DriveItem) error {
+	ancestors, err := getAncestors(db, c.Locals("user_id").(string), item.Type, item.ID)
+	if err != nil {
+		log.Println("Error fetching ancestors: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching ancestors", "message": err.Error()})
+	}
+
+	names := []string{}
+	for _, ancestor := range ancestors {
+		names = append(names, ancestor.Name)
+	}
+	names = append(names, item.Name)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"item":      item,
+		"ancestors": ancestors,
+		"path":      "/" + strings.Join(names, "/"),
+	})
+}
+
+// ResolvePath finds the folder or file at a slash path within an organization, given in the path query
+// parameter. Names are matched ignoring case and folders win over files with the same name
+func ResolvePath(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	names, err := splitPath(c.Query("path"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Walk down the folders named along the path, as far as they exist
+	var folderId *string
+	var depth int
+	err = db.QueryRow(
+		context.Background(),
+		`
+			WITH RECURSIVE walk AS (
+				SELECT f.id, 1 AS depth FROM folders f
+				WHERE COALESCE(f.parent_folder_id, f.organization_id) = $1 AND LOWER(f.name) = LOWER(($2::text[])[1])
+				AND f.deleted = false
+				UNION ALL
+				SELECT f.id, walk.depth + 1 FROM walk
+				JOIN folders f ON COALESCE(f.parent_folder_id, f.organization_id) = walk.id
+				AND LOWER(f.name) = LOWER(($2::text[])[walk.depth + 1]) AND f.deleted = false
+				WHERE walk.depth < cardinality($2::text[])
+			)
+			SELECT id, depth FROM walk ORDER BY depth DESC LIMIT 1;
+		`,
+		organizationId, names,
+	).Scan(&folderId, &depth)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Println("Error resolving path: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error resolving path", "message": err.Error()})
+	}
+
+	var item *models.DriveItem
+	switch depth {
+	case len(names):
+		item, err = getDriveItem(db, userID, "folder", *folderId)
+	case len(names) - 1:
+		// The last name can be a file in the deepest folder found, or at the root for single names
+		var fileId string
+		err = db.QueryRow(
+			context.Background(),
+			`
+				SELECT id FROM files
+				WHERE COALESCE(folder_id, organization_id) = COALESCE($1::uuid, $2::uuid) AND LOWER(name) = LOWER($3)
+				AND deleted = false;
+			`,
+			folderId, organizationId, names[len(names)-1],
+		).Scan(&fileId)
+		if err == nil {
+			item, err = getDriveItem(db, userID, "file", fileId)
+		} else if errors.Is(err, pgx.ErrNoRows) {
+			err = nil
+		}
+	}
+	if err != nil {
+		log.Println("Error resolving path: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error resolving path", "message": err.Error()})
+	}
+
+	// Items the user can't open are reported as missing so their names don't leak
+	if item == nil || item.Role == permissionRole(permissionNone) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Path not found"})
+	}
+
+	return respondWithAncestors(c, db, item)
+}
+
+// GetAncestors returns a file or folder with the chain of folders holding it, from the root of its organization
+func GetAncestors(c *fiber.Ctx, db *pgxpool.Pool) error {
+	itemType, itemId := "folder", c.Params("folder_id")
+	if fileId := c.Params("file_id"); fileId != "" {
+		itemType, itemId = "file", fileId
+	}
+
+	item, err := getDriveItem(db, c.Locals("user_id").(string), itemType, itemId)
+	if err != nil {
+		log.Println("Error fetching item: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching item", "message": err.Error()})
+	}
+	if item == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Item not found"})
+	}
+
+	return respondWithAncestors(c, db, item)
+}
+
+func RegisterPathRoutes(app *fiber.App, db *pgxpool.Pool) {
+	pathGroup := app.Group("/path", middleware.AuthRequired(db))
+	read := middleware.RequireScope(db, middleware.ScopeReadFiles)
+
+	pathGroup.Get("/resolve/:organization_id", read, func(c *fiber.Ctx) error {
+		return ResolvePath(c, db)
+	})
+	pathGroup.Get("/ancestors/folder/:folder_id", read, requireFolderPermission(db, permissionViewer), func(c *fiber.Ctx) error {
+		return GetAncestors(c, db)
+	})
+	pathGroup.Get("/ancestors/file/:file_id", read, requireFilePermission(db, permissionViewer), func(c *fiber.Ctx) error {
+		return GetAncestors(c, db)
+	})
+}
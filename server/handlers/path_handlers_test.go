@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFillFolderAncestors(t *testing.T) {
+	db := testDB(t)
+
+	creatorID := testUser(t, db, "creator@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+	root := testFolder(t, db, organizationID, "", true)
+	child := testFolder(t, db, organizationID, root, true)
+	grandchild := testFolder(t, db, organizationID, child, true)
+
+	// Folders of a database from before ancestors were kept have none
+	if _, err := db.Exec(context.Background(), "UPDATE folders SET ancestor_ids = '{}';"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(context.Background(), "SELECT fill_folder_ancestors();"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{root: {}, child: {root}, grandchild: {root, child}}
+	for folderID, ancestors := range want {
+		var got []string
+		err := db.QueryRow(context.Background(), "SELECT ancestor_ids::text[] FROM folders WHERE id = $1;", folderID).Scan(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(ancestors) {
+			t.Errorf("folder %s has ancestors %v, want %v", folderID, got, ancestors)
+			continue
+		}
+		for i := range got {
+			if got[i] != ancestors[i] {
+				t.Errorf("folder %s has ancestors %v, want %v", folderID, got, ancestors)
+				break
+			}
+		}
+	}
+}
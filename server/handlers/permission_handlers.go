@@ -0,0 +1,560 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"server/middleware"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Permission ranks on folders and files, they match folder_role_rank in the schema
+const (
+	permissionNone = iota
+	permissionViewer
+	permissionEditor
+	permissionManager
+)
+
+var folderRoles = map[string]int{
+	"viewer":  permissionViewer,
+	"editor":  permissionEditor,
+	"manager": permissionManager,
+}
+
+// folderChainQuery selects a folder and the ancestors it inherits permissions from, nearest first
+const folderChainQuery = `
+	WITH RECURSIVE chain AS (
+		SELECT id, parent_folder_id, inherit_permissions, 0 AS depth FROM folders WHERE id = $1
+		UNION ALL
+		SELECT parent.id, parent.parent_folder_id, parent.inherit_permissions, chain.depth + 1
+		FROM folders parent
+		JOIN chain ON parent.id = chain.parent_folder_id
+		WHERE chain.inherit_permissions
+	)
+`
+
+// folderGrantQuery returns the query giving a role on a folder to a user or group, granteeColumn is user_id or
+// group_id and onConflict sets the columns of an existing grant
+func folderGrantQuery(granteeColumn string, onConflict string) string {
+	return `
+		INSERT INTO folderpermissions (id, folder_id, organization_id, ` + granteeColumn + `, role, granted_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (folder_id, ` + granteeColumn + `) DO UPDATE SET ` + onConflict + `
+		RETURNING id, created_at;
+	`
+}
+
+// permissionRole returns the role name of a permission rank
+func permissionRole(rank int) string {
+	for role, roleRank := range folderRoles {
+		if roleRank == rank {
+			return role
+		}
+	}
+	return "none"
+}
+
+// folderPermission returns the permission rank of a user on a folder
+func folderPermission(db *pgxpool.Pool, userID string, folderID string) (int, error) {
+	var rank int
+	err := db.QueryRow(context.Background(), "SELECT folder_permission_rank($1, $2);", userID, folderID).Scan(&rank)
+	return rank, err
+}
+
+// filePermission returns the permission rank of a user on a file
+func filePermission(db *pgxpool.Pool, userID string, fileID string) (int, error) {
+	var rank int
+	err := db.QueryRow(context.Background(), "SELECT file_permission_rank($1, $2);", userID, fileID).Scan(&rank)
+	return rank, err
+}
+
+// containerPermission returns the permission rank of a user on the folder items are added to, or on the
+// root of the organization when there is no folder. Folders of other organizations give no access
+func containerPermission(db *pgxpool.Pool, userID string, organizationID string, folderID *string) (int, error) {
+	var rank int
+	var err error
+	if folderID == nil || *folderID == "" {
+		err = db.QueryRow(context.Background(), "SELECT organization_permission_rank($1, $2);", userID, organizationID).Scan(&rank)
+	} else {
+		err = db.QueryRow(
+			context.Background(),
+			"SELECT folder_permission_rank($1, id) FROM folders WHERE id = $2 AND organization_id = $3 AND deleted = false;",
+			userID, *folderID, organizationID,
+		).Scan(&rank)
+	}
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return permissionNone, nil
+	}
+	return rank, err
+}
+
+// folderRankCondition is a condition on the folder id in column, true when the user in user has at least rank
+// on it. The folders are ranked in a single walk down from folder, or from the root of organization when
+// folder is NULL, that stops depth levels down, NULL for the whole subtree
+func folderRankCondition(column string, user string, organization string, folder string, depth string, rank int) string {
+	return fmt.Sprintf("%s IN (SELECT id FROM folder_permission_ranks(%s, %s, %s, %s) WHERE rank >= %d)", column, user, organization, folder, depth, rank)
+}
+
+// fileRankCondition is a condition on files of organization with their folder in folderColumn, true when the
+// user in user has at least rank on them. Files at the root take the rank of the user in the organization
+func fileRankCondition(folderColumn string, user string, organization string, rank int) string {
+	return fmt.Sprintf(
+		"CASE WHEN %[1]s IS NULL THEN organization_permission_rank(%[2]s, %[3]s) >= %[4]d ELSE %[5]s END",
+		folderColumn, user, organization, rank, folderRankCondition(folderColumn, user, organization, "NULL", "NULL", rank),
+	)
+}
+
+// hasRestrictedDescendants reports whether the user lacks rank on any subfolder under a folder
+func hasRestrictedDescendants(db dbConn, userID string, folderID string, rank int) (bool, error) {
+	var restricted bool
+	err := db.QueryRow(
+		context.Background(),
+		`
+			SELECT EXISTS (
+				SELECT 1 FROM folders f
+				CROSS JOIN LATERAL folder_permission_ranks($1, f.organization_id, f.id, NULL) r
+				WHERE f.id = $2 AND r.rank < $3
+			);
+		`,
+		userID, folderID, rank,
+	).Scan(&restricted)
+	return restricted, err
+}
+
+// requireFolderPermission rejects users without at least the given permission on the folder_id param
+func requireFolderPermission(db *pgxpool.Pool, rank int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		current, err := folderPermission(db, c.Locals("user_id").(string), c.Params("folder_id"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+		}
+		if current < rank {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You need " + permissionRole(rank) + " access to this folder"})
+		}
+
+		return c.Next()
+	}
+}
+
+// requireFilePermission rejects users without at least the given permission on the file_id or id param
+func requireFilePermission(db *pgxpool.Pool, rank int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fileId := c.Params("file_id")
+		if fileId == "" {
+			fileId = c.Params("id")
+		}
+
+		current, err := filePermission(db, c.Locals("user_id").(string), fileId)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+		}
+		if current < rank {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You need " + permissionRole(rank) + " access to this file"})
+		}
+
+		return c.Next()
+	}
+}
+
+// GetFolderPermissions lists the grants on a folder along with those it inherits
+func GetFolderPermissions(c *fiber.Ctx, db *pgxpool.Pool) error {
+	folderId := c.Params("folder_id")
+
+	var inheritPermissions bool
+	err := db.QueryRow(context.Background(), "SELECT inherit_permissions FROM folders WHERE id = $1;", folderId).Scan(&inheritPermissions)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Folder not found"})
+	} else if err != nil {
+		log.Println("Error fetching folder: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching folder", "message": err.Error()})
+	}
+
+	query := folderChainQuery + `
+		SELECT fp.id, fp.folder_id, fp.organization_id, fp.user_id, fp.group_id, fp.role, fp.granted_by, fp.created_at
+		FROM folderpermissions fp
+		JOIN chain ON chain.id = fp.folder_id
+		ORDER BY chain.depth, fp.created_at;
+	`
+	rows, err := db.Query(context.Background(), query, folderId)
+	if err != nil {
+		log.Println("Error fetching folder permissions: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching folder permissions", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	permissions := []models.FolderPermission{}
+	for rows.Next() {
+		var permission models.FolderPermission
+		if err := rows.Scan(
+			&permission.ID,
+			&permission.FolderID,
+			&permission.OrganizationID,
+			&permission.UserID,
+			&permission.GroupID,
+			&permission.Role,
+			&permission.GrantedBy,
+			&permission.CreatedAt,
+		); err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		if permission.FolderID != folderId {
+			inheritedFrom := permission.FolderID
+			permission.InheritedFrom = &inheritedFrom
+		}
+		permissions = append(permissions, permission)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"folder_id":           folderId,
+		"inherit_permissions": inheritPermissions,
+		"permissions":         permissions,
+	})
+}
+
+// GrantFolderPermission gives a member or group of the organization a role on a folder, replacing any role
+// they had on it
+func GrantFolderPermission(c *fiber.Ctx, db *pgxpool.Pool) error {
+	folderId := c.Params("folder_id")
+	userID := c.Locals("user_id").(string)
+
+	var permission models.FolderPermission
+	if err := c.BodyParser(&permission); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	if (permission.UserID == nil) == (permission.GroupID == nil) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Either user_id or group_id is required"})
+	}
+	if _, ok := folderRoles[permission.Role]; !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Role must be viewer, editor or manager"})
+	}
+
+	folder := auditFolder(db, folderId)
+	if folder == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Folder not found"})
+	}
+
+	granteeColumn, granteeID := "user_id", ""
+	if permission.UserID != nil {
+		granteeID = *permission.UserID
+		role, err := getOrganizationRole(db, granteeID, folder.OrganizationID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking membership", "message": err.Error()})
+		}
+		if role == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "User is not a member of this organization"})
+		}
+	} else {
+		granteeColumn, granteeID = "group_id", *permission.GroupID
+		exists, err := groupExists(db, granteeID, folder.OrganizationID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching group", "message": err.Error()})
+		}
+		if !exists {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Group not found in this organization"})
+		}
+	}
+
+	var before *models.FolderPermission
+	var previousRole string
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT role FROM folderpermissions WHERE folder_id = $1 AND "+granteeColumn+" = $2;",
+		folderId, granteeID,
+	).Scan(&previousRole)
+	if err == nil {
+		before = &models.FolderPermission{
+			FolderID:       folderId,
+			OrganizationID: folder.OrganizationID,
+			UserID:         permission.UserID,
+			GroupID:        permission.GroupID,
+			Role:           previousRole,
+		}
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		log.Println("Error fetching folder permission: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching folder permission", "message": err.Error()})
+	}
+
+	permission.FolderID = folderId
+	permission.OrganizationID = folder.OrganizationID
+	permission.GrantedBy = &userID
+	permission.InheritedFrom = nil
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if err := tx.QueryRow(
+			context.Background(),
+			folderGrantQuery(granteeColumn, "role = EXCLUDED.role, granted_by = EXCLUDED.granted_by"),
+			uuid.New().String(), permission.FolderID, permission.OrganizationID, granteeID, permission.Role, userID, time.Now(),
+		).Scan(&permission.ID, &permission.CreatedAt); err != nil {
+			return nil, err
+		}
+		return &auditEvent{
+			OrganizationID: folder.OrganizationID,
+			Action:         "permission.grant",
+			TargetType:     "folder",
+			TargetID:       folderId,
+			Before:         before,
+			After:          &permission,
+		}, nil
+	})
+	if err != nil {
+		log.Println("Error granting folder permission: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error granting folder permission", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(permission)
+}
+
+// RevokeFolderPermission removes a grant from a folder, inherited grants have to be revoked where they are set
+func RevokeFolderPermission(c *fiber.Ctx, db *pgxpool.Pool) error {
+	folderId := c.Params("folder_id")
+	permissionId := c.Params("permission_id")
+
+	var permission models.FolderPermission
+	err := auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if err := tx.QueryRow(
+			context.Background(),
+			`
+				DELETE FROM folderpermissions WHERE id = $1 AND folder_id = $2
+				RETURNING id, folder_id, organization_id, user_id, group_id, role, granted_by, created_at;
+			`,
+			permissionId, folderId,
+		).Scan(
+			&permission.ID,
+			&permission.FolderID,
+			&permission.OrganizationID,
+			&permission.UserID,
+			&permission.GroupID,
+			&permission.Role,
+			&permission.GrantedBy,
+			&permission.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		return &auditEvent{
+			OrganizationID: permission.OrganizationID,
+			Action:         "permission.revoke",
+			TargetType:     "folder",
+			TargetID:       folderId,
+			Before:         &permission,
+		}, nil
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Permission not found on this folder"})
+	} else if err != nil {
+		log.Println("Error revoking folder permission: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error revoking folder permission", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Permission revoked"})
+}
+
+// UpdateFolderInheritance breaks or restores the inheritance of permissions from the parent folder. When breaking
+// it the inherited grants are copied to the folder unless copy_permissions is false. The default access of
+// organization members is never copied, and a manager who isn't an admin keeps managing the folder
+func UpdateFolderInheritance(c *fiber.Ctx, db *pgxpool.Pool) error {
+	folderId := c.Params("folder_id")
+	userID := c.Locals("user_id").(string)
+
+	var data struct {
+		InheritPermissions *bool `json:"inherit_permissions"`
+		CopyPermissions    *bool `json:"copy_permissions"`
+	}
+	if err := c.BodyParser(&data); err != nil || data.InheritPermissions == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "inherit_permissions is required"})
+	}
+
+	folder := auditFolder(db, folderId)
+	if folder == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Folder not found"})
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error starting transaction", "message": err.Error()})
+	}
+	defer tx.Rollback(context.Background())
+
+	var wasInherited bool
+	err = tx.QueryRow(context.Background(), "SELECT inherit_permissions FROM folders WHERE id = $1 FOR UPDATE;", folderId).Scan(&wasInherited)
+	if err != nil {
+		log.Println("Error fetching folder: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching folder", "message": err.Error()})
+	}
+
+	if wasInherited && !*data.InheritPermissions {
+		keepHigher := "role = GREATEST(folderpermissions.role, EXCLUDED.role)"
+
+		if data.CopyPermissions == nil || *data.CopyPermissions {
+			rows, err := tx.Query(
+				context.Background(),
+				folderChainQuery+`
+					SELECT fp.user_id, fp.group_id, fp.role FROM folderpermissions fp
+					JOIN chain ON chain.id = fp.folder_id
+					WHERE chain.depth > 0;
+				`,
+				folderId,
+			)
+			if err != nil {
+				log.Println("Error fetching inherited permissions: ", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching inherited permissions", "message": err.Error()})
+			}
+
+			var inherited []models.FolderPermission
+			for rows.Next() {
+				var permission models.FolderPermission
+				if err := rows.Scan(&permission.UserID, &permission.GroupID, &permission.Role); err != nil {
+					rows.Close()
+					log.Println("Error scanning row: ", err)
+					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+				}
+				inherited = append(inherited, permission)
+			}
+			rows.Close()
+
+			if err := rows.Err(); err != nil {
+				log.Println("Error iterating rows: ", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+			}
+
+			for _, permission := range inherited {
+				granteeColumn, granteeID := "user_id", permission.UserID
+				if permission.GroupID != nil {
+					granteeColumn, granteeID = "group_id", permission.GroupID
+				}
+
+				_, err = tx.Exec(
+					context.Background(),
+					folderGrantQuery(granteeColumn, keepHigher),
+					uuid.New().String(), folderId, folder.OrganizationID, granteeID, permission.Role, userID, time.Now(),
+				)
+				if err != nil {
+					log.Println("Error copying folder permission: ", err)
+					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error copying folder permissions", "message": err.Error()})
+				}
+			}
+		}
+
+		isAdmin, err := isOrganizationAdmin(db, userID, folder.OrganizationID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+		}
+		if !isAdmin {
+			_, err = tx.Exec(
+				context.Background(),
+				folderGrantQuery("user_id", keepHigher),
+				uuid.New().String(), folderId, folder.OrganizationID, userID, "manager", userID, time.Now(),
+			)
+			if err != nil {
+				log.Println("Error granting folder permission: ", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error granting folder permission", "message": err.Error()})
+			}
+		}
+	}
+
+	_, err = tx.Exec(context.Background(), "UPDATE folders SET inherit_permissions = $1 WHERE id = $2;", *data.InheritPermissions, folderId)
+	if err != nil {
+		log.Println("Error updating folder inheritance: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating folder inheritance", "message": err.Error()})
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{
+		OrganizationID: folder.OrganizationID,
+		Action:         "folder.inheritance",
+		TargetType:     "folder",
+		TargetID:       folderId,
+		Before:         fiber.Map{"inherit_permissions": wasInherited},
+		After:          fiber.Map{"inherit_permissions": *data.InheritPermissions},
+	}); err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating folder inheritance", "message": err.Error()})
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error committing transaction", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Folder inheritance updated", "inherit_permissions": *data.InheritPermissions})
+}
+
+// GetEffectivePermissions returns the access a user has on a folder or file after inheritance, defaulting to the
+// logged in user. Looking up another user requires managing the item
+func GetEffectivePermissions(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userID := c.Locals("user_id").(string)
+	targetUserID := c.Query("user_id", userID)
+
+	itemType, itemId := "folder", c.Params("folder_id")
+	permission := folderPermission
+	if fileId := c.Params("file_id"); fileId != "" {
+		itemType, itemId = "file", fileId
+		permission = filePermission
+	}
+
+	if targetUserID != userID {
+		rank, err := permission(db, userID, itemId)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+		}
+		if rank < permissionManager {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You need manager access to view the permissions of other users"})
+		}
+	}
+
+	rank, err := permission(db, targetUserID, itemId)
+	if err != nil {
+		log.Println("Error fetching effective permissions: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching effective permissions", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"user_id":    targetUserID,
+		"item_type":  itemType,
+		"item_id":    itemId,
+		"role":       permissionRole(rank),
+		"can_view":   rank >= permissionViewer,
+		"can_edit":   rank >= permissionEditor,
+		"can_manage": rank >= permissionManager,
+	})
+}
+
+func RegisterPermissionRoutes(app *fiber.App, db *pgxpool.Pool) {
+	permissionGroup := app.Group("/permissions", middleware.AuthRequired(db))
+	read := middleware.RequireScope(db, middleware.ScopeReadFiles)
+	manage := middleware.RequireScope(db, middleware.ScopeManageMembers)
+
+	permissionGroup.Get("/folder/:folder_id", read, requireFolderPermission(db, permissionManager), func(c *fiber.Ctx) error {
+		return GetFolderPermissions(c, db)
+	})
+	permissionGroup.Post("/folder/:folder_id", manage, requireFolderPermission(db, permissionManager), func(c *fiber.Ctx) error {
+		return GrantFolderPermission(c, db)
+	})
+	permissionGroup.Delete("/folder/:folder_id/:permission_id", manage, requireFolderPermission(db, permissionManager), func(c *fiber.Ctx) error {
+		return RevokeFolderPermission(c, db)
+	})
+	permissionGroup.Put("/folder/:folder_id/inheritance", manage, requireFolderPermission(db, permissionManager), func(c *fiber.Ctx) error {
+		return UpdateFolderInheritance(c, db)
+	})
+	permissionGroup.Get("/effective/folder/:folder_id", read, func(c *fiber.Ctx) error {
+		return GetEffectivePermissions(c, db)
+	})
+	permissionGroup.Get("/effective/file/:file_id", read, func(c *fiber.Ctx) error {
+		return GetEffectivePermissions(c, db)
+	})
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// testFolder inserts a folder of an organization under a parent, or at the root when parent is empty
+func testFolder(t *testing.T, db *pgxpool.Pool, organizationID string, parent string, inherit bool) string {
+	t.Helper()
+
+	folderID := uuid.New().String()
+	var parentID *string
+	if parent != "" {
+		parentID = &parent
+	}
+	_, err := db.Exec(
+		context.Background(),
+		"INSERT INTO folders (id, name, organization_id, parent_folder_id, inherit_permissions) VALUES ($1, $1, $2, $3, $4);",
+		folderID, organizationID, parentID, inherit,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return folderID
+}
+
+func TestFolderPermissionRanks(t *testing.T) {
+	db := testDB(t)
+
+	creatorID := testUser(t, db, "creator@example.com")
+	memberID := testUser(t, db, "member@example.com")
+	outsiderID := testUser(t, db, "outsider@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+	if err := addUserToOrganization(db, memberID, organizationID, "member"); err != nil {
+		t.Fatal(err)
+	}
+
+	// root
+	// ├── restricted, doesn't inherit, the member is a viewer
+	// │   └── nested
+	// │       └── managed, the member is a manager
+	// └── open
+	root := testFolder(t, db, organizationID, "", true)
+	restricted := testFolder(t, db, organizationID, root, false)
+	nested := testFolder(t, db, organizationID, restricted, true)
+	managed := testFolder(t, db, organizationID, nested, true)
+	open := testFolder(t, db, organizationID, root, true)
+	for folderID, role := range map[string]string{restricted: "viewer", managed: "manager"} {
+		_, err := db.Exec(
+			context.Background(),
+			"INSERT INTO folderpermissions (id, folder_id, organization_id, user_id, role) VALUES ($1, $2, $3, $4, $5);",
+			uuid.New().String(), folderID, organizationID, memberID, role,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]int{root: permissionEditor, restricted: permissionViewer, nested: permissionViewer, managed: permissionManager, open: permissionEditor}
+	for _, userID := range []string{creatorID, memberID, outsiderID} {
+		for _, start := range []string{"", root, restricted} {
+			var folder *string
+			if start != "" {
+				folder = &start
+			}
+			rows, err := db.Query(context.Background(), "SELECT id::text, rank FROM folder_permission_ranks($1, $2, $3, NULL);", userID, organizationID, folder)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ranks := map[string]int{}
+			for rows.Next() {
+				var id string
+				var rank int
+				if err := rows.Scan(&id, &rank); err != nil {
+					t.Fatal(err)
+				}
+				ranks[id] = rank
+			}
+			rows.Close()
+
+			for id, rank := range ranks {
+				single, err := folderPermission(db, userID, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rank != single {
+					t.Errorf("folder_permission_ranks ranks %s at %d, folder_permission_rank at %d", id, rank, single)
+				}
+				if userID == memberID && rank != want[id] {
+					t.Errorf("member has rank %d on %s, want %d", rank, id, want[id])
+				}
+			}
+		}
+	}
+
+	var children int
+	err := db.QueryRow(context.Background(), "SELECT COUNT(*) FROM folder_permission_ranks($1, $2, $3, 1);", memberID, organizationID, root).Scan(&children)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if children != 3 {
+		t.Errorf("a walk one level down returned %d folders, want the folder and its 2 children", children)
+	}
+
+	for folderID, want := range map[string]bool{root: true, restricted: true, managed: false, open: false} {
+		restricted, err := hasRestrictedDescendants(db, memberID, folderID, permissionEditor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restricted != want {
+			t.Errorf("hasRestrictedDescendants(%s) = %v, want %v", folderID, restricted, want)
+		}
+	}
+}
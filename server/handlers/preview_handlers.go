@@ -0,0 +1,450 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/spaces"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	// previewBatchSize is how many queued blobs the generator claims at once
+	previewBatchSize = 5
+	// previewPollInterval is how long the generator waits when no blob is queued
+	previewPollInterval = 5 * time.Second
+	// previewMaxObjectSize is the largest content previews are generated for
+	previewMaxObjectSize = 50 << 20
+	// previewMaxPixels is the largest image thumbnails are generated for, decoded images take 4 bytes a pixel
+	previewMaxPixels = 40_000_000
+	// previewSnippetLength is how many characters of text a snippet holds
+	previewSnippetLength = 1000
+	// previewRenderTimeout is how long rendering the first page of a PDF may take
+	previewRenderTimeout = 30 * time.Second
+	// thumbnailQuality is the JPEG quality thumbnails are encoded with
+	thumbnailQuality = 80
+)
+
+// thumbnailSizes are the sizes thumbnails are generated in, with the longest side images are scaled down to
+var thumbnailSizes = []struct {
+	Name string
+	Side int
+}{
+	{"small", 128},
+	{"medium", 512},
+	{"large", 1024},
+}
+
+// errPDFRendererMissing is returned for PDFs when pdftoppm, which renders their first page, isn't installed
+var errPDFRendererMissing = errors.New("pdftoppm isn't installed to render PDFs")
+
+// thumbnailKey returns the object key of the thumbnail of a blob in the given size. Keys of deleted blobs are
+// never used again so their objects can be deleted after the blob
+func thumbnailKey(organizationID string, blobID string, size string) string {
+	return "previews/" + organizationID + "/" + blobID + "/" + size + ".jpg"
+}
+
+// StartPreviewGenerator generates the previews of the blobs queued when they were stored in the background.
+// Blobs left mid-way by a restart and blobs stored before previews existed are queued first
+func StartPreviewGenerator(db *pgxpool.Pool) {
+	if spaces.S3Client == nil {
+		log.Println("Spaces is not configured, previews won't be generated")
+		return
+	}
+
+	if _, err := db.Exec(context.Background(), "UPDATE previews SET status = 'pending' WHERE status = 'generating';"); err != nil {
+		log.Println("Error requeuing interrupted previews: ", err)
+	}
+
+	_, err := db.Exec(
+		context.Background(),
+		`
+			INSERT INTO previews (blob_id, status, queued_at)
+			SELECT id, 'pending', NOW() FROM blobs
+			ON CONFLICT (blob_id) DO NOTHING;
+		`,
+	)
+	if err != nil {
+		log.Println("Error queuing blobs for previews: ", err)
+	}
+
+	go func() {
+		for {
+			if generateQueuedPreviews(db) == 0 {
+				time.Sleep(previewPollInterval)
+			}
+		}
+	}()
+}
+
+// queuedPreview is a blob waiting for its previews
+type queuedPreview struct {
+	BlobID, OrganizationID, FilePath string
+	FileSize                         int64
+	EncryptionKeyID                  *string
+}
+
+// generateQueuedPreviews generates the previews of a batch of queued blobs and returns how many it took
+func generateQueuedPreviews(db *pgxpool.Pool) int {
+	rows, err := db.Query(
+		context.Background(),
+		`
+			UPDATE previews p SET status = 'generating'
+			FROM blobs b
+			WHERE b.id = p.blob_id AND p.blob_id IN (
+				SELECT blob_id FROM previews WHERE status = 'pending'
+				ORDER BY queued_at LIMIT $1 FOR UPDATE SKIP LOCKED
+			)
+			RETURNING p.blob_id, b.organization_id, b.file_path, b.file_size, b.encryption_key_id;
+		`,
+		previewBatchSize,
+	)
+	if err != nil {
+		log.Println("Error claiming blobs to preview: ", err)
+		return 0
+	}
+
+	var queued []queuedPreview
+	for rows.Next() {
+		var blob queuedPreview
+		if err := rows.Scan(&blob.BlobID, &blob.OrganizationID, &blob.FilePath, &blob.FileSize, &blob.EncryptionKeyID); err != nil {
+			log.Println("Error scanning row: ", err)
+			break
+		}
+		queued = append(queued, blob)
+	}
+	rows.Close()
+
+	for _, blob := range queued {
+		status, kind, snippet, previewErr := generatePreview(db, blob)
+
+		var message *string
+		if previewErr != nil {
+			text := previewErr.Error()
+			message = &text
+		}
+
+		_, err := db.Exec(
+			context.Background(),
+			`
+				UPDATE previews SET status = $1, kind = $2, snippet = $3, error = $4, generated_at = NOW()
+				WHERE blob_id = $5 AND status = 'generating';
+			`,
+			status, kind, snippet, message, blob.BlobID,
+		)
+		if err != nil {
+			log.Printf("Error saving preview of blob %s: %v", blob.BlobID, err)
+		}
+	}
+
+	return len(queued)
+}
+
+// generatePreview reads the content of a blob and generates the preview its type has, thumbnails are stored
+// before returning. The status is ready with the kind of preview, unsupported for content without previews or
+// too large, and failed when the content can't be read or previewed
+func generatePreview(db *pgxpool.Pool, blob queuedPreview) (string, *string, *string, error) {
+	if blob.FileSize > previewMaxObjectSize {
+		return "unsupported", nil, nil, fmt.Errorf("file is larger than %d MB", previewMaxObjectSize>>20)
+	}
+
+	object, err := openEncryptedObject(db, blob.FilePath, blob.EncryptionKeyID, blob.FileSize)
+	if err != nil {
+		return "failed", nil, nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(object.Body, previewMaxObjectSize+1))
+	object.Body.Close()
+	if err != nil {
+		return "failed", nil, nil, err
+	}
+
+	var kind string
+	var page image.Image
+	contentType := http.DetectContentType(data)
+	switch {
+	case contentType == "image/png" || contentType == "image/jpeg" || contentType == "image/gif":
+		kind = "image"
+		page, err = decodePreviewImage(data)
+	case contentType == "application/pdf":
+		kind = "pdf"
+		page, err = renderPDFPage(data)
+		if errors.Is(err, errPDFRendererMissing) {
+			return "unsupported", nil, nil, err
+		}
+	case strings.HasPrefix(contentType, "text/"):
+		snippet := textSnippet(data)
+		kind = "text"
+		return "ready", &kind, &snippet, nil
+	default:
+		return "unsupported", nil, nil, nil
+	}
+	if err != nil {
+		return "failed", nil, nil, err
+	}
+
+	if err := storeThumbnails(db, blob, page); err != nil {
+		return "failed", nil, nil, err
+	}
+	return "ready", &kind, nil, nil
+}
+
+// decodePreviewImage decodes a PNG, JPEG or GIF image, images with too many pixels aren't decoded
+func decodePreviewImage(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > previewMaxPixels {
+		return nil, fmt.Errorf("image is larger than %d megapixels", previewMaxPixels/1_000_000)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// renderPDFPage renders the first page of a PDF with pdftoppm at the largest thumbnail size
+func renderPDFPage(data []byte) (image.Image, error) {
+	renderer, err := exec.LookPath("pdftoppm")
+	if err != nil {
+		return nil, errPDFRendererMissing
+	}
+
+	dir, err := os.MkdirTemp("", "pdf-preview-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "document.pdf")
+	if err := os.WriteFile(input, data, 0600); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), previewRenderTimeout)
+	defer cancel()
+
+	output := filepath.Join(dir, "page")
+	side := strconv.Itoa(thumbnailSizes[len(thumbnailSizes)-1].Side)
+	command := exec.CommandContext(ctx, renderer, "-f", "1", "-l", "1", "-singlefile", "-png", "-scale-to", side, input, output)
+	if out, err := command.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("rendering the first page failed: %v %s", err, strings.TrimSpace(string(out)))
+	}
+
+	page, err := os.ReadFile(output + ".png")
+	if err != nil {
+		return nil, err
+	}
+	return decodePreviewImage(page)
+}
+
+// textSnippet returns the start of text cut to whole characters, with line endings normalized
+func textSnippet(data []byte) string {
+	if len(data) > previewSnippetLength*4 {
+		data = data[:previewSnippetLength*4]
+	}
+
+	text := strings.ToValidUTF8(string(data), "")
+	text = strings.ReplaceAll(text, "\x00", "")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if characters := []rune(text); len(characters) > previewSnippetLength {
+		text = string(characters[:previewSnippetLength])
+	}
+	return strings.TrimSpace(text)
+}
+
+// storeThumbnails stores a thumbnail of an image in every size, encrypted like the blob it comes from. Objects
+// already stored are deleted when one fails
+func storeThumbnails(db *pgxpool.Pool, blob queuedPreview, img image.Image) error {
+	// Transparent pixels are shown on white since JPEG has no transparency
+	bounds := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, bounds.Min, draw.Over)
+
+	var stored []string
+	cleanUp := func() {
+		for _, filePath := range stored {
+			if err := spaces.DeleteFile(filePath); err != nil {
+				log.Println("Error deleting thumbnail from Spaces: ", err)
+			}
+		}
+	}
+
+	batch := &pgx.Batch{}
+	for _, size := range thumbnailSizes {
+		thumbnail := scaleImage(flat, size.Side)
+
+		var encoded bytes.Buffer
+		if err := jpeg.Encode(&encoded, thumbnail, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			cleanUp()
+			return err
+		}
+
+		filePath, err := putEncryptedObject(db, encoded.Bytes(), blob.EncryptionKeyID, thumbnailKey(blob.OrganizationID, blob.BlobID, size.Name))
+		if err != nil {
+			cleanUp()
+			return err
+		}
+		stored = append(stored, filePath)
+
+		batch.Queue(
+			`
+				INSERT INTO thumbnails (blob_id, size, file_path, file_size, width, height)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				ON CONFLICT (blob_id, size) DO UPDATE
+				SET file_path = EXCLUDED.file_path, file_size = EXCLUDED.file_size, width = EXCLUDED.width, height = EXCLUDED.height;
+			`,
+			blob.BlobID, size.Name, filePath, encoded.Len(), thumbnail.Bounds().Dx(), thumbnail.Bounds().Dy(),
+		)
+	}
+
+	results := db.SendBatch(context.Background(), batch)
+	for range thumbnailSizes {
+		if _, err := results.Exec(); err != nil {
+			results.Close()
+			cleanUp()
+			return err
+		}
+	}
+	return results.Close()
+}
+
+// scaleImage scales an opaque image down so its longest side fits side, every pixel is the average of the pixels
+// it covers. Smaller images keep their size
+func scaleImage(src *image.RGBA, side int) *image.RGBA {
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+	width, height := srcWidth, srcHeight
+	if width > side || height > side {
+		if width >= height {
+			width, height = side, max(1, height*side/width)
+		} else {
+			width, height = max(1, width*side/height), side
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		top, bottom := y*srcHeight/height, max((y+1)*srcHeight/height, y*srcHeight/height+1)
+		for x := 0; x < width; x++ {
+			left, right := x*srcWidth/width, max((x+1)*srcWidth/width, x*srcWidth/width+1)
+
+			var red, green, blue, count int
+			for srcY := top; srcY < bottom; srcY++ {
+				row := src.Pix[srcY*src.Stride:]
+				for srcX := left; srcX < right; srcX++ {
+					red += int(row[srcX*4])
+					green += int(row[srcX*4+1])
+					blue += int(row[srcX*4+2])
+					count++
+				}
+			}
+
+			pixel := dst.Pix[y*dst.Stride+x*4:]
+			pixel[0], pixel[1], pixel[2], pixel[3] = uint8(red/count), uint8(green/count), uint8(blue/count), 255
+		}
+	}
+	return dst
+}
+
+// GetFilePreview responds with the preview of a file. Images and PDFs get their thumbnail in the size of the
+// size query, medium by default, and text its snippet. Previews still being generated respond with 202, files
+// whose content couldn't be hashed respond with a failed status like previews that failed
+func GetFilePreview(c *fiber.Ctx, db *pgxpool.Pool) error {
+	fileId := c.Params("file_id")
+
+	size := c.Query("size", "medium")
+	known := false
+	for _, thumbnailSize := range thumbnailSizes {
+		known = known || thumbnailSize.Name == size
+	}
+	if !known {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "size must be small, medium or large"})
+	}
+
+	var status, kind, snippet, blobID, filePath, keyID *string
+	var fileSize *int64
+	var hashQueued, hashFailed bool
+	err := db.QueryRow(
+		context.Background(),
+		`
+			SELECT p.status, p.kind, p.snippet, b.id, t.file_path, t.file_size, b.encryption_key_id,
+				ph.file_id IS NOT NULL, ph.error IS NOT NULL
+			FROM files f
+			LEFT JOIN blobs b ON b.id = f.blob_id
+			LEFT JOIN previews p ON p.blob_id = b.id
+			LEFT JOIN thumbnails t ON t.blob_id = b.id AND t.size = $2
+			LEFT JOIN pendinghashes ph ON ph.file_id = f.id
+			WHERE f.id = $1;
+		`,
+		fileId, size,
+	).Scan(&status, &kind, &snippet, &blobID, &filePath, &fileSize, &keyID, &hashQueued, &hashFailed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	} else if err != nil {
+		log.Println("Error fetching preview: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching preview", "message": err.Error()})
+	}
+
+	// Files are previewed once their content has been hashed. Hashing is retried after a failure, but the
+	// preview is reported failed meanwhile so clients stop waiting for it
+	if status == nil {
+		switch {
+		case hashFailed:
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File has no preview", "status": "failed"})
+		case hashQueued:
+			return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"status": "pending"})
+		default:
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File has no preview", "status": "unsupported"})
+		}
+	}
+
+	switch {
+	case *status == "pending" || *status == "generating":
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"status": "pending"})
+	case *status != "ready":
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File has no preview", "status": *status})
+	case snippet != nil:
+		c.Set(fiber.HeaderContentType, "text/plain; charset=utf-8")
+		return c.Status(fiber.StatusOK).SendString(*snippet)
+	case filePath == nil:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File has no preview", "status": *status})
+	}
+
+	// The thumbnail of a blob in a size doesn't change, new content has a new blob. Browsers check it again on
+	// every use so access is checked too, and get it again only when the file has new content
+	etag := `"` + *blobID + "-" + size + `"`
+	c.Set(fiber.HeaderCacheControl, "private, no-cache")
+	c.Set(fiber.HeaderETag, etag)
+	if c.Get(fiber.HeaderIfNoneMatch) == etag {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	object, err := openEncryptedObject(db, *filePath, keyID, *fileSize)
+	if err != nil {
+		log.Println("Error fetching preview from Spaces: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching preview", "message": err.Error()})
+	}
+
+	c.Set(fiber.HeaderContentType, "image/jpeg")
+	c.Set("X-Preview-Kind", *kind)
+	return c.SendStream(object.Body, int(*fileSize))
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestScaleImage(t *testing.T) {
+	tests := []struct {
+		width, height, side int
+		wantWidth           int
+		wantHeight          int
+	}{
+		{400, 100, 128, 128, 32},
+		{100, 400, 128, 32, 128},
+		{10, 1000, 128, 1, 128},
+		{50, 20, 128, 50, 20},
+		{128, 128, 128, 128, 128},
+	}
+	for _, test := range tests {
+		src := image.NewRGBA(image.Rect(0, 0, test.width, test.height))
+		scaled := scaleImage(src, test.side)
+		if scaled.Bounds().Dx() != test.wantWidth || scaled.Bounds().Dy() != test.wantHeight {
+			t.Errorf("%dx%d scaled to %d: %dx%d, want %dx%d", test.width, test.height, test.side, scaled.Bounds().Dx(), scaled.Bounds().Dy(), test.wantWidth, test.wantHeight)
+		}
+	}
+
+	// Every pixel is the average of the pixels it covers: a red half and a checkered half
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			pixel := color.RGBA{255, 0, 0, 255}
+			if x >= 2 {
+				pixel = color.RGBA{0, 0, 0, 255}
+				if (x+y)%2 == 0 {
+					pixel = color.RGBA{255, 255, 255, 255}
+				}
+			}
+			src.SetRGBA(x, y, pixel)
+		}
+	}
+	scaled := scaleImage(src, 2)
+	if got := scaled.RGBAAt(0, 0); got != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("red half scaled to %v", got)
+	}
+	if got := scaled.RGBAAt(1, 0); got != (color.RGBA{127, 127, 127, 255}) {
+		t.Errorf("checkered half scaled to %v, want grey", got)
+	}
+}
+
+func TestTextSnippet(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"line endings", "first\r\nsecond\r\n", "first\nsecond"},
+		{"invalid bytes", "caf\xc3\xa9 \xff\x00bar", "café bar"},
+		{"surrounding space", "\n\n  text  \n", "text"},
+		{"long text", strings.Repeat("é", previewSnippetLength+10), strings.Repeat("é", previewSnippetLength)},
+		{"character cut by the byte limit", "a" + strings.Repeat("😀", previewSnippetLength), "a" + strings.Repeat("😀", previewSnippetLength-1)},
+	}
+	for _, test := range tests {
+		if got := textSnippet([]byte(test.data)); got != test.want {
+			t.Errorf("%s: snippet %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// testPNG encodes an image of the given size, then sets the size its header claims
+func testPNG(t *testing.T, width, height int, claimedWidth, claimedHeight uint32) []byte {
+	t.Helper()
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The header chunk follows the 8 byte signature and its 4 byte length, its CRC covers its type and data
+	data := encoded.Bytes()
+	binary.BigEndian.PutUint32(data[16:], claimedWidth)
+	binary.BigEndian.PutUint32(data[20:], claimedHeight)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestPreviewSizeGuards(t *testing.T) {
+	if _, err := decodePreviewImage(testPNG(t, 20, 10, 20, 10)); err != nil {
+		t.Errorf("small image: %v", err)
+	}
+
+	// Images with too many pixels are refused from their header, before they are decoded
+	if _, err := decodePreviewImage(testPNG(t, 1, 1, 10_000, previewMaxPixels/10_000+1)); err == nil || !strings.Contains(err.Error(), "megapixels") {
+		t.Errorf("image larger than the limit: %v, want it refused for its size", err)
+	}
+
+	// Content larger than the limit isn't read
+	status, kind, snippet, err := generatePreview(nil, queuedPreview{FileSize: previewMaxObjectSize + 1})
+	if status != "unsupported" || kind != nil || snippet != nil || err == nil {
+		t.Errorf("content larger than the limit: %s, %v, %v, %v, want unsupported", status, kind, snippet, err)
+	}
+}
+
+func TestGetFilePreviewStatus(t *testing.T) {
+	db := testDB(t)
+
+	creatorID := testUser(t, db, "creator@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+
+	// Files are queued for hashing when they are saved without a blob
+	queued := testNamedFile(t, db, organizationID, nil, "queued.txt", time.Now())
+	failed := testNamedFile(t, db, organizationID, nil, "failed.txt", time.Now())
+	unqueued := testNamedFile(t, db, organizationID, nil, "unqueued.txt", time.Now())
+	type statement struct {
+		query string
+		args  []interface{}
+	}
+	setup := []statement{
+		{"UPDATE pendinghashes SET error = 'object not found' WHERE file_id = $1;", []interface{}{failed}},
+		{"DELETE FROM pendinghashes WHERE file_id = $1;", []interface{}{unqueued}},
+	}
+
+	// Hashed files take the status of the preview of their blob
+	blobFiles := map[string]string{}
+	for _, preview := range []string{"pending", "unsupported", "ready"} {
+		blobID := testBlob(t, db, organizationID, time.Now())
+		fileID := testNamedFile(t, db, organizationID, nil, preview+".png", time.Now())
+		blobFiles[preview] = fileID
+		setup = append(setup,
+			statement{"UPDATE files SET file_path = $1, blob_id = $2 WHERE id = $3;", []interface{}{"blobs/" + blobID, blobID, fileID}},
+			statement{"UPDATE previews SET status = $1, kind = 'image' WHERE blob_id = $2;", []interface{}{preview, blobID}},
+		)
+		if preview == "ready" {
+			setup = append(setup, statement{"INSERT INTO thumbnails (blob_id, size, file_path, file_size, width, height) VALUES ($1, 'medium', 'previews/medium.jpg', 10, 1, 1);", []interface{}{blobID}})
+			blobFiles["etag"] = `"` + blobID + `-medium"`
+		}
+	}
+	for _, step := range setup {
+		if _, err := db.Exec(context.Background(), step.query, step.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := fiber.New()
+	app.Get("/:file_id", func(c *fiber.Ctx) error {
+		return GetFilePreview(c, db)
+	})
+
+	tests := []struct {
+		name    string
+		fileID  string
+		status  int
+		preview string
+	}{
+		{"queued for hashing", queued, fiber.StatusAccepted, "pending"},
+		{"hashing failed", failed, fiber.StatusNotFound, "failed"},
+		{"not queued", unqueued, fiber.StatusNotFound, "unsupported"},
+		{"preview pending", blobFiles["pending"], fiber.StatusAccepted, "pending"},
+		{"no preview", blobFiles["unsupported"], fiber.StatusNotFound, "unsupported"},
+	}
+	for _, test := range tests {
+		resp, err := app.Test(httptest.NewRequest("GET", "/"+test.fileID, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Status string `json:"status"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if resp.StatusCode != test.status || body.Status != test.preview {
+			t.Errorf("%s: %d %s, want %d %s", test.name, resp.StatusCode, body.Status, test.status, test.preview)
+		}
+	}
+
+	// Thumbnails the browser holds are checked again without being sent
+	req := httptest.NewRequest("GET", "/"+blobFiles["ready"], nil)
+	req.Header.Set(fiber.HeaderIfNoneMatch, blobFiles["etag"])
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusNotModified || resp.Header.Get(fiber.HeaderCacheControl) != "private, no-cache" {
+		t.Errorf("thumbnail held by the browser: %d with Cache-Control %q, want 304 and no-cache", resp.StatusCode, resp.Header.Get(fiber.HeaderCacheControl))
+	}
+}
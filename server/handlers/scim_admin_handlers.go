@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"server/models"
+	"server/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// CreateScimToken creates a SCIM bearer token for an organization, the token is only returned once
+func CreateScimToken(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	isAdmin, err := isOrganizationAdmin(db, userID, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if !isAdmin {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can manage SCIM tokens"})
+	}
+
+	var scimToken models.ScimToken
+	if err := c.BodyParser(&scimToken); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+
+	token, err := utils.GenerateSecureToken("silo_scim_")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error generating token"})
+	}
+
+	scimToken.ID = uuid.New().String()
+	scimToken.OrganizationID = organizationId
+	scimToken.CreatedAt = time.Now()
+
+	query := `
+		INSERT INTO scimtokens (id, organization_id, name, token_hash, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6);
+	`
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(
+			context.Background(),
+			query,
+			scimToken.ID, scimToken.OrganizationID, scimToken.Name, utils.HashToken(token), userID, scimToken.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "scim_token.create", TargetType: "scim_token", TargetID: scimToken.ID, After: fiber.Map{"name": scimToken.Name}}, nil
+	})
+	if err != nil {
+		log.Println("Error creating SCIM token: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating SCIM token", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "SCIM token created, it won't be shown again",
+		"id":      scimToken.ID,
+		"token":   token,
+	})
+}
+
+// GetScimTokens lists the SCIM tokens of an organization
+func GetScimTokens(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	isAdmin, err := isOrganizationAdmin(db, userID, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if !isAdmin {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can manage SCIM tokens"})
+	}
+
+	query := `
+		SELECT id, organization_id, COALESCE(name, ''), created_at, last_used_at, revoked_at
+		FROM scimtokens
+		WHERE organization_id = $1
+		ORDER BY created_at DESC;
+	`
+	rows, err := db.Query(context.Background(), query, organizationId)
+	if err != nil {
+		log.Println("Error fetching SCIM tokens: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching SCIM tokens", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	tokens := []models.ScimToken{}
+	for rows.Next() {
+		var token models.ScimToken
+		if err := rows.Scan(&token.ID, &token.OrganizationID, &token.Name, &token.CreatedAt, &token.LastUsedAt, &token.RevokedAt); err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	return sendList(c, tokens)
+}
+
+// RevokeScimToken revokes a SCIM token of an organization
+func RevokeScimToken(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	tokenId := c.Params("token_id")
+	userID := c.Locals("user_id").(string)
+
+	isAdmin, err := isOrganizationAdmin(db, userID, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if !isAdmin {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can manage SCIM tokens"})
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		commandTag, err := tx.Exec(
+			context.Background(),
+			"UPDATE scimtokens SET revoked_at = NOW() WHERE id = $1 AND organization_id = $2 AND revoked_at IS NULL;",
+			tokenId, organizationId,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if commandTag.RowsAffected() == 0 {
+			return nil, pgx.ErrNoRows
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "scim_token.revoke", TargetType: "scim_token", TargetID: tokenId}, nil
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "SCIM token not found"})
+	}
+	if err != nil {
+		log.Println("Error revoking SCIM token: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error revoking SCIM token", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "SCIM token revoked!"})
+}
+
+// UpdateScimGroupRole maps a provisioned group to a role, members get the highest role of their groups
+func UpdateScimGroupRole(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	groupId := c.Params("group_id")
+	userID := c.Locals("user_id").(string)
+
+	isAdmin, err := isOrganizationAdmin(db, userID, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if !isAdmin {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can map SCIM groups"})
+	}
+
+	var group models.ScimGroup
+	if err := c.BodyParser(&group); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+
+	if group.Role != "member" && group.Role != "admin" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Role must be member or admin"})
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating SCIM group", "message": err.Error()})
+	}
+	defer tx.Rollback(context.Background())
+
+	commandTag, err := tx.Exec(
+		context.Background(),
+		"UPDATE scimgroups SET role = $1 WHERE id = $2 AND organization_id = $3;",
+		group.Role, groupId, organizationId,
+	)
+	if err != nil {
+		log.Println("Error updating SCIM group: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating SCIM group", "message": err.Error()})
+	}
+
+	if commandTag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "SCIM group not found"})
+	}
+
+	rows, err := tx.Query(context.Background(), "SELECT user_id FROM scimgroupmembers WHERE group_id = $1;", groupId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching group members", "message": err.Error()})
+	}
+
+	var memberIDs []string
+	for rows.Next() {
+		var memberID string
+		if err := rows.Scan(&memberID); err != nil {
+			rows.Close()
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		memberIDs = append(memberIDs, memberID)
+	}
+	rows.Close()
+
+	for _, memberID := range memberIDs {
+		if err := syncScimUserRole(tx, organizationId, memberID); err != nil {
+			log.Println("Error syncing SCIM user role: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating member roles", "message": err.Error()})
+		}
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "scim_group.update_role", TargetType: "scim_group", TargetID: groupId, After: fiber.Map{"role": group.Role}}); err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating SCIM group", "message": err.Error()})
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating SCIM group", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "SCIM group role updated!"})
+}
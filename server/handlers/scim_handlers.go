@@ -0,0 +1,1160 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/middleware"
+	"server/sessions"
+	"server/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	scimUserSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema  = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimContentType  = "application/scim+json"
+	scimDefaultCount = 100
+)
+
+// scimFilterPattern matches the simple `attribute eq "value"` filters sent by identity providers
+var scimFilterPattern = regexp.MustCompile(`^\s*(\w+)\s+eq\s+"([^"]*)"\s*$`)
+
+type scimName struct {
+	GivenName  string `json:"givenName"`
+	FamilyName string `json:"familyName"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Primary bool   `json:"primary"`
+}
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+}
+
+type scimUser struct {
+	Schemas    []string    `json:"schemas"`
+	ID         string      `json:"id"`
+	ExternalID string      `json:"externalId,omitempty"`
+	UserName   string      `json:"userName"`
+	Name       scimName    `json:"name"`
+	Emails     []scimEmail `json:"emails,omitempty"`
+	Active     *bool       `json:"active,omitempty"`
+	Meta       *scimMeta   `json:"meta,omitempty"`
+}
+
+type scimMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+type scimGroup struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members"`
+	Meta        *scimMeta    `json:"meta,omitempty"`
+}
+
+type scimPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+func scimError(c *fiber.Ctx, status int, detail string) error {
+	c.Set(fiber.HeaderContentType, scimContentType)
+	return c.Status(status).JSON(fiber.Map{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	})
+}
+
+func scimJSON(c *fiber.Ctx, status int, body interface{}) error {
+	if err := c.Status(status).JSON(body); err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, scimContentType)
+	return nil
+}
+
+func scimList(c *fiber.Ctx, resources interface{}, total int, startIndex int, count int) error {
+	return scimJSON(c, fiber.StatusOK, fiber.Map{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   startIndex,
+		"itemsPerPage": count,
+		"Resources":    resources,
+	})
+}
+
+// scimPagination reads the 1-based startIndex and count query parameters
+func scimPagination(c *fiber.Ctx) (int, int) {
+	startIndex := c.QueryInt("startIndex", 1)
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	count := c.QueryInt("count", scimDefaultCount)
+	if count < 0 {
+		count = 0
+	}
+	return startIndex, count
+}
+
+// scimFilter parses a filter like `userName eq "jane@example.com"`
+func scimFilter(c *fiber.Ctx) (string, string, bool) {
+	matches := scimFilterPattern.FindStringSubmatch(c.Query("filter"))
+	if matches == nil {
+		return "", "", false
+	}
+	return strings.ToLower(matches[1]), matches[2], true
+}
+
+const scimUserColumns = `
+	u.user_id, COALESCE(su.external_id, ''), u.email, COALESCE(u.first_name, ''), COALESCE(u.last_name, ''), su.active, su.created_at
+`
+
+func scanScimUser(row pgx.Row) (scimUser, error) {
+	var user scimUser
+	var active bool
+	var created time.Time
+
+	err := row.Scan(&user.ID, &user.ExternalID, &user.UserName, &user.Name.GivenName, &user.Name.FamilyName, &active, &created)
+	if err != nil {
+		return user, err
+	}
+
+	user.Schemas = []string{scimUserSchema}
+	user.Emails = []scimEmail{{Value: user.UserName, Primary: true}}
+	user.Active = &active
+	user.Meta = &scimMeta{ResourceType: "User", Created: created}
+
+	return user, nil
+}
+
+func getScimUser(db dbConn, organizationID string, userID string) (scimUser, error) {
+	query := `SELECT ` + scimUserColumns + `
+		FROM scimusers su
+		JOIN users u ON u.user_id = su.user_id
+		WHERE su.organization_id = $1 AND su.user_id = $2;
+	`
+	return scanScimUser(db.QueryRow(context.Background(), query, organizationID, userID))
+}
+
+// syncScimUserRole gives a provisioned user the membership and role derived from their groups,
+// the organization creator's role is never changed through SCIM
+func syncScimUserRole(db dbConn, organizationID string, userID string) error {
+	var active bool
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT active FROM scimusers WHERE organization_id = $1 AND user_id = $2;",
+		organizationID, userID,
+	).Scan(&active)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && !active) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var isAdmin bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM scimgroupmembers m
+			JOIN scimgroups g ON g.id = m.group_id
+			WHERE g.organization_id = $1 AND m.user_id = $2 AND g.role = 'admin'
+		);
+	`
+	if err := db.QueryRow(context.Background(), query, organizationID, userID).Scan(&isAdmin); err != nil {
+		return err
+	}
+
+	role := "member"
+	if isAdmin {
+		role = "admin"
+	}
+
+	currentRole, err := getOrganizationRole(db, userID, organizationID)
+	if err != nil {
+		return err
+	}
+
+	switch currentRole {
+	case "creator", role:
+		return nil
+	case "":
+		_, err = db.Exec(
+			context.Background(),
+			"INSERT INTO userorganizations (id, user_id, organization_id, role, created_at) VALUES ($1, $2, $3, $4, $5);",
+			uuid.New().String(), userID, organizationID, role, time.Now(),
+		)
+	default:
+		_, err = db.Exec(
+			context.Background(),
+			"UPDATE userorganizations SET role = $1 WHERE user_id = $2 AND organization_id = $3;",
+			role, userID, organizationID,
+		)
+	}
+
+	return err
+}
+
+// deprovisionScimUser removes a user from the organization along with their folder grants, groups and access
+// tokens of the organization. Their sessions are only revoked when the organization provisioned the account,
+// other accounts keep working in their other organizations. Callers run it in the transaction of the change
+func deprovisionScimUser(db dbConn, organizationID string, userID string) error {
+	queries := []string{
+		"DELETE FROM userorganizations WHERE user_id = $1 AND organization_id = $2 AND role <> 'creator';",
+		"DELETE FROM folderpermissions WHERE user_id = $1 AND organization_id = $2;",
+		"DELETE FROM groupmembers gm USING groups g WHERE gm.group_id = g.id AND gm.user_id = $1 AND g.organization_id = $2;",
+		"UPDATE personalaccesstokens SET revoked_at = NOW() WHERE user_id = $1 AND organization_id = $2 AND revoked_at IS NULL;",
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(context.Background(), query, userID, organizationID); err != nil {
+			return err
+		}
+	}
+
+	var owned bool
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT scim_organization_id IS NOT NULL AND scim_organization_id = $2 FROM users WHERE user_id = $1;",
+		userID, organizationID,
+	).Scan(&owned)
+	if err != nil {
+		return err
+	}
+
+	if !owned {
+		return nil
+	}
+	return sessions.RevokeUserSessions(db, userID)
+}
+
+// canLinkScimUser reports whether SCIM may take over an existing account, only accounts the organization
+// provisioned itself or accounts already members of it can be linked
+func canLinkScimUser(organizationID string, scimOrganizationID string, isMember bool) bool {
+	return scimOrganizationID == organizationID || isMember
+}
+
+// updateScimUserName sets the name of a provisioned user, accounts the organization didn't provision keep
+// the name their owner set
+func updateScimUserName(db dbConn, organizationID string, userID string, name scimName) error {
+	_, err := db.Exec(
+		context.Background(),
+		"UPDATE users SET first_name = $1, last_name = $2 WHERE user_id = $3 AND scim_organization_id = $4;",
+		name.GivenName, name.FamilyName, userID, organizationID,
+	)
+	return err
+}
+
+// setScimUserActive activates or deactivates a provisioned user
+func setScimUserActive(db dbConn, organizationID string, userID string, active bool) error {
+	_, err := db.Exec(
+		context.Background(),
+		"UPDATE scimusers SET active = $1 WHERE organization_id = $2 AND user_id = $3;",
+		active, organizationID, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if !active {
+		return deprovisionScimUser(db, organizationID, userID)
+	}
+	return syncScimUserRole(db, organizationID, userID)
+}
+
+// ScimListUsers lists the users provisioned in an organization
+func ScimListUsers(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Locals("organization_id").(string)
+	startIndex, count := scimPagination(c)
+
+	where := "su.organization_id = $1"
+	args := []interface{}{organizationId}
+
+	if attribute, value, ok := scimFilter(c); ok {
+		switch attribute {
+		case "username":
+			where += " AND LOWER(u.email) = LOWER($2)"
+		case "externalid":
+			where += " AND su.external_id = $2"
+		default:
+			return scimError(c, fiber.StatusBadRequest, "Unsupported filter")
+		}
+		args = append(args, value)
+	}
+
+	var total int
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT COUNT(*) FROM scimusers su JOIN users u ON u.user_id = su.user_id WHERE "+where,
+		args...,
+	).Scan(&total)
+	if err != nil {
+		log.Println("Error counting SCIM users: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error listing users")
+	}
+
+	args = append(args, count, startIndex-1)
+	query := `SELECT ` + scimUserColumns + `
+		FROM scimusers su
+		JOIN users u ON u.user_id = su.user_id
+		WHERE ` + where + `
+		ORDER BY su.created_at
+		LIMIT $` + strconv.Itoa(len(args)-1) + ` OFFSET $` + strconv.Itoa(len(args)) + `;`
+
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		log.Println("Error listing SCIM users: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error listing users")
+	}
+	defer rows.Close()
+
+	users := []scimUser{}
+	for rows.Next() {
+		user, err := scanScimUser(rows)
+		if err != nil {
+			log.Println("Error scanning row: ", err)
+			return scimError(c, fiber.StatusInternalServerError, "Error listing users")
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error listing users")
+	}
+
+	return scimList(c, users, total, startIndex, len(users))
+}
+
+// ScimGetUser fetches a provisioned user
+func ScimGetUser(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Locals("organization_id").(string)
+
+	user, err := getScimUser(db, organizationId, c.Params("user_id"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return scimError(c, fiber.StatusNotFound, "User not found")
+	} else if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error fetching user")
+	}
+
+	return scimJSON(c, fiber.StatusOK, user)
+}
+
+// ScimCreateUser provisions a user into the organization, linking an existing account with the same email when
+// canLinkScimUser allows it
+func ScimCreateUser(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Locals("organization_id").(string)
+
+	var data scimUser
+	if err := c.BodyParser(&data); err != nil {
+		return scimError(c, fiber.StatusBadRequest, "Invalid input")
+	}
+
+	email := strings.ToLower(data.UserName)
+	for _, e := range data.Emails {
+		if !strings.Contains(email, "@") && (e.Primary || len(data.Emails) == 1) {
+			email = strings.ToLower(e.Value)
+		}
+	}
+	if email == "" {
+		return scimError(c, fiber.StatusBadRequest, "userName is required")
+	}
+
+	active := data.Active == nil || *data.Active
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error provisioning user")
+	}
+	defer tx.Rollback(context.Background())
+
+	var userID string
+	var scimOrganizationID string
+	var isMember bool
+	err = tx.QueryRow(
+		context.Background(),
+		`
+			SELECT u.user_id, COALESCE(u.scim_organization_id::text, ''),
+			EXISTS (SELECT 1 FROM userorganizations uo WHERE uo.user_id = u.user_id AND uo.organization_id = $2)
+			FROM users u WHERE LOWER(u.email) = $1;
+		`,
+		email, organizationId,
+	).Scan(&userID, &scimOrganizationID, &isMember)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Provisioned users sign in through SSO or a password reset, so they get a random password
+		randomPassword, err := utils.GenerateSecureToken("")
+		if err != nil {
+			return scimError(c, fiber.StatusInternalServerError, "Error creating user")
+		}
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomPassword), bcrypt.DefaultCost)
+		if err != nil {
+			return scimError(c, fiber.StatusInternalServerError, "Error creating user")
+		}
+
+		userID = uuid.New().String()
+		_, err = tx.Exec(
+			context.Background(),
+			`
+				INSERT INTO
+				users (user_id, first_name, last_name, email, password, email_verified, scim_organization_id, created_at)
+				VALUES ($1, $2, $3, $4, $5, true, $6, $7)
+			`,
+			userID, data.Name.GivenName, data.Name.FamilyName, email, string(hashedPassword), organizationId, time.Now(),
+		)
+		if err != nil {
+			log.Println("Error creating SCIM user: ", err)
+			return scimError(c, fiber.StatusInternalServerError, "Error creating user")
+		}
+	} else if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error fetching user")
+	} else if !canLinkScimUser(organizationId, scimOrganizationID, isMember) {
+		return scimError(c, fiber.StatusConflict, "A user with this userName exists outside the organization")
+	}
+
+	commandTag, err := tx.Exec(
+		context.Background(),
+		`
+			INSERT INTO scimusers (organization_id, user_id, external_id, active, created_at)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (organization_id, user_id) DO NOTHING;
+		`,
+		organizationId, userID, data.ExternalID, active, time.Now(),
+	)
+	if err != nil {
+		log.Println("Error provisioning SCIM user: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error provisioning user")
+	}
+	if commandTag.RowsAffected() == 0 {
+		return scimError(c, fiber.StatusConflict, "User already provisioned")
+	}
+
+	if active {
+		err = syncScimUserRole(tx, organizationId, userID)
+	} else {
+		err = deprovisionScimUser(tx, organizationId, userID)
+	}
+	if err != nil {
+		log.Println("Error syncing SCIM user membership: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error provisioning user")
+	}
+
+	user, err := getScimUser(tx, organizationId, userID)
+	if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error fetching user")
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "scim.user.create", TargetType: "user", TargetID: userID, After: &user}); err != nil {
+		log.Println(err)
+		return scimError(c, fiber.StatusInternalServerError, "Error provisioning user")
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error provisioning user")
+	}
+
+	return scimJSON(c, fiber.StatusCreated, user)
+}
+
+// ScimReplaceUser replaces the attributes of a provisioned user, names only change on accounts the organization
+// provisioned
+func ScimReplaceUser(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Locals("organization_id").(string)
+	userID := c.Params("user_id")
+
+	if _, err := getScimUser(db, organizationId, userID); errors.Is(err, pgx.ErrNoRows) {
+		return scimError(c, fiber.StatusNotFound, "User not found")
+	} else if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error fetching user")
+	}
+
+	var data scimUser
+	if err := c.BodyParser(&data); err != nil {
+		return scimError(c, fiber.StatusBadRequest, "Invalid input")
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating user")
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := updateScimUserName(tx, organizationId, userID, data.Name); err != nil {
+		log.Println("Error updating SCIM user: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating user")
+	}
+
+	_, err = tx.Exec(
+		context.Background(),
+		"UPDATE scimusers SET external_id = $1 WHERE organization_id = $2 AND user_id = $3;",
+		data.ExternalID, organizationId, userID,
+	)
+	if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error updating user")
+	}
+
+	if err := setScimUserActive(tx, organizationId, userID, data.Active == nil || *data.Active); err != nil {
+		log.Println("Error updating SCIM user membership: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating user")
+	}
+
+	user, err := getScimUser(tx, organizationId, userID)
+	if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error fetching user")
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "scim.user.replace", TargetType: "user", TargetID: userID, After: &user}); err != nil {
+		log.Println(err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating user")
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating user")
+	}
+
+	return scimJSON(c, fiber.StatusOK, user)
+}
+
+// scimBool reads booleans sent either as JSON booleans or as strings
+func scimBool(value interface{}) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case string:
+		parsed, err := strconv.ParseBool(v)
+		return parsed, err == nil
+	}
+	return false, false
+}
+
+// ScimPatchUser applies PatchOp operations to a provisioned user, mostly used to (de)activate them
+func ScimPatchUser(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Locals("organization_id").(string)
+	userID := c.Params("user_id")
+
+	user, err := getScimUser(db, organizationId, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return scimError(c, fiber.StatusNotFound, "User not found")
+	} else if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error fetching user")
+	}
+
+	var data scimPatchRequest
+	if err := c.BodyParser(&data); err != nil {
+		return scimError(c, fiber.StatusBadRequest, "Invalid input")
+	}
+
+	active := *user.Active
+	for _, operation := range data.Operations {
+		if !strings.EqualFold(operation.Op, "replace") && !strings.EqualFold(operation.Op, "add") {
+			return scimError(c, fiber.StatusBadRequest, "Unsupported operation")
+		}
+
+		// Operations either target a path or carry a map of attributes
+		values := map[string]interface{}{}
+		if operation.Path != "" {
+			values[operation.Path] = operation.Value
+		} else if attributes, ok := operation.Value.(map[string]interface{}); ok {
+			values = attributes
+		}
+
+		for path, value := range values {
+			switch strings.ToLower(path) {
+			case "active":
+				parsed, ok := scimBool(value)
+				if !ok {
+					return scimError(c, fiber.StatusBadRequest, "Invalid value for active")
+				}
+				active = parsed
+			case "name.givenname":
+				user.Name.GivenName, _ = value.(string)
+			case "name.familyname":
+				user.Name.FamilyName, _ = value.(string)
+			case "externalid":
+				user.ExternalID, _ = value.(string)
+			}
+		}
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating user")
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := updateScimUserName(tx, organizationId, userID, user.Name); err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error updating user")
+	}
+
+	_, err = tx.Exec(
+		context.Background(),
+		"UPDATE scimusers SET external_id = $1 WHERE organization_id = $2 AND user_id = $3;",
+		user.ExternalID, organizationId, userID,
+	)
+	if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error updating user")
+	}
+
+	if err := setScimUserActive(tx, organizationId, userID, active); err != nil {
+		log.Println("Error updating SCIM user membership: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating user")
+	}
+
+	user, err = getScimUser(tx, organizationId, userID)
+	if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error fetching user")
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "scim.user.patch", TargetType: "user", TargetID: userID, After: &user}); err != nil {
+		log.Println(err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating user")
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating user")
+	}
+
+	return scimJSON(c, fiber.StatusOK, user)
+}
+
+// ScimDeleteUser deprovisions a user from the organization, the account itself is kept
+func ScimDeleteUser(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Locals("organization_id").(string)
+	userID := c.Params("user_id")
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error deleting user")
+	}
+	defer tx.Rollback(context.Background())
+
+	commandTag, err := tx.Exec(
+		context.Background(),
+		"DELETE FROM scimusers WHERE organization_id = $1 AND user_id = $2;",
+		organizationId, userID,
+	)
+	if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error deleting user")
+	}
+	if commandTag.RowsAffected() == 0 {
+		return scimError(c, fiber.StatusNotFound, "User not found")
+	}
+
+	_, err = tx.Exec(
+		context.Background(),
+		"DELETE FROM scimgroupmembers WHERE user_id = $1 AND group_id IN (SELECT id FROM scimgroups WHERE organization_id = $2);",
+		userID, organizationId,
+	)
+	if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error deleting user")
+	}
+
+	if err := deprovisionScimUser(tx, organizationId, userID); err != nil {
+		log.Println("Error deprovisioning SCIM user: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error deleting user")
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "scim.user.delete", TargetType: "user", TargetID: userID}); err != nil {
+		log.Println(err)
+		return scimError(c, fiber.StatusInternalServerError, "Error deleting user")
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error deleting user")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func getScimGroup(db dbConn, organizationID string, groupID string) (scimGroup, error) {
+	var group scimGroup
+	var created time.Time
+
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT id, COALESCE(external_id, ''), display_name, created_at FROM scimgroups WHERE organization_id = $1 AND id = $2;",
+		organizationID, groupID,
+	).Scan(&group.ID, &group.ExternalID, &group.DisplayName, &created)
+	if err != nil {
+		return group, err
+	}
+
+	group.Schemas = []string{scimGroupSchema}
+	group.Meta = &scimMeta{ResourceType: "Group", Created: created}
+	group.Members = []scimMember{}
+
+	rows, err := db.Query(
+		context.Background(),
+		"SELECT u.user_id, u.email FROM scimgroupmembers m JOIN users u ON u.user_id = m.user_id WHERE m.group_id = $1;",
+		groupID,
+	)
+	if err != nil {
+		return group, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var member scimMember
+		if err := rows.Scan(&member.Value, &member.Display); err != nil {
+			return group, err
+		}
+		group.Members = append(group.Members, member)
+	}
+
+	return group, rows.Err()
+}
+
+// setScimGroupMembers adds or removes members of a group and updates their roles
+func setScimGroupMembers(db dbConn, organizationID string, groupID string, userIDs []string, add bool) error {
+	for _, userID := range userIDs {
+		var err error
+		if add {
+			_, err = db.Exec(
+				context.Background(),
+				`
+					INSERT INTO scimgroupmembers (group_id, user_id)
+					SELECT $1, user_id FROM scimusers WHERE organization_id = $2 AND user_id = $3
+					ON CONFLICT DO NOTHING;
+				`,
+				groupID, organizationID, userID,
+			)
+		} else {
+			_, err = db.Exec(
+				context.Background(),
+				"DELETE FROM scimgroupmembers WHERE group_id = $1 AND user_id = $2;",
+				groupID, userID,
+			)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := syncScimUserRole(db, organizationID, userID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scimMemberIDs extracts the user ids of a members value
+func scimMemberIDs(value interface{}) []string {
+	var ids []string
+	members, _ := value.([]interface{})
+	for _, member := range members {
+		if attributes, ok := member.(map[string]interface{}); ok {
+			if id, ok := attributes["value"].(string); ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// scimMemberPathPattern matches paths like members[value eq "id"]
+var scimMemberPathPattern = regexp.MustCompile(`^members\[value eq "([^"]+)"\]$`)
+
+// ScimListGroups lists the groups of an organization
+func ScimListGroups(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Locals("organization_id").(string)
+	startIndex, count := scimPagination(c)
+
+	where := "organization_id = $1"
+	args := []interface{}{organizationId}
+
+	if attribute, value, ok := scimFilter(c); ok {
+		switch attribute {
+		case "displayname":
+			where += " AND display_name = $2"
+		case "externalid":
+			where += " AND external_id = $2"
+		default:
+			return scimError(c, fiber.StatusBadRequest, "Unsupported filter")
+		}
+		args = append(args, value)
+	}
+
+	var total int
+	if err := db.QueryRow(context.Background(), "SELECT COUNT(*) FROM scimgroups WHERE "+where, args...).Scan(&total); err != nil {
+		log.Println("Error counting SCIM groups: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error listing groups")
+	}
+
+	args = append(args, count, startIndex-1)
+	query := "SELECT id FROM scimgroups WHERE " + where + " ORDER BY created_at LIMIT $" + strconv.Itoa(len(args)-1) + " OFFSET $" + strconv.Itoa(len(args)) + ";"
+
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		log.Println("Error listing SCIM groups: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error listing groups")
+	}
+
+	var groupIDs []string
+	for rows.Next() {
+		var groupID string
+		if err := rows.Scan(&groupID); err != nil {
+			rows.Close()
+			return scimError(c, fiber.StatusInternalServerError, "Error listing groups")
+		}
+		groupIDs = append(groupIDs, groupID)
+	}
+	rows.Close()
+
+	groups := []scimGroup{}
+	for _, groupID := range groupIDs {
+		group, err := getScimGroup(db, organizationId, groupID)
+		if err != nil {
+			return scimError(c, fiber.StatusInternalServerError, "Error listing groups")
+		}
+		groups = append(groups, group)
+	}
+
+	return scimList(c, groups, total, startIndex, len(groups))
+}
+
+// ScimGetGroup fetches a group with its members
+func ScimGetGroup(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Locals("organization_id").(string)
+
+	group, err := getScimGroup(db, organizationId, c.Params("group_id"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return scimError(c, fiber.StatusNotFound, "Group not found")
+	} else if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error fetching group")
+	}
+
+	return scimJSON(c, fiber.StatusOK, group)
+}
+
+// ScimCreateGroup creates a group, new groups map to the member role until an admin maps them
+func ScimCreateGroup(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Locals("organization_id").(string)
+
+	var data scimGroup
+	if err := c.BodyParser(&data); err != nil || data.DisplayName == "" {
+		return scimError(c, fiber.StatusBadRequest, "Invalid input")
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error creating group")
+	}
+	defer tx.Rollback(context.Background())
+
+	groupID := uuid.New().String()
+	_, err = tx.Exec(
+		context.Background(),
+		"INSERT INTO scimgroups (id, organization_id, external_id, display_name, created_at) VALUES ($1, $2, $3, $4, $5);",
+		groupID, organizationId, data.ExternalID, data.DisplayName, time.Now(),
+	)
+	if err != nil {
+		log.Println("Error creating SCIM group: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error creating group")
+	}
+
+	var memberIDs []string
+	for _, member := range data.Members {
+		memberIDs = append(memberIDs, member.Value)
+	}
+	if err := setScimGroupMembers(tx, organizationId, groupID, memberIDs, true); err != nil {
+		log.Println("Error adding SCIM group members: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error adding group members")
+	}
+
+	group, err := getScimGroup(tx, organizationId, groupID)
+	if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error fetching group")
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "scim.group.create", TargetType: "scim_group", TargetID: groupID, After: &group}); err != nil {
+		log.Println(err)
+		return scimError(c, fiber.StatusInternalServerError, "Error creating group")
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error creating group")
+	}
+
+	return scimJSON(c, fiber.StatusCreated, group)
+}
+
+// ScimReplaceGroup replaces the name and members of a group
+func ScimReplaceGroup(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Locals("organization_id").(string)
+	groupID := c.Params("group_id")
+
+	current, err := getScimGroup(db, organizationId, groupID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return scimError(c, fiber.StatusNotFound, "Group not found")
+	} else if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error fetching group")
+	}
+
+	var data scimGroup
+	if err := c.BodyParser(&data); err != nil || data.DisplayName == "" {
+		return scimError(c, fiber.StatusBadRequest, "Invalid input")
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating group")
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(
+		context.Background(),
+		"UPDATE scimgroups SET display_name = $1, external_id = $2 WHERE id = $3;",
+		data.DisplayName, data.ExternalID, groupID,
+	)
+	if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error updating group")
+	}
+
+	var removed []string
+	for _, member := range current.Members {
+		removed = append(removed, member.Value)
+	}
+	var added []string
+	for _, member := range data.Members {
+		added = append(added, member.Value)
+	}
+
+	if err := setScimGroupMembers(tx, organizationId, groupID, removed, false); err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error updating group members")
+	}
+	if err := setScimGroupMembers(tx, organizationId, groupID, added, true); err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error updating group members")
+	}
+
+	group, err := getScimGroup(tx, organizationId, groupID)
+	if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error fetching group")
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "scim.group.replace", TargetType: "scim_group", TargetID: groupID, After: &group}); err != nil {
+		log.Println(err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating group")
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating group")
+	}
+
+	return scimJSON(c, fiber.StatusOK, group)
+}
+
+// ScimPatchGroup applies PatchOp operations to a group, mostly used to add and remove members
+func ScimPatchGroup(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Locals("organization_id").(string)
+	groupID := c.Params("group_id")
+
+	current, err := getScimGroup(db, organizationId, groupID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return scimError(c, fiber.StatusNotFound, "Group not found")
+	} else if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error fetching group")
+	}
+
+	var data scimPatchRequest
+	if err := c.BodyParser(&data); err != nil {
+		return scimError(c, fiber.StatusBadRequest, "Invalid input")
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating group")
+	}
+	defer tx.Rollback(context.Background())
+
+	for _, operation := range data.Operations {
+		op := strings.ToLower(operation.Op)
+		path := strings.ToLower(operation.Path)
+
+		switch {
+		case path == "members" && op == "add":
+			err = setScimGroupMembers(tx, organizationId, groupID, scimMemberIDs(operation.Value), true)
+		case path == "members" && op == "remove":
+			err = setScimGroupMembers(tx, organizationId, groupID, scimMemberIDs(operation.Value), false)
+		case path == "members" && op == "replace":
+			var removed []string
+			for _, member := range current.Members {
+				removed = append(removed, member.Value)
+			}
+			err = setScimGroupMembers(tx, organizationId, groupID, removed, false)
+			if err == nil {
+				err = setScimGroupMembers(tx, organizationId, groupID, scimMemberIDs(operation.Value), true)
+			}
+		case scimMemberPathPattern.MatchString(operation.Path) && op == "remove":
+			memberID := scimMemberPathPattern.FindStringSubmatch(operation.Path)[1]
+			err = setScimGroupMembers(tx, organizationId, groupID, []string{memberID}, false)
+		case (path == "displayname" || path == "") && op == "replace":
+			displayName, ok := operation.Value.(string)
+			if attributes, isMap := operation.Value.(map[string]interface{}); isMap {
+				displayName, ok = attributes["displayName"].(string)
+			}
+			if !ok || displayName == "" {
+				return scimError(c, fiber.StatusBadRequest, "Invalid displayName")
+			}
+			_, err = tx.Exec(context.Background(), "UPDATE scimgroups SET display_name = $1 WHERE id = $2;", displayName, groupID)
+		default:
+			return scimError(c, fiber.StatusBadRequest, "Unsupported operation")
+		}
+
+		if err != nil {
+			log.Println("Error patching SCIM group: ", err)
+			return scimError(c, fiber.StatusInternalServerError, "Error updating group")
+		}
+	}
+
+	group, err := getScimGroup(tx, organizationId, groupID)
+	if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error fetching group")
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "scim.group.patch", TargetType: "scim_group", TargetID: groupID, After: &group}); err != nil {
+		log.Println(err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating group")
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error updating group")
+	}
+
+	return scimJSON(c, fiber.StatusOK, group)
+}
+
+// ScimDeleteGroup deletes a group and recomputes the roles of its members
+func ScimDeleteGroup(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Locals("organization_id").(string)
+	groupID := c.Params("group_id")
+
+	group, err := getScimGroup(db, organizationId, groupID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return scimError(c, fiber.StatusNotFound, "Group not found")
+	} else if err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error fetching group")
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error deleting group")
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(context.Background(), "DELETE FROM scimgroups WHERE id = $1;", groupID); err != nil {
+		return scimError(c, fiber.StatusInternalServerError, "Error deleting group")
+	}
+
+	for _, member := range group.Members {
+		if err := syncScimUserRole(tx, organizationId, member.Value); err != nil {
+			log.Println("Error syncing SCIM user role: ", err)
+			return scimError(c, fiber.StatusInternalServerError, "Error deleting group")
+		}
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "scim.group.delete", TargetType: "scim_group", TargetID: groupID, Before: &group}); err != nil {
+		log.Println(err)
+		return scimError(c, fiber.StatusInternalServerError, "Error deleting group")
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return scimError(c, fiber.StatusInternalServerError, "Error deleting group")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func RegisterScimRoutes(app *fiber.App, db *pgxpool.Pool) {
+	scimRoutes := app.Group("/scim/v2/:organization_id", middleware.ScimAuthRequired(db))
+
+	scimRoutes.Get("/Users", func(c *fiber.Ctx) error {
+		return ScimListUsers(c, db)
+	})
+	scimRoutes.Get("/Users/:user_id", func(c *fiber.Ctx) error {
+		return ScimGetUser(c, db)
+	})
+	scimRoutes.Post("/Users", func(c *fiber.Ctx) error {
+		return ScimCreateUser(c, db)
+	})
+	scimRoutes.Put("/Users/:user_id", func(c *fiber.Ctx) error {
+		return ScimReplaceUser(c, db)
+	})
+	scimRoutes.Patch("/Users/:user_id", func(c *fiber.Ctx) error {
+		return ScimPatchUser(c, db)
+	})
+	scimRoutes.Delete("/Users/:user_id", func(c *fiber.Ctx) error {
+		return ScimDeleteUser(c, db)
+	})
+	scimRoutes.Get("/Groups", func(c *fiber.Ctx) error {
+		return ScimListGroups(c, db)
+	})
+	scimRoutes.Get("/Groups/:group_id", func(c *fiber.Ctx) error {
+		return ScimGetGroup(c, db)
+	})
+	scimRoutes.Post("/Groups", func(c *fiber.Ctx) error {
+		return ScimCreateGroup(c, db)
+	})
+	scimRoutes.Put("/Groups/:group_id", func(c *fiber.Ctx) error {
+		return ScimReplaceGroup(c, db)
+	})
+	scimRoutes.Patch("/Groups/:group_id", func(c *fiber.Ctx) error {
+		return ScimPatchGroup(c, db)
+	})
+	scimRoutes.Delete("/Groups/:group_id", func(c *fiber.Ctx) error {
+		return ScimDeleteGroup(c, db)
+	})
+
+	scimAdminGroup := app.Group("/organization/scim")
+
+	scimAdminGroup.Post("/tokens/:organization_id", middleware.AuthRequired(db), func(c *fiber.Ctx) error {
+		return CreateScimToken(c, db)
+	})
+	scimAdminGroup.Get("/tokens/:organization_id", middleware.AuthRequired(db), func(c *fiber.Ctx) error {
+		return GetScimTokens(c, db)
+	})
+	scimAdminGroup.Delete("/tokens/:organization_id/:token_id", middleware.AuthRequired(db), func(c *fiber.Ctx) error {
+		return RevokeScimToken(c, db)
+	})
+	scimAdminGroup.Put("/groups/:organization_id/:group_id", middleware.AuthRequired(db), func(c *fiber.Ctx) error {
+		return UpdateScimGroupRole(c, db)
+	})
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCanLinkScimUser(t *testing.T) {
+	tests := []struct {
+		name               string
+		scimOrganizationID string
+		isMember           bool
+		link               bool
+	}{
+		{"provisioned by the organization", "org", false, true},
+		{"member of the organization", "", true, true},
+		{"provisioned by another organization", "other", false, false},
+		{"unrelated account", "", false, false},
+	}
+	for _, test := range tests {
+		if canLinkScimUser("org", test.scimOrganizationID, test.isMember) != test.link {
+			t.Errorf("%s: canLinkScimUser != %v", test.name, test.link)
+		}
+	}
+}
+
+func TestScimBool(t *testing.T) {
+	for value, expected := range map[interface{}]bool{true: true, "True": true, "false": false} {
+		parsed, ok := scimBool(value)
+		if !ok || parsed != expected {
+			t.Errorf("scimBool(%v) = %v, %v", value, parsed, ok)
+		}
+	}
+	if _, ok := scimBool(1); ok {
+		t.Error("scimBool accepted a number")
+	}
+}
+
+func TestDeprovisionScimUser(t *testing.T) {
+	db := testDB(t)
+
+	creatorID := testUser(t, db, "creator@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+	otherOrganizationID := testOrganization(t, db, creatorID)
+
+	provisionedID := testUser(t, db, "provisioned@example.com")
+	linkedID := testUser(t, db, "linked@example.com")
+	_, err := db.Exec(context.Background(), "UPDATE users SET scim_organization_id = $1 WHERE user_id = $2;", organizationID, provisionedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, userID := range []string{provisionedID, linkedID} {
+		for _, orgID := range []string{organizationID, otherOrganizationID} {
+			if err := addUserToOrganization(db, userID, orgID, "member"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := db.Exec(
+			context.Background(),
+			"INSERT INTO sessions (id, user_id, created_at, expires_at) VALUES ($1, $2, NOW(), $3);",
+			uuid.New().String(), userID, time.Now().Add(time.Hour),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := deprovisionScimUser(db, organizationID, userID); err != nil {
+			t.Fatal(err)
+		}
+
+		role, err := getOrganizationRole(db, userID, organizationID)
+		if err != nil || role != "" {
+			t.Errorf("user is still a %q of the organization, %v", role, err)
+		}
+		role, err = getOrganizationRole(db, userID, otherOrganizationID)
+		if err != nil || role != "member" {
+			t.Errorf("user lost their other organization, role %q, %v", role, err)
+		}
+	}
+
+	active := map[string]bool{}
+	rows, err := db.Query(context.Background(), "SELECT user_id::text, revoked_at IS NULL FROM sessions;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var userID string
+		var isActive bool
+		if err := rows.Scan(&userID, &isActive); err != nil {
+			t.Fatal(err)
+		}
+		active[userID] = isActive
+	}
+	rows.Close()
+
+	if active[provisionedID] {
+		t.Error("sessions of an account the organization provisioned weren't revoked")
+	}
+	if !active[linkedID] {
+		t.Error("sessions of a linked account were revoked")
+	}
+}
+
+func TestUpdateScimUserName(t *testing.T) {
+	db := testDB(t)
+
+	creatorID := testUser(t, db, "creator@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+	linkedID := testUser(t, db, "linked@example.com")
+
+	if err := updateScimUserName(db, organizationID, linkedID, scimName{GivenName: "Changed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var firstName *string
+	if err := db.QueryRow(context.Background(), "SELECT first_name FROM users WHERE user_id = $1;", linkedID).Scan(&firstName); err != nil {
+		t.Fatal(err)
+	}
+	if firstName != nil {
+		t.Errorf("name of an account the organization didn't provision changed to %q", *firstName)
+	}
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"server/middleware"
+	"server/models"
+	"server/spaces"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	// indexBatchSize is how many queued files the indexer claims at once
+	indexBatchSize = 10
+	// indexPollInterval is how long the indexer waits when no file is queued
+	indexPollInterval = 5 * time.Second
+	// indexMaxObjectSize is the largest file whose content is indexed
+	indexMaxObjectSize = 50 << 20
+	// searchMaxWords is the most words of a search matched against names
+	searchMaxWords = 10
+)
+
+// Highlights are marked with control characters by Postgres, the text around them is escaped before they
+// become <mark> tags
+const searchHighlightOptions = `StartSel="` + "\x01" + `", StopSel="` + "\x02" + `"`
+
+// StartContentIndexer extracts the text of the files queued for search in the background. Files left mid-way
+// by a restart and files saved before search existed are queued first
+func StartContentIndexer(db *pgxpool.Pool) {
+	if spaces.S3Client == nil {
+		log.Println("Spaces is not configured, file contents won't be indexed for search")
+		return
+	}
+
+	if _, err := db.Exec(context.Background(), "UPDATE filecontents SET status = 'pending' WHERE status = 'indexing';"); err != nil {
+		log.Println("Error requeuing interrupted indexing: ", err)
+	}
+
+	_, err := db.Exec(
+		context.Background(),
+		`
+			INSERT INTO filecontents (file_id, file_path, status, queued_at)
+			SELECT id, file_path, 'pending', NOW() FROM files
+			ON CONFLICT (file_id) DO NOTHING;
+		`,
+	)
+	if err != nil {
+		log.Println("Error queuing files for indexing: ", err)
+	}
+
+	go func() {
+		for {
+			if indexQueuedContents(db) == 0 {
+				time.Sleep(indexPollInterval)
+			}
+		}
+	}()
+}
+
+// indexQueuedContents indexes a batch of queued files and returns how many it took. Files waiting to be hashed
+// are left until their content has moved to its blob
+func indexQueuedContents(db *pgxpool.Pool) int {
+	rows, err := db.Query(
+		context.Background(),
+		`
+			UPDATE filecontents fc SET status = 'indexing'
+			FROM files f
+			WHERE f.id = fc.file_id AND fc.file_id IN (
+				SELECT file_id FROM filecontents c WHERE status = 'pending'
+				AND NOT EXISTS (SELECT 1 FROM pendinghashes ph WHERE ph.file_id = c.file_id AND ph.error IS NULL)
+				ORDER BY queued_at LIMIT $1 FOR UPDATE SKIP LOCKED
+			)
+			RETURNING fc.file_id, fc.file_path, f.name;
+		`,
+		indexBatchSize,
+	)
+	if err != nil {
+		log.Println("Error claiming files to index: ", err)
+		return 0
+	}
+
+	type queuedFile struct {
+		ID, FilePath, Name string
+	}
+	var queued []queuedFile
+	for rows.Next() {
+		var file queuedFile
+		if err := rows.Scan(&file.ID, &file.FilePath, &file.Name); err != nil {
+			log.Println("Error scanning row: ", err)
+			break
+		}
+		queued = append(queued, file)
+	}
+	rows.Close()
+
+	for _, file := range queued {
+		status, content, indexErr := extractFileContent(db, file.FilePath, file.Name)
+
+		var message *string
+		if indexErr != nil {
+			text := indexErr.Error()
+			message = &text
+		}
+
+		// Files whose content was replaced meanwhile are queued again and left for the next batch
+		_, err := db.Exec(
+			context.Background(),
+			`
+				UPDATE filecontents
+				SET status = $1, content = $2, content_vector = to_tsvector('english', COALESCE($2, '')), error = $3, indexed_at = NOW()
+				WHERE file_id = $4 AND file_path = $5 AND status = 'indexing';
+			`,
+			status, content, message, file.ID, file.FilePath,
+		)
+		if err != nil {
+			log.Printf("Error saving content of file %s: %v", file.ID, err)
+		}
+	}
+
+	return len(queued)
+}
+
+// extractFileContent reads a file from Spaces, decrypted when it is stored encrypted, and extracts its text. The
+// status is indexed with the text, unsupported for formats without text or files too large, and failed when the
+// file can't be read
+func extractFileContent(db *pgxpool.Pool, filePath string, name string) (string, *string, error) {
+	extract := contentExtractor(name)
+	if extract == nil {
+		return "unsupported", nil, nil
+	}
+
+	object, err := openStoredFile(db, filePath)
+	if err != nil {
+		return "failed", nil, err
+	}
+	defer object.Body.Close()
+
+	if object.ContentLength != nil && *object.ContentLength > indexMaxObjectSize {
+		return "unsupported", nil, fmt.Errorf("file is larger than %d MB", indexMaxObjectSize>>20)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(object.Body, indexMaxObjectSize+1))
+	if err != nil {
+		return "failed", nil, err
+	}
+	if len(data) > indexMaxObjectSize {
+		return "unsupported", nil, fmt.Errorf("file is larger than %d MB", indexMaxObjectSize>>20)
+	}
+
+	text, err := extract(data)
+	if err != nil {
+		return "failed", nil, err
+	}
+	return "indexed", &text, nil
+}
+
+// searchNameQuery turns a search into a prefix query on the words of names, so partly typed words match
+func searchNameQuery(search string) string {
+	words := strings.FieldsFunc(strings.ToLower(search), func(char rune) bool {
+		return !unicode.IsLetter(char) && !unicode.IsDigit(char)
+	})
+	if len(words) > searchMaxWords {
+		words = words[:searchMaxWords]
+	}
+
+	for i := range words {
+		words[i] += ":*"
+	}
+	return strings.Join(words, " & ")
+}
+
+// searchHighlight escapes a highlight from Postgres and marks its matches with <mark> tags
+func searchHighlight(highlight string) string {
+	return strings.NewReplacer("\x01", "<mark>", "\x02", "</mark>").Replace(html.EscapeString(highlight))
+}
+
+// SearchFiles searches the files of an organization by name, tags and metadata values and, for supported formats,
+// by content. The q query parameter is the search, folder_id limits it to a folder and its subfolders and the file
+// listing filters apply. Results are ranked by relevance, names weighing more than tags and metadata and those more
+// than content, with the matches highlighted
+func SearchFiles(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	search := strings.TrimSpace(c.Query("q"))
+	if search == "" || len(search) > 200 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "q must be between 1 and 200 characters"})
+	}
+	nameQuery := searchNameQuery(search)
+	if nameQuery == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "q must contain a word"})
+	}
+
+	args := []interface{}{organizationId, userID, nameQuery, search}
+	nameMatch := "to_tsquery('simple', $3)"
+	contentMatch := "websearch_to_tsquery('english', $4)"
+	rank := fmt.Sprintf(
+		"(ts_rank(name_vector, %[1]s) * 2 + ts_rank(label_vector, %[1]s) * 1.5 + COALESCE(ts_rank(content_vector, %[2]s), 0))::real",
+		nameMatch, contentMatch,
+	)
+
+	sortColumns := map[string]sortColumn{"relevance": {Expression: rank, Type: "real", Descending: true}}
+	for name, column := range fileSortColumns {
+		sortColumns[name] = column
+	}
+	page, err := parsePageRequest(c, sortColumns, "relevance")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	where := fmt.Sprintf(`
+		organization_id = $1 AND deleted = false AND %[3]s
+		AND (name_vector @@ %[1]s OR label_vector @@ %[1]s OR content_vector @@ %[2]s)
+		AND (folder_id IS NULL OR NOT EXISTS (
+			SELECT 1 FROM folders p JOIN folders a ON a.id = ANY(p.ancestor_ids || p.id)
+			WHERE p.id = hits.folder_id AND a.deleted
+		))
+	`, nameMatch, contentMatch, fileRankCondition("folder_id", "$2", "$1", permissionViewer))
+
+	if folderId := c.Query("folder_id"); folderId != "" {
+		if _, err := uuid.Parse(folderId); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "folder_id must be a folder id"})
+		}
+		args = append(args, folderId)
+		where += fmt.Sprintf(" AND folder_id IN (SELECT id FROM folders WHERE id = $%[1]d::uuid OR $%[1]d::uuid = ANY(ancestor_ids))", len(args))
+	}
+
+	filters, args, err := parseFilters(c, fileFilterColumns, args)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Highlights are only worked out for the rows of the page
+	args = append(args, searchHighlightOptions)
+	columns := fmt.Sprintf(`
+		%s, %s,
+		ts_headline('simple', name, %s, 'HighlightAll=true, ' || $%[4]d),
+		CASE WHEN content_vector @@ %s THEN ts_headline('english', content, %[5]s, 'MaxFragments=2, MinWords=5, MaxWords=20, ' || $%[4]d) END
+	`, fileColumns, rank, nameMatch, len(args), contentMatch)
+
+	from := `(
+		SELECT f.id, f.name, f.folder_id, f.file_path, f.file_size, f.created_at, f.updated_at, f.organization_id,
+		f.deleted, f.deleted_at, f.created_by, f.metadata, f.blob_id, fc.content, fc.content_vector, search_name_vector(f.name) AS name_vector,
+		to_tsvector('simple', array_to_string(file_tag_names(f.id), ' ')) || jsonb_to_tsvector('simple', f.metadata, '["string", "numeric"]') AS label_vector
+		FROM files f
+		LEFT JOIN filecontents fc ON fc.file_id = f.id AND fc.status = 'indexed'
+	) hits`
+
+	rows, total, err := queryPage(db, page, columns, from, where+" AND "+filters, "id", args)
+	if err != nil {
+		log.Println("Error searching files: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error searching files", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	results := []models.SearchResult{}
+	var keys []pageKey
+	for rows.Next() {
+		var result models.SearchResult
+		var nameHighlight string
+		var contentHighlight *string
+		var key pageKey
+		file, err := scanFile(rows, &result.Rank, &nameHighlight, &contentHighlight, &key.Value)
+		if err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+
+		result.File = file
+		result.NameHighlight = searchHighlight(nameHighlight)
+		if contentHighlight != nil {
+			highlight := searchHighlight(*contentHighlight)
+			result.ContentHighlight = &highlight
+		}
+		key.ID = file.ID
+		results = append(results, result)
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	nextCursor := page.nextCursor(keys)
+	if len(results) > page.Limit {
+		results = results[:page.Limit]
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"items":       results,
+		"next_cursor": nextCursor,
+		"total":       total,
+	})
+}
+
+func RegisterSearchRoutes(app *fiber.App, db *pgxpool.Pool) {
+	searchGroup := app.Group("/search", middleware.AuthRequired(db))
+	read := middleware.RequireScope(db, middleware.ScopeReadFiles)
+
+	searchGroup.Get("/:organization_id", read, func(c *fiber.Ctx) error {
+		return SearchFiles(c, db)
+	})
+}
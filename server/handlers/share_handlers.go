@@ -0,0 +1,615 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"server/middleware"
+	"server/models"
+	"server/spaces"
+	"server/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// shareDownloadTTL is how long a presigned download link of a share stays valid
+const shareDownloadTTL = 5 * time.Minute
+
+const (
+	// sharePasswordAttempts is how many wrong passwords in a row lock a share link
+	sharePasswordAttempts = 5
+	// sharePasswordLockout is how long a locked share link refuses passwords
+	sharePasswordLockout = 15 * time.Minute
+)
+
+const shareLinkColumns = `
+	s.id, s.organization_id, s.file_id, s.folder_id, s.group_id, s.mode, s.password_hash IS NOT NULL, s.expires_at, s.max_downloads,
+	s.view_count, s.download_count, s.created_by, s.created_at, s.last_accessed_at, s.revoked_at
+`
+
+// sharedItem is what the public sees of a shared file or folder, storage paths are never exposed
+type sharedItem struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Size      int64     `json:"size,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func scanShareLink(row pgx.Row) (models.ShareLink, error) {
+	var link models.ShareLink
+	err := row.Scan(
+		&link.ID,
+		&link.OrganizationID,
+		&link.FileID,
+		&link.FolderID,
+		&link.GroupID,
+		&link.Mode,
+		&link.PasswordProtected,
+		&link.ExpiresAt,
+		&link.MaxDownloads,
+		&link.ViewCount,
+		&link.DownloadCount,
+		&link.CreatedBy,
+		&link.CreatedAt,
+		&link.LastAccessedAt,
+		&link.RevokedAt,
+	)
+	return link, err
+}
+
+// CreateShareLink creates a public link to a file or folder, the token is only returned once
+func CreateShareLink(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userID := c.Locals("user_id").(string)
+
+	var link models.ShareLink
+	if err := c.BodyParser(&link); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+
+	var organizationId string
+	var rank int
+	var err error
+	if fileId := c.Params("file_id"); fileId != "" {
+		link.FileID, link.FolderID = &fileId, nil
+		err = db.QueryRow(
+			context.Background(),
+			"SELECT organization_id, file_permission_rank($2, id) FROM files WHERE id = $1 AND deleted = false;",
+			fileId, userID,
+		).Scan(&organizationId, &rank)
+	} else {
+		folderId := c.Params("folder_id")
+		link.FileID, link.FolderID = nil, &folderId
+		err = db.QueryRow(
+			context.Background(),
+			"SELECT organization_id, folder_permission_rank($2, id) FROM folders WHERE id = $1 AND deleted = false;",
+			folderId, userID,
+		).Scan(&organizationId, &rank)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File or folder not found"})
+	} else if err != nil {
+		log.Println("Error fetching shared item: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching shared item", "message": err.Error()})
+	}
+
+	if rank < permissionEditor {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You need editor access to share this item"})
+	}
+
+	if link.Mode == "" {
+		link.Mode = "view"
+	}
+	if link.Mode != "view" && link.Mode != "download" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Mode must be view or download"})
+	}
+	if link.ExpiresAt != nil && link.ExpiresAt.Before(time.Now()) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Expiry must be in the future"})
+	}
+	if link.MaxDownloads != nil && *link.MaxDownloads <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Download limit must be positive"})
+	}
+	if link.GroupID != nil {
+		exists, err := groupExists(db, *link.GroupID, organizationId)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching group", "message": err.Error()})
+		}
+		if !exists {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Group not found in this organization"})
+		}
+	}
+
+	var passwordHash *string
+	if link.Password != "" {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(link.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error hashing password", "message": err.Error()})
+		}
+		hash := string(hashedPassword)
+		passwordHash = &hash
+	}
+
+	token, err := utils.GenerateSecureToken("")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error generating token"})
+	}
+
+	link.ID = uuid.New().String()
+	link.OrganizationID = organizationId
+	link.Password = ""
+	link.PasswordProtected = passwordHash != nil
+	link.CreatedBy = &userID
+	link.CreatedAt = time.Now()
+
+	query := `
+		INSERT INTO sharelinks
+		(id, token_hash, organization_id, file_id, folder_id, group_id, mode, password_hash, expires_at, max_downloads, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);
+	`
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(
+			context.Background(),
+			query,
+			link.ID, utils.HashToken(token), link.OrganizationID, link.FileID, link.FolderID, link.GroupID, link.Mode, passwordHash, link.ExpiresAt, link.MaxDownloads, userID, link.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "share.create", TargetType: "share_link", TargetID: link.ID, After: &link}, nil
+	})
+	if err != nil {
+		log.Println("Error creating share link: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating share link", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Share link created, it won't be shown again",
+		"link":    link,
+		"token":   token,
+		"url":     os.Getenv("CLIENT_URL") + "/share/" + token,
+	})
+}
+
+// GetShareLinks lists the share links of an organization
+func GetShareLinks(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	role, err := getOrganizationRole(db, userID, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking membership", "message": err.Error()})
+	}
+	if role == "" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You are not a member of this organization"})
+	}
+
+	// Links to items the user can't open are left out
+	query := `SELECT ` + shareLinkColumns + `
+		FROM sharelinks s
+		LEFT JOIN files fi ON fi.id = s.file_id
+		WHERE s.organization_id = $1 AND s.revoked_at IS NULL
+		AND (s.folder_id IS NULL OR ` + folderRankCondition("s.folder_id", "$2", "$1", "NULL", "NULL", permissionViewer) + `)
+		AND (s.file_id IS NULL OR ` + fileRankCondition("fi.folder_id", "$2", "$1", permissionViewer) + `)
+		ORDER BY s.created_at DESC;
+	`
+	rows, err := db.Query(context.Background(), query, organizationId, userID)
+	if err != nil {
+		log.Println("Error fetching share links: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching share links", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	links := []models.ShareLink{}
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		links = append(links, link)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	return sendList(c, links)
+}
+
+// RevokeShareLink revokes a share link, allowed for its creator and organization admins
+func RevokeShareLink(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	shareId := c.Params("share_id")
+	userID := c.Locals("user_id").(string)
+
+	isAdmin, err := isOrganizationAdmin(db, userID, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		commandTag, err := tx.Exec(
+			context.Background(),
+			"UPDATE sharelinks SET revoked_at = NOW() WHERE id = $1 AND organization_id = $2 AND revoked_at IS NULL AND ($3 OR created_by = $4);",
+			shareId, organizationId, isAdmin, userID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if commandTag.RowsAffected() == 0 {
+			return nil, pgx.ErrNoRows
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "share.revoke", TargetType: "share_link", TargetID: shareId}, nil
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Share link not found"})
+	}
+	if err != nil {
+		log.Println("Error revoking share link: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error revoking share link", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Share link revoked!"})
+}
+
+// resolveShareLink finds the active share link of the token in the URL and checks its password,
+// given in the X-Share-Password header. Links shared with a group are only open to its signed in
+// members. When ok is false the error response has been sent
+func resolveShareLink(c *fiber.Ctx, db *pgxpool.Pool) (models.ShareLink, bool, error) {
+	var passwordHash *string
+	var lockedUntil *time.Time
+	query := `SELECT ` + shareLinkColumns + `, s.password_hash, s.password_locked_until
+		FROM sharelinks s
+		JOIN organizations o ON o.organization_id = s.organization_id
+		LEFT JOIN files f ON f.id = s.file_id
+		LEFT JOIN folders d ON d.id = s.folder_id
+		WHERE s.token_hash = $1 AND s.revoked_at IS NULL AND (s.expires_at IS NULL OR s.expires_at > NOW())
+		AND o.deleted_at IS NULL AND COALESCE(f.deleted, d.deleted) = false;
+	`
+	row := db.QueryRow(context.Background(), query, utils.HashToken(c.Params("token")))
+
+	var link models.ShareLink
+	err := row.Scan(
+		&link.ID,
+		&link.OrganizationID,
+		&link.FileID,
+		&link.FolderID,
+		&link.GroupID,
+		&link.Mode,
+		&link.PasswordProtected,
+		&link.ExpiresAt,
+		&link.MaxDownloads,
+		&link.ViewCount,
+		&link.DownloadCount,
+		&link.CreatedBy,
+		&link.CreatedAt,
+		&link.LastAccessedAt,
+		&link.RevokedAt,
+		&passwordHash,
+		&lockedUntil,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return link, false, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Invalid or expired share link"})
+	} else if err != nil {
+		log.Println("Error fetching share link: ", err)
+		return link, false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching share link", "message": err.Error()})
+	}
+
+	if link.GroupID != nil {
+		userID, _ := c.Locals("user_id").(string)
+		if userID == "" {
+			return link, false, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Sign in to open this link", "login_required": true})
+		}
+
+		isMember, err := isGroupMember(db, *link.GroupID, userID)
+		if err != nil {
+			return link, false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking membership", "message": err.Error()})
+		}
+		if !isMember {
+			return link, false, c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "This link is shared with a group you are not part of"})
+		}
+	}
+
+	if passwordHash != nil {
+		password := c.Get("X-Share-Password")
+		if password == "" {
+			return link, false, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Password required", "password_required": true})
+		}
+		if lockedUntil != nil && lockedUntil.After(time.Now()) {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(time.Until(*lockedUntil).Seconds())+1))
+			return link, false, c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Too many wrong passwords, try again later", "password_required": true})
+		}
+		if bcrypt.CompareHashAndPassword([]byte(*passwordHash), []byte(password)) != nil {
+			// Every sharePasswordAttempts wrong passwords in a row lock the link for sharePasswordLockout
+			_, err := db.Exec(
+				context.Background(),
+				`
+					UPDATE sharelinks SET password_failures = password_failures + 1,
+					password_locked_until = CASE
+						WHEN (password_failures + 1) % $2 = 0 THEN NOW() + $3 * INTERVAL '1 second'
+						ELSE password_locked_until
+					END
+					WHERE id = $1;
+				`,
+				link.ID, sharePasswordAttempts, sharePasswordLockout.Seconds(),
+			)
+			if err != nil {
+				log.Println("Error recording wrong share password: ", err)
+			}
+			return link, false, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid password", "password_required": true})
+		}
+
+		_, err := db.Exec(
+			context.Background(),
+			"UPDATE sharelinks SET password_failures = 0 WHERE id = $1 AND password_failures > 0;",
+			link.ID,
+		)
+		if err != nil {
+			log.Println("Error resetting share password failures: ", err)
+		}
+	}
+
+	return link, true, nil
+}
+
+// sharedFolderContains reports whether a folder is the shared folder of a link or one of its subfolders the
+// creator of the link could share. Subfolders that don't inherit the permissions of the shared folder are only
+// served while the creator has editor access to them, as sharing them directly needs
+func sharedFolderContains(db *pgxpool.Pool, link models.ShareLink, folderID string) (bool, error) {
+	var contains bool
+	err := db.QueryRow(
+		context.Background(),
+		`
+			WITH RECURSIVE tree AS (
+				SELECT id FROM folders WHERE id = $1 AND deleted = false
+				UNION ALL
+				SELECT f.id FROM folders f JOIN tree t ON f.parent_folder_id = t.id WHERE f.deleted = false
+			)
+			SELECT EXISTS (
+				SELECT 1 FROM tree WHERE id = $2 AND `+folderRankCondition("id", "$3", "$4", "$1", "NULL", permissionEditor)+`
+			);
+		`,
+		*link.FolderID, folderID, link.CreatedBy, link.OrganizationID,
+	).Scan(&contains)
+	return contains, err
+}
+
+// GetSharedItem returns what a share link points to, for a folder it also lists the content of the
+// shared folder or of the subfolder given in the folder_id query parameter
+func GetSharedItem(c *fiber.Ctx, db *pgxpool.Pool) error {
+	link, ok, err := resolveShareLink(c, db)
+	if !ok {
+		return err
+	}
+
+	_, err = db.Exec(
+		context.Background(),
+		"UPDATE sharelinks SET view_count = view_count + 1, last_accessed_at = NOW() WHERE id = $1;",
+		link.ID,
+	)
+	if err != nil {
+		log.Println("Error recording share link view: ", err)
+	}
+
+	response := fiber.Map{
+		"mode":       link.Mode,
+		"expires_at": link.ExpiresAt,
+	}
+	if link.MaxDownloads != nil {
+		response["downloads_remaining"] = *link.MaxDownloads - link.DownloadCount
+	}
+
+	if link.FileID != nil {
+		var item sharedItem
+		err := db.QueryRow(
+			context.Background(),
+			"SELECT id, name, COALESCE(file_size, 0), updated_at FROM files WHERE id = $1;",
+			*link.FileID,
+		).Scan(&item.ID, &item.Name, &item.Size, &item.UpdatedAt)
+		if err != nil {
+			log.Println("Error fetching shared file: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching shared file", "message": err.Error()})
+		}
+		item.Type = "file"
+		response["item"] = item
+		return c.Status(fiber.StatusOK).JSON(response)
+	}
+
+	folderId := c.Query("folder_id", *link.FolderID)
+	contains, err := sharedFolderContains(db, link, folderId)
+	if err != nil {
+		log.Println("Error checking shared folder: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking shared folder", "message": err.Error()})
+	}
+	if !contains {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Folder not found"})
+	}
+
+	var folder sharedItem
+	err = db.QueryRow(context.Background(), "SELECT id, name, updated_at FROM folders WHERE id = $1;", folderId).Scan(&folder.ID, &folder.Name, &folder.UpdatedAt)
+	if err != nil {
+		log.Println("Error fetching shared folder: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching shared folder", "message": err.Error()})
+	}
+	folder.Type = "folder"
+
+	query := `
+		SELECT id, name, 'folder', 0, updated_at FROM folders
+		WHERE parent_folder_id = $1 AND deleted = false AND ` + folderRankCondition("id", "$2", "$3", "$1", "1", permissionEditor) + `
+		UNION ALL
+		SELECT id, name, 'file', COALESCE(file_size, 0), updated_at FROM files WHERE folder_id = $1 AND deleted = false
+		ORDER BY 3 DESC, 2;
+	`
+	rows, err := db.Query(context.Background(), query, folderId, link.CreatedBy, link.OrganizationID)
+	if err != nil {
+		log.Println("Error fetching shared folder content: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching shared folder content", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	items := []sharedItem{}
+	for rows.Next() {
+		var item sharedItem
+		if err := rows.Scan(&item.ID, &item.Name, &item.Type, &item.Size, &item.UpdatedAt); err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	response["item"] = folder
+	response["items"] = items
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// GetSharedFile serves a shared file, or a file inside a shared folder given by the file_id query
+// parameter. View-only links stream the content inline when its type is safe to show, download links redirect
+// to a short-lived presigned URL and count against the download limit
+func GetSharedFile(c *fiber.Ctx, db *pgxpool.Pool) error {
+	link, ok, err := resolveShareLink(c, db)
+	if !ok {
+		return err
+	}
+
+	var file models.File
+	if link.FileID != nil {
+		file.ID = *link.FileID
+	} else {
+		file.ID = c.Query("file_id")
+		if file.ID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "file_id missing"})
+		}
+	}
+
+	err = db.QueryRow(
+		context.Background(),
+		"SELECT name, folder_id, file_path, COALESCE(file_size, 0) FROM files WHERE id = $1 AND organization_id = $2 AND deleted = false;",
+		file.ID, link.OrganizationID,
+	).Scan(&file.Name, &file.FolderID, &file.FilePath, &file.FileSize)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+	} else if err != nil {
+		log.Println("Error fetching shared file: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching shared file", "message": err.Error()})
+	}
+
+	if link.FolderID != nil {
+		contains := false
+		if file.FolderID != nil {
+			contains, err = sharedFolderContains(db, link, *file.FolderID)
+		}
+		if err != nil {
+			log.Println("Error checking shared folder: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking shared folder", "message": err.Error()})
+		}
+		if !contains {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+		}
+	}
+
+	if link.Mode == "view" {
+		object, err := openStoredFile(db, file.FilePath)
+		if err != nil {
+			log.Println("Error fetching file from Spaces: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching file"})
+		}
+
+		_, err = db.Exec(context.Background(), "UPDATE sharelinks SET view_count = view_count + 1, last_accessed_at = NOW() WHERE id = $1;", link.ID)
+		if err != nil {
+			log.Println("Error recording share link view: ", err)
+		}
+
+		return sendStoredFile(c, object, file.Name, "inline")
+	}
+
+	// Encrypted files can't be downloaded from Spaces directly, they are streamed decrypted instead
+	keyID, _, err := storedEncryptionKey(db, file.FilePath)
+	if err != nil {
+		log.Println("Error fetching shared file: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching shared file", "message": err.Error()})
+	}
+
+	// The download is only counted if the limit hasn't been reached
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		commandTag, err := tx.Exec(
+			context.Background(),
+			`
+				UPDATE sharelinks SET download_count = download_count + 1, last_accessed_at = NOW()
+				WHERE id = $1 AND (max_downloads IS NULL OR download_count < max_downloads);
+			`,
+			link.ID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if commandTag.RowsAffected() == 0 {
+			return nil, pgx.ErrNoRows
+		}
+		return &auditEvent{OrganizationID: link.OrganizationID, Action: "share.download", TargetType: "file", TargetID: file.ID, After: fiber.Map{"share_link_id": link.ID}}, nil
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{"error": "Download limit reached"})
+	} else if err != nil {
+		log.Println("Error recording share link download: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error downloading file", "message": err.Error()})
+	}
+
+	if keyID != nil {
+		object, err := openStoredFile(db, file.FilePath)
+		if err != nil {
+			log.Println("Error fetching file from Spaces: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching file"})
+		}
+
+		return sendStoredFile(c, object, file.Name, "attachment")
+	}
+
+	url, err := spaces.PresignDownload(file.FilePath, file.Name, shareDownloadTTL)
+	if err != nil {
+		log.Println("Error creating download link: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating download link", "message": err.Error()})
+	}
+
+	return c.Redirect(url, fiber.StatusFound)
+}
+
+func RegisterShareRoutes(app *fiber.App, db *pgxpool.Pool) {
+	shareGroup := app.Group("/share")
+	auth := middleware.AuthRequired(db)
+	write := middleware.RequireScope(db, middleware.ScopeWriteFiles)
+	read := middleware.RequireScope(db, middleware.ScopeReadFiles)
+
+	shareGroup.Post("/create/file/:file_id", auth, write, func(c *fiber.Ctx) error {
+		return CreateShareLink(c, db)
+	})
+	shareGroup.Post("/create/folder/:folder_id", auth, write, func(c *fiber.Ctx) error {
+		return CreateShareLink(c, db)
+	})
+	shareGroup.Get("/fetch/all/:organization_id", auth, read, func(c *fiber.Ctx) error {
+		return GetShareLinks(c, db)
+	})
+	shareGroup.Delete("/revoke/:organization_id/:share_id", auth, write, func(c *fiber.Ctx) error {
+		return RevokeShareLink(c, db)
+	})
+
+	// Public routes, the token in the URL is the credential. Links shared with a group also need a signed in member
+	shareGroup.Get("/public/:token", middleware.OptionalAuth(db), func(c *fiber.Ctx) error {
+		return GetSharedItem(c, db)
+	})
+	shareGroup.Get("/public/:token/file", middleware.OptionalAuth(db), func(c *fiber.Ctx) error {
+		return GetSharedFile(c, db)
+	})
+}
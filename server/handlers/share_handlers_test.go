@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"server/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func TestSendStoredFileDisposition(t *testing.T) {
+	tests := []struct {
+		contentType string
+		disposition string
+	}{
+		{"image/png", "inline"},
+		{"application/pdf", "inline"},
+		{"text/plain; charset=utf-8", "inline"},
+		{"text/html", "attachment"},
+		{"image/svg+xml", "attachment"},
+		{"application/xhtml+xml", "attachment"},
+		{"", "attachment"},
+		{"not a type", "attachment"},
+	}
+	for _, test := range tests {
+		app := fiber.New()
+		app.Get("/", func(c *fiber.Ctx) error {
+			object := &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("content")), ContentLength: aws.Int64(7)}
+			if test.contentType != "" {
+				object.ContentType = aws.String(test.contentType)
+			}
+			return sendStoredFile(c, object, "file", "inline")
+		})
+
+		resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if disposition := resp.Header.Get(fiber.HeaderContentDisposition); !strings.HasPrefix(disposition, test.disposition+";") {
+			t.Errorf("%q: Content-Disposition %q, expected %s", test.contentType, disposition, test.disposition)
+		}
+		if resp.Header.Get(fiber.HeaderXContentTypeOptions) != "nosniff" {
+			t.Errorf("%q: missing X-Content-Type-Options", test.contentType)
+		}
+		if resp.Header.Get(fiber.HeaderContentSecurityPolicy) != "sandbox" {
+			t.Errorf("%q: missing Content-Security-Policy", test.contentType)
+		}
+	}
+}
+
+func TestSharedFolderHidesRestrictedSubfolders(t *testing.T) {
+	db := testDB(t)
+
+	creatorID := testUser(t, db, "creator@example.com")
+	memberID := testUser(t, db, "member@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+	if err := addUserToOrganization(db, memberID, organizationID, "member"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The member shares root
+	// root
+	// ├── restricted, doesn't inherit, the member is a viewer
+	// │   └── managed, the member is a manager
+	// └── open
+	root := testFolder(t, db, organizationID, "", true)
+	restricted := testFolder(t, db, organizationID, root, false)
+	managed := testFolder(t, db, organizationID, restricted, true)
+	open := testFolder(t, db, organizationID, root, true)
+	hidden := testNamedFile(t, db, organizationID, &restricted, "hidden.txt", time.Now())
+	for folderID, role := range map[string]string{restricted: "viewer", managed: "manager"} {
+		_, err := db.Exec(
+			context.Background(),
+			"INSERT INTO folderpermissions (id, folder_id, organization_id, user_id, role) VALUES ($1, $2, $3, $4, $5);",
+			uuid.New().String(), folderID, organizationID, memberID, role,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := db.Exec(
+		context.Background(),
+		"INSERT INTO sharelinks (id, token_hash, organization_id, folder_id, created_by) VALUES ($1, $2, $3, $4, $5);",
+		uuid.New().String(), utils.HashToken("token"), organizationID, root, memberID,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Get("/:token", func(c *fiber.Ctx) error {
+		return GetSharedItem(c, db)
+	})
+	app.Get("/:token/file", func(c *fiber.Ctx) error {
+		return GetSharedFile(c, db)
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/token", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Items []sharedItem `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Items) != 1 || body.Items[0].ID != open {
+		t.Errorf("shared folder lists %v, want only the open subfolder", body.Items)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"restricted subfolder", "/token?folder_id=" + restricted, fiber.StatusNotFound},
+		{"file of the restricted subfolder", "/token/file?file_id=" + hidden, fiber.StatusNotFound},
+		{"subfolder the creator manages", "/token?folder_id=" + managed, fiber.StatusOK},
+		{"open subfolder", "/token?folder_id=" + open, fiber.StatusOK},
+	}
+	for _, test := range tests {
+		resp, err := app.Test(httptest.NewRequest("GET", test.target, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: %d, want %d", test.name, resp.StatusCode, test.status)
+		}
+	}
+}
@@ -0,0 +1,806 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"server/middleware"
+	"server/models"
+	"server/oidc"
+	"server/otp"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const ssoStateTTL = 10 * time.Minute
+
+// ssoVerificationRecord is the name, under a domain, of the TXT record proving an organization owns it
+const ssoVerificationRecord = "_silo-verification"
+
+var ssoDomainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// lookupTXT resolves the TXT records of a name
+var lookupTXT = net.DefaultResolver.LookupTXT
+
+var errSSOAccountNotLinked = errors.New("no account is linked to this identity")
+var errSSOIdentityTaken = errors.New("identity is linked to another account")
+
+// ssoState is stored in redis between the login redirect and the callback. LinkUserID is the signed in user
+// the identity is linked to, when the flow was started to link one
+type ssoState struct {
+	OrganizationID string `json:"organization_id"`
+	Verifier       string `json:"verifier"`
+	Nonce          string `json:"nonce"`
+	LinkUserID     string `json:"link_user_id,omitempty"`
+}
+
+func ssoRedirectURL() string {
+	return os.Getenv("SSO_REDIRECT_URL")
+}
+
+// requireSSOAdmin only lets organization admins through to the SSO settings of the organization in the
+// organization_id parameter
+func requireSSOAdmin(db *pgxpool.Pool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		isAdmin, err := isOrganizationAdmin(db, c.Locals("user_id").(string), c.Params("organization_id"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+		}
+		if !isAdmin {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can configure SSO"})
+		}
+
+		return c.Next()
+	}
+}
+
+// getSSOConfig fetches the identity provider configuration of an organization
+func getSSOConfig(db *pgxpool.Pool, organizationID string) (models.OrganizationSSO, error) {
+	var config models.OrganizationSSO
+	query := `
+		SELECT organization_id, issuer, client_id, client_secret, email_domains, default_role, enforce_sso, created_at, updated_at
+		FROM organizationsso
+		WHERE organization_id = $1;
+	`
+
+	err := db.QueryRow(context.Background(), query, organizationID).Scan(
+		&config.OrganizationID,
+		&config.Issuer,
+		&config.ClientID,
+		&config.ClientSecret,
+		&config.EmailDomains,
+		&config.DefaultRole,
+		&config.EnforceSSO,
+		&config.CreatedAt,
+		&config.UpdatedAt,
+	)
+
+	return config, err
+}
+
+// isSSOEnforced reports whether an organization that forbids password login owns the account of the user,
+// because it provisioned the account or verified the domain of its email. Members an organization doesn't own
+// keep their password for their other organizations
+func isSSOEnforced(db *pgxpool.Pool, userID string) (bool, error) {
+	var enforced bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM userorganizations uo
+			JOIN organizationsso sso ON sso.organization_id = uo.organization_id
+			JOIN users u ON u.user_id = uo.user_id
+			WHERE uo.user_id = $1 AND sso.enforce_sso = true
+			AND (
+				u.scim_organization_id = uo.organization_id
+				OR EXISTS (
+					SELECT 1 FROM ssodomains d
+					WHERE d.organization_id = uo.organization_id AND d.verified_at IS NOT NULL
+					AND d.domain = LOWER(SPLIT_PART(u.email, '@', 2))
+				)
+			)
+		);
+	`
+
+	err := db.QueryRow(context.Background(), query, userID).Scan(&enforced)
+	return enforced, err
+}
+
+// ConfigureSSO creates or updates the identity provider of an organization
+func ConfigureSSO(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	isAdmin, err := isOrganizationAdmin(db, userID, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if !isAdmin {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can configure SSO"})
+	}
+
+	var config models.OrganizationSSO
+	if err := c.BodyParser(&config); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+
+	if config.Issuer == "" || config.ClientID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing fields"})
+	}
+
+	if config.DefaultRole == "" {
+		config.DefaultRole = "member"
+	}
+	if config.DefaultRole != "member" && config.DefaultRole != "admin" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Default role must be member or admin"})
+	}
+
+	for i, domain := range config.EmailDomains {
+		config.EmailDomains[i] = normalizeSSODomain(domain)
+		if !ssoDomainPattern.MatchString(config.EmailDomains[i]) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid email domain " + domain})
+		}
+	}
+	if config.EmailDomains == nil {
+		config.EmailDomains = []string{}
+	}
+
+	// Make sure the issuer is reachable before saving it
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := oidc.Discover(ctx, config.Issuer); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid issuer", "message": err.Error()})
+	}
+
+	query := `
+		INSERT INTO organizationsso
+		(organization_id, issuer, client_id, client_secret, email_domains, default_role, enforce_sso, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+		ON CONFLICT (organization_id) DO UPDATE SET
+			issuer = EXCLUDED.issuer,
+			client_id = EXCLUDED.client_id,
+			client_secret = COALESCE(NULLIF(EXCLUDED.client_secret, ''), organizationsso.client_secret),
+			email_domains = EXCLUDED.email_domains,
+			default_role = EXCLUDED.default_role,
+			enforce_sso = EXCLUDED.enforce_sso,
+			updated_at = EXCLUDED.updated_at;
+	`
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error configuring SSO", "message": err.Error()})
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(
+		context.Background(),
+		query,
+		organizationId, config.Issuer, config.ClientID, config.ClientSecret, config.EmailDomains, config.DefaultRole, config.EnforceSSO, time.Now(),
+	)
+	if err != nil {
+		log.Println("Error configuring SSO: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error configuring SSO", "message": err.Error()})
+	}
+
+	if err := syncSSODomains(tx, organizationId, config.EmailDomains); err != nil {
+		log.Println("Error saving SSO domains: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error configuring SSO", "message": err.Error()})
+	}
+
+	// The client secret is never written to the audit log
+	config.ClientSecret = ""
+	if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "sso.configure", TargetType: "organization", TargetID: organizationId, After: &config}); err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error configuring SSO", "message": err.Error()})
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error configuring SSO", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "SSO configured successfully!", "domains": config.EmailDomains})
+}
+
+// normalizeSSODomain lowercases a domain and strips the @ it may be written with
+func normalizeSSODomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(domain), "@"), "."))
+}
+
+// syncSSODomains makes the domains of an organization the given ones, new domains get a verification token and
+// wait for verification, domains already listed keep theirs
+func syncSSODomains(tx pgx.Tx, organizationID string, domains []string) error {
+	_, err := tx.Exec(
+		context.Background(),
+		"DELETE FROM ssodomains WHERE organization_id = $1 AND NOT (domain = ANY($2));",
+		organizationID, domains,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, domain := range domains {
+		token, err := oidc.RandomString()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			context.Background(),
+			`
+				INSERT INTO ssodomains (organization_id, domain, verification_token, created_at)
+				VALUES ($1, $2, $3, NOW())
+				ON CONFLICT (organization_id, domain) DO NOTHING;
+			`,
+			organizationID, domain, token,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ssoVerificationValue is the value of the TXT record proving an organization owns a domain
+func ssoVerificationValue(token string) string {
+	return "silo-verification=" + token
+}
+
+// hasSSOVerificationRecord reports whether the TXT records of a domain hold its verification token
+func hasSSOVerificationRecord(ctx context.Context, domain string, token string) (bool, error) {
+	records, err := lookupTXT(ctx, ssoVerificationRecord+"."+domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	for _, record := range records {
+		if strings.TrimSpace(record) == ssoVerificationValue(token) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetSSODomains lists the email domains of an organization with the TXT record verifying each one
+func GetSSODomains(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+
+	rows, err := db.Query(
+		context.Background(),
+		"SELECT domain, verification_token, verified_at, created_at FROM ssodomains WHERE organization_id = $1 ORDER BY domain;",
+		organizationId,
+	)
+	if err != nil {
+		log.Println("Error fetching SSO domains: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching SSO domains", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	domains := []models.SSODomain{}
+	for rows.Next() {
+		var domain models.SSODomain
+		var token string
+		if err := rows.Scan(&domain.Domain, &token, &domain.VerifiedAt, &domain.CreatedAt); err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		domain.RecordName = ssoVerificationRecord + "." + domain.Domain
+		domain.RecordValue = ssoVerificationValue(token)
+		domains = append(domains, domain)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	return sendList(c, domains)
+}
+
+// VerifySSODomain checks the TXT record of a domain of an organization and marks the domain verified, a domain
+// can only be verified by one organization
+func VerifySSODomain(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	domain := normalizeSSODomain(c.Params("domain"))
+
+	var token string
+	var verifiedAt *time.Time
+	err := db.QueryRow(
+		context.Background(),
+		"SELECT verification_token, verified_at FROM ssodomains WHERE organization_id = $1 AND domain = $2;",
+		organizationId, domain,
+	).Scan(&token, &verifiedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Domain not found"})
+	} else if err != nil {
+		log.Println("Error fetching SSO domain: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching SSO domain", "message": err.Error()})
+	}
+	if verifiedAt != nil {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Domain already verified", "verified_at": verifiedAt})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	found, err := hasSSOVerificationRecord(ctx, domain, token)
+	if err != nil {
+		log.Println("Error looking up verification record: ", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Error looking up verification record", "message": err.Error()})
+	}
+	if !found {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":        "Verification record not found",
+			"record_name":  ssoVerificationRecord + "." + domain,
+			"record_value": ssoVerificationValue(token),
+		})
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(
+			context.Background(),
+			"UPDATE ssodomains SET verified_at = NOW() WHERE organization_id = $1 AND domain = $2;",
+			organizationId, domain,
+		); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "sso.domain_verify", TargetType: "domain", TargetID: domain}, nil
+	})
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Domain is already verified by another organization"})
+	} else if err != nil {
+		log.Println("Error verifying SSO domain: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error verifying SSO domain", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Domain verified!"})
+}
+
+// GetSSOConfig returns the identity provider of an organization without its client secret
+func GetSSOConfig(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	isAdmin, err := isOrganizationAdmin(db, userID, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if !isAdmin {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can view SSO settings"})
+	}
+
+	config, err := getSSOConfig(db, organizationId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "SSO not configured"})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching SSO settings", "message": err.Error()})
+	}
+
+	config.ClientSecret = ""
+
+	return c.Status(fiber.StatusOK).JSON(config)
+}
+
+// DeleteSSOConfig removes the identity provider of an organization
+func DeleteSSOConfig(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	isAdmin, err := isOrganizationAdmin(db, userID, organizationId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+	}
+	if !isAdmin {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can configure SSO"})
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(context.Background(), "DELETE FROM organizationsso WHERE organization_id = $1;", organizationId); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "sso.delete", TargetType: "organization", TargetID: organizationId}, nil
+	})
+	if err != nil {
+		log.Println("Error deleting SSO settings: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting SSO settings", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "SSO settings deleted!"})
+}
+
+// DiscoverSSO routes an email address to the organization that verified its domain, used by the login page
+// to decide between password and SSO login
+func DiscoverSSO(c *fiber.Ctx, db *pgxpool.Pool) error {
+	email := strings.ToLower(c.Query("email"))
+
+	at := strings.LastIndex(email, "@")
+	if at == -1 || at == len(email)-1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid email"})
+	}
+	domain := email[at+1:]
+
+	var organizationID string
+	var enforced bool
+	err := db.QueryRow(
+		context.Background(),
+		`
+			SELECT sso.organization_id, sso.enforce_sso FROM ssodomains d
+			JOIN organizationsso sso ON sso.organization_id = d.organization_id
+			WHERE d.domain = $1 AND d.verified_at IS NOT NULL;
+		`,
+		domain,
+	).Scan(&organizationID, &enforced)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"sso": false})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error looking up SSO settings", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"sso":             true,
+		"organization_id": organizationID,
+		"enforced":        enforced,
+		"login_url":       "/auth/sso/login/" + organizationID,
+	})
+}
+
+// SSOLogin redirects the user to the identity provider of an organization
+func SSOLogin(c *fiber.Ctx, db *pgxpool.Pool) error {
+	return startSSOFlow(c, db, c.Params("organization_id"), "")
+}
+
+// LinkSSOIdentity redirects the signed in user to the identity provider of an organization, the identity they
+// sign in with there is linked to their account so they can use SSO to log in
+func LinkSSOIdentity(c *fiber.Ctx, db *pgxpool.Pool) error {
+	return startSSOFlow(c, db, c.Params("organization_id"), c.Locals("user_id").(string))
+}
+
+// startSSOFlow redirects to the identity provider of an organization, linking the identity to linkUserID when set
+func startSSOFlow(c *fiber.Ctx, db *pgxpool.Pool, organizationId string, linkUserID string) error {
+	config, err := getSSOConfig(db, organizationId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "SSO not configured"})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching SSO settings", "message": err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	provider, err := oidc.Discover(ctx, config.Issuer)
+	if err != nil {
+		log.Println("Error discovering identity provider: ", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Identity provider unavailable"})
+	}
+
+	state, err := oidc.RandomString()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error generating state"})
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error generating nonce"})
+	}
+	verifier, err := oidc.RandomString()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error generating verifier"})
+	}
+
+	stored, _ := json.Marshal(ssoState{OrganizationID: organizationId, Verifier: verifier, Nonce: nonce, LinkUserID: linkUserID})
+	if err := otp.StoreToken("sso_state_"+state, string(stored), ssoStateTTL); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error storing SSO state"})
+	}
+
+	return c.Redirect(provider.AuthCodeURL(config.ClientID, ssoRedirectURL(), state, nonce, verifier), fiber.StatusFound)
+}
+
+// ssoAccount is what is known about the accounts an ID token could sign in to
+type ssoAccount struct {
+	// LinkedUserID is the user the issuer and subject of the token are linked to
+	LinkedUserID string
+	// EmailUserID is the user with the email of the token
+	EmailUserID string
+	// DomainVerified is whether the organization verified the domain of the email
+	DomainVerified bool
+}
+
+// login decides which user an ID token signs in as and whether its identity gets linked to them. Linked
+// identities sign in to their user. Other identities are linked to the user with their email when the
+// organization verified the email domain, and new emails of a verified domain get a new user, returned as an
+// empty id. Any other identity could be asserted by an identity provider for an email it doesn't own, so it is
+// refused, its user links it with LinkSSOIdentity while signed in
+func (account ssoAccount) login() (string, bool, error) {
+	switch {
+	case account.LinkedUserID != "":
+		return account.LinkedUserID, false, nil
+	case account.EmailUserID != "" && account.DomainVerified:
+		return account.EmailUserID, true, nil
+	case account.EmailUserID == "" && account.DomainVerified:
+		return "", true, nil
+	}
+	return "", false, errSSOAccountNotLinked
+}
+
+// emailDomain returns the domain of an email address, empty when it has none
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at == -1 {
+		return ""
+	}
+	return email[at+1:]
+}
+
+// provisionSSOUser finds or creates the user of a verified ID token as decided by ssoAccount.login. Users of a
+// domain the organization verified are added to it with the default role
+func provisionSSOUser(db *pgxpool.Pool, config models.OrganizationSSO, claims *oidc.Claims) (models.User, error) {
+	var user models.User
+	email := strings.ToLower(claims.Email)
+
+	var account ssoAccount
+	err := db.QueryRow(
+		context.Background(),
+		`
+			SELECT
+			COALESCE((SELECT user_id::text FROM ssoidentities WHERE issuer = $1 AND subject = $2), ''),
+			COALESCE((SELECT user_id::text FROM users WHERE LOWER(email) = $3 ORDER BY created_at LIMIT 1), ''),
+			EXISTS (SELECT 1 FROM ssodomains WHERE organization_id = $4 AND domain = $5 AND verified_at IS NOT NULL);
+		`,
+		claims.Issuer, claims.Subject, email, config.OrganizationID, emailDomain(email),
+	).Scan(&account.LinkedUserID, &account.EmailUserID, &account.DomainVerified)
+	if err != nil {
+		return user, err
+	}
+
+	userID, link, err := account.login()
+	if err != nil {
+		return user, err
+	}
+
+	if userID == "" {
+		// SSO users never log in with a password, so they get a random one
+		randomPassword, err := oidc.RandomString()
+		if err != nil {
+			return user, err
+		}
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomPassword), bcrypt.DefaultCost)
+		if err != nil {
+			return user, err
+		}
+
+		user = models.User{
+			UserID:    uuid.New().String(),
+			FirstName: claims.GivenName,
+			LastName:  claims.FamilyName,
+			Email:     email,
+		}
+
+		_, err = db.Exec(
+			context.Background(),
+			`
+				INSERT INTO
+				users (user_id, first_name, last_name, email, password, email_verified, created_at)
+				VALUES ($1, $2, $3, $4, $5, true, $6)
+			`,
+			user.UserID, user.FirstName, user.LastName, user.Email, string(hashedPassword), time.Now(),
+		)
+		if err != nil {
+			return user, err
+		}
+	} else {
+		err := db.QueryRow(
+			context.Background(),
+			"SELECT user_id, email, first_name, last_name FROM users WHERE user_id = $1;",
+			userID,
+		).Scan(&user.UserID, &user.Email, &user.FirstName, &user.LastName)
+		if err != nil {
+			return user, err
+		}
+	}
+
+	if link {
+		_, err = db.Exec(
+			context.Background(),
+			`
+				INSERT INTO ssoidentities (issuer, subject, user_id, organization_id, created_at)
+				VALUES ($1, $2, $3, $4, NOW())
+				ON CONFLICT (issuer, subject) DO NOTHING;
+			`,
+			claims.Issuer, claims.Subject, user.UserID, config.OrganizationID,
+		)
+		if err != nil {
+			return user, err
+		}
+	}
+
+	_, err = db.Exec(
+		context.Background(),
+		"UPDATE ssoidentities SET last_login_at = NOW() WHERE issuer = $1 AND subject = $2;",
+		claims.Issuer, claims.Subject,
+	)
+	if err != nil {
+		return user, err
+	}
+
+	if !account.DomainVerified {
+		return user, nil
+	}
+	return user, addUserToOrganization(db, user.UserID, config.OrganizationID, config.DefaultRole)
+}
+
+// linkSSOIdentity links the identity of a verified ID token to a user, unless it is linked to another user
+func linkSSOIdentity(db *pgxpool.Pool, config models.OrganizationSSO, claims *oidc.Claims, userID string) error {
+	_, err := db.Exec(
+		context.Background(),
+		`
+			INSERT INTO ssoidentities (issuer, subject, user_id, organization_id, created_at)
+			VALUES ($1, $2, $3, $4, NOW())
+			ON CONFLICT (issuer, subject) DO NOTHING;
+		`,
+		claims.Issuer, claims.Subject, userID, config.OrganizationID,
+	)
+	if err != nil {
+		return err
+	}
+
+	var linkedUserID string
+	err = db.QueryRow(
+		context.Background(),
+		"SELECT user_id FROM ssoidentities WHERE issuer = $1 AND subject = $2;",
+		claims.Issuer, claims.Subject,
+	).Scan(&linkedUserID)
+	if err != nil {
+		return err
+	}
+	if linkedUserID != userID {
+		return errSSOIdentityTaken
+	}
+	return nil
+}
+
+// SSOCallback completes the authorization code flow, provisions the user and starts a session
+func SSOCallback(c *fiber.Ctx, db *pgxpool.Pool) error {
+	if errorCode := c.Query("error"); errorCode != "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "SSO login failed", "message": errorCode})
+	}
+
+	code := c.Query("code")
+	stateParam := c.Query("state")
+	if code == "" || stateParam == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing code or state"})
+	}
+
+	storedState, err := otp.ConsumeToken("sso_state_" + stateParam)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired SSO state"})
+	}
+
+	var state ssoState
+	if err := json.Unmarshal([]byte(storedState), &state); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error reading SSO state"})
+	}
+
+	config, err := getSSOConfig(db, state.OrganizationID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching SSO settings", "message": err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	provider, err := oidc.Discover(ctx, config.Issuer)
+	if err != nil {
+		log.Println("Error discovering identity provider: ", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Identity provider unavailable"})
+	}
+
+	rawIDToken, err := provider.Exchange(ctx, config.ClientID, config.ClientSecret, ssoRedirectURL(), code, state.Verifier)
+	if err != nil {
+		log.Println("Error exchanging SSO code: ", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "SSO login failed", "message": err.Error()})
+	}
+
+	claims, err := provider.VerifyIDToken(ctx, rawIDToken, config.ClientID, state.Nonce)
+	if err != nil {
+		log.Println("Error verifying ID token: ", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "SSO login failed", "message": err.Error()})
+	}
+
+	if claims.Subject == "" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Identity provider did not return a subject"})
+	}
+	if claims.Email == "" || (claims.EmailVerified != nil && !*claims.EmailVerified) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Identity provider did not return a verified email"})
+	}
+
+	if len(config.EmailDomains) > 0 {
+		email := strings.ToLower(claims.Email)
+		allowed := false
+		for _, domain := range config.EmailDomains {
+			if strings.HasSuffix(email, "@"+domain) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Email domain not allowed for this organization"})
+		}
+	}
+
+	if state.LinkUserID != "" {
+		err := linkSSOIdentity(db, config, claims, state.LinkUserID)
+		if errors.Is(err, errSSOIdentityTaken) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "This identity is linked to another account"})
+		} else if err != nil {
+			log.Println("Error linking SSO identity: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error linking identity", "message": err.Error()})
+		}
+		return c.Redirect(os.Getenv("CLIENT_URL")+"/organization/"+config.OrganizationID, fiber.StatusFound)
+	}
+
+	user, err := provisionSSOUser(db, config, claims)
+	if errors.Is(err, errSSOAccountNotLinked) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "No account is linked to this identity, sign in with your password and link it, or ask an admin to verify your email domain",
+		})
+	} else if err != nil {
+		log.Println("Error provisioning SSO user: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error provisioning user", "message": err.Error()})
+	}
+
+	if _, err := startSession(c, db, user); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error starting session", "message": err.Error()})
+	}
+
+	return c.Redirect(os.Getenv("CLIENT_URL")+"/organization/"+config.OrganizationID, fiber.StatusFound)
+}
+
+func RegisterSSORoutes(app *fiber.App, db *pgxpool.Pool) {
+	ssoGroup := app.Group("/auth/sso")
+
+	ssoGroup.Get("/discover", func(c *fiber.Ctx) error {
+		return DiscoverSSO(c, db)
+	})
+	ssoGroup.Get("/login/:organization_id", func(c *fiber.Ctx) error {
+		return SSOLogin(c, db)
+	})
+	ssoGroup.Get("/callback", func(c *fiber.Ctx) error {
+		return SSOCallback(c, db)
+	})
+	ssoGroup.Get("/link/:organization_id", middleware.AuthRequired(db), middleware.SessionRequired(), func(c *fiber.Ctx) error {
+		return LinkSSOIdentity(c, db)
+	})
+
+	ssoConfigGroup := app.Group("/organization/sso")
+
+	ssoConfigGroup.Put("/:organization_id", middleware.AuthRequired(db), func(c *fiber.Ctx) error {
+		return ConfigureSSO(c, db)
+	})
+	ssoConfigGroup.Get("/:organization_id", middleware.AuthRequired(db), func(c *fiber.Ctx) error {
+		return GetSSOConfig(c, db)
+	})
+	ssoConfigGroup.Delete("/:organization_id", middleware.AuthRequired(db), func(c *fiber.Ctx) error {
+		return DeleteSSOConfig(c, db)
+	})
+	ssoConfigGroup.Get("/:organization_id/domains", middleware.AuthRequired(db), requireSSOAdmin(db), func(c *fiber.Ctx) error {
+		return GetSSODomains(c, db)
+	})
+	ssoConfigGroup.Post("/:organization_id/domains/:domain/verify", middleware.AuthRequired(db), requireSSOAdmin(db), func(c *fiber.Ctx) error {
+		return VerifySSODomain(c, db)
+	})
+}
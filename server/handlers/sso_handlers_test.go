@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestSSOAccountLogin(t *testing.T) {
+	tests := []struct {
+		name    string
+		account ssoAccount
+		userID  string
+		link    bool
+		err     error
+	}{
+		{"linked identity", ssoAccount{LinkedUserID: "linked", EmailUserID: "other"}, "linked", false, nil},
+		{"email of verified domain", ssoAccount{EmailUserID: "user", DomainVerified: true}, "user", true, nil},
+		{"new user of verified domain", ssoAccount{DomainVerified: true}, "", true, nil},
+		{"email of unverified domain", ssoAccount{EmailUserID: "user"}, "", false, errSSOAccountNotLinked},
+		{"new user of unverified domain", ssoAccount{}, "", false, errSSOAccountNotLinked},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			userID, link, err := test.account.login()
+			if userID != test.userID || link != test.link || !errors.Is(err, test.err) {
+				t.Errorf("login() = %q, %v, %v, expected %q, %v, %v", userID, link, err, test.userID, test.link, test.err)
+			}
+		})
+	}
+}
+
+func TestSSODomainPattern(t *testing.T) {
+	tests := map[string]bool{
+		"example.com":        true,
+		"mail.example.co.uk": true,
+		"xn--bcher-kva.de":   true,
+		"localhost":          false,
+		"-example.com":       false,
+		"example..com":       false,
+		"exa mple.com":       false,
+		"example.com/path":   false,
+	}
+	for domain, valid := range tests {
+		if ssoDomainPattern.MatchString(normalizeSSODomain(domain)) != valid {
+			t.Errorf("domain %q valid != %v", domain, valid)
+		}
+	}
+
+	if normalizeSSODomain(" @Example.COM. ") != "example.com" {
+		t.Errorf("normalizeSSODomain didn't normalize the domain")
+	}
+}
+
+func TestHasSSOVerificationRecord(t *testing.T) {
+	records := map[string][]string{
+		"_silo-verification.example.com": {"v=spf1 -all", "silo-verification=token"},
+		"_silo-verification.other.com":   {"silo-verification=other"},
+	}
+	resolve := lookupTXT
+	lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		if found, ok := records[name]; ok {
+			return found, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	defer func() { lookupTXT = resolve }()
+
+	tests := []struct {
+		domain string
+		found  bool
+	}{
+		{"example.com", true},
+		{"other.com", false},
+		{"missing.com", false},
+	}
+	for _, test := range tests {
+		found, err := hasSSOVerificationRecord(context.Background(), test.domain, "token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != test.found {
+			t.Errorf("hasSSOVerificationRecord(%s) = %v, expected %v", test.domain, found, test.found)
+		}
+	}
+}
+
+func TestEmailDomain(t *testing.T) {
+	if emailDomain("ada@example.com") != "example.com" || emailDomain("invalid") != "" {
+		t.Error("emailDomain returned the wrong domain")
+	}
+}
+
+func TestIsSSOEnforced(t *testing.T) {
+	db := testDB(t)
+
+	creatorID := testUser(t, db, "creator@elsewhere.com")
+	organizationID := testOrganization(t, db, creatorID)
+	statements := []string{
+		"INSERT INTO organizationsso (organization_id, issuer, client_id, enforce_sso) VALUES ($1, 'https://idp.example.com', 'client', true);",
+		"INSERT INTO ssodomains (organization_id, domain, verification_token, verified_at) VALUES ($1, 'example.com', 'token', NOW());",
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(context.Background(), statement, organizationID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Members on the verified domain or provisioned by the organization sign in with SSO, other members keep
+	// their password
+	domainID := testUser(t, db, "Member@Example.com")
+	provisionedID := testUser(t, db, "provisioned@elsewhere.com")
+	guestID := testUser(t, db, "guest@elsewhere.com")
+	outsiderID := testUser(t, db, "outsider@example.com")
+	for _, userID := range []string{domainID, provisionedID, guestID} {
+		if err := addUserToOrganization(db, userID, organizationID, "member"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(context.Background(), "UPDATE users SET scim_organization_id = $1 WHERE user_id = $2;", organizationID, provisionedID); err != nil {
+		t.Fatal(err)
+	}
+
+	for userID, want := range map[string]bool{domainID: true, provisionedID: true, guestID: false, creatorID: false, outsiderID: false} {
+		enforced, err := isSSOEnforced(db, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enforced != want {
+			t.Errorf("user %s has SSO enforced %v, want %v", userID, enforced, want)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"server/middleware"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// tagBatchLimit is the most tags, and the most files and folders, a single tagging request can hold
+const tagBatchLimit = 100
+
+// tagColorPattern matches the #rrggbb colors tags can have
+var tagColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+const tagColumns = `
+	t.id, t.organization_id, t.name, t.color,
+	(SELECT COUNT(*) FROM itemtags it WHERE it.tag_id = t.id), t.created_by, t.created_at
+`
+
+func scanTag(row pgx.Row) (models.Tag, error) {
+	var tag models.Tag
+	err := row.Scan(
+		&tag.ID,
+		&tag.OrganizationID,
+		&tag.Name,
+		&tag.Color,
+		&tag.ItemCount,
+		&tag.CreatedBy,
+		&tag.CreatedAt,
+	)
+	return tag, err
+}
+
+// tagItemsRequest is the body of requests adding or removing tags on files and folders
+type tagItemsRequest struct {
+	TagIDs    []string `json:"tag_ids"`
+	FileIDs   []string `json:"file_ids"`
+	FolderIDs []string `json:"folder_ids"`
+}
+
+// requireLabelAdmin rejects users who aren't admins of the organization in the URL from managing its tags and
+// metadata fields
+func requireLabelAdmin(db *pgxpool.Pool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		isAdmin, err := isOrganizationAdmin(db, c.Locals("user_id").(string), c.Params("organization_id"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking permissions", "message": err.Error()})
+		}
+		if !isAdmin {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only organization admins can manage tags and metadata fields"})
+		}
+
+		return c.Next()
+	}
+}
+
+// validateTag checks the name and color of a tag, an empty color means no color
+func validateTag(name string, color *string) error {
+	if name == "" || len(name) > 100 {
+		return errors.New("name must be between 1 and 100 characters")
+	}
+	if strings.Contains(name, ",") {
+		return errors.New("name can't contain commas")
+	}
+	if color != nil && *color != "" && !tagColorPattern.MatchString(*color) {
+		return errors.New("color must be a #rrggbb color")
+	}
+	return nil
+}
+
+// CreateTag adds a tag to the tags of an organization
+func CreateTag(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	var tag models.Tag
+	if err := c.BodyParser(&tag); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+
+	tag.Name = strings.TrimSpace(tag.Name)
+	if err := validateTag(tag.Name, tag.Color); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if tag.Color != nil && *tag.Color == "" {
+		tag.Color = nil
+	}
+
+	tag.ID = uuid.New().String()
+	tag.OrganizationID = organizationId
+	tag.ItemCount = 0
+	tag.CreatedBy = &userID
+	tag.CreatedAt = time.Now()
+
+	err := auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(
+			context.Background(),
+			"INSERT INTO tags (id, organization_id, name, color, created_by, created_at) VALUES ($1, $2, $3, $4, $5, $6);",
+			tag.ID, tag.OrganizationID, tag.Name, tag.Color, userID, tag.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "tag.create", TargetType: "tag", TargetID: tag.ID, After: &tag}, nil
+	})
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A tag with this name already exists"})
+	} else if err != nil {
+		log.Println("Error creating tag: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating tag", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(tag)
+}
+
+// GetTags lists the tags of an organization with how many of the files and folders the user can see carry each
+func GetTags(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	query := `
+		SELECT
+			t.id, t.organization_id, t.name, t.color,
+			(
+				SELECT COUNT(*) FROM itemtags it
+				LEFT JOIN files f ON f.id = it.file_id
+				WHERE it.tag_id = t.id AND CASE
+					WHEN it.folder_id IS NOT NULL THEN ` + folderRankCondition("it.folder_id", "$2", "$1", "NULL", "NULL", permissionViewer) + `
+					ELSE ` + fileRankCondition("f.folder_id", "$2", "$1", permissionViewer) + `
+				END
+			),
+			t.created_by, t.created_at
+		FROM tags t
+		WHERE t.organization_id = $1
+		ORDER BY LOWER(t.name);
+	`
+	rows, err := db.Query(context.Background(), query, organizationId, userID)
+	if err != nil {
+		log.Println("Error fetching tags: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching tags", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	tags := []models.Tag{}
+	for rows.Next() {
+		tag, err := scanTag(rows)
+		if err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		tags = append(tags, tag)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	return sendList(c, tags)
+}
+
+// UpdateTag renames a tag or changes its color, an empty color removes it
+func UpdateTag(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	tagId := c.Params("tag_id")
+
+	var data models.Tag
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+
+	query := `SELECT ` + tagColumns + `
+		FROM tags t
+		WHERE t.id = $1 AND t.organization_id = $2;
+	`
+	before, err := scanTag(db.QueryRow(context.Background(), query, tagId, organizationId))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Tag not found"})
+	} else if err != nil {
+		log.Println("Error fetching tag: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching tag", "message": err.Error()})
+	}
+
+	after := before
+	if name := strings.TrimSpace(data.Name); name != "" {
+		after.Name = name
+	}
+	if data.Color != nil {
+		after.Color = data.Color
+		if *data.Color == "" {
+			after.Color = nil
+		}
+	}
+	if err := validateTag(after.Name, data.Color); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(
+			context.Background(),
+			"UPDATE tags SET name = $1, color = $2 WHERE id = $3;",
+			after.Name, after.Color, tagId,
+		); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "tag.update", TargetType: "tag", TargetID: tagId, Before: &before, After: &after}, nil
+	})
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A tag with this name already exists"})
+	} else if err != nil {
+		log.Println("Error updating tag: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating tag", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(after)
+}
+
+// DeleteTag deletes a tag and removes it from the files and folders carrying it
+func DeleteTag(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	tagId := c.Params("tag_id")
+
+	query := `SELECT ` + tagColumns + `
+		FROM tags t
+		WHERE t.id = $1 AND t.organization_id = $2;
+	`
+	tag, err := scanTag(db.QueryRow(context.Background(), query, tagId, organizationId))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Tag not found"})
+	} else if err != nil {
+		log.Println("Error fetching tag: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching tag", "message": err.Error()})
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(context.Background(), "DELETE FROM tags WHERE id = $1;", tagId); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "tag.delete", TargetType: "tag", TargetID: tagId, Before: &tag}, nil
+	})
+	if err != nil {
+		log.Println("Error deleting tag: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting tag", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Tag deleted!"})
+}
+
+// parseTagItemsRequest reads a tagging request and checks its tags and items. The tags must belong to the
+// organization in the URL and the user needs editor access to each file and folder, which must be in it too
+func parseTagItemsRequest(c *fiber.Ctx, db *pgxpool.Pool) (tagItemsRequest, error) {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	var request tagItemsRequest
+	if err := c.BodyParser(&request); err != nil {
+		return request, &statusError{fiber.StatusBadRequest, "Invalid input"}
+	}
+	if len(request.TagIDs) == 0 || len(request.FileIDs)+len(request.FolderIDs) == 0 {
+		return request, &statusError{fiber.StatusBadRequest, "tag_ids and file_ids or folder_ids are required"}
+	}
+	if len(request.TagIDs) > tagBatchLimit || len(request.FileIDs)+len(request.FolderIDs) > tagBatchLimit {
+		return request, &statusError{fiber.StatusBadRequest, "A request can hold at most 100 tags and 100 items"}
+	}
+
+	for _, ids := range [][]string{request.TagIDs, request.FileIDs, request.FolderIDs} {
+		for _, id := range ids {
+			if _, err := uuid.Parse(id); err != nil {
+				return request, &statusError{fiber.StatusBadRequest, id + " is not a valid id"}
+			}
+		}
+	}
+
+	for _, tagID := range request.TagIDs {
+		var exists bool
+		err := db.QueryRow(
+			context.Background(),
+			"SELECT EXISTS (SELECT 1 FROM tags WHERE id = $1 AND organization_id = $2);",
+			tagID, organizationId,
+		).Scan(&exists)
+		if err != nil {
+			return request, err
+		}
+		if !exists {
+			return request, &statusError{fiber.StatusNotFound, "Tag " + tagID + " not found"}
+		}
+	}
+
+	files, folders, err := loadTransferItems(db, userID, transferRequest{FileIDs: request.FileIDs, FolderIDs: request.FolderIDs}, permissionEditor)
+	if err != nil {
+		return request, err
+	}
+	for _, file := range files {
+		if file.OrganizationID != organizationId {
+			return request, &statusError{fiber.StatusBadRequest, "File " + file.Name + " is not in the organization"}
+		}
+	}
+	for _, folder := range folders {
+		if folder.OrganizationID != organizationId {
+			return request, &statusError{fiber.StatusBadRequest, "Folder " + folder.Name + " is not in the organization"}
+		}
+	}
+
+	return request, nil
+}
+
+// TagItems adds tags to a batch of files and folders, items already carrying a tag keep it
+func TagItems(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+	userID := c.Locals("user_id").(string)
+
+	request, err := parseTagItemsRequest(c, db)
+	if err != nil {
+		return respondStatusError(c, err, "Error tagging items")
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return respondStatusError(c, err, "Error tagging items")
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(
+		context.Background(),
+		`
+			INSERT INTO itemtags (tag_id, file_id, tagged_by, created_at)
+			SELECT tag_id, file_id, $3, NOW() FROM unnest($1::uuid[]) tag_id, unnest($2::uuid[]) file_id
+			ON CONFLICT DO NOTHING;
+		`,
+		request.TagIDs, request.FileIDs, userID,
+	)
+	if err != nil {
+		return respondStatusError(c, err, "Error tagging items")
+	}
+
+	_, err = tx.Exec(
+		context.Background(),
+		`
+			INSERT INTO itemtags (tag_id, folder_id, tagged_by, created_at)
+			SELECT tag_id, folder_id, $3, NOW() FROM unnest($1::uuid[]) tag_id, unnest($2::uuid[]) folder_id
+			ON CONFLICT DO NOTHING;
+		`,
+		request.TagIDs, request.FolderIDs, userID,
+	)
+	if err != nil {
+		return respondStatusError(c, err, "Error tagging items")
+	}
+
+	for _, tagID := range request.TagIDs {
+		items := tagItemsRequest{FileIDs: request.FileIDs, FolderIDs: request.FolderIDs}
+		if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "tag.apply", TargetType: "tag", TargetID: tagID, After: &items}); err != nil {
+			return respondStatusError(c, err, "Error tagging items")
+		}
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return respondStatusError(c, err, "Error tagging items")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Items tagged!"})
+}
+
+// UntagItems removes tags from a batch of files and folders
+func UntagItems(c *fiber.Ctx, db *pgxpool.Pool) error {
+	organizationId := c.Params("organization_id")
+
+	request, err := parseTagItemsRequest(c, db)
+	if err != nil {
+		return respondStatusError(c, err, "Error untagging items")
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return respondStatusError(c, err, "Error untagging items")
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(
+		context.Background(),
+		"DELETE FROM itemtags WHERE tag_id = ANY($1::uuid[]) AND (file_id = ANY($2::uuid[]) OR folder_id = ANY($3::uuid[]));",
+		request.TagIDs, request.FileIDs, request.FolderIDs,
+	)
+	if err != nil {
+		return respondStatusError(c, err, "Error untagging items")
+	}
+
+	for _, tagID := range request.TagIDs {
+		items := tagItemsRequest{FileIDs: request.FileIDs, FolderIDs: request.FolderIDs}
+		if err := recordAuditTx(c, tx, auditEvent{OrganizationID: organizationId, Action: "tag.remove", TargetType: "tag", TargetID: tagID, Before: &items}); err != nil {
+			return respondStatusError(c, err, "Error untagging items")
+		}
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return respondStatusError(c, err, "Error untagging items")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Items untagged!"})
+}
+
+func RegisterTagRoutes(app *fiber.App, db *pgxpool.Pool) {
+	tagGroup := app.Group("/tag", middleware.AuthRequired(db))
+	read := middleware.RequireScope(db, middleware.ScopeReadFiles)
+	write := middleware.RequireScope(db, middleware.ScopeWriteFiles)
+	admin := requireLabelAdmin(db)
+
+	tagGroup.Post("/create/:organization_id", write, admin, func(c *fiber.Ctx) error {
+		return CreateTag(c, db)
+	})
+	tagGroup.Get("/fetch/all/:organization_id", read, requireGroupMember(db), func(c *fiber.Ctx) error {
+		return GetTags(c, db)
+	})
+	tagGroup.Put("/update/:organization_id/:tag_id", write, admin, func(c *fiber.Ctx) error {
+		return UpdateTag(c, db)
+	})
+	tagGroup.Delete("/delete/:organization_id/:tag_id", write, admin, func(c *fiber.Ctx) error {
+		return DeleteTag(c, db)
+	})
+	tagGroup.Post("/items/:organization_id", write, requireGroupMember(db), func(c *fiber.Ctx) error {
+		return TagItems(c, db)
+	})
+	tagGroup.Delete("/items/:organization_id", write, requireGroupMember(db), func(c *fiber.Ctx) error {
+		return UntagItems(c, db)
+	})
+}
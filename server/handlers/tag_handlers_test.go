@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func TestGetTagsCountsVisibleItems(t *testing.T) {
+	db := testDB(t)
+
+	creatorID := testUser(t, db, "creator@example.com")
+	memberID := testUser(t, db, "member@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+	if err := addUserToOrganization(db, memberID, organizationID, "member"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The member sees the open folder, its file and the file at the root, not the restricted folder or its file
+	open := testFolder(t, db, organizationID, "", true)
+	restricted := testFolder(t, db, organizationID, "", false)
+	openFile := testNamedFile(t, db, organizationID, &open, "open.txt", time.Now())
+	restrictedFile := testNamedFile(t, db, organizationID, &restricted, "restricted.txt", time.Now())
+	rootFile := testNamedFile(t, db, organizationID, nil, "root.txt", time.Now())
+
+	tagID := uuid.New().String()
+	if _, err := db.Exec(context.Background(), "INSERT INTO tags (id, organization_id, name) VALUES ($1, $2, 'review');", tagID, organizationID); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []struct{ file, folder *string }{{&openFile, nil}, {&restrictedFile, nil}, {&rootFile, nil}, {nil, &open}, {nil, &restricted}} {
+		if _, err := db.Exec(context.Background(), "INSERT INTO itemtags (tag_id, file_id, folder_id) VALUES ($1, $2, $3);", tagID, item.file, item.folder); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for userID, want := range map[string]int{creatorID: 5, memberID: 3} {
+		app := fiber.New()
+		app.Get("/:organization_id", func(c *fiber.Ctx) error {
+			c.Locals("user_id", userID)
+			return GetTags(c, db)
+		})
+
+		resp, err := app.Test(httptest.NewRequest("GET", "/"+organizationID, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Items []models.Tag `json:"items"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Items) != 1 || body.Items[0].ItemCount != want {
+			t.Errorf("tags of %s: %+v, want one tag on %d items", userID, body.Items, want)
+		}
+	}
+}
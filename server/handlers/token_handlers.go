@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"server/middleware"
+	"server/models"
+	"server/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// CreatePersonalAccessToken creates a named token with scopes, the token is only returned once
+func CreatePersonalAccessToken(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userID := c.Locals("user_id").(string)
+
+	var accessToken models.PersonalAccessToken
+	if err := c.BodyParser(&accessToken); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+
+	if accessToken.Name == "" || len(accessToken.Scopes) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing fields"})
+	}
+
+	for _, scope := range accessToken.Scopes {
+		valid := false
+		for _, known := range middleware.Scopes {
+			if scope == known {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Unknown scope " + scope})
+		}
+	}
+
+	if accessToken.ExpiresAt != nil && accessToken.ExpiresAt.Before(time.Now()) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Expiry must be in the future"})
+	}
+
+	if accessToken.OrganizationID != nil && *accessToken.OrganizationID == "" {
+		accessToken.OrganizationID = nil
+	}
+	if accessToken.OrganizationID != nil {
+		role, err := getOrganizationRole(db, userID, *accessToken.OrganizationID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking organization", "message": err.Error()})
+		}
+		if role == "" {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You are not a member of this organization"})
+		}
+	}
+
+	token, err := utils.GenerateSecureToken(middleware.PersonalAccessTokenPrefix)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error generating token"})
+	}
+
+	accessToken.ID = uuid.New().String()
+	accessToken.UserID = userID
+	accessToken.CreatedAt = time.Now()
+
+	query := `
+		INSERT INTO personalaccesstokens
+		(id, user_id, name, token_hash, scopes, organization_id, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
+	`
+	organizationId := ""
+	if accessToken.OrganizationID != nil {
+		organizationId = *accessToken.OrganizationID
+	}
+
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		if _, err := tx.Exec(
+			context.Background(),
+			query,
+			accessToken.ID, accessToken.UserID, accessToken.Name, utils.HashToken(token), accessToken.Scopes, accessToken.OrganizationID, accessToken.ExpiresAt, accessToken.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		return &auditEvent{OrganizationID: organizationId, Action: "token.create", TargetType: "personal_access_token", TargetID: accessToken.ID, After: &accessToken}, nil
+	})
+	if err != nil {
+		log.Println("Error creating personal access token: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating token", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Token created, it won't be shown again",
+		"id":      accessToken.ID,
+		"token":   token,
+	})
+}
+
+// GetPersonalAccessTokens lists the tokens of the logged in user
+func GetPersonalAccessTokens(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userID := c.Locals("user_id").(string)
+
+	query := `
+		SELECT id, user_id, name, scopes, organization_id, expires_at, last_used_at, revoked_at, created_at
+		FROM personalaccesstokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC;
+	`
+	rows, err := db.Query(context.Background(), query, userID)
+	if err != nil {
+		log.Println("Error fetching personal access tokens: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error fetching tokens", "message": err.Error()})
+	}
+	defer rows.Close()
+
+	tokens := []models.PersonalAccessToken{}
+	for rows.Next() {
+		var token models.PersonalAccessToken
+		if err := rows.Scan(
+			&token.ID,
+			&token.UserID,
+			&token.Name,
+			&token.Scopes,
+			&token.OrganizationID,
+			&token.ExpiresAt,
+			&token.LastUsedAt,
+			&token.RevokedAt,
+			&token.CreatedAt,
+		); err != nil {
+			log.Println("Error scanning row: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning row", "message": err.Error()})
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Println("Error iterating rows: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error iterating rows", "message": err.Error()})
+	}
+
+	return sendList(c, tokens)
+}
+
+// RevokePersonalAccessToken revokes a token of the logged in user
+func RevokePersonalAccessToken(c *fiber.Ctx, db *pgxpool.Pool) error {
+	userID := c.Locals("user_id").(string)
+	tokenId := c.Params("token_id")
+
+	err := auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		commandTag, err := tx.Exec(
+			context.Background(),
+			"UPDATE personalaccesstokens SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL;",
+			tokenId, userID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if commandTag.RowsAffected() == 0 {
+			return nil, pgx.ErrNoRows
+		}
+		return &auditEvent{Action: "token.revoke", TargetType: "personal_access_token", TargetID: tokenId}, nil
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Token not found"})
+	}
+	if err != nil {
+		log.Println("Error revoking personal access token: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error revoking token", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Token revoked!"})
+}
+
+func RegisterTokenRoutes(app *fiber.App, db *pgxpool.Pool) {
+	tokenGroup := app.Group("/auth/tokens", middleware.AuthRequired(db), middleware.SessionRequired())
+
+	tokenGroup.Post("/", func(c *fiber.Ctx) error {
+		return CreatePersonalAccessToken(c, db)
+	})
+	tokenGroup.Get("/", func(c *fiber.Ctx) error {
+		return GetPersonalAccessTokens(c, db)
+	})
+	tokenGroup.Delete("/:token_id", func(c *fiber.Ctx) error {
+		return RevokePersonalAccessToken(c, db)
+	})
+}
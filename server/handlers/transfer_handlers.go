@@ -0,0 +1,726 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// transferBatchLimit is the most files and folders a single move or copy request can hold
+const transferBatchLimit = 100
+
+// transferRequest is the body of move and copy requests. Items go to FolderID, or to the root of
+// OrganizationID when there is no folder. Without either the items go to the root of their organization
+type transferRequest struct {
+	FileIDs        []string `json:"file_ids"`
+	FolderIDs      []string `json:"folder_ids"`
+	FolderID       *string  `json:"folder_id"`
+	OrganizationID string   `json:"organization_id"`
+	// Strategy is the name conflict strategy from the on_conflict query parameter
+	Strategy string `json:"-"`
+}
+
+// transferResult lists the items a move or copy request produced
+type transferResult struct {
+	Files   []models.File   `json:"files"`
+	Folders []models.Folder `json:"folders"`
+	// Skipped holds the items left out because their name is taken in the destination
+	Skipped []string `json:"skipped"`
+}
+
+// transferDestination is where items are moved or copied to, FolderID is nil for the organization root
+type transferDestination struct {
+	OrganizationID string
+	FolderID       *string
+}
+
+// statusError is a reason a request on files or folders can't be done along with the status it is reported with
+type statusError struct {
+	Status  int
+	Message string
+}
+
+func (err *statusError) Error() string {
+	return err.Message
+}
+
+// respondStatusError reports a statusError with its status and any other error as a server error
+func respondStatusError(c *fiber.Ctx, err error, message string) error {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return c.Status(statusErr.Status).JSON(fiber.Map{"error": statusErr.Message})
+	}
+
+	log.Println(message+": ", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": message, "message": err.Error()})
+}
+
+// checkDestination verifies items can be added to a folder of an organization, or to its root when the folder
+// is nil. The folder must be in the organization, outside the recycle bin and editable by the user
+func checkDestination(db *pgxpool.Pool, userID string, organizationID string, folderID *string) error {
+	if folderID != nil {
+		var folderOrganizationID string
+		var inBin bool
+		err := db.QueryRow(
+			context.Background(),
+			`
+				SELECT f.organization_id, EXISTS (SELECT 1 FROM folders a WHERE a.id = ANY(f.ancestor_ids || f.id) AND a.deleted)
+				FROM folders f WHERE f.id = $1;
+			`,
+			*folderID,
+		).Scan(&folderOrganizationID, &inBin)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return &statusError{fiber.StatusNotFound, "Destination folder not found"}
+		} else if err != nil {
+			return err
+		}
+
+		if folderOrganizationID != organizationID {
+			return &statusError{fiber.StatusBadRequest, "Destination folder is not in the organization"}
+		}
+		if inBin {
+			return &statusError{fiber.StatusConflict, "Destination folder is in the recycle bin"}
+		}
+	}
+
+	rank, err := containerPermission(db, userID, organizationID, folderID)
+	if err != nil {
+		return err
+	}
+	if rank < permissionEditor {
+		return &statusError{fiber.StatusForbidden, "You need editor access to the destination folder"}
+	}
+
+	return nil
+}
+
+// checkFolderCycle rejects moving a folder into itself or one of its subfolders. It runs in the transaction of
+// the move and locks the folder with the destination and its ancestors first, so a concurrent move can't
+// change the tree between the check and the move
+func checkFolderCycle(tx pgx.Tx, folderID string, destinationID *string) error {
+	if destinationID == nil {
+		return nil
+	}
+
+	_, err := tx.Exec(
+		context.Background(),
+		`
+			SELECT id FROM folders
+			WHERE id = $1 OR id = $2 OR id = ANY((SELECT ancestor_ids FROM folders WHERE id = $1)::uuid[])
+			ORDER BY id FOR UPDATE;
+		`,
+		*destinationID, folderID,
+	)
+	if err != nil {
+		return err
+	}
+
+	var cycle bool
+	err = tx.QueryRow(
+		context.Background(),
+		"SELECT id = $2 OR $2 = ANY(ancestor_ids) FROM folders WHERE id = $1;",
+		*destinationID, folderID,
+	).Scan(&cycle)
+	if err != nil {
+		return err
+	}
+	if cycle {
+		return &statusError{fiber.StatusBadRequest, "A folder can't be moved into itself or one of its subfolders"}
+	}
+
+	return nil
+}
+
+// loadTransferItems fetches the files and folders of a request, they must be outside the recycle bin and
+// the user needs at least rank on each of them
+func loadTransferItems(db *pgxpool.Pool, userID string, request transferRequest, rank int) ([]models.File, []models.Folder, error) {
+	var files []models.File
+	for _, fileID := range request.FileIDs {
+		file := auditFile(db, fileID)
+		if file == nil {
+			return nil, nil, &statusError{fiber.StatusNotFound, "File " + fileID + " not found"}
+		}
+		if file.Deleted {
+			return nil, nil, &statusError{fiber.StatusConflict, "File " + file.Name + " is in the recycle bin"}
+		}
+
+		current, err := filePermission(db, userID, fileID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if current < rank {
+			return nil, nil, &statusError{fiber.StatusForbidden, "You need " + permissionRole(rank) + " access to " + file.Name}
+		}
+		files = append(files, *file)
+	}
+
+	var folders []models.Folder
+	for _, folderID := range request.FolderIDs {
+		folder := auditFolder(db, folderID)
+		if folder == nil {
+			return nil, nil, &statusError{fiber.StatusNotFound, "Folder " + folderID + " not found"}
+		}
+		if folder.Deleted {
+			return nil, nil, &statusError{fiber.StatusConflict, "Folder " + folder.Name + " is in the recycle bin"}
+		}
+
+		current, err := folderPermission(db, userID, folderID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if current < rank {
+			return nil, nil, &statusError{fiber.StatusForbidden, "You need " + permissionRole(rank) + " access to " + folder.Name}
+		}
+		folders = append(folders, *folder)
+	}
+
+	return files, folders, nil
+}
+
+// prepareTransfer validates a move or copy request and returns its items and destination. Moving needs editor
+// access to the items and keeps them in their organization, copying needs viewer access and can target any
+// organization the user can add items to
+func prepareTransfer(c *fiber.Ctx, db *pgxpool.Pool, request transferRequest, move bool) ([]models.File, []models.Folder, transferDestination, error) {
+	userID := c.Locals("user_id").(string)
+	var destination transferDestination
+
+	count := len(request.FileIDs) + len(request.FolderIDs)
+	if count == 0 {
+		return nil, nil, destination, &statusError{fiber.StatusBadRequest, "No files or folders given"}
+	}
+	if count > transferBatchLimit {
+		return nil, nil, destination, &statusError{fiber.StatusBadRequest, "Too many files and folders in one request"}
+	}
+
+	rank := permissionViewer
+	if move {
+		rank = permissionEditor
+	}
+	files, folders, err := loadTransferItems(db, userID, request, rank)
+	if err != nil {
+		return nil, nil, destination, err
+	}
+
+	destination.OrganizationID = request.OrganizationID
+	if request.FolderID != nil && *request.FolderID != "" && *request.FolderID != "null" {
+		destination.FolderID = request.FolderID
+		if folder := auditFolder(db, *request.FolderID); folder != nil && destination.OrganizationID == "" {
+			destination.OrganizationID = folder.OrganizationID
+		}
+	}
+	if destination.OrganizationID == "" {
+		if len(files) > 0 {
+			destination.OrganizationID = files[0].OrganizationID
+		} else {
+			destination.OrganizationID = folders[0].OrganizationID
+		}
+	}
+
+	if err := checkDestination(db, userID, destination.OrganizationID, destination.FolderID); err != nil {
+		return nil, nil, destination, err
+	}
+
+	// Tokens limited to an organization can't take items in or out of it
+	tokenOrganizationID, isLimited := c.Locals("token_organization_id").(string)
+	organizations := []string{destination.OrganizationID}
+	for _, file := range files {
+		organizations = append(organizations, file.OrganizationID)
+	}
+	for _, folder := range folders {
+		organizations = append(organizations, folder.OrganizationID)
+	}
+	for _, organizationID := range organizations {
+		if isLimited && organizationID != tokenOrganizationID {
+			return nil, nil, destination, &statusError{fiber.StatusForbidden, "Token is not allowed to access this organization"}
+		}
+		if move && organizationID != destination.OrganizationID {
+			return nil, nil, destination, &statusError{fiber.StatusBadRequest, "Items can't be moved to another organization"}
+		}
+	}
+
+	return files, folders, destination, nil
+}
+
+// moveItems moves files and folders to a destination in one transaction, names taken in the destination are
+// resolved with the conflict strategy of the request
+func moveItems(c *fiber.Ctx, db *pgxpool.Pool, request transferRequest) (transferResult, error) {
+	result := transferResult{Files: []models.File{}, Folders: []models.Folder{}, Skipped: []string{}}
+	userID := c.Locals("user_id").(string)
+
+	files, folders, destination, err := prepareTransfer(c, db, request, true)
+	if err != nil {
+		return result, err
+	}
+
+	// Items moved together can't take the same name
+	batch := batchNames{}
+	fileNames := make([]nameResolution, len(files))
+	for i, file := range files {
+		fileNames[i], err = resolveBatchNameConflict(db, batch, request.Strategy, "file", destination.OrganizationID, destination.FolderID, file.Name, file.ID)
+		if err != nil {
+			return result, err
+		}
+	}
+	folderNames := make([]nameResolution, len(folders))
+	for i, folder := range folders {
+		folderNames[i], err = resolveBatchNameConflict(db, batch, request.Strategy, "folder", destination.OrganizationID, destination.FolderID, folder.Name, folder.ID)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback(context.Background())
+
+	for _, folder := range folders {
+		if err := checkFolderCycle(tx, folder.ID, destination.FolderID); err != nil {
+			return result, err
+		}
+	}
+
+	now := time.Now()
+	for i, file := range files {
+		switch {
+		case fileNames[i].Skip:
+			continue
+		case fileNames[i].Replace:
+			err = mergeFileInto(tx, file.ID, fileNames[i].ExistingID, userID)
+		default:
+			_, err = tx.Exec(
+				context.Background(),
+				"UPDATE files SET folder_id = $1, name = $2, updated_at = $3 WHERE id = $4;",
+				destination.FolderID, fileNames[i].Name, now, file.ID,
+			)
+		}
+		if err != nil {
+			return result, nameTaken(err)
+		}
+	}
+	for i, folder := range folders {
+		if folderNames[i].Skip {
+			continue
+		}
+		_, err := tx.Exec(
+			context.Background(),
+			"UPDATE folders SET parent_folder_id = $1, name = $2, updated_at = $3 WHERE id = $4;",
+			destination.FolderID, folderNames[i].Name, now, folder.ID,
+		)
+		if err != nil {
+			return result, nameTaken(err)
+		}
+	}
+
+	for i := range files {
+		if fileNames[i].Skip {
+			result.Skipped = append(result.Skipped, files[i].ID)
+			continue
+		}
+
+		// A replaced file lives on as the file it replaced
+		fileID := files[i].ID
+		if fileNames[i].Replace {
+			fileID = fileNames[i].ExistingID
+		}
+		after := auditFile(tx, fileID)
+		if err := recordAuditTx(c, tx, auditEvent{Action: "file.move", TargetType: "file", TargetID: files[i].ID, Before: &files[i], After: after}); err != nil {
+			return result, err
+		}
+		if after != nil {
+			result.Files = append(result.Files, *after)
+		}
+	}
+	for i := range folders {
+		if folderNames[i].Skip {
+			result.Skipped = append(result.Skipped, folders[i].ID)
+			continue
+		}
+
+		after := auditFolder(tx, folders[i].ID)
+		if err := recordAuditTx(c, tx, auditEvent{Action: "folder.move", TargetType: "folder", TargetID: folders[i].ID, Before: &folders[i], After: after}); err != nil {
+			return result, err
+		}
+		if after != nil {
+			result.Folders = append(result.Folders, *after)
+		}
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return result, nameTaken(err)
+	}
+
+	for _, file := range result.Files {
+		touchRecentItem(db, userID, "file", file.ID, true)
+	}
+	for _, folder := range result.Folders {
+		touchRecentItem(db, userID, "folder", folder.ID, true)
+	}
+
+	return result, nil
+}
+
+// copyFileTo duplicates a file into a destination, under the resolved name or as a new version of the file it
+// replaces. Copies in the organization of the file share its blob, other copies get a blob of their own
+func copyFileTo(c *fiber.Ctx, db *pgxpool.Pool, userID string, file models.File, destination transferDestination, resolution nameResolution) (models.File, error) {
+	blobID, filePath, err := sharedBlob(db, file.ID, destination.OrganizationID)
+	if err != nil {
+		return file, err
+	}
+
+	// Copies that can't share the blob get one of the destination organization, encrypted with its key. Blobs
+	// left unreferenced by a failure are removed after their grace period
+	if blobID == nil {
+		copiedBlobID, copiedPath, err := ingestUpload(db, destination.OrganizationID, file.FilePath)
+		if err != nil {
+			return file, err
+		}
+		blobID, filePath = &copiedBlobID, copiedPath
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return file, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var copied models.File
+	if resolution.Replace {
+		if err := replaceFileContent(tx, resolution.ExistingID, filePath, file.FileSize, blobID, userID); err != nil {
+			return file, err
+		}
+
+		replaced := auditFile(tx, resolution.ExistingID)
+		if replaced == nil {
+			return file, errors.New("replaced file not found")
+		}
+		copied = *replaced
+	} else {
+		copied = file
+		copied.ID = uuid.New().String()
+		copied.Name = resolution.Name
+		copied.FolderID = destination.FolderID
+		copied.OrganizationID = destination.OrganizationID
+		copied.FilePath = filePath
+		copied.CreatedAt = time.Now()
+		copied.UpdatedAt = copied.CreatedAt
+		copied.CreatedBy = &userID
+
+		_, err = tx.Exec(
+			context.Background(),
+			`INSERT INTO files (id, name, folder_id, file_path, file_size, created_at, updated_at, organization_id, deleted, created_by, blob_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, false, $9, $10);`,
+			copied.ID, copied.Name, copied.FolderID, copied.FilePath, copied.FileSize, copied.CreatedAt, copied.UpdatedAt, copied.OrganizationID, userID, blobID,
+		)
+		if err != nil {
+			return file, nameTaken(err)
+		}
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{Action: "file.copy", TargetType: "file", TargetID: copied.ID, Before: &file, After: &copied}); err != nil {
+		return file, err
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return file, err
+	}
+
+	return copied, nil
+}
+
+// copyFolderTo duplicates a folder with the subfolders and files the user can see into a destination, the
+// copy of the folder takes the given name. Files copied in their organization share their blob, other files
+// are stored first in blobs of the destination organization
+func copyFolderTo(c *fiber.Ctx, db *pgxpool.Pool, userID string, folder models.Folder, destination transferDestination, name string) (models.Folder, error) {
+	rows, err := db.Query(
+		context.Background(),
+		`
+			WITH RECURSIVE visible AS (
+				SELECT r.id FROM folders root
+				CROSS JOIN LATERAL folder_permission_ranks($2, root.organization_id, root.id, NULL) r
+				WHERE root.id = $1 AND r.rank >= 1
+			),
+			tree AS (
+				SELECT id, name, parent_folder_id, 0 AS depth FROM folders WHERE id = $1
+				UNION ALL
+				SELECT f.id, f.name, f.parent_folder_id, tree.depth + 1
+				FROM folders f
+				JOIN tree ON f.parent_folder_id = tree.id
+				WHERE f.deleted = false AND f.id IN (SELECT id FROM visible)
+			)
+			SELECT id, name, parent_folder_id FROM tree ORDER BY depth;
+		`,
+		folder.ID, userID,
+	)
+	if err != nil {
+		return folder, err
+	}
+
+	var subtree []models.Folder
+	copiedIDs := map[string]string{}
+	var sourceIDs []string
+	for rows.Next() {
+		var item models.Folder
+		if err := rows.Scan(&item.ID, &item.Name, &item.ParentFolderID); err != nil {
+			rows.Close()
+			return folder, err
+		}
+		subtree = append(subtree, item)
+		copiedIDs[item.ID] = uuid.New().String()
+		sourceIDs = append(sourceIDs, item.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return folder, err
+	}
+
+	rows, err = db.Query(
+		context.Background(),
+		`SELECT f.id, f.name, f.folder_id, f.file_path, f.file_size, b.id, b.file_path FROM files f
+		LEFT JOIN blobs b ON b.id = f.blob_id AND b.organization_id = $2
+		WHERE f.folder_id = ANY($1) AND f.deleted = false;`,
+		sourceIDs, destination.OrganizationID,
+	)
+	if err != nil {
+		return folder, err
+	}
+
+	var files []models.File
+	// blobIDs holds the blobs the copies share, nil for files whose storage object is copied
+	var blobIDs []*string
+	for rows.Next() {
+		var file models.File
+		var blobID, blobPath *string
+		if err := rows.Scan(&file.ID, &file.Name, &file.FolderID, &file.FilePath, &file.FileSize, &blobID, &blobPath); err != nil {
+			rows.Close()
+			return folder, err
+		}
+		if blobID != nil {
+			file.FilePath = *blobPath
+		}
+		files = append(files, file)
+		blobIDs = append(blobIDs, blobID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return folder, err
+	}
+
+	// Blobs left unreferenced by a failure are removed after their grace period
+	for i := range files {
+		if blobIDs[i] != nil {
+			continue
+		}
+		blobID, filePath, err := ingestUpload(db, destination.OrganizationID, files[i].FilePath)
+		if err != nil {
+			return folder, err
+		}
+		blobIDs[i], files[i].FilePath = &blobID, filePath
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return folder, err
+	}
+	defer tx.Rollback(context.Background())
+
+	now := time.Now()
+	for _, item := range subtree {
+		parentID, itemName := destination.FolderID, name
+		if item.ID != folder.ID {
+			copiedParentID := copiedIDs[*item.ParentFolderID]
+			parentID, itemName = &copiedParentID, item.Name
+		}
+
+		_, err := tx.Exec(
+			context.Background(),
+			`INSERT INTO folders (id, name, organization_id, parent_folder_id, created_at, updated_at, deleted, created_by)
+			VALUES ($1, $2, $3, $4, $5, $5, false, $6);`,
+			copiedIDs[item.ID], itemName, destination.OrganizationID, parentID, now, userID,
+		)
+		if err != nil {
+			return folder, nameTaken(err)
+		}
+	}
+
+	for i, file := range files {
+		_, err := tx.Exec(
+			context.Background(),
+			`INSERT INTO files (id, name, folder_id, file_path, file_size, created_at, updated_at, organization_id, deleted, created_by, blob_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $6, $7, false, $8, $9);`,
+			uuid.New().String(), file.Name, copiedIDs[*file.FolderID], file.FilePath, file.FileSize, now, destination.OrganizationID, userID, blobIDs[i],
+		)
+		if err != nil {
+			return folder, nameTaken(err)
+		}
+	}
+
+	copied := auditFolder(tx, copiedIDs[folder.ID])
+	if copied == nil {
+		return folder, errors.New("copied folder not found")
+	}
+
+	if err := recordAuditTx(c, tx, auditEvent{Action: "folder.copy", TargetType: "folder", TargetID: copied.ID, Before: &folder, After: copied}); err != nil {
+		return folder, err
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return folder, nameTaken(err)
+	}
+
+	return *copied, nil
+}
+
+// copyItems copies files and folders to a destination, each item is copied on its own so items copied
+// before a failure are kept. Names taken in the destination are resolved with the conflict strategy
+func copyItems(c *fiber.Ctx, db *pgxpool.Pool, request transferRequest) (transferResult, error) {
+	result := transferResult{Files: []models.File{}, Folders: []models.Folder{}, Skipped: []string{}}
+	userID := c.Locals("user_id").(string)
+
+	files, folders, destination, err := prepareTransfer(c, db, request, false)
+	if err != nil {
+		return result, err
+	}
+
+	for _, file := range files {
+		resolution, err := resolveNameConflict(db, request.Strategy, "file", destination.OrganizationID, destination.FolderID, file.Name, "")
+		if err != nil {
+			return result, err
+		}
+		if resolution.Skip {
+			result.Skipped = append(result.Skipped, file.ID)
+			continue
+		}
+
+		copied, err := copyFileTo(c, db, userID, file, destination, resolution)
+		if err != nil {
+			return result, err
+		}
+		touchRecentItem(db, userID, "file", copied.ID, true)
+		result.Files = append(result.Files, copied)
+	}
+	for _, folder := range folders {
+		resolution, err := resolveNameConflict(db, request.Strategy, "folder", destination.OrganizationID, destination.FolderID, folder.Name, "")
+		if err != nil {
+			return result, err
+		}
+		if resolution.Skip {
+			result.Skipped = append(result.Skipped, folder.ID)
+			continue
+		}
+
+		copied, err := copyFolderTo(c, db, userID, folder, destination, resolution.Name)
+		if err != nil {
+			return result, err
+		}
+		touchRecentItem(db, userID, "folder", copied.ID, true)
+		result.Folders = append(result.Folders, copied)
+	}
+
+	return result, nil
+}
+
+// parseTransferRequest reads a move or copy request with its conflict strategy. For single items the
+// file_id or folder_id param is the item
+func parseTransferRequest(c *fiber.Ctx) (transferRequest, error) {
+	var request transferRequest
+	if err := c.BodyParser(&request); err != nil {
+		return request, &statusError{fiber.StatusBadRequest, "Invalid input"}
+	}
+
+	strategy, err := conflictStrategy(c)
+	if err != nil {
+		return request, err
+	}
+	request.Strategy = strategy
+
+	if fileId := c.Params("file_id"); fileId != "" {
+		request.FileIDs, request.FolderIDs = []string{fileId}, nil
+	} else if folderId := c.Params("folder_id"); folderId != "" {
+		request.FileIDs, request.FolderIDs = nil, []string{folderId}
+	}
+
+	return request, nil
+}
+
+// respondSingleTransfer responds with the item a single move or copy produced, or with the result when
+// the item was skipped
+func respondSingleTransfer(c *fiber.Ctx, result transferResult, status int) error {
+	if len(result.Files) > 0 {
+		return c.Status(status).JSON(result.Files[0])
+	}
+	if len(result.Folders) > 0 {
+		return c.Status(status).JSON(result.Folders[0])
+	}
+	return c.Status(fiber.StatusOK).JSON(result)
+}
+
+// MoveItem moves a single file or folder to another folder of its organization
+func MoveItem(c *fiber.Ctx, db *pgxpool.Pool) error {
+	request, err := parseTransferRequest(c)
+	if err != nil {
+		return respondStatusError(c, err, "Error moving item")
+	}
+
+	result, err := moveItems(c, db, request)
+	if err != nil {
+		return respondStatusError(c, err, "Error moving item")
+	}
+
+	return respondSingleTransfer(c, result, fiber.StatusOK)
+}
+
+// CopyItem copies a single file, or a folder with its content, to a folder
+func CopyItem(c *fiber.Ctx, db *pgxpool.Pool) error {
+	request, err := parseTransferRequest(c)
+	if err != nil {
+		return respondStatusError(c, err, "Error copying item")
+	}
+
+	result, err := copyItems(c, db, request)
+	if err != nil {
+		return respondStatusError(c, err, "Error copying item")
+	}
+
+	return respondSingleTransfer(c, result, fiber.StatusCreated)
+}
+
+// MoveItems moves a batch of files and folders to another folder of their organization, nothing is moved
+// if any of them can't be
+func MoveItems(c *fiber.Ctx, db *pgxpool.Pool) error {
+	request, err := parseTransferRequest(c)
+	if err != nil {
+		return respondStatusError(c, err, "Error moving items")
+	}
+
+	result, err := moveItems(c, db, request)
+	if err != nil {
+		return respondStatusError(c, err, "Error moving items")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(result)
+}
+
+// CopyItems copies a batch of files and folders to a folder
+func CopyItems(c *fiber.Ctx, db *pgxpool.Pool) error {
+	request, err := parseTransferRequest(c)
+	if err != nil {
+		return respondStatusError(c, err, "Error copying items")
+	}
+
+	result, err := copyItems(c, db, request)
+	if err != nil {
+		return respondStatusError(c, err, "Error copying items")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(result)
+}
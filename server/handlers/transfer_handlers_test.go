@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCheckFolderCycle(t *testing.T) {
+	db := testDB(t)
+
+	creatorID := testUser(t, db, "creator@example.com")
+	organizationID := testOrganization(t, db, creatorID)
+	parent := testFolder(t, db, organizationID, "", true)
+	child := testFolder(t, db, organizationID, parent, true)
+	grandchild := testFolder(t, db, organizationID, child, true)
+	other := testFolder(t, db, organizationID, "", true)
+
+	tests := []struct {
+		folder      string
+		destination string
+		cycle       bool
+	}{
+		{parent, parent, true},
+		{parent, child, true},
+		{parent, grandchild, true},
+		{child, grandchild, true},
+		{grandchild, parent, false},
+		{parent, other, false},
+		{other, grandchild, false},
+	}
+	for _, test := range tests {
+		tx, err := db.Begin(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkFolderCycle(tx, test.folder, &test.destination)
+		tx.Rollback(context.Background())
+
+		var statusErr *statusError
+		if test.cycle && !errors.As(err, &statusErr) {
+			t.Errorf("moving %s into %s wasn't rejected, %v", test.folder, test.destination, err)
+		}
+		if !test.cycle && err != nil {
+			t.Errorf("moving %s into %s was rejected, %v", test.folder, test.destination, err)
+		}
+	}
+}
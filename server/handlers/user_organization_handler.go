@@ -2,53 +2,18 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"log"
+	"server/middleware"
 	"server/models"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 /**
-* CreateUserOrganization - Creates a user organization
-* @c: fiber context
-* db: database
-* Return: Error or Ok
- */
-func CreateUserOrganization(c *fiber.Ctx, db *pgxpool.Pool) error {
-	var userOrganization models.UserOrganization
-
-	if err := c.BodyParser(&userOrganization); err != nil {
-		log.Println("Error parsing body: ", err.Error())
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Bad request!"})
-	}
-
-	if userOrganization.OrganizationID == "" || userOrganization.UserID == "" || userOrganization.Role == "" {
-		log.Println("Error, missing fields")
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing fields"})
-	}
-
-	userOrganization.ID = uuid.New().String()
-
-	query := "INSERT INTO userorganizations (id, user_id, organization_id, role) VALUES ($1, $2, $3, $4);"
-
-	_, err := db.Exec(
-		context.Background(),
-		query,
-		userOrganization.ID, userOrganization.UserID, userOrganization.OrganizationID, userOrganization.Role,
-	)
-
-	if err != nil {
-		log.Println("Error creating user organization")
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error creating organization", "message": err.Error()})
-	}
-
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "User organization created successfully!"})
-}
-
-/**
-	* CreateUserOrganization - Creates a user organization
+	* UpdateUserOrganization - Updates the role of a user in an organization
 	* @c: fiber context
 	* db: database
 	* Return: Error or Ok
@@ -73,27 +38,52 @@ func UpdateUserOrganization(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing fields"})
 	}
 
+	// The creator role can only change hands through an ownership transfer
+	if userOrganization.Role == "creator" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Use an ownership transfer to change the creator"})
+	}
+
 	query := `
 		UPDATE userorganizations
 		SET role = $1
-		WHERE user_id = $2 AND organization_id = $3;
+		WHERE user_id = $2 AND organization_id = $3 AND role <> 'creator';
 	`
 
-	commandTag, err := db.Exec(
-		context.Background(),
-		query,
-		userOrganization.Role, userId, organizationId,
-	)
-
+	beforeRole, err := getOrganizationRole(db, userId, organizationId)
 	if err != nil {
-		log.Println("Error updating User Oorganization")
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating userorganization", "message": err.Error()})
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking membership", "message": err.Error()})
 	}
 
-	if commandTag.RowsAffected() == 0 {
+	err = auditedTx(c, db, func(tx pgx.Tx) (*auditEvent, error) {
+		commandTag, err := tx.Exec(
+			context.Background(),
+			query,
+			userOrganization.Role, userId, organizationId,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if commandTag.RowsAffected() == 0 {
+			return nil, pgx.ErrNoRows
+		}
+		return &auditEvent{
+			OrganizationID: organizationId,
+			Action:         "member.update",
+			TargetType:     "user",
+			TargetID:       userId,
+			Before:         fiber.Map{"role": beforeRole},
+			After:          fiber.Map{"role": userOrganization.Role},
+		}, nil
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User Organization not found"})
 	}
 
+	if err != nil {
+		log.Println("Error updating User Oorganization")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error updating userorganization", "message": err.Error()})
+	}
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "User Organization updated successfully!"})
 }
 
@@ -105,9 +95,22 @@ func DeleteUserOrganization(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "USer ID missing"})
 	}
 
-	query := "DELETE FROM userorganizations WHERE user_id = $1 AND organization_id = $2;"
+	// The creator can't be removed, ownership has to be transferred first
+	query := "DELETE FROM userorganizations WHERE user_id = $1 AND organization_id = $2 AND role <> 'creator';"
+
+	beforeRole, err := getOrganizationRole(db, user_id, organization_id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking membership", "message": err.Error()})
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		log.Println("Error starting transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting user organization", "message": err.Error()})
+	}
+	defer tx.Rollback(context.Background())
 
-	_, err := db.Exec(
+	commandTag, err := tx.Exec(
 		context.Background(),
 		query,
 		user_id, organization_id,
@@ -118,6 +121,46 @@ func DeleteUserOrganization(c *fiber.Ctx, db *pgxpool.Pool) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting user organization", "message": err.Error()})
 	}
 
+	if commandTag.RowsAffected() > 0 {
+		// Former members lose their folder grants and group memberships
+		_, err = tx.Exec(
+			context.Background(),
+			"DELETE FROM folderpermissions WHERE user_id = $1 AND organization_id = $2;",
+			user_id, organization_id,
+		)
+		if err != nil {
+			log.Println("Error deleting folder permissions: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting user organization", "message": err.Error()})
+		}
+
+		_, err = tx.Exec(
+			context.Background(),
+			"DELETE FROM groupmembers gm USING groups g WHERE gm.group_id = g.id AND gm.user_id = $1 AND g.organization_id = $2;",
+			user_id, organization_id,
+		)
+		if err != nil {
+			log.Println("Error deleting group memberships: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting user organization", "message": err.Error()})
+		}
+
+		err = recordAuditTx(c, tx, auditEvent{
+			OrganizationID: organization_id,
+			Action:         "member.remove",
+			TargetType:     "user",
+			TargetID:       user_id,
+			Before:         fiber.Map{"role": beforeRole},
+		})
+		if err != nil {
+			log.Println(err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting user organization", "message": err.Error()})
+		}
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		log.Println("Error committing transaction: ", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error deleting user organization", "message": err.Error()})
+	}
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "User Organization deleted successfully!"})
 }
 
@@ -141,7 +184,7 @@ func GetUserOrganizations(c *fiber.Ctx, db *pgxpool.Pool) error {
 		JOIN 
 			Organizations o ON uo.organization_id = o.organization_id
 		WHERE 
-			uo.user_id = $1;
+			uo.user_id = $1 AND o.deleted_at IS NULL;
 	`
 
 	rows, err := db.Query(
@@ -156,7 +199,7 @@ func GetUserOrganizations(c *fiber.Ctx, db *pgxpool.Pool) error {
 	}
 	defer rows.Close()
 
-	var organizations []map[string]interface{}
+	organizations := []map[string]interface{}{}
 	var organization models.Organization
 	var userOrganization models.UserOrganization
 
@@ -175,22 +218,20 @@ func GetUserOrganizations(c *fiber.Ctx, db *pgxpool.Pool) error {
 		}
 		organizations = append(organizations, organization)
 }
-	return c.Status(fiber.StatusOK).JSON(organizations)
+	return sendList(c, organizations)
 }
 
 func RegisterUserOrganizationRoutes(app *fiber.App, db *pgxpool.Pool) {
-	userOrganizatonGroup := app.Group("/user_organization")
+	userOrganizatonGroup := app.Group("/user_organization", middleware.AuthRequired(db))
+	manage := middleware.RequireScope(db, middleware.ScopeManageMembers)
 
-	userOrganizatonGroup.Post("/create", func(c *fiber.Ctx) error {
-		return CreateUserOrganization(c, db)
-	})
-	userOrganizatonGroup.Put("/update/:user_id/:organization_id", func(c *fiber.Ctx) error {
+	userOrganizatonGroup.Put("/update/:user_id/:organization_id", manage, func(c *fiber.Ctx) error {
 		return UpdateUserOrganization(c, db)
 	})
 	userOrganizatonGroup.Get("/fetch/:user_id", func(c *fiber.Ctx) error {
 		return GetUserOrganizations(c, db)
 	})
-	userOrganizatonGroup.Delete("/delete/:user_id/:organization_id", func(c *fiber.Ctx) error {
+	userOrganizatonGroup.Delete("/delete/:user_id/:organization_id", manage, func(c *fiber.Ctx) error {
 		return DeleteUserOrganization(c, db)
 	})
 }
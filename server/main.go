@@ -4,7 +4,9 @@ import (
 	"log"
 	"os"
 	"server/database"
+	"server/encryption"
 	"server/handlers"
+	"server/middleware"
 	"server/redis_pkg"
 	"server/routes"
 	"server/spaces"
@@ -30,20 +32,47 @@ func main() {
 	}
 	defer db.Close()
 
+	// Imports that were running when the server stopped can't be resumed
+	handlers.FailInterruptedImports(db)
+
 	redis_pkg.InitRedis()
 
 	// Initialize digital ocean spaces
 	spaces.InitS3()
 
+	// Load the master keys wrapping the keys file contents are encrypted with
+	encryption.InitKeyManager()
+
+	// Wrap the keys of organizations with the current master key in the background
+	handlers.StartKeyRewrapper(db)
+
+	// Encrypt the file contents stored before encryption was configured in the background
+	handlers.StartBlobEncrypter(db)
+
+	// Hash uploaded files and deduplicate their storage in the background
+	handlers.StartContentHasher(db)
+
+	// Extract the text of uploaded files for search in the background
+	handlers.StartContentIndexer(db)
+
+	// Generate thumbnails and snippets of uploaded files in the background
+	handlers.StartPreviewGenerator(db)
+
 	// Initialize Fiber router
-	app := fiber.New()
+	app := fiber.New(fiber.Config{
+		// Request bodies are read as handlers ask for them, so archive imports are streamed to disk
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	})
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "http://localhost:3000,http://localhost:5174,https://alx-silo.vercel.app",
 		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS",
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, X-Share-Password",
 		AllowCredentials: true,
 		MaxAge:           300, // Optional: cache preflight requests for 5 minutes
 	}))
+	// Other routes keep the default body limit, archive imports check their own
+	app.Use(middleware.BodyLimit(fiber.DefaultBodyLimit, handlers.ImportPathPrefix))
 	// Register all routes
 	routes.RegisterRoutes(app, db, redis_pkg.RedisClient)
 
@@ -52,7 +81,12 @@ func main() {
 	c.AddFunc("@daily", func() { 
 		handlers.DeleteExpiredFolders(db) 
 		handlers.DeleteExpiredFiles(db)
+		handlers.PurgeDeletedOrganizations(db)
 	})
+	// Unverified accounts can log in when verification isn't required, so they are kept
+	if handlers.EmailVerificationRequired() {
+		c.AddFunc("@daily", func() { handlers.DeleteUnverifiedUsers(db) })
+	}
 	c.Start()
 	
 	defer c.Stop()
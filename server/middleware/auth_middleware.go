@@ -1,25 +1,99 @@
-package utils
+package middleware
 
 import (
-"os"
-"time"
+	"errors"
+	"log"
+	"strings"
 
-"github.com/golang-jwt/jwt/v5"
+	"server/sessions"
+	"server/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v4/pgxpool"
 )
 
-var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+// errInvalidCredentials is returned by authenticate for tokens that are invalid, expired or revoked
+type errInvalidCredentials struct {
+	message string
+}
+
+func (err errInvalidCredentials) Error() string {
+	return err.message
+}
 
-func GenerateToken(userID int, email string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"user_id": userID,
-			"email": email,
-			"exp":     time.Now().Add(time.Hour * 72).Unix(),
-	})
+// authenticate verifies the auth token or personal access token sent as a Bearer token or in the
+// auth_token cookie and stores the caller in the request locals. Credentials that aren't accepted
+// return an errInvalidCredentials
+func authenticate(c *fiber.Ctx, db *pgxpool.Pool) error {
+	tokenString := c.Cookies("auth_token")
+	if authHeader := c.Get(fiber.HeaderAuthorization); strings.HasPrefix(authHeader, "Bearer ") {
+		tokenString = strings.TrimPrefix(authHeader, "Bearer ")
+	}
+
+	if tokenString == "" {
+		return errInvalidCredentials{"Missing auth token"}
+	}
 
-	tokenString, err := token.SignedString(jwtSecret)
+	if strings.HasPrefix(tokenString, PersonalAccessTokenPrefix) {
+		return authenticatePersonalAccessToken(c, db, tokenString)
+	}
+
+	claims, err := utils.VerifyToken(tokenString)
 	if err != nil {
-			return "", err
+		return errInvalidCredentials{"Invalid or expired token"}
+	}
+
+	// Purpose tokens (password reset etc.) can't be used to authenticate
+	if _, ok := claims["purpose"]; ok {
+		return errInvalidCredentials{"Invalid or expired token"}
+	}
+
+	userID, _ := claims["user_id"].(string)
+	sessionID, _ := claims["session_id"].(string)
+	if userID == "" || sessionID == "" {
+		return errInvalidCredentials{"Invalid or expired token"}
 	}
 
-	return tokenString, nil
+	active, err := sessions.IsSessionActive(db, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return errInvalidCredentials{"Session expired or revoked"}
+	}
+
+	c.Locals("user_id", userID)
+	c.Locals("session_id", sessionID)
+	return nil
+}
+
+// AuthRequired verifies the auth token or personal access token sent as a Bearer token or in the
+// auth_token cookie and stores the user_id and session_id of the caller in the request locals
+func AuthRequired(db *pgxpool.Pool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var invalid errInvalidCredentials
+		if err := authenticate(c, db); errors.As(err, &invalid) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": invalid.message})
+		} else if err != nil {
+			log.Println("Error checking credentials: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking credentials", "message": err.Error()})
+		}
+
+		return c.Next()
+	}
+}
+
+// OptionalAuth authenticates requests that carry credentials like AuthRequired and lets anonymous requests
+// through, for routes that serve both. Credentials that aren't accepted, like the cookie of an expired
+// session, are ignored so the request goes on as anonymous
+func OptionalAuth(db *pgxpool.Pool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var invalid errInvalidCredentials
+		if err := authenticate(c, db); err != nil && !errors.As(err, &invalid) {
+			log.Println("Error checking credentials: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking credentials", "message": err.Error()})
+		}
+
+		return c.Next()
+	}
 }
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"server/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestOptionalAuthIgnoresInvalidCredentials(t *testing.T) {
+	expired, err := utils.GeneratePurposeToken("user", "password_reset", "token", -time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	purpose, err := utils.GeneratePurposeToken("user", "password_reset", "token", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	whoami := func(c *fiber.Ctx) error {
+		userID, _ := c.Locals("user_id").(string)
+		return c.SendString(userID)
+	}
+	app.Get("/optional", OptionalAuth(nil), whoami)
+	app.Get("/required", AuthRequired(nil), whoami)
+
+	tests := []struct {
+		name   string
+		cookie string
+		bearer string
+	}{
+		{"anonymous", "", ""},
+		{"malformed cookie", "not a token", ""},
+		{"expired cookie", expired, ""},
+		{"purpose token", "", purpose},
+		{"malformed bearer", "", "not a token"},
+	}
+	for _, test := range tests {
+		for path, status := range map[string]int{"/optional": fiber.StatusOK, "/required": fiber.StatusUnauthorized} {
+			req := httptest.NewRequest("GET", path, nil)
+			if test.cookie != "" {
+				req.Header.Set("Cookie", "auth_token="+test.cookie)
+			}
+			if test.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+test.bearer)
+			}
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != status {
+				t.Errorf("%s on %s: status %d, want %d", test.name, path, resp.StatusCode, status)
+			}
+			if path == "/optional" && len(body) != 0 {
+				t.Errorf("%s on %s: authenticated as %q", test.name, path, body)
+			}
+		}
+	}
+}
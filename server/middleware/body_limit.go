@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// BodyLimit rejects request bodies larger than limit bytes. The server streams request bodies so a few routes
+// can take large uploads without holding them in memory, which leaves the size of every other body to this
+// check. Requests to paths starting with one of the skip prefixes are left to a limit of their own route
+func BodyLimit(limit int, skip ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		for _, prefix := range skip {
+			if strings.HasPrefix(c.Path(), prefix) {
+				return c.Next()
+			}
+		}
+
+		tooLarge := func() error {
+			// The rest of the body is never read, so the connection can't take another request
+			c.Context().SetConnectionClose()
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": fmt.Sprintf("Request body is larger than %d bytes", limit)})
+		}
+
+		if c.Request().Header.ContentLength() > limit {
+			return tooLarge()
+		}
+
+		// Chunked bodies have no length up front, they are read here up to the limit
+		if stream := c.Context().RequestBodyStream(); stream != nil && c.Request().Header.ContentLength() < 0 {
+			body, err := io.ReadAll(io.LimitReader(stream, int64(limit)+1))
+			if err != nil {
+				c.Context().SetConnectionClose()
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Error reading request body", "message": err.Error()})
+			}
+			if len(body) > limit {
+				return tooLarge()
+			}
+			c.Request().SetBody(body)
+		}
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestBodyLimit(t *testing.T) {
+	app := fiber.New(fiber.Config{StreamRequestBody: true, DisablePreParseMultipartForm: true})
+	app.Use(BodyLimit(16, "/large/"))
+	echo := func(c *fiber.Ctx) error {
+		return c.Send(c.Body())
+	}
+	app.Post("/small", echo)
+	app.Post("/large/upload", BodyLimit(64), echo)
+
+	tests := []struct {
+		path    string
+		size    int
+		chunked bool
+		status  int
+	}{
+		{"/small", 16, false, fiber.StatusOK},
+		{"/small", 17, false, fiber.StatusRequestEntityTooLarge},
+		{"/small", 16, true, fiber.StatusOK},
+		{"/small", 17, true, fiber.StatusRequestEntityTooLarge},
+		{"/large/upload", 64, false, fiber.StatusOK},
+		{"/large/upload", 65, false, fiber.StatusRequestEntityTooLarge},
+		{"/large/upload", 65, true, fiber.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		body := strings.Repeat("x", test.size)
+		req := httptest.NewRequest("POST", test.path, strings.NewReader(body))
+		if test.chunked {
+			req.ContentLength = -1
+			req.TransferEncoding = []string{"chunked"}
+		}
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echoed, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != test.status {
+			t.Errorf("%d bytes to %s, chunked %v: status %d, want %d", test.size, test.path, test.chunked, resp.StatusCode, test.status)
+		} else if test.status == fiber.StatusOK && string(echoed) != body {
+			t.Errorf("%d bytes to %s, chunked %v: handler read %d bytes", test.size, test.path, test.chunked, len(echoed))
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"server/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// ScimAuthRequired verifies the organization scoped SCIM bearer token of the organization in the url
+func ScimAuthRequired(db *pgxpool.Pool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		organizationId := c.Params("organization_id")
+		authHeader := c.Get(fiber.HeaderAuthorization)
+
+		if !strings.HasPrefix(authHeader, "Bearer ") || organizationId == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Missing SCIM token"})
+		}
+
+		// Tokens of an organization scheduled for deletion stop working with it
+		var tokenID string
+		query := `
+			UPDATE scimtokens st SET last_used_at = NOW()
+			FROM organizations o
+			WHERE st.token_hash = $1 AND st.organization_id = $2 AND st.revoked_at IS NULL
+			AND o.organization_id = st.organization_id AND o.deleted_at IS NULL
+			RETURNING st.id;
+		`
+		err := db.QueryRow(
+			context.Background(),
+			query,
+			utils.HashToken(strings.TrimPrefix(authHeader, "Bearer ")), organizationId,
+		).Scan(&tokenID)
+
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid SCIM token"})
+		} else if err != nil {
+			log.Println("Error checking SCIM token: ", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking SCIM token", "message": err.Error()})
+		}
+
+		c.Locals("organization_id", organizationId)
+
+		return c.Next()
+	}
+}
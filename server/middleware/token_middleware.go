@@ -0,0 +1,211 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"server/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// PersonalAccessTokenPrefix marks bearer tokens that are personal access tokens rather than session tokens
+const PersonalAccessTokenPrefix = "silo_pat_"
+
+// Scopes that can be granted to personal access tokens
+const (
+	ScopeReadFiles     = "files:read"
+	ScopeWriteFiles    = "files:write"
+	ScopeManageMembers = "members:manage"
+	ScopeReadAudit     = "audit:read"
+)
+
+var Scopes = []string{ScopeReadFiles, ScopeWriteFiles, ScopeManageMembers, ScopeReadAudit}
+
+// authenticatePersonalAccessToken verifies a personal access token, records its use and stores
+// the user_id, token_id, token_scopes and token_organization_id in the request locals, tokens that
+// aren't accepted return an errInvalidCredentials
+func authenticatePersonalAccessToken(c *fiber.Ctx, db *pgxpool.Pool, token string) error {
+	var userID, tokenID string
+	var scopes []string
+	var organizationID *string
+
+	query := `
+		UPDATE personalaccesstokens SET last_used_at = NOW()
+		WHERE token_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		RETURNING id, user_id, scopes, organization_id;
+	`
+	err := db.QueryRow(context.Background(), query, utils.HashToken(token)).Scan(&tokenID, &userID, &scopes, &organizationID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errInvalidCredentials{"Invalid, expired or revoked token"}
+	} else if err != nil {
+		return err
+	}
+
+	c.Locals("user_id", userID)
+	c.Locals("token_id", tokenID)
+	c.Locals("token_scopes", scopes)
+	if organizationID != nil {
+		c.Locals("token_organization_id", *organizationID)
+	}
+
+	return nil
+}
+
+// resourceOrganizations finds the organizations a request targets from the organization, folders and files in
+// its params and body, ids that don't exist are left out
+func resourceOrganizations(c *fiber.Ctx, db *pgxpool.Pool) ([]string, error) {
+	var body struct {
+		OrganizationID string   `json:"organization_id"`
+		FolderID       string   `json:"folder_id"`
+		ParentFolderID string   `json:"parent_folder_id"`
+		FileIDs        []string `json:"file_ids"`
+		FolderIDs      []string `json:"folder_ids"`
+	}
+	if len(c.Body()) > 0 {
+		json.Unmarshal(c.Body(), &body)
+	}
+
+	organizationIDs := validIDs(c.Params("organization_id"), body.OrganizationID)
+	folderIDs := validIDs(append([]string{c.Params("folder_id"), c.Params("parent_folder_id"), body.FolderID, body.ParentFolderID}, body.FolderIDs...)...)
+	fileIDs := validIDs(append([]string{c.Params("file_id", c.Params("id"))}, body.FileIDs...)...)
+
+	rows, err := db.Query(
+		context.Background(),
+		`
+			SELECT organization_id::text FROM organizations WHERE organization_id = ANY($1::uuid[])
+			UNION SELECT organization_id::text FROM folders WHERE id = ANY($2::uuid[])
+			UNION SELECT organization_id::text FROM files WHERE id = ANY($3::uuid[]);
+		`,
+		organizationIDs, folderIDs, fileIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var organizations []string
+	for rows.Next() {
+		var organizationID string
+		if err := rows.Scan(&organizationID); err != nil {
+			return nil, err
+		}
+		organizations = append(organizations, organizationID)
+	}
+	return organizations, rows.Err()
+}
+
+// validIDs keeps the values that are UUIDs
+func validIDs(values ...string) []string {
+	ids := []string{}
+	for _, value := range values {
+		if _, err := uuid.Parse(value); err == nil {
+			ids = append(ids, value)
+		}
+	}
+	return ids
+}
+
+// onlyOrganization reports whether a request targets resources of one organization only, the one of the token
+func onlyOrganization(organizationIDs []string, tokenOrganizationID string) bool {
+	if len(organizationIDs) == 0 {
+		return false
+	}
+	for _, organizationID := range organizationIDs {
+		if organizationID != tokenOrganizationID {
+			return false
+		}
+	}
+	return true
+}
+
+// RequireScope limits personal access tokens to routes allowed by their scopes and to resources of their
+// organization, session tokens are not restricted. Routes without it refuse tokens, see RejectUnscopedTokens.
+// Must be used after AuthRequired
+func RequireScope(db *pgxpool.Pool, scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		scopes, isToken := c.Locals("token_scopes").([]string)
+		if !isToken {
+			return c.Next()
+		}
+
+		allowed := false
+		for _, granted := range scopes {
+			// Writing files implies reading them
+			if granted == scope || (scope == ScopeReadFiles && granted == ScopeWriteFiles) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Token is missing the " + scope + " scope"})
+		}
+
+		if tokenOrganizationID, ok := c.Locals("token_organization_id").(string); ok {
+			organizationIDs, err := resourceOrganizations(c, db)
+			if err != nil {
+				log.Println("Error resolving organization: ", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error checking token", "message": err.Error()})
+			}
+			if !onlyOrganization(organizationIDs, tokenOrganizationID) {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Token is not allowed to access this organization"})
+			}
+		}
+
+		c.Locals("token_scope", scope)
+		return c.Next()
+	}
+}
+
+// rejectUnscopedToken rejects personal access tokens that no RequireScope let through
+func rejectUnscopedToken(c *fiber.Ctx) error {
+	_, isToken := c.Locals("token_id").(string)
+	_, isScoped := c.Locals("token_scope").(string)
+	if isToken && !isScoped {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Personal access tokens can't be used here"})
+	}
+
+	return c.Next()
+}
+
+// RejectUnscopedTokens closes every route to personal access tokens unless it declares the scope it needs with
+// RequireScope, so routes added without one don't accept tokens by accident. The check runs right before the
+// handler of each route, after the route and group middleware. Must be called once all routes are registered
+func RejectUnscopedTokens(app *fiber.App) {
+	// Handlers of routes, group and app middleware aren't listed
+	handlers := map[*fiber.Handler]bool{}
+	for _, route := range app.GetRoutes(true) {
+		handlers[&route.Handlers[len(route.Handlers)-1]] = true
+	}
+
+	for _, routes := range app.Stack() {
+		for _, route := range routes {
+			last := len(route.Handlers) - 1
+			if last < 0 || !handlers[&route.Handlers[last]] {
+				continue
+			}
+
+			checked := make([]fiber.Handler, 0, len(route.Handlers)+1)
+			checked = append(checked, route.Handlers[:last]...)
+			checked = append(checked, rejectUnscopedToken, route.Handlers[last])
+			route.Handlers = checked
+		}
+	}
+}
+
+// SessionRequired rejects personal access tokens on routes that need an interactive login.
+// Must be used after AuthRequired
+func SessionRequired() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if _, isToken := c.Locals("token_id").(string); isToken {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Personal access tokens can't be used here"})
+		}
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// testApp serves routes with and without scopes behind a fake authentication, requests sent with a token
+// header are authenticated as a personal access token with the files:read scope
+func testApp() *fiber.App {
+	app := fiber.New()
+	authenticate := func(c *fiber.Ctx) error {
+		c.Locals("user_id", "user")
+		if c.Get("X-Test-Token") != "" {
+			c.Locals("token_id", "token")
+			c.Locals("token_scopes", []string{ScopeReadFiles})
+		}
+		return c.Next()
+	}
+	ok := func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	}
+
+	files := app.Group("/files", authenticate)
+	files.Get("/read", RequireScope(nil, ScopeReadFiles), ok)
+	files.Post("/write", RequireScope(nil, ScopeWriteFiles), ok)
+	files.Get("/unscoped", ok)
+
+	audit := app.Group("/audit", authenticate, RequireScope(nil, ScopeReadFiles))
+	audit.Get("/log", ok)
+
+	app.Get("/session", authenticate, SessionRequired(), ok)
+
+	RejectUnscopedTokens(app)
+	return app
+}
+
+func TestRejectUnscopedTokens(t *testing.T) {
+	app := testApp()
+
+	tests := []struct {
+		method string
+		path   string
+		token  bool
+		status int
+	}{
+		{"GET", "/files/read", true, fiber.StatusOK},
+		{"HEAD", "/files/read", true, fiber.StatusOK},
+		{"GET", "/files/read", false, fiber.StatusOK},
+		{"POST", "/files/write", true, fiber.StatusForbidden},
+		{"GET", "/files/unscoped", true, fiber.StatusForbidden},
+		{"GET", "/files/unscoped", false, fiber.StatusOK},
+		{"GET", "/audit/log", true, fiber.StatusOK},
+		{"GET", "/session", true, fiber.StatusForbidden},
+		{"GET", "/session", false, fiber.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.token {
+			req.Header.Set("X-Test-Token", "1")
+		}
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s with token %v: status %d, expected %d", test.method, test.path, test.token, resp.StatusCode, test.status)
+		}
+	}
+}
+
+func TestOnlyOrganization(t *testing.T) {
+	tests := []struct {
+		organizations []string
+		allowed       bool
+	}{
+		{[]string{"org"}, true},
+		{[]string{"org", "other"}, false},
+		{[]string{"other"}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if onlyOrganization(test.organizations, "org") != test.allowed {
+			t.Errorf("onlyOrganization(%v) != %v", test.organizations, test.allowed)
+		}
+	}
+}
+
+func TestValidIDs(t *testing.T) {
+	ids := validIDs("", "not-an-id", "8c0a1b2e-4f6d-4c3b-9a1e-2d3f4a5b6c7d")
+	if len(ids) != 1 || ids[0] != "8c0a1b2e-4f6d-4c3b-9a1e-2d3f4a5b6c7d" {
+		t.Errorf("validIDs kept %v", ids)
+	}
+}
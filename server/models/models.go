@@ -1,6 +1,9 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type User struct {
 	UserID          string      `json:"user_id"`
@@ -9,19 +12,184 @@ type User struct {
 	Email           string      `json:"email"`
 	PhoneNumber     string      `json:"phone_number"`
 	Password        string      `json:"password"`
+	EmailVerified   bool        `json:"email_verified"`
 	CreatedAt       time.Time   `json:"created_at"`
 }
 
 type Organization struct {
+	OrganizationID string     `json:"organization_id"`
+	Name           string     `json:"name"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeletedAt      *time.Time `json:"deleted_at,omitempty"`
+	PurgeAt        *time.Time `json:"purge_at,omitempty"`
+}
+
+type UserOrganization struct {
+	ID             string    `json:"id"`
+	UserID         string    `json:"user_id"`
+	OrganizationID string    `json:"organization_id"`
+	Role           string    `json:"role"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type OrganizationSSO struct {
+	OrganizationID string    `json:"organization_id"`
+	Issuer         string    `json:"issuer"`
+	ClientID       string    `json:"client_id"`
+	ClientSecret   string    `json:"client_secret,omitempty"`
+	EmailDomains   []string  `json:"email_domains"`
+	DefaultRole    string    `json:"default_role"`
+	EnforceSSO     bool      `json:"enforce_sso"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// SSODomain is an email domain an organization routes to its identity provider, it is used once the TXT record
+// RecordName holds RecordValue and the domain is verified
+type SSODomain struct {
+	Domain      string     `json:"domain"`
+	RecordName  string     `json:"record_name"`
+	RecordValue string     `json:"record_value"`
+	VerifiedAt  *time.Time `json:"verified_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+type Invitation struct {
+	ID               string     `json:"id"`
+	OrganizationID   string     `json:"organization_id"`
+	OrganizationName string     `json:"organization_name"`
+	Email            string     `json:"email"`
+	Role             string     `json:"role"`
+	Status           string     `json:"status"`
+	InvitedBy        *string    `json:"invited_by,omitempty"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	CreatedAt        time.Time  `json:"created_at"`
+	AcceptedAt       *time.Time `json:"accepted_at,omitempty"`
+}
+
+type OwnershipTransfer struct {
+	ID             string     `json:"id"`
+	OrganizationID string     `json:"organization_id"`
+	FromUserID     string     `json:"from_user_id"`
+	ToUserID       string     `json:"to_user_id"`
+	Status         string     `json:"status"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	RespondedAt    *time.Time `json:"responded_at,omitempty"`
+}
+
+type AuditLog struct {
+	ID             string          `json:"id"`
+	OrganizationID *string         `json:"organization_id,omitempty"`
+	ActorID        *string         `json:"actor_id,omitempty"`
+	ActorEmail     *string         `json:"actor_email,omitempty"`
+	ActorType      string          `json:"actor_type"`
+	Action         string          `json:"action"`
+	TargetType     *string         `json:"target_type,omitempty"`
+	TargetID       *string         `json:"target_id,omitempty"`
+	IPAddress      *string         `json:"ip_address,omitempty"`
+	UserAgent      *string         `json:"user_agent,omitempty"`
+	Before         json.RawMessage `json:"before,omitempty"`
+	After          json.RawMessage `json:"after,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+type ShareLink struct {
+	ID                string     `json:"id"`
+	OrganizationID    string     `json:"organization_id"`
+	FileID            *string    `json:"file_id,omitempty"`
+	FolderID          *string    `json:"folder_id,omitempty"`
+	GroupID           *string    `json:"group_id,omitempty"`
+	Mode              string     `json:"mode"`
+	Password          string     `json:"password,omitempty"`
+	PasswordProtected bool       `json:"password_protected"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads      *int       `json:"max_downloads,omitempty"`
+	ViewCount         int        `json:"view_count"`
+	DownloadCount     int        `json:"download_count"`
+	CreatedBy         *string    `json:"created_by,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	LastAccessedAt    *time.Time `json:"last_accessed_at,omitempty"`
+	RevokedAt         *time.Time `json:"revoked_at,omitempty"`
+}
+
+type Group struct {
+	ID             string    `json:"id"`
 	OrganizationID string    `json:"organization_id"`
 	Name           string    `json:"name"`
+	Description    *string   `json:"description,omitempty"`
+	Role           string    `json:"role"`
+	MemberCount    int       `json:"member_count"`
+	CreatedBy      *string   `json:"created_by,omitempty"`
 	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
 }
 
-type UserOrganization struct {
+type GroupMember struct {
+	GroupID   string    `json:"group_id"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	AddedBy   *string   `json:"added_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type FolderPermission struct {
+	ID             string    `json:"id"`
+	FolderID       string    `json:"folder_id"`
+	OrganizationID string    `json:"organization_id"`
+	UserID         *string   `json:"user_id,omitempty"`
+	GroupID        *string   `json:"group_id,omitempty"`
+	Role           string    `json:"role"`
+	GrantedBy      *string   `json:"granted_by,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	InheritedFrom  *string   `json:"inherited_from,omitempty"`
+}
+
+type FolderShare struct {
+	ID                   string     `json:"id"`
+	FolderID             string     `json:"folder_id"`
+	FolderName           string     `json:"folder_name,omitempty"`
+	OrganizationID       string     `json:"organization_id"`
+	OrganizationName     string     `json:"organization_name,omitempty"`
+	TargetOrganizationID *string    `json:"target_organization_id,omitempty"`
+	TargetUserID         *string    `json:"target_user_id,omitempty"`
+	TargetName           string     `json:"target_name,omitempty"`
+	Email                string     `json:"email,omitempty"`
+	Role                 string     `json:"role"`
+	CreatedBy            *string    `json:"created_by,omitempty"`
+	CreatedAt            time.Time  `json:"created_at"`
+	AcceptedAt           *time.Time `json:"accepted_at"`
+	RevokedAt            *time.Time `json:"revoked_at,omitempty"`
+}
+
+type PersonalAccessToken struct {
+	ID             string     `json:"id"`
+	UserID         string     `json:"user_id"`
+	Name           string     `json:"name"`
+	Scopes         []string   `json:"scopes"`
+	OrganizationID *string    `json:"organization_id,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+type ScimToken struct {
+	ID             string     `json:"id"`
+	OrganizationID string     `json:"organization_id"`
+	Name           string     `json:"name"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+}
+
+type ScimGroup struct {
 	ID             string    `json:"id"`
-	UserID         string    `json:"user_id"`
 	OrganizationID string    `json:"organization_id"`
+	ExternalID     string    `json:"external_id"`
+	DisplayName    string    `json:"display_name"`
 	Role           string    `json:"role"`
 	CreatedAt      time.Time `json:"created_at"`
 }
@@ -35,6 +203,9 @@ type Folder struct {
 	UpdatedAt       time.Time `json:"updated_at"`
 	Deleted         bool      `json:"deleted"`
 	DeletedAt       *time.Time `json:"deleted_at,omitempty"`
+	CreatedBy       *string    `json:"created_by,omitempty"`
+	Tags            []string   `json:"tags,omitempty"`
+	Metadata        map[string]interface{} `json:"metadata,omitempty"`
 }
 
 type File struct {
@@ -48,6 +219,114 @@ type File struct {
 	OrganizationID  string    `json:"organization_id"`
 	Deleted         bool      `json:"deleted"`
 	DeletedAt       *time.Time `json:"deleted_at,omitempty"`
+	CreatedBy       *string    `json:"created_by,omitempty"`
+	Tags            []string   `json:"tags,omitempty"`
+	Metadata        map[string]interface{} `json:"metadata,omitempty"`
+	// ContentHash is the hex SHA-256 of the content, missing until the content has been hashed
+	ContentHash     *string    `json:"content_hash,omitempty"`
+}
+
+// FileVersion is earlier content of a file, kept when an upload replaced it
+type FileVersion struct {
+	ID         string     `json:"id"`
+	FileID     string     `json:"file_id"`
+	FileSize   int64      `json:"file_size"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	ReplacedBy *string    `json:"replaced_by,omitempty"`
+	ReplacedAt time.Time  `json:"replaced_at"`
+}
+
+// Tag labels files and folders of an organization, ItemCount is how many carry it. Tag listings only count
+// the files and folders the user can see
+type Tag struct {
+	ID             string    `json:"id"`
+	OrganizationID string    `json:"organization_id"`
+	Name           string    `json:"name"`
+	Color          *string   `json:"color,omitempty"`
+	ItemCount      int       `json:"item_count"`
+	CreatedBy      *string   `json:"created_by,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// MetadataField is a key files and folders of an organization can hold metadata for. Type is text, number,
+// date, boolean or select, select values must be one of Options
+type MetadataField struct {
+	ID             string    `json:"id"`
+	OrganizationID string    `json:"organization_id"`
+	Key            string    `json:"key"`
+	Label          string    `json:"label"`
+	Type           string    `json:"type"`
+	Options        []string  `json:"options"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// EncryptionKey is a data key file contents of an organization are encrypted with, the active key encrypts new
+// content. The key itself is only stored wrapped by the master key MasterKeyID identifies and is never returned
+type EncryptionKey struct {
+	ID             string    `json:"id"`
+	OrganizationID string    `json:"organization_id"`
+	Version        int       `json:"version"`
+	MasterKeyID    string    `json:"master_key_id"`
+	Active         bool      `json:"active"`
+	BlobCount      int       `json:"blob_count"`
+	CreatedAt      time.Time `json:"created_at"`
+	WrappedAt      time.Time `json:"wrapped_at"`
+}
+
+// SearchResult is a file matching a search, highlights mark the matches in its name and content with <mark> tags
+type SearchResult struct {
+	File
+	Rank             float32 `json:"rank"`
+	NameHighlight    string  `json:"name_highlight"`
+	ContentHighlight *string `json:"content_highlight,omitempty"`
+}
+
+// DriveItem is a file or folder in a listing that mixes both, like starred or recent items
+type DriveItem struct {
+	ID               string     `json:"id"`
+	Type             string     `json:"type"`
+	Name             string     `json:"name"`
+	OrganizationID   string     `json:"organization_id"`
+	OrganizationName string     `json:"organization_name"`
+	ParentID         *string    `json:"parent_id,omitempty"`
+	Size             int64      `json:"size"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+	Role             string     `json:"role"`
+	StarredAt        *time.Time `json:"starred_at,omitempty"`
+	ActivityAt       *time.Time `json:"activity_at,omitempty"`
+	SharedAt         *time.Time `json:"shared_at,omitempty"`
+	SharedBy         *string    `json:"shared_by,omitempty"`
+}
+
+// Breadcrumb is a folder on the way from the root of an organization to an item
+type Breadcrumb struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// ImportJob extracts an uploaded archive into a folder, or into the root of an organization when FolderID is nil
+type ImportJob struct {
+	ID               string     `json:"id"`
+	OrganizationID   string     `json:"organization_id"`
+	FolderID         *string    `json:"folder_id,omitempty"`
+	UserID           string     `json:"user_id"`
+	ArchiveName      string     `json:"archive_name"`
+	OnConflict       string     `json:"on_conflict"`
+	Status           string     `json:"status"`
+	TotalEntries     int        `json:"total_entries"`
+	TotalBytes       int64      `json:"total_bytes"`
+	ProcessedEntries int        `json:"processed_entries"`
+	ProcessedBytes   int64      `json:"processed_bytes"`
+	FilesCreated     int        `json:"files_created"`
+	FilesReplaced    int        `json:"files_replaced"`
+	FoldersCreated   int        `json:"folders_created"`
+	SkippedEntries   int        `json:"skipped_entries"`
+	Error            *string    `json:"error,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	StartedAt        *time.Time `json:"started_at,omitempty"`
+	CompletedAt      *time.Time `json:"completed_at,omitempty"`
 }
 
 type Fleet struct {
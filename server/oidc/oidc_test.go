@@ -0,0 +1,244 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID = "silo"
+	testKeyID    = "test-key"
+)
+
+// mockProvider is an identity provider serving discovery, keys and a token endpoint checking PKCE
+type mockProvider struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	idToken   string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := &mockProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Provider{
+			Issuer:                mock.server.URL,
+			AuthorizationEndpoint: mock.server.URL + "/authorize",
+			TokenEndpoint:         mock.server.URL + "/token",
+			JWKSURI:               mock.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": testKeyID,
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "code" || CodeChallenge(r.Form.Get("code_verifier")) != mock.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": mock.idToken})
+	})
+
+	mock.server = httptest.NewTLSServer(mux)
+	t.Cleanup(mock.server.Close)
+
+	// The mock listens on loopback, which the default client refuses
+	client := httpClient
+	httpClient = mock.server.Client()
+	t.Cleanup(func() { httpClient = client })
+
+	return mock
+}
+
+func (mock *mockProvider) sign(t *testing.T, key *rsa.PrivateKey, claims Claims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = testKeyID
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (mock *mockProvider) claims(nonce string) Claims {
+	return Claims{
+		Subject: "user-1",
+		Email:   "ada@example.com",
+		Nonce:   nonce,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    mock.server.URL,
+			Audience:  jwt.ClaimStrings{testClientID},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+}
+
+func TestLogin(t *testing.T) {
+	mock := newMockProvider(t)
+
+	provider, err := Discover(context.Background(), mock.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, _ := RandomString()
+	mock.challenge = CodeChallenge(verifier)
+	mock.idToken = mock.sign(t, mock.key, mock.claims("nonce"))
+
+	rawIDToken, err := provider.Exchange(context.Background(), testClientID, "", "https://silo.test/callback", "code", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := provider.VerifyIDToken(context.Background(), rawIDToken, testClientID, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "user-1" || claims.Email != "ada@example.com" {
+		t.Errorf("got claims %+v", claims)
+	}
+
+	if _, err := provider.Exchange(context.Background(), testClientID, "", "https://silo.test/callback", "code", "other"); err == nil {
+		t.Error("exchange succeeded with the wrong PKCE verifier")
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	mock := newMockProvider(t)
+
+	provider, err := Discover(context.Background(), mock.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		key   *rsa.PrivateKey
+		claim func(*Claims)
+	}{
+		{"wrong nonce", mock.key, func(c *Claims) { c.Nonce = "other" }},
+		{"wrong audience", mock.key, func(c *Claims) { c.Audience = jwt.ClaimStrings{"other"} }},
+		{"wrong issuer", mock.key, func(c *Claims) { c.Issuer = "https://other.test" }},
+		{"expired", mock.key, func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }},
+		{"no expiry", mock.key, func(c *Claims) { c.ExpiresAt = nil }},
+		{"bad signature", otherKey, func(c *Claims) {}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := mock.claims("nonce")
+			test.claim(&claims)
+
+			rawIDToken := mock.sign(t, test.key, claims)
+			if _, err := provider.VerifyIDToken(context.Background(), rawIDToken, testClientID, "nonce"); err == nil {
+				t.Error("token was accepted")
+			}
+		})
+	}
+}
+
+func TestDiscoverRejects(t *testing.T) {
+	mock := newMockProvider(t)
+
+	if _, err := Discover(context.Background(), strings.Replace(mock.server.URL, "https", "http", 1)); err == nil {
+		t.Error("http issuer was accepted")
+	}
+	if _, err := Discover(context.Background(), mock.server.URL+"/other"); err == nil {
+		t.Error("issuer not matching its discovery document was accepted")
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	provider := &Provider{AuthorizationEndpoint: "https://idp.test/authorize?tenant=1"}
+
+	login, err := url.Parse(provider.AuthCodeURL(testClientID, "https://silo.test/callback", "state", "nonce", "verifier"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := login.Query()
+	expected := map[string]string{
+		"tenant":                "1",
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          "https://silo.test/callback",
+		"state":                 "state",
+		"nonce":                 "nonce",
+		"code_challenge":        CodeChallenge("verifier"),
+		"code_challenge_method": "S256",
+	}
+	for name, value := range expected {
+		if query.Get(name) != value {
+			t.Errorf("%s = %q, expected %q", name, query.Get(name), value)
+		}
+	}
+}
+
+func TestIsPrivateAddress(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1":       true,
+		"10.1.2.3":        true,
+		"172.16.0.1":      true,
+		"192.168.1.1":     true,
+		"169.254.169.254": true,
+		"100.64.0.1":      true,
+		"0.0.0.0":         true,
+		"::1":             true,
+		"fd00::1":         true,
+		"fe80::1":         true,
+		"8.8.8.8":         false,
+		"2606:4700::1111": false,
+	}
+	for address, private := range tests {
+		if IsPrivateAddress(net.ParseIP(address)) != private {
+			t.Errorf("IsPrivateAddress(%s) != %v", address, private)
+		}
+	}
+}
+
+func TestClientRefusesPrivateAddress(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	_, err := httpClient.Get(server.URL)
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("expected ErrPrivateAddress, got %v", err)
+	}
+}
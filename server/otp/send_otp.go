@@ -3,6 +3,7 @@ package otp
 import (
 	"context"
 	"fmt"
+	"html"
 	"log"
 	"os"
 	"time"
@@ -11,7 +12,8 @@ import (
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 )
 
-func SendOTPEmail(recipientEmail, otp string) error {
+// SendEmail sends an email through sendgrid
+func SendEmail(recipientEmail, subject, plainTextContent, htmlContent string) error {
 	APIKey := os.Getenv("SENDGRID_API_KEY");
 	if APIKey == "" {
 		log.Println("No API KEY")
@@ -19,9 +21,6 @@ func SendOTPEmail(recipientEmail, otp string) error {
 	}
 
 	from := mail.NewEmail("Silo", os.Getenv("MAIL_FROM"))
-	subject := "Your Login OTP"
-	plainTextContent := fmt.Sprintf("Your OTP is: %s. This OTP will expire in 5 minutes.", otp)
-	htmlContent := fmt.Sprintf("<p>Your OTP is: <strong>%s</strong>. This OTP will expire in 5 minutes.</p>", otp)
 	to := mail.NewEmail("Recipient", recipientEmail)
 	message := mail.NewSingleEmail(from, subject, to, plainTextContent, htmlContent)
 
@@ -39,3 +38,64 @@ func SendOTPEmail(recipientEmail, otp string) error {
 	log.Printf("Email sent successfully. Status Code: %d", response.StatusCode)
 	return nil
 }
+
+func SendOTPEmail(recipientEmail, otp string) error {
+	subject := "Your Login OTP"
+	plainTextContent := fmt.Sprintf("Your OTP is: %s. This OTP will expire in 5 minutes.", otp)
+	htmlContent := fmt.Sprintf("<p>Your OTP is: <strong>%s</strong>. This OTP will expire in 5 minutes.</p>", otp)
+
+	return SendEmail(recipientEmail, subject, plainTextContent, htmlContent)
+}
+
+// SendPasswordResetEmail sends a link containing a password reset token
+func SendPasswordResetEmail(recipientEmail, token string) error {
+	resetLink := fmt.Sprintf("%s/reset-password?token=%s", os.Getenv("CLIENT_URL"), token)
+
+	subject := "Reset your password"
+	plainTextContent := fmt.Sprintf("Use this link to reset your password: %s. The link will expire in 30 minutes.", resetLink)
+	htmlContent := fmt.Sprintf("<p>Use <a href=\"%s\">this link</a> to reset your password. The link will expire in 30 minutes.</p>", resetLink)
+
+	return SendEmail(recipientEmail, subject, plainTextContent, htmlContent)
+}
+
+// SendVerificationEmail sends a link containing an email verification token
+func SendVerificationEmail(recipientEmail, token string) error {
+	verificationLink := fmt.Sprintf("%s/verify-email?token=%s", os.Getenv("CLIENT_URL"), token)
+
+	subject := "Verify your email"
+	plainTextContent := fmt.Sprintf("Use this link to verify your email: %s. The link will expire in 24 hours.", verificationLink)
+	htmlContent := fmt.Sprintf("<p>Use <a href=\"%s\">this link</a> to verify your email. The link will expire in 24 hours.</p>", verificationLink)
+
+	return SendEmail(recipientEmail, subject, plainTextContent, htmlContent)
+}
+
+// SendInvitationEmail sends a link to join an organization
+func SendInvitationEmail(recipientEmail, organizationName, token string) error {
+	invitationLink := fmt.Sprintf("%s/invitation?token=%s", os.Getenv("CLIENT_URL"), token)
+
+	subject := fmt.Sprintf("You have been invited to join %s on Silo", organizationName)
+	plainTextContent := fmt.Sprintf("You have been invited to join %s. Use this link to accept the invitation: %s. The link will expire in 7 days.", organizationName, invitationLink)
+	htmlContent := fmt.Sprintf("<p>You have been invited to join <strong>%s</strong>. Use <a href=\"%s\">this link</a> to accept the invitation. The link will expire in 7 days.</p>", html.EscapeString(organizationName), invitationLink)
+
+	return SendEmail(recipientEmail, subject, plainTextContent, htmlContent)
+}
+
+func SendOwnershipTransferEmail(recipientEmail, organizationName, organizationID string) error {
+	transferLink := fmt.Sprintf("%s/organization/%s/transfer", os.Getenv("CLIENT_URL"), organizationID)
+
+	subject := fmt.Sprintf("You have been asked to become the owner of %s on Silo", organizationName)
+	plainTextContent := fmt.Sprintf("The owner of %s wants to transfer the organization to you. Use this link to accept or decline: %s. The request will expire in 7 days.", organizationName, transferLink)
+	htmlContent := fmt.Sprintf("<p>The owner of <strong>%s</strong> wants to transfer the organization to you. Use <a href=\"%s\">this link</a> to accept or decline. The request will expire in 7 days.</p>", html.EscapeString(organizationName), transferLink)
+
+	return SendEmail(recipientEmail, subject, plainTextContent, htmlContent)
+}
+
+func SendFolderShareEmail(recipientEmail, folderName, organizationName string) error {
+	sharedLink := fmt.Sprintf("%s/shared", os.Getenv("CLIENT_URL"))
+
+	subject := fmt.Sprintf("%s shared the folder %s with you on Silo", organizationName, folderName)
+	plainTextContent := fmt.Sprintf("%s shared the folder %s with you. Accept it in your shared items to open it: %s", organizationName, folderName, sharedLink)
+	htmlContent := fmt.Sprintf("<p><strong>%s</strong> shared the folder <strong>%s</strong> with you. Accept it in <a href=\"%s\">your shared items</a> to open it.</p>", html.EscapeString(organizationName), html.EscapeString(folderName), sharedLink)
+
+	return SendEmail(recipientEmail, subject, plainTextContent, htmlContent)
+}
@@ -0,0 +1,39 @@
+package otp
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"server/redis_pkg"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// StoreToken stores a single use token under the given key until it expires
+func StoreToken(key string, value string, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err := redis_pkg.RedisClient.Set(ctx, key, value, ttl).Err()
+	if err != nil {
+		return fmt.Errorf("failed to store token: %w", err)
+	}
+
+	return nil
+}
+
+// ConsumeToken retrieves a token stored with StoreToken and deletes it so it can't be used again
+func ConsumeToken(key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	value, err := redis_pkg.RedisClient.GetDel(ctx, key).Result()
+	if err == redis.Nil {
+		return "", fmt.Errorf("token not found or already used")
+	} else if err != nil {
+		return "", fmt.Errorf("failed to retrieve token: %w", err)
+	}
+
+	return value, nil
+}
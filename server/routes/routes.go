@@ -2,6 +2,7 @@ package routes
 
 import (
 	"server/handlers"
+	"server/middleware"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -11,15 +12,56 @@ import (
 func RegisterRoutes(app *fiber.App, db *pgxpool.Pool, redisClient *redis.Client) {
 	// Auth routes
 	handlers.RegisterAuthRoutes(app, db)
+	// Account routes
+	handlers.RegisterAccountRoutes(app, db)
+	// Personal access token routes
+	handlers.RegisterTokenRoutes(app, db)
+	// SSO routes
+	handlers.RegisterSSORoutes(app, db)
 	// Folder routes
 	handlers.RegisterFolderRoutes(app, db)
 	// File routes
 	handlers.RegisterFileRoutes(app, db)
+	// Share link routes
+	handlers.RegisterShareRoutes(app, db)
+	// Permission routes
+	handlers.RegisterPermissionRoutes(app, db)
+	// Group routes
+	handlers.RegisterGroupRoutes(app, db)
+	// Cross-organization folder share routes
+	handlers.RegisterFolderShareRoutes(app, db)
+	// Drive routes
+	handlers.RegisterDriveRoutes(app, db)
+	// Path routes
+	handlers.RegisterPathRoutes(app, db)
+	// Download routes
+	handlers.RegisterDownloadRoutes(app, db)
+	// Import routes
+	handlers.RegisterImportRoutes(app, db)
+	// Search routes
+	handlers.RegisterSearchRoutes(app, db)
+	// Tag routes
+	handlers.RegisterTagRoutes(app, db)
+	// Metadata routes
+	handlers.RegisterMetadataRoutes(app, db)
+	// Encryption routes
+	handlers.RegisterEncryptionRoutes(app, db)
 	// Organization routes
 	handlers.RegisterOrganizationRoutes(app, db)
+	// Ownership transfer routes
+	handlers.RegisterOwnershipTransferRoutes(app, db)
 	// User Organization routes
 	handlers.RegisterUserOrganizationRoutes(app, db)
+	// Invitation routes
+	handlers.RegisterInvitationRoutes(app, db)
+	// Audit log routes
+	handlers.RegisterAuditRoutes(app, db)
+	// SCIM provisioning routes
+	handlers.RegisterScimRoutes(app, db)
 	// User Device Routes
 	// Bin routes
 	handlers.RegisterBinRoutes(app, db)
+
+	// Personal access tokens only work on routes declaring a scope
+	middleware.RejectUnscopedTokens(app)
 }
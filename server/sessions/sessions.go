@@ -0,0 +1,68 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// SessionDuration matches the lifetime of the auth token
+const SessionDuration = 72 * time.Hour
+
+// CreateSession stores a new session for a user and returns its id
+func CreateSession(db *pgxpool.Pool, userID string, ipAddress string, userAgent string) (string, error) {
+	sessionID := uuid.New().String()
+	now := time.Now()
+
+	query := `
+		INSERT INTO sessions (id, user_id, ip_address, user_agent, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6);
+	`
+
+	_, err := db.Exec(
+		context.Background(),
+		query,
+		sessionID, userID, ipAddress, userAgent, now, now.Add(SessionDuration),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return sessionID, nil
+}
+
+// IsSessionActive reports whether a session belongs to the user and is neither revoked nor expired
+func IsSessionActive(db *pgxpool.Pool, sessionID string, userID string) (bool, error) {
+	var id string
+	query := `
+		SELECT id FROM sessions
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > NOW();
+	`
+
+	err := db.QueryRow(context.Background(), query, sessionID, userID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Execer is a pool or a transaction, revoking sessions can be part of a larger change
+type Execer interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+}
+
+// RevokeUserSessions revokes every active session of a user
+func RevokeUserSessions(db Execer, userID string) error {
+	query := "UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL;"
+
+	_, err := db.Exec(context.Background(), query, userID)
+	return err
+}
@@ -2,13 +2,19 @@ package spaces
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 var S3Client *s3.Client
@@ -52,11 +58,64 @@ func InitS3() {
 	S3Client = s3Client
 }
 
+// ObjectKey returns the key of an object from the file path stored for it,
+// file paths are full URLs in the form https://<spaces url>/<bucket>/<key>
+func ObjectKey(filePath string) string {
+	spacesURL := os.Getenv("D_O_SPACES_URL")
+	return strings.TrimPrefix(filePath, "https://"+spacesURL+"/"+spacesURL+"/")
+}
+
+// FilePath returns the file path stored for an object key, the inverse of ObjectKey
+func FilePath(key string) string {
+	spacesURL := os.Getenv("D_O_SPACES_URL")
+	return "https://" + spacesURL + "/" + spacesURL + "/" + key
+}
+
+// CopyObject duplicates an object to the given key without downloading it and returns the file path of the copy,
+// the copy is private like the objects PutObject stores
+func CopyObject(filePath string, key string) (string, error) {
+	bucket := os.Getenv("D_O_SPACES_URL")
+	source := (&url.URL{Path: bucket + "/" + ObjectKey(filePath)}).EscapedPath()
+
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(key),
+		CopySource: aws.String(source),
+		ACL:        types.ObjectCannedACLPrivate,
+	}
+
+	if _, err := S3Client.CopyObject(context.TODO(), input); err != nil {
+		log.Printf("Failed to copy file %s: %v", filePath, err)
+		return "", err
+	}
+
+	return FilePath(key), nil
+}
+
+// PutObject stores content as the object with the given key and returns its file path. The object is private,
+// it is read through the server with GetFile or with a URL from PresignDownload
+func PutObject(body io.ReadSeeker, size int64, key string) (string, error) {
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(os.Getenv("D_O_SPACES_URL")),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+		ACL:           types.ObjectCannedACLPrivate,
+	}
+
+	if _, err := S3Client.PutObject(context.TODO(), input); err != nil {
+		log.Printf("Failed to upload object %s: %v", key, err)
+		return "", err
+	}
+
+	return FilePath(key), nil
+}
+
 func DeleteFile(fileName string) error {
 	// Create the input for the delete request
 	input := &s3.DeleteObjectInput{
 		Bucket: aws.String(os.Getenv("D_O_SPACES_URL")),
-		Key:    aws.String(fileName),
+		Key:    aws.String(ObjectKey(fileName)),
 	}
 
 	_, err := S3Client.DeleteObject(context.TODO(), input)
@@ -67,3 +126,32 @@ func DeleteFile(fileName string) error {
 
 	return nil
 }
+
+// PresignDownload returns a temporary URL to download an object, the browser saves it
+// as fileName when one is given
+func PresignDownload(filePath string, fileName string, ttl time.Duration) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(os.Getenv("D_O_SPACES_URL")),
+		Key:    aws.String(ObjectKey(filePath)),
+	}
+	if fileName != "" {
+		input.ResponseContentDisposition = aws.String(fmt.Sprintf("attachment; filename=%q", fileName))
+	}
+
+	request, err := s3.NewPresignClient(S3Client).PresignGetObject(context.TODO(), input, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+
+	return request.URL, nil
+}
+
+// GetFile opens an object for reading, the caller must close its Body
+func GetFile(filePath string) (*s3.GetObjectOutput, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(os.Getenv("D_O_SPACES_URL")),
+		Key:    aws.String(ObjectKey(filePath)),
+	}
+
+	return S3Client.GetObject(context.TODO(), input)
+}
@@ -10,10 +10,11 @@ import (
 
 var secretKey = []byte(os.Getenv("JWT_SECRET"))
 
-// GenerateToken generates a JWT token with the user ID as part of the claims
-func GenerateToken(userID string, email string, firstName string, lastName string) (string, error) {
+// GenerateToken generates a JWT token with the user ID and session ID as part of the claims
+func GenerateToken(userID string, email string, firstName string, lastName string, sessionID string) (string, error) {
     claims := jwt.MapClaims{}
     claims["user_id"] = userID
+    claims["session_id"] = sessionID
     claims["email"] = email
     claims["first_name"] = firstName
     claims["last_name"] = lastName
@@ -51,3 +52,29 @@ func VerifyToken(tokenString string) (jwt.MapClaims, error) {
 
     return nil, fmt.Errorf("invalid token")
 }
+
+// GeneratePurposeToken generates a short lived JWT token that can only be used for the given purpose
+func GeneratePurposeToken(userID string, purpose string, tokenID string, ttl time.Duration) (string, error) {
+    claims := jwt.MapClaims{}
+    claims["user_id"] = userID
+    claims["purpose"] = purpose
+    claims["jti"] = tokenID
+    claims["exp"] = time.Now().Add(ttl).Unix()
+
+    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+    return token.SignedString(secretKey)
+}
+
+// VerifyPurposeToken verifies a token generated by GeneratePurposeToken for the given purpose
+func VerifyPurposeToken(tokenString string, purpose string) (jwt.MapClaims, error) {
+    claims, err := VerifyToken(tokenString)
+    if err != nil {
+        return nil, err
+    }
+
+    if claimPurpose, _ := claims["purpose"].(string); claimPurpose != purpose {
+        return nil, fmt.Errorf("invalid token purpose")
+    }
+
+    return claims, nil
+}
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"fmt"
+	"unicode"
+)
+
+const minPasswordLength = 8
+
+// ValidatePassword checks a password against the password policy:
+// at least 8 characters with an upper case letter, a lower case letter and a digit
+func ValidatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", minPasswordLength)
+	}
+
+	var hasUpper, hasLower, hasDigit bool
+	for _, char := range password {
+		switch {
+		case unicode.IsUpper(char):
+			hasUpper = true
+		case unicode.IsLower(char):
+			hasLower = true
+		case unicode.IsDigit(char):
+			hasDigit = true
+		}
+	}
+
+	if !hasUpper || !hasLower || !hasDigit {
+		return fmt.Errorf("password must contain an upper case letter, a lower case letter and a digit")
+	}
+
+	return nil
+}
@@ -33,7 +33,7 @@ export async function POST(request: NextRequest) {
       Key: fileKey,
       Body: fileContent,
       ContentType: contentType,
-      ACL: 'public-read',
+      ACL: 'private',
     });
 
     const uploadResult = await s3.send(command);
@@ -183,7 +183,7 @@ const Options = (
       if (type === "folder") {
         downloadFolderAsZip(organization_id, object?.id)
       } else if (type === "file") {
-        downloadFile(object?.file_path, object.name)
+        downloadFile(object?.id, object.name)
       }
     } else if (option.name === "Restore") {
       handleRestore()
@@ -56,7 +56,7 @@ const FileSummary = ({ object, type } : { object: any, type: string }) => {
       if (type === "folder") {
         router.push(`${orgUrl}/folder/${object?.id}`)
       } else {
-        downloadFile(object?.file_path, object?.name)
+        downloadFile(object?.id, object?.name)
       }
     } else {
       return;
@@ -76,7 +76,7 @@ export const downloadFolderAsZip = async (organizationId: string, folderId: stri
     const addFolderToZip = async (zipFolder: any, folderData: any) => {
       // Add files to the current folder
       for (const file of folderData.files || []) { // Safeguard for empty or undefined files array
-        const fileData = await fetchFileData(file.file_path);
+        const fileData = await fetchFileData(file.id);
         zipFolder.file(file.name, fileData);
       }
     
@@ -102,9 +102,10 @@ export const downloadFolderAsZip = async (organizationId: string, folderId: stri
   }
 };
 
-const fetchFileData = async (fileUrl: string) => {
+// Stored files are private, their content is read through the server
+const fetchFileData = async (fileId: string) => {
   try {
-    const response = await axios.get(fileUrl, {
+    const response = await axios.get(`${API_URL}/download/file/${fileId}`, {
       responseType: 'blob',
     });
     return response.data; // Return the blob directly
@@ -114,9 +115,9 @@ const fetchFileData = async (fileUrl: string) => {
   }
 };
 
-export const downloadFile = async (fileUrl: string, fileName: string) => {
+export const downloadFile = async (fileId: string, fileName: string) => {
   try {
-    const response = await axios.get(fileUrl, {
+    const response = await axios.get(`${API_URL}/download/file/${fileId}`, {
       responseType: 'blob',
     });
 
@@ -6,10 +6,22 @@ interface User {
   email: string;
 }
 
+// Listings are returned a page at a time as { items, next_cursor, total }, this follows the cursors to fetch all the items
+const fetchAllItems = async (url: string) => {
+  const items: any[] = []
+  let cursor: string | null = null
+  do {
+    const params: Record<string, string | number> = cursor ? { limit: 500, cursor } : { limit: 500 }
+    const response = await axios.get(url, { params })
+    items.push(...response.data.items)
+    cursor = response.data.next_cursor
+  } while (cursor)
+  return items
+}
+
 export const fetchOrganizations = async (user: User | undefined | null) => {
   try {
-    const response = await axios.get(`${API_URL}/organization/fetch/all/${user?.user_id}`)
-    const organizations = response.data
+    const organizations = await fetchAllItems(`${API_URL}/organization/fetch/all/${user?.user_id}`)
     return organizations  
   } catch (error: any) {
     console.error("Error fetching organizations: ", error)
@@ -30,8 +42,7 @@ export const fetchOrganization = async (organizationId: string) => {
 
 export const fetchFolders = async (organizationId: string) => {
   try {
-    const response = await axios.get(`${API_URL}/folder/fetch/all/${organizationId}`)
-    const folders = response.data
+    const folders = await fetchAllItems(`${API_URL}/folder/fetch/all/${organizationId}`)
     return folders
   } catch (error: any) {
     console.error("Error fetching folders: ", error)
@@ -41,8 +52,7 @@ export const fetchFolders = async (organizationId: string) => {
 
 export const fetchRootFiles = async (organizationId: string) => {
   try {
-    const response = await axios.get(`${API_URL}/file/fetch/all/${organizationId}`)
-    const files = response.data
+    const files = await fetchAllItems(`${API_URL}/file/fetch/all/${organizationId}`)
     console.log("Root Files: ", files)
     return files
   } catch (error: any) {
@@ -53,8 +63,7 @@ export const fetchRootFiles = async (organizationId: string) => {
 
 export const fetchChildFiles = async (organizationId: string, folderId: string) => {
   try {
-    const response = await axios.get(`${API_URL}/file/fetch/all/${organizationId}/${folderId}`)
-    const files = response.data
+    const files = await fetchAllItems(`${API_URL}/file/fetch/all/${organizationId}/${folderId}`)
     return files
   } catch (error: any) {
     console.error("Error fetching files: ", error)
@@ -88,8 +97,7 @@ export const fetchFolderHierarchy = async (folderId: string) => {
 
 export const fetchRootFolders = async (organizationId: string) => {
   try {
-    const response = await axios.get(`${API_URL}/folder/fetch/children/${organizationId}/root`)
-    const folders = response.data
+    const folders = await fetchAllItems(`${API_URL}/folder/fetch/children/${organizationId}/root`)
     return folders
   } catch (error: any) {
     console.error("Error fetching folders: ", error)
@@ -99,8 +107,7 @@ export const fetchRootFolders = async (organizationId: string) => {
 
 export const fetchChildrenFolders = async (organizationId: string, parentFolderId: string) => {
   try {
-    const response = await axios.get(`${API_URL}/folder/fetch/children/${organizationId}/${parentFolderId}`)
-    const folders = response.data
+    const folders = await fetchAllItems(`${API_URL}/folder/fetch/children/${organizationId}/${parentFolderId}`)
     return folders
   } catch (error: any) {
     console.error("Error fetching folders: ", error)
@@ -110,8 +117,7 @@ export const fetchChildrenFolders = async (organizationId: string, parentFolderI
 
 export const fetchDeletedFolders = async (organizationId: string) => {
   try {
-    const response = await axios.get(`${API_URL}/folder/fetch/deleted/${organizationId}`)
-    const folders = response.data
+    const folders = await fetchAllItems(`${API_URL}/folder/fetch/deleted/${organizationId}`)
     return folders
   } catch (error: any) {
     return error.response ? error.response : { data: { error: "Unknown error occurred" } }; 
@@ -120,8 +126,7 @@ export const fetchDeletedFolders = async (organizationId: string) => {
 
 export const fetchDeletedFiles = async (organizationId: string) => {
   try {
-    const response = await axios.get(`${API_URL}/file/fetch/deleted/${organizationId}`)
-    const files = response.data
+    const files = await fetchAllItems(`${API_URL}/file/fetch/deleted/${organizationId}`)
     return files
   } catch (error: any) {
     return error.response ? error.response : { data: { error: "Unknown error occurred" } }; 